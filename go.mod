@@ -8,9 +8,7 @@ require (
 	github.com/urfave/cli/v3 v3.10.1
 	github.com/vishvananda/netlink v1.3.1
 	golang.org/x/crypto v0.54.0
+	golang.org/x/sys v0.47.0
 )
 
-require (
-	github.com/vishvananda/netns v0.0.5 // indirect
-	golang.org/x/sys v0.47.0 // indirect
-)
+require github.com/vishvananda/netns v0.0.5 // indirect
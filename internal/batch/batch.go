@@ -0,0 +1,190 @@
+// Package batch packs several IPv4 frames into one write — one record of the
+// encrypted stream, or one obfuscated datagram — so that small frames such as
+// TCP acknowledgements and voice packets share a nonce, a tag and a header,
+// and a system call. Each frame delimits itself by its total length, so a
+// batch is just frames back to back.
+package batch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+var log = logging.MustGetLogger("batch")
+
+// MaxBytes is the most a batch for a stream gathers: one record of the
+// encrypted stream (see internal/secure).
+const MaxBytes = 16 * 1024
+
+// Join returns frames back to back.
+func Join(frames []ipv4.Frame) []byte {
+	length := 0
+	for _, frame := range frames {
+		length += len(frame)
+	}
+	joined := make([]byte, 0, length)
+	for _, frame := range frames {
+		joined = append(joined, frame...)
+	}
+	return joined
+}
+
+// Split returns the frames of a batch, copied, up to the first that is
+// malformed.
+func Split(payload []byte) []ipv4.Frame {
+	var frames []ipv4.Frame
+	for len(payload) > 0 {
+		advance, token, err := ipv4.ScanFrame(payload, true)
+		if err != nil || token == nil {
+			break
+		}
+		frames = append(frames, ipv4.Frame(token).Copy())
+		payload = payload[advance:]
+	}
+	return frames
+}
+
+// Pack divides frames, in order, into runs of at most size bytes each; a
+// frame longer than size runs alone.
+func Pack(frames []ipv4.Frame, size int) [][]ipv4.Frame {
+	var runs [][]ipv4.Frame
+	length := 0
+	for _, frame := range frames {
+		if len(runs) == 0 || length+len(frame) > size {
+			runs = append(runs, nil)
+			length = 0
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], frame)
+		length += len(frame)
+	}
+	return runs
+}
+
+// Gather returns first and the frames queued behind it in queue, up to about
+// MaxBytes in all, waiting up to delay after first for more to arrive; with
+// no delay it takes only those already queued. It stops early when done is
+// closed.
+func Gather(queue <-chan ipv4.Frame, first ipv4.Frame, delay time.Duration, done <-chan struct{}) []ipv4.Frame {
+	frames, length := []ipv4.Frame{first}, len(first)
+	if delay <= 0 {
+		for length < MaxBytes {
+			select {
+			case frame := <-queue:
+				frames = append(frames, frame)
+				length += len(frame)
+			default:
+				return frames
+			}
+		}
+		return frames
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for length < MaxBytes {
+		select {
+		case frame := <-queue:
+			frames = append(frames, frame)
+			length += len(frame)
+		case <-timer.C:
+			return frames
+		case <-done:
+			return frames
+		}
+	}
+	return frames
+}
+
+// Batcher gathers frames for a sender with no queue of its own to drain: it
+// holds each frame for up to delay after the first of its batch, and hands
+// the batch to emit then, or once the next frame would take it past size
+// bytes. It is safe for concurrent use.
+type Batcher struct {
+	mutex   sync.Mutex
+	size    int
+	delay   time.Duration
+	pending []ipv4.Frame
+	length  int
+	timer   *time.Timer
+	armed   uint64 // counts timers, so that a stopped one that fires anyway is ignored
+	closed  bool
+	emit    func(frames []ipv4.Frame) error
+}
+
+func NewBatcher(size int, delay time.Duration, emit func(frames []ipv4.Frame) error) *Batcher {
+	return &Batcher{size: size, delay: delay, emit: emit}
+}
+
+// Add queues a frame, emitting the batch before it if the frame does not fit.
+func (self *Batcher) Add(frame ipv4.Frame) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		return nil
+	}
+	if self.length+len(frame) > self.size {
+		if err := self.flush(); err != nil {
+			return err
+		}
+	}
+	self.pending = append(self.pending, frame)
+	self.length += len(frame)
+	if len(self.pending) == 1 {
+		self.arm()
+	}
+	return nil
+}
+
+// arm starts the timer for a new batch. The caller holds the mutex.
+func (self *Batcher) arm() {
+	self.stop()
+	self.armed++
+	armed := self.armed
+	self.timer = time.AfterFunc(self.delay, func() { self.expire(armed) })
+}
+
+func (self *Batcher) stop() {
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+}
+
+func (self *Batcher) expire(armed uint64) {
+	defer deferutil.Recover()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed || armed != self.armed || self.timer == nil {
+		return
+	}
+	self.timer = nil
+	if err := self.flush(); err != nil {
+		log.Debugf("failed to send batch: %s", err)
+	}
+}
+
+// flush emits the pending batch and stops its timer. The caller holds the
+// mutex.
+func (self *Batcher) flush() error {
+	self.stop()
+	if len(self.pending) == 0 {
+		return nil
+	}
+	frames := self.pending
+	self.pending, self.length = nil, 0
+	return self.emit(frames)
+}
+
+// Close sends what is pending and stops the timer.
+func (self *Batcher) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.flush(); err != nil {
+		log.Debugf("failed to send batch: %s", err)
+	}
+	self.closed = true
+}
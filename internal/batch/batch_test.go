@@ -0,0 +1,144 @@
+package batch
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+func frame(length int) ipv4.Frame {
+	frame := append(ipv4.MakeFrame(net.ParseIP("172.18.0.2"), net.ParseIP("172.18.0.1")), bytes.Repeat([]byte{byte(length)}, length-20)...)
+	frame.SetTotalLength(uint16(length))
+	return frame
+}
+
+func TestJoinSplit(t *testing.T) {
+	frames := []ipv4.Frame{frame(40), frame(20), frame(1400)}
+	split := Split(Join(frames))
+	if len(split) != len(frames) {
+		t.Fatalf("split %d frames, want %d", len(split), len(frames))
+	}
+	for index := range frames {
+		if !bytes.Equal(split[index], frames[index]) {
+			t.Errorf("frame %d differs", index)
+		}
+	}
+	if split := Split(append(Join(frames[:1]), 0x45, 0)); len(split) != 1 {
+		t.Errorf("split %d frames from a batch with a truncated tail, want 1", len(split))
+	}
+}
+
+func TestPack(t *testing.T) {
+	runs := Pack([]ipv4.Frame{frame(100), frame(100), frame(100), frame(500), frame(50)}, 300)
+	var lengths [][]int
+	for _, run := range runs {
+		var run_ []int
+		for _, frame := range run {
+			run_ = append(run_, len(frame))
+		}
+		lengths = append(lengths, run_)
+	}
+	if len(runs) != 3 || len(runs[0]) != 3 || len(runs[1]) != 1 || len(runs[2]) != 1 {
+		t.Errorf("Pack = %v, want [[100 100 100] [500] [50]]", lengths)
+	}
+}
+
+func TestGather(t *testing.T) {
+	queue := make(chan ipv4.Frame, 8)
+	queue <- frame(20)
+	queue <- frame(20)
+	if frames := Gather(queue, frame(20), 0, nil); len(frames) != 3 {
+		t.Errorf("Gather without delay took %d frames, want the 3 queued", len(frames))
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue <- frame(20)
+	}()
+	if frames := Gather(queue, frame(20), time.Second/4, nil); len(frames) != 2 {
+		t.Errorf("Gather with delay took %d frames, want 2", len(frames))
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	var mutex sync.Mutex
+	var batches [][]ipv4.Frame
+	batcher := NewBatcher(250, 20*time.Millisecond, func(frames []ipv4.Frame) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		batches = append(batches, frames)
+		return nil
+	})
+	defer batcher.Close()
+	for range 3 {
+		_ = batcher.Add(frame(100))
+	}
+	mutex.Lock()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Errorf("the batch that filled up was not sent at once: %d batches", len(batches))
+	}
+	mutex.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(batches) != 2 || len(batches[1]) != 1 {
+		t.Errorf("the last frame was not sent after the delay: %d batches", len(batches))
+	}
+}
+
+func TestBatcherIgnoresStaleTimer(t *testing.T) {
+	var batches [][]ipv4.Frame
+	batcher := NewBatcher(250, time.Hour, func(frames []ipv4.Frame) error {
+		batches = append(batches, frames)
+		return nil
+	})
+	defer batcher.Close()
+	_ = batcher.Add(frame(100))
+	batcher.mutex.Lock()
+	stale := batcher.armed
+	batcher.mutex.Unlock()
+	for range 2 {
+		_ = batcher.Add(frame(100))
+	}
+
+	// The timer of the batch sent when it filled up fires late: the frame
+	// that began the next batch stays held.
+	batcher.expire(stale)
+	if len(batches) != 1 {
+		t.Errorf("a stale timer sent the next batch early: %d batches", len(batches))
+	}
+	batcher.mutex.Lock()
+	current := batcher.armed
+	batcher.mutex.Unlock()
+	batcher.expire(current)
+	if len(batches) != 2 || len(batches[1]) != 1 {
+		t.Errorf("the batch's own timer did not send it: %d batches", len(batches))
+	}
+}
+
+func TestBatcherRecoversFromPanickingEmit(t *testing.T) {
+	sent, count := make(chan struct{}, 2), 0
+	batcher := NewBatcher(250, time.Millisecond, func(frames []ipv4.Frame) error {
+		count++
+		sent <- struct{}{}
+		if count == 1 {
+			panic("emit")
+		}
+		return nil
+	})
+	defer batcher.Close()
+	// The first batch's emit panics on the timer; the next is still sent.
+	for range 2 {
+		_ = batcher.Add(frame(100))
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatal("the batch was not sent after the delay")
+		}
+	}
+}
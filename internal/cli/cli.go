@@ -8,13 +8,22 @@ import (
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
 	"github.com/urfave/cli/v3"
 
 	"github.com/ziyan/shadowgate/internal/client"
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/fec"
+	"github.com/ziyan/shadowgate/internal/hop"
+	"github.com/ziyan/shadowgate/internal/multipath"
+	"github.com/ziyan/shadowgate/internal/plugin"
+	"github.com/ziyan/shadowgate/internal/relay"
 	"github.com/ziyan/shadowgate/internal/server"
+	"github.com/ziyan/shadowgate/internal/sockopt"
+	"github.com/ziyan/shadowgate/internal/stdio"
 	"github.com/ziyan/shadowgate/internal/tun"
 	"github.com/ziyan/shadowgate/internal/version"
 )
@@ -28,8 +37,8 @@ type tunnel interface {
 	Close() error
 }
 
-// commonFlags are shared by the server and client subcommands. Both transports
-// (TCP and UDP) are always active; there is no transport selection.
+// commonFlags are shared by the server and client subcommands. Both main
+// transports (TCP and UDP) are always active; ICMP is an opt-in last resort.
 func commonFlags() []cli.Flag {
 	return []cli.Flag{
 		&cli.StringFlag{Name: "ifname", Usage: "tun interface name to create"},
@@ -37,8 +46,20 @@ func commonFlags() []cli.Flag {
 		&cli.StringFlag{Name: "password", Value: "", Usage: "shared secret used to encrypt the tunnel"},
 		&cli.StringFlag{Name: "timeout", Value: "2s", Usage: "network operation timeout"},
 		&cli.BoolFlag{Name: "compress", Usage: "tcp: Snappy-compress the stream (off by default)"},
-		&cli.IntFlag{Name: "padding", Value: 256, Usage: "udp: maximum random padding bytes per datagram (0 disables)"},
-		&cli.IntFlag{Name: "mtu", Value: 0, Usage: "tun interface MTU (0 = kernel default); lower it to keep UDP datagrams under the path MTU and avoid fragmentation"},
+		&cli.IntFlag{Name: "padding", Value: 256, Usage: "udp, icmp: maximum random padding bytes per datagram (0 disables)"},
+		&cli.StringFlag{Name: "udp-hop-ports", Usage: "udp port hopping range first-last (server: also listen on each; client: hop between them)"},
+		&cli.BoolFlag{Name: "p2p", Usage: "direct udp paths between clients (server: introduce clients to each other; client: reach other clients directly when a path punches through)"},
+		&cli.IntFlag{Name: "faketcp-port", Usage: "also carry UDP-style datagrams in TCP-shaped packets on raw sockets to/from this port (0 disables; needs raw sockets)"},
+		&cli.BoolFlag{Name: "icmp", Usage: "also carry the tunnel in ICMP echo messages, for networks that only allow ping (needs raw sockets)"},
+		&cli.StringFlag{Name: "plugin", Usage: "external pluggable transport command (run with /bin/sh -c) that carries the TCP link, e.g. obfs4proxy or v2ray-plugin"},
+		&cli.StringFlag{Name: "plugin-opts", Usage: "plugin options: SS_PLUGIN_OPTIONS for sip003, or key=value;key=value transport arguments for tor"},
+		&cli.StringFlag{Name: "plugin-protocol", Value: "sip003", Usage: "how the plugin is launched: sip003 (Shadowsocks plugin) or tor (Tor pluggable-transport managed proxy)"},
+		&cli.StringFlag{Name: "plugin-transport", Usage: "tor: the transport name the managed proxy provides, e.g. obfs4"},
+		&cli.StringFlag{Name: "socket", Usage: "socket options as key=value[,…]: mark=N (SO_MARK), device=IFNAME (SO_BINDTODEVICE), congestion=ALG (e.g. bbr), user-timeout=DURATION, keepalive=IDLE[/INTERVAL[/COUNT]], sndbuf=BYTES, rcvbuf=BYTES (server: on the tcp and udp listeners; client: on every link, each overridable by a --link)"},
+		&cli.BoolFlag{Name: "batch", Usage: "pack frames queued together into one tcp record or udp datagram (off by default)"},
+		&cli.StringFlag{Name: "batch-delay", Value: "0s", Usage: "with --batch, how long a frame waits for others to share its record or datagram (0s takes only those already queued; the server batches udp datagrams only with a delay)"},
+		&cli.StringFlag{Name: "flow-idle", Value: "0s", Usage: "keep each flow on the link it came in on until it has been idle this long or the link fails, so that only new flows follow a newly chosen link (client: its frames; server: their replies; 0s moves every flow at once)"},
+		&cli.IntFlag{Name: "mtu", Value: 0, Usage: "tun interface MTU (0 = kernel default); udp links split frames the path cannot carry, but faketcp and icmp links need it lowered below the path MTU less 54 bytes and the padding"},
 	}
 }
 
@@ -75,6 +96,7 @@ func Run(arguments []string) int {
 		Commands: []*cli.Command{
 			serverCommand(),
 			clientCommand(),
+			relayCommand(),
 		},
 	}
 
@@ -92,6 +114,14 @@ func serverCommand() *cli.Command {
 		Flags: append(commonFlags(),
 			&cli.StringFlag{Name: "ip", Value: "172.18.0.1/24", Usage: "tunnel address in CIDR notation"},
 			&cli.StringFlag{Name: "listen", Value: ":3389", Usage: "address (TCP and UDP) to listen on"},
+			&cli.BoolFlag{Name: "stdio", Usage: "serve a single client over standard input and output instead of listening on --listen (for example under ssh)"},
+			&cli.StringFlag{Name: "http-listen", Usage: "also serve the tunnel as plain HTTP polling on this address (empty disables; put TLS in front for HTTPS)"},
+			&cli.StringSliceFlag{Name: "proxy-protocol-from", Usage: "CIDR of a load balancer that sends a PROXY protocol (v1 or v2) header with each TCP connection (repeatable); its connections must carry one"},
+			&cli.StringSliceFlag{Name: "mesh-peer", Usage: "TCP address (host:port) of another server to federate with (repeatable); the servers exchange the subnets attached to them"},
+			&cli.StringFlag{Name: "standby-of", Usage: "run as the standby of the primary server at this TCP address (host:port), sharing its tunnel address"},
+			&cli.StringSliceFlag{Name: "standby-from", Usage: "CIDR of a standby server allowed to pair with this primary (repeatable)"},
+			&cli.StringSliceFlag{Name: "dial-client", Usage: "address (host:port) of a client started with --listen to dial over TCP and UDP (repeatable)"},
+			&cli.StringSliceFlag{Name: "mesh-from", Usage: "CIDR of other servers whose TCP connections may federate with this one (repeatable)"},
 			&cli.StringFlag{Name: "gateway", Usage: "tunnel address of a connected client to route otherwise-unroutable egress through (fallback when the host routing table has no next hop)"},
 		),
 		Action: func(ctx context.Context, command *cli.Command) error {
@@ -117,6 +147,25 @@ func clientCommand() *cli.Command {
 		Flags: append(commonFlags(),
 			&cli.StringFlag{Name: "ip", Value: "172.18.0.2/24", Usage: "tunnel address in CIDR notation"},
 			&cli.StringFlag{Name: "connect", Value: "127.0.0.1:3389", Usage: "server address to connect to (TCP and UDP)"},
+			&cli.StringFlag{Name: "listen", Usage: "accept the server on this address (TCP and UDP) instead of dialing --connect, for a site that cannot dial out; the server dials it with --dial-client"},
+			&cli.StringFlag{Name: "policy", Value: client.PolicyLowestLatency, Usage: "how the active link is chosen among healthy ones: lowest-latency, prefer:NAME, loss-aware, jitter-aware or throughput-aware"},
+			&cli.StringFlag{Name: "policy-file", Usage: "read the --policy value from this file instead, and again on SIGHUP to switch policies without reconnecting"},
+			&cli.FloatFlag{Name: "policy-switch-factor", Value: 2, Usage: "leave the active link for another of the same rank only when the policy scores it better by this factor"},
+			&cli.FloatFlag{Name: "policy-max-loss", Value: 0.05, Usage: "fraction of lost keepalives above which loss-aware avoids a link"},
+			&cli.StringFlag{Name: "policy-max-jitter", Value: "30ms", Usage: "jitter above which jitter-aware avoids a link"},
+			&cli.BoolFlag{Name: "watch-network", Value: true, Usage: "redial a link at once when a change to the host's addresses or routes moves its route to the server, as after Wi-Fi roaming or a resume from suspend, and probe the server at once over the others (--watch-network=false disables)"},
+			&cli.BoolFlag{Name: "on-demand", Usage: "dial the links only once the tunnel has traffic to send, back their keepalives off while it is quiet, and close them after --idle-timeout"},
+			&cli.StringFlag{Name: "idle-timeout", Value: "5m", Usage: "with --on-demand, close the links once the tunnel has carried nothing for this long (0 keeps them up once dialed)"},
+			&cli.StringSliceFlag{Name: "rule", Usage: "send matching frames over the named links whatever the policy chose, as [protocol=P][,port=N|A-B][,dscp=CODE/…][,to=CIDR],via=NAME/… (repeatable; the first matching rule applies)"},
+			&cli.StringFlag{Name: "multipath", Value: "active", Usage: "how frames are spread across links: active (the best healthy link), redundant (a copy over every healthy link) or bonded (striped across healthy links by weight)"},
+			&cli.StringFlag{Name: "failover", Usage: "standby server address (host:port); every derived link but http gets a twin to it, used only while no link to --connect is healthy"},
+			&cli.StringFlag{Name: "connect-command", Usage: "shell command whose standard input and output reach the server, e.g. \"ssh host shadowgate server --stdio\"; replaces all other links"},
+			&cli.StringFlag{Name: "proxy", Usage: "upstream proxy to reach the server through: socks5://[user:pass@]host:port (TCP, and UDP via UDP ASSOCIATE) or http://[user:pass@]host:port (TCP via CONNECT)"},
+			&cli.StringSliceFlag{Name: "link", Usage: "declare a link as type:endpoint[,name=…][,padding=N][,compress][,priority=N][,weight=N][,metered][,source=IP][,device=IFNAME][,mark=N][,congestion=ALG][,user-timeout=D][,keepalive=IDLE[/INTERVAL[/COUNT]]][,sndbuf=N][,rcvbuf=N][,fec=D:P][,fec-adaptive] (repeatable; type is udp, tcp, faketcp, icmp, http or plugin); replaces the links derived from --connect, --faketcp-port, --icmp and --http-url"},
+			&cli.StringFlag{Name: "udp-hop-interval", Value: "30s", Usage: "how often the udp link moves to the next port of --udp-hop-ports"},
+			&cli.StringFlag{Name: "fec", Usage: "forward error correction for udp links as data:parity shards per group, e.g. 10:3 (empty disables); the server answers in kind"},
+			&cli.BoolFlag{Name: "fec-adaptive", Usage: "send only as many of the --fec parity shards as the loss measured on the link calls for"},
+			&cli.StringFlag{Name: "http-url", Usage: "also carry the tunnel in HTTP polling requests to this URL, for networks that only allow web traffic (empty disables)"},
 		),
 		Action: func(ctx context.Context, command *cli.Command) error {
 			ip, network, timeout, err := parseCommon(command)
@@ -134,6 +183,40 @@ func clientCommand() *cli.Command {
 	}
 }
 
+// relayCommand forwards the encrypted tunnel between clients and a server
+// without a tun device or the password.
+func relayCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "relay",
+		Usage: "Forward clients' encrypted TCP and UDP traffic to a server, without the password",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "listen", Value: ":3389", Usage: "address (TCP and UDP) to accept clients on"},
+			&cli.StringFlag{Name: "upstream", Usage: "server address (TCP and UDP) to forward to"},
+			&cli.StringFlag{Name: "timeout", Value: "2s", Usage: "network operation timeout"},
+			&cli.IntFlag{Name: "max-udp-clients", Value: relay.DefaultMaxMappings, Usage: "UDP clients forwarded at once; a new one replaces the longest-quiet client if it has been quiet for 10s, and is dropped otherwise"},
+		},
+		Action: func(ctx context.Context, command *cli.Command) error {
+			timeout, err := time.ParseDuration(command.String("timeout"))
+			if err != nil {
+				log.Errorf("failed to parse timeout option: %s", err)
+				return err
+			}
+			runner, err := relay.NewRelay(relay.Config{
+				Listen:      command.String("listen"),
+				Upstream:    command.String("upstream"),
+				Timeout:     timeout,
+				MaxMappings: command.Int("max-udp-clients"),
+			})
+			if err != nil {
+				log.Errorf("failed to start relay: %s", err)
+				return err
+			}
+			defer func() { _ = runner.Close() }()
+			return runner.Run(interruptChannel())
+		},
+	}
+}
+
 // parseCommon parses the tunnel address and timeout shared by both subcommands.
 func parseCommon(command *cli.Command) (net.IP, *net.IPNet, time.Duration, error) {
 	ip, network, err := net.ParseCIDR(command.String("ip"))
@@ -162,14 +245,83 @@ func newServer(command *cli.Command, ip net.IP, network *net.IPNet, timeout time
 			return nil, fmt.Errorf("cli: invalid gateway address: %q", raw)
 		}
 	}
+	batchDelay, err := time.ParseDuration(command.String("batch-delay"))
+	if err != nil {
+		return nil, err
+	}
+	flowIdle, err := time.ParseDuration(command.String("flow-idle"))
+	if err != nil {
+		return nil, err
+	}
+	socket, err := sockopt.Parse(command.String("socket"))
+	if err != nil {
+		return nil, err
+	}
+	proxyFrom, err := parseNetworks(command, "proxy-protocol-from")
+	if err != nil {
+		return nil, err
+	}
+	meshFrom, err := parseNetworks(command, "mesh-from")
+	if err != nil {
+		return nil, err
+	}
+	standbyFrom, err := parseNetworks(command, "standby-from")
+	if err != nil {
+		return nil, err
+	}
+	hopPorts, err := parseHopPorts(command)
+	if err != nil {
+		return nil, err
+	}
+	var icmpListen string
+	if command.Bool("icmp") {
+		host, _, err := net.SplitHostPort(listen)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			host = "0.0.0.0"
+		}
+		icmpListen = host
+	}
+	var fakeTcpListen string
+	if port := command.Int("faketcp-port"); port != 0 {
+		host, _, err := net.SplitHostPort(listen)
+		if err != nil {
+			return nil, err
+		}
+		fakeTcpListen = net.JoinHostPort(host, strconv.Itoa(port))
+	}
 	config := server.Config{
-		TCPListen: listen,
-		UDPListen: listen,
-		Password:  []byte(command.String("password")),
-		Compress:  command.Bool("compress"),
-		Padding:   command.Int("padding"),
-		Gateway:   gateway,
-		Timeout:   timeout,
+		TCPListen:     listen,
+		UDPListen:     listen,
+		UDPHopPorts:   hopPorts,
+		Rendezvous:    command.Bool("p2p"),
+		ICMPListen:    icmpListen,
+		FakeTCPListen: fakeTcpListen,
+		HTTPListen:    command.String("http-listen"),
+		Password:      []byte(command.String("password")),
+		Compress:      command.Bool("compress"),
+		Padding:       command.Int("padding"),
+		Batch:         command.Bool("batch"),
+		BatchDelay:    batchDelay,
+		Socket:        socket,
+		Plugin:        pluginConfig(command),
+		Gateway:       gateway,
+		FlowIdle:      flowIdle,
+		Timeout:       timeout,
+
+		ProxyProtocolFrom: proxyFrom,
+		MeshPeers:         command.StringSlice("mesh-peer"),
+		MeshFrom:          meshFrom,
+		StandbyOf:         command.String("standby-of"),
+		StandbyFrom:       standbyFrom,
+		DialClients:       command.StringSlice("dial-client"),
+	}
+	if command.Bool("stdio") {
+		config.TCPListen = ""
+		config.UDPListen = ""
+		config.Stdio = stdio.Standard()
 	}
 	runner, err := server.NewServer(device, ip, network, config)
 	if err != nil {
@@ -184,14 +336,202 @@ func newClient(command *cli.Command, ip net.IP, network *net.IPNet, timeout time
 	if err != nil {
 		return nil, err
 	}
-	runner, err := client.NewClient(device, ip, network, command.String("connect"), []byte(command.String("password")), command.Bool("compress"), command.Int("padding"), timeout)
+	hopPorts, err := parseHopPorts(command)
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	hopInterval, err := time.ParseDuration(command.String("udp-hop-interval"))
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	mode, err := multipath.ParseMode(command.String("multipath"))
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	flowIdle, err := time.ParseDuration(command.String("flow-idle"))
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	batchDelay, err := time.ParseDuration(command.String("batch-delay"))
 	if err != nil {
 		_ = device.Close()
 		return nil, err
 	}
+	idleTimeout, err := time.ParseDuration(command.String("idle-timeout"))
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	socket, err := sockopt.Parse(command.String("socket"))
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	ratio, err := parseFec(command)
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	loadPolicy, err := policyLoader(command)
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	var links []client.LinkConfig
+	defaults := client.LinkConfig{Padding: command.Int("padding"), Compress: command.Bool("compress"), HopPorts: hopPorts, HopInterval: hopInterval, FEC: ratio, Socket: socket}
+	for _, spec := range command.StringSlice("link") {
+		link, err := client.ParseLink(spec, defaults)
+		if err != nil {
+			_ = device.Close()
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	var rules []client.Rule
+	for _, spec := range command.StringSlice("rule") {
+		rule, err := client.ParseRule(spec)
+		if err != nil {
+			_ = device.Close()
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	config := client.Config{
+		Links:        links,
+		Connect:      command.String("connect"),
+		Listen:       command.String("listen"),
+		Failover:     command.String("failover"),
+		Password:     []byte(command.String("password")),
+		Compress:     command.Bool("compress"),
+		Padding:      command.Int("padding"),
+		UDPHopPorts:  hopPorts,
+		HopInterval:  hopInterval,
+		FEC:          ratio,
+		PeerToPeer:   command.Bool("p2p"),
+		Multipath:    mode,
+		FlowIdle:     flowIdle,
+		Batch:        command.Bool("batch"),
+		BatchDelay:   batchDelay,
+		OnDemand:     command.Bool("on-demand"),
+		WatchNetwork: command.Bool("watch-network"),
+		IdleTimeout:  idleTimeout,
+		Policy:       policy,
+		Rules:        rules,
+		ICMP:         command.Bool("icmp"),
+		FakeTCPPort:  command.Int("faketcp-port"),
+		HTTPURL:      command.String("http-url"),
+		Proxy:        command.String("proxy"),
+		Plugin:       pluginConfig(command),
+		Timeout:      timeout,
+
+		ConnectCommand: command.String("connect-command"),
+	}
+	runner, err := client.NewClient(device, ip, network, config)
+	if err != nil {
+		_ = device.Close()
+		return nil, err
+	}
+	if command.String("policy-file") != "" {
+		go reloadPolicy(runner, loadPolicy)
+	}
 	return runner, nil
 }
 
+// policyLoader returns a function that parses the link-selection policy named
+// by --policy, or by the contents of --policy-file each time it is called.
+func policyLoader(command *cli.Command) (func() (client.Policy, error), error) {
+	maxJitter, err := time.ParseDuration(command.String("policy-max-jitter"))
+	if err != nil {
+		return nil, err
+	}
+	thresholds := client.PolicyThresholds{
+		SwitchFactor: command.Float("policy-switch-factor"),
+		MaxLoss:      command.Float("policy-max-loss"),
+		MaxJitter:    maxJitter,
+	}
+	spec, path := command.String("policy"), command.String("policy-file")
+	return func() (client.Policy, error) {
+		if path == "" {
+			return client.ParsePolicy(spec, thresholds)
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return client.ParsePolicy(string(contents), thresholds)
+	}, nil
+}
+
+// reloadPolicy switches the client to the policy in --policy-file each time
+// the process receives SIGHUP, keeping the current one if the file is invalid.
+func reloadPolicy(runner *client.Client, loadPolicy func() (client.Policy, error)) {
+	defer deferutil.Recover()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		policy, err := loadPolicy()
+		if err != nil {
+			log.Warningf("failed to reload link policy: %s", err)
+			continue
+		}
+		runner.SetPolicy(policy)
+		log.Infof("reloaded link policy")
+	}
+}
+
+// parseNetworks parses the CIDRs given to a repeatable flag.
+func parseNetworks(command *cli.Command, name string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, raw := range command.StringSlice(name) {
+		_, network, err := net.ParseCIDR(raw)
+		if err != nil {
+			return nil, fmt.Errorf("cli: invalid --%s network: %q", name, raw)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseHopPorts parses the optional --udp-hop-ports range.
+func parseHopPorts(command *cli.Command) (hop.Range, error) {
+	if raw := command.String("udp-hop-ports"); raw != "" {
+		return hop.ParseRange(raw)
+	}
+	return hop.Range{}, nil
+}
+
+// parseFec parses the optional --fec ratio and --fec-adaptive.
+func parseFec(command *cli.Command) (fec.Ratio, error) {
+	raw := command.String("fec")
+	if raw == "" {
+		return fec.Ratio{}, nil
+	}
+	ratio, err := fec.ParseRatio(raw)
+	ratio.Adaptive = command.Bool("fec-adaptive")
+	return ratio, err
+}
+
+// pluginConfig collects the pluggable-transport flags shared by both
+// subcommands.
+func pluginConfig(command *cli.Command) plugin.Config {
+	return plugin.Config{
+		Protocol:  command.String("plugin-protocol"),
+		Command:   command.String("plugin"),
+		Options:   command.String("plugin-opts"),
+		Transport: command.String("plugin-transport"),
+	}
+}
+
 // runTunnel configures the interface and runs the tunnel until interrupted.
 func runTunnel(runner tunnel, ip net.IP, network *net.IPNet, mtu int) error {
 	defer func() {
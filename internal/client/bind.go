@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/faketcp"
+	"github.com/ziyan/shadowgate/internal/netwatch"
+	"github.com/ziyan/shadowgate/internal/sockopt"
+)
+
+// binding pins a link's sockets to one uplink of a multi-homed host: a source
+// address, a network device (SO_BINDTODEVICE, which needs CAP_NET_RAW), or
+// both; and tunes them with the rest of its socket options (see
+// internal/sockopt), such as a firewall mark. The zero binding leaves the
+// choice to the routing table.
+type binding struct {
+	source  net.IP
+	options sockopt.Options
+}
+
+// bindingOf returns the binding of a link's sockets.
+func bindingOf(linkConfig LinkConfig) binding {
+	return binding{source: linkConfig.Source, options: linkConfig.Socket}
+}
+
+// bound reports whether the binding changes anything about a socket.
+func (self binding) bound() bool {
+	return self.source != nil || self.options != sockopt.Options{}
+}
+
+// dialer returns a dialer for network ("tcp" or "udp") whose sockets are bound.
+func (self binding) dialer(network string, timeout time.Duration) *net.Dialer {
+	dialer := self.options.Dialer(timeout)
+	if self.source != nil {
+		if network == "udp" {
+			dialer.LocalAddr = &net.UDPAddr{IP: self.source}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: self.source}
+		}
+	}
+	return dialer
+}
+
+// listenPacket opens a packet socket (such as a raw one) listening on address,
+// with the binding's options.
+func (self binding) listenPacket(network, address string) (net.PacketConn, error) {
+	return self.options.ListenConfig().ListenPacket(context.Background(), network, address)
+}
+
+// listen opens a stream listener on address whose sockets, and the
+// connections accepted on them, have the binding's options.
+func (self binding) listen(network, address string) (net.Listener, error) {
+	return self.options.ListenConfig().Listen(context.Background(), network, address)
+}
+
+// route looks up the route the binding's sockets take to remote.
+func (self binding) route(remote net.IP) (netwatch.Route, error) {
+	return netwatch.RouteTo(remote, self.source, self.options.Device, self.options.Mark)
+}
+
+// sourceFor returns the IPv4 source address for raw packets to remote: the
+// bound source, else the device's first IPv4 address, else the one the routing
+// table picks.
+func (self binding) sourceFor(remote net.IP) (net.IP, error) {
+	if self.source != nil {
+		if source := self.source.To4(); source != nil {
+			return source, nil
+		}
+		return nil, errors.New("client: raw links need an ipv4 source address")
+	}
+	if self.options.Device == "" {
+		return faketcp.SourceAddress(remote)
+	}
+	device, err := net.InterfaceByName(self.options.Device)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := device.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.To4() != nil {
+			return network.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("client: device %s has no ipv4 address", self.options.Device)
+}
@@ -1,12 +1,19 @@
 // Package client implements the shadowgate client. It opens one or more links
-// to the server — a TCP link and a UDP link — probes each with keepalives, and
-// sends tunnel traffic over the healthy link with the lowest latency, switching
-// automatically as conditions change (or falling back when one path fails).
+// to the server — by default a TCP link, a UDP link, and optionally fake TCP,
+// ICMP and HTTP polling links, or any set declared in Config.Links — probes
+// each with keepalives, and sends tunnel traffic over the healthy link with
+// the best priority and lowest latency, switching automatically as conditions
+// change (or falling back when one path fails).
 package client
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,25 +21,163 @@ import (
 	"github.com/op/go-logging"
 
 	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/fec"
+	"github.com/ziyan/shadowgate/internal/flow"
+	"github.com/ziyan/shadowgate/internal/hop"
 	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/multipath"
+	"github.com/ziyan/shadowgate/internal/netwatch"
+	"github.com/ziyan/shadowgate/internal/plugin"
+	"github.com/ziyan/shadowgate/internal/proxy"
+	"github.com/ziyan/shadowgate/internal/sockopt"
 	"github.com/ziyan/shadowgate/internal/tun"
 )
 
 var log = logging.MustGetLogger("client")
 
-// latencySwitchFactor is the hysteresis margin for switching between two
-// *healthy* links purely for latency: the client stays on its current link
-// unless another is faster by this factor (its smoothed RTT is less than the
-// current link's divided by the factor). This — together with RTT smoothing —
-// keeps the client from flapping when both links have similar latency, which
-// would re-pin the server's return route mid-flow and cause heavy packet loss.
+// latencySwitchFactor is the default hysteresis margin for switching between
+// two *healthy* links purely for latency (see PolicyThresholds.SwitchFactor):
+// the client stays on its current link unless another is faster by this
+// factor (its smoothed RTT is less than the current link's divided by the
+// factor). This — together with RTT smoothing — keeps the client from
+// flapping when both links have similar latency, which would re-pin the
+// server's return route mid-flow and cause heavy packet loss.
 // A failed (unhealthy) link always triggers a switch regardless of this margin.
 const latencySwitchFactor = 2
 
+// maxFlows bounds how many flows the client keeps pinned to links (see
+// Config.FlowIdle).
+const maxFlows = 16384
+
+// Config selects the server to connect to and how the client's links behave.
+type Config struct {
+	// Links, when set, declares every link explicitly, replacing the ones
+	// otherwise derived from Connect, FakeTCPPort, ICMP and HTTPURL.
+	Links    []LinkConfig
+	Connect  string // server address (host:port) for every link
+	Password []byte
+	Compress bool // TCP: Snappy-compress the stream
+	Padding  int  // UDP and ICMP: maximum random padding bytes per datagram
+	ICMP     bool // also run an ICMP echo link, used only when no other link is healthy
+
+	// Failover, when set, is the address (host:port) of a standby server: each
+	// link derived for Connect, but HTTP polling, gets a twin to it that ranks
+	// below every link to Connect.
+	Failover string
+	// Listen, when set, inverts the connection for a site that can accept
+	// connections but not make them: instead of dialing Connect, a UDP link
+	// and a TCP link listen on this local address (host:port) for the server,
+	// which dials this client (see server.Config.DialClients).
+	Listen string
+	// UDPHopPorts, unless empty, makes the UDP link hop across this range of
+	// server ports every HopInterval (see LinkConfig.HopPorts).
+	UDPHopPorts hop.Range
+	HopInterval time.Duration
+	// FEC, when enabled, sends the UDP link's frames in forward error
+	// correction groups (see LinkConfig.FEC).
+	FEC fec.Ratio
+	// Socket tunes the sockets of every link derived for Connect (see
+	// LinkConfig.Socket), binding them to its Device if any, and those of
+	// the peer-to-peer paths.
+	Socket sockopt.Options
+	// Multipath selects how frames are spread across links: over the active one
+	// (the default), copied over every healthy link, or striped across them by
+	// weight (see internal/multipath). Every link must reach the same server.
+	Multipath multipath.Mode
+	// FlowIdle, when positive, keeps each flow (by its 5-tuple) on the link it
+	// started on until the flow has been idle this long or the link fails, so
+	// that only new flows follow a newly chosen link. Zero moves every flow at
+	// once. The server pins the replies given its own FlowIdle.
+	FlowIdle time.Duration
+	// Policy chooses the link that carries traffic among the healthy ones;
+	// nil means lowest-latency (see ParsePolicy). Client.SetPolicy changes it
+	// at runtime.
+	Policy Policy
+	// Batch packs frames queued together on a link into one record of the
+	// encrypted stream, or one datagram up to the path's size, waiting up to
+	// BatchDelay after the first for more; zero takes only those already
+	// queued (see internal/batch).
+	Batch      bool
+	BatchDelay time.Duration
+	// OnDemand keeps the links down until the tunnel has traffic to send,
+	// holding the first frames until a link is up, backs their keepalives
+	// off while the tunnel is quiet, and closes them once it has been idle
+	// for IdleTimeout (never, when zero), for clients on batteries or metered
+	// data. It cannot be combined with Listen or PeerToPeer.
+	OnDemand    bool
+	IdleTimeout time.Duration
+	// WatchNetwork redials a link at once, with its backoff reset, when the
+	// host's addresses or routes change, as after Wi-Fi roaming or a resume
+	// from suspend, and the change moved the route to its server: another
+	// source address, next hop or interface (see internal/netwatch). Links
+	// not connected, or whose route cannot be told, redial on every change;
+	// the others send a keepalive at once, to learn whether their path still
+	// carries.
+	WatchNetwork bool
+	// Rules send the frames they match over the links they name, in order,
+	// whichever link the policy chose; the first matching rule applies.
+	Rules []Rule
+	// PeerToPeer sends frames for other clients of the tunnel network over
+	// direct UDP paths, punched through NATs with the server (started with
+	// rendezvous) introducing the two ends, while such a path works.
+	PeerToPeer bool
+	// FakeTCPPort, when non-zero, adds a fake TCP link to this port on the
+	// server's host: UDP-style datagrams in TCP-shaped packets on raw sockets.
+	FakeTCPPort int
+	// HTTPURL, when set, adds an HTTP polling link to this URL (http:// or
+	// https://, possibly through a CDN or reverse proxy), used only when no other
+	// link is healthy.
+	HTTPURL string
+	// Proxy, when set, is an upstream proxy URL (socks5:// or http://, with
+	// optional user:password@) that the TCP, UDP and HTTP links go through. An
+	// HTTP proxy cannot carry UDP, so the UDP link is left out. Fake TCP and ICMP
+	// always go direct.
+	Proxy string
+	// ConnectCommand, when set, is a shell command whose standard input and
+	// output reach the server (say, `ssh host shadowgate server --stdio`). The
+	// client then runs only a stream link over it, spawning the command afresh
+	// on every redial, and ignores Connect and the other link options.
+	ConnectCommand string
+	// Plugin, when its Command is set, runs an external pluggable transport
+	// (SIP003 or Tor managed proxy) that carries the TCP link in place of a
+	// direct connection, or every plugin link of Links. It cannot be combined
+	// with Proxy.
+	Plugin  plugin.Config
+	Timeout time.Duration
+}
+
 type Client struct {
-	ip    net.IP
-	tun   tun.TUN
-	links []*link
+	ip      net.IP
+	tun     tun.TUN
+	links   []*link
+	plugins []*plugin.Process // one per plugin link
+	peers   *peers            // direct paths to other clients; nil unless enabled
+
+	// listeners are the sockets of listening links, which outlive each
+	// connection accepted on them.
+	listeners []io.Closer
+
+	// multipath is the mode frames are sent in; outside the active mode the
+	// sender numbers them, and the receiver takes those the server wraps.
+	multipath multipath.Mode
+	sender    *multipath.Sender
+	receiver  *multipath.Receiver
+	stripe    multipath.Stripe[*link]
+
+	// watchNetwork redials the links when the host's network changes.
+	watchNetwork bool
+
+	// demand brings the links up and down with traffic; nil unless on demand.
+	demand *demand
+
+	// flows pins flows to the link they started on; nil unless enabled.
+	flows *flow.Table[*link]
+
+	// policy chooses the active link among the healthy ones (see reselect).
+	policy atomic.Pointer[Policy]
+	// rules overrides the active link for the frames they match; nil when
+	// there are none.
+	rules *classifier
 
 	// active is the link currently chosen for outbound traffic. It is updated by
 	// the monitor goroutine and read by the tun reader.
@@ -43,32 +188,332 @@ type Client struct {
 	group     sync.WaitGroup
 }
 
-// NewClient tunnels over an already-opened tun device. It runs a UDP link and a
-// TCP link to the server, each of which keeps itself connected (re-dialing on
-// failure), and adapts between them at runtime. It fails only if the server
-// address is malformed.
-func NewClient(device tun.TUN, ip net.IP, network *net.IPNet, connect string, password []byte, useCompression bool, maxPadding int, timeout time.Duration) (*Client, error) {
-	if _, err := net.ResolveUDPAddr("udp", connect); err != nil {
+// NewClient tunnels over an already-opened tun device. It runs the links of
+// config.Links, or by default a UDP link and a TCP link to the server (plus
+// fake TCP, ICMP and HTTP links when enabled), each of which keeps itself
+// connected (re-dialing on failure), and adapts between them at runtime. It
+// fails only if a link, server or proxy address is malformed or a plugin fails
+// to start.
+func NewClient(device tun.TUN, ip net.IP, network *net.IPNet, config Config) (*Client, error) {
+	if config.ConnectCommand != "" {
+		only := newLink("command", func() (transport, error) {
+			return dialCommand(config.ConnectCommand, config.Password, config.Compress)
+		}, ip)
+		self := newClient(device, ip, []*link{only})
+		self.watchNetwork = config.WatchNetwork
+		if config.OnDemand {
+			self.setDemand(newDemand(config.IdleTimeout))
+		}
+		return self, nil
+	}
+
+	var upstream *proxy.Proxy
+	if config.Proxy != "" {
+		var err error
+		if upstream, err = proxy.Parse(config.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	configs := config.Links
+	if len(configs) > 0 && config.Failover != "" {
+		return nil, errors.New("client: declare the links to a failover server explicitly too")
+	}
+	if len(configs) == 0 {
+		var err error
+		if configs, err = defaultLinks(config, upstream); err != nil {
+			return nil, err
+		}
+	}
+	for _, linkConfig := range configs {
+		if err := linkConfig.validate(); err != nil {
+			return nil, err
+		}
+		switch {
+		case linkConfig.Type == LinkUDP && upstream != nil && !upstream.SupportsUDP():
+			return nil, fmt.Errorf("client: the proxy cannot carry udp link %s", linkConfig.Connect)
+		case linkConfig.Type == LinkPlugin && config.Plugin.Command == "":
+			return nil, fmt.Errorf("client: plugin link %s needs a plugin command", linkConfig.Connect)
+		case linkConfig.Type == LinkPlugin && upstream != nil:
+			return nil, errors.New("client: a plugin cannot be combined with a proxy")
+		case (linkConfig.Source != nil || linkConfig.Socket != sockopt.Options{}) && upstream != nil && linkConfig.Type != LinkFakeTCP && linkConfig.Type != LinkICMP:
+			return nil, fmt.Errorf("client: link %s cannot be bound to a source or device, or have socket options, through a proxy", linkConfig.Connect)
+		case linkConfig.Type == LinkUDP && !linkConfig.HopPorts.Empty() && upstream != nil:
+			return nil, fmt.Errorf("client: udp link %s cannot hop ports through a proxy", linkConfig.Connect)
+		case linkConfig.Listen && upstream != nil:
+			return nil, fmt.Errorf("client: link %s cannot listen through a proxy", linkConfig.Connect)
+		}
+	}
+	if config.PeerToPeer && (upstream != nil || config.Connect == "" || config.Listen != "") {
+		return nil, errors.New("client: peer-to-peer paths need a direct server address")
+	}
+	if config.OnDemand {
+		if config.PeerToPeer {
+			return nil, errors.New("client: peer-to-peer paths cannot be kept on demand")
+		}
+		for _, linkConfig := range configs {
+			if linkConfig.Listen {
+				return nil, fmt.Errorf("client: listening link %s cannot be brought up on demand", linkConfig.Connect)
+			}
+		}
+	}
+
+	self := newClient(device, ip, nil)
+	self.multipath = config.Multipath
+	self.watchNetwork = config.WatchNetwork
+	if config.FlowIdle > 0 {
+		self.flows = flow.NewTable[*link](config.FlowIdle, maxFlows)
+	}
+	labels := linkLabels(configs)
+	for index, linkConfig := range configs {
+		dial, err := self.dialer(linkConfig, config, upstream)
+		if err != nil {
+			self.stopPlugins()
+			self.closeListeners()
+			return nil, err
+		}
+		current := newLink(labels[index], dial, ip)
+		current.bind = bindingOf(linkConfig)
+		current.priority = linkConfig.Priority
+		current.metered = linkConfig.Metered
+		current.batch, current.batchDelay = config.Batch, config.BatchDelay
+		if linkConfig.Weight > 0 {
+			current.weight = linkConfig.Weight
+		}
+		self.links = append(self.links, current)
+	}
+	self.active.Store(self.links[0])
+	if config.Policy != nil {
+		self.SetPolicy(config.Policy)
+	}
+	if config.OnDemand {
+		self.setDemand(newDemand(config.IdleTimeout))
+	}
+	rules, err := newClassifier(config.Rules, self.links)
+	if err != nil {
+		self.stopPlugins()
+		self.closeListeners()
 		return nil, err
 	}
+	self.rules = rules
+	if config.PeerToPeer {
+		var err error
+		if self.peers, err = newPeers(ip, network, config.Connect, config.Password, config.Padding, binding{options: config.Socket}, config.Timeout); err != nil {
+			self.stopPlugins()
+			self.closeListeners()
+			return nil, err
+		}
+	}
+	return self, nil
+}
 
-	links := []*link{
-		newLink("udp", func() (transport, error) {
-			return dialUdp(connect, password, maxPadding, timeout)
-		}, ip),
-		newLink("tcp", func() (transport, error) {
-			return dialTcp(connect, password, useCompression, timeout)
-		}, ip),
+// defaultLinks derives the links of a configuration that declares none: UDP
+// (unless the proxy cannot carry it) and TCP, or the plugin in place of TCP,
+// to Connect, then the optional fake TCP, ICMP and HTTP links. A listening
+// client has a listening UDP link and TCP link only.
+func defaultLinks(config Config, upstream *proxy.Proxy) ([]LinkConfig, error) {
+	if config.Listen != "" {
+		if config.Failover != "" {
+			return nil, errors.New("client: a listening client has no failover server")
+		}
+		base := LinkConfig{Connect: config.Listen, Padding: config.Padding, Compress: config.Compress, Listen: true, FEC: config.FEC, Socket: config.Socket}
+		udp, tcp := base, base
+		udp.Type, tcp.Type = LinkUDP, LinkTCP
+		return []LinkConfig{udp, tcp}, nil
+	}
+	host, _, err := net.SplitHostPort(config.Connect)
+	if err != nil {
+		return nil, err
 	}
+	if _, err := url.Parse(config.HTTPURL); err != nil {
+		return nil, err
+	}
+	base := LinkConfig{Connect: config.Connect, Padding: config.Padding, Compress: config.Compress, HopPorts: config.UDPHopPorts, HopInterval: config.HopInterval, FEC: config.FEC, Socket: config.Socket}
+	with := func(kind string, connect string, priority int) LinkConfig {
+		linkConfig := base
+		linkConfig.Type, linkConfig.Connect, linkConfig.Priority = kind, connect, priority
+		return linkConfig
+	}
+
+	var links []LinkConfig
+	if upstream == nil || upstream.SupportsUDP() {
+		links = append(links, with(LinkUDP, config.Connect, 0))
+	}
+	if config.Plugin.Command != "" {
+		links = append(links, with(LinkPlugin, config.Connect, 0))
+	} else {
+		links = append(links, with(LinkTCP, config.Connect, 0))
+	}
+	if config.FakeTCPPort != 0 {
+		links = append(links, with(LinkFakeTCP, net.JoinHostPort(host, strconv.Itoa(config.FakeTCPPort)), 0))
+	}
+	// Polling makes ICMP slower than the other links even when its probes
+	// answer quickly, and every HTTP frame costs a request, so both only carry
+	// traffic when nothing else works.
+	if config.ICMP {
+		links = append(links, with(LinkICMP, config.Connect, 1))
+	}
+	if config.HTTPURL != "" {
+		links = append(links, with(LinkHTTP, config.HTTPURL, 1))
+	}
+	if config.Failover != "" {
+		failovers, err := failoverLinks(links, config.Failover)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, failovers...)
+	}
+	return links, nil
+}
+
+// failoverLinks returns a twin of each link toward the standby server at
+// failover, ranked below all of them. HTTP polling has no twin, as its URL
+// names its server.
+func failoverLinks(links []LinkConfig, failover string) ([]LinkConfig, error) {
+	host, _, err := net.SplitHostPort(failover)
+	if err != nil {
+		return nil, err
+	}
+	var twins []LinkConfig
+	for _, linkConfig := range links {
+		switch linkConfig.Type {
+		case LinkHTTP:
+			continue
+		case LinkFakeTCP:
+			_, port, _ := net.SplitHostPort(linkConfig.Connect)
+			linkConfig.Connect = net.JoinHostPort(host, port)
+		default:
+			linkConfig.Connect = failover
+		}
+		linkConfig.Name = "failover-" + linkConfig.Type
+		linkConfig.Priority += 2
+		twins = append(twins, linkConfig)
+	}
+	return twins, nil
+}
 
+// linkLabels names each link for logs: its Name, or its type, numbered when
+// several links share the type.
+func linkLabels(configs []LinkConfig) []string {
+	counts := make(map[string]int)
+	for _, linkConfig := range configs {
+		counts[linkConfig.Type]++
+	}
+	seen := make(map[string]int)
+	labels := make([]string, len(configs))
+	for index, linkConfig := range configs {
+		seen[linkConfig.Type]++
+		switch {
+		case linkConfig.Name != "":
+			labels[index] = linkConfig.Name
+		case counts[linkConfig.Type] > 1:
+			labels[index] = fmt.Sprintf("%s-%d", linkConfig.Type, seen[linkConfig.Type])
+		default:
+			labels[index] = linkConfig.Type
+		}
+	}
+	return labels
+}
+
+// dialer returns the function that dials one link, starting its plugin process
+// first for a plugin link.
+func (self *Client) dialer(linkConfig LinkConfig, config Config, upstream *proxy.Proxy) (dialer, error) {
+	password, timeout := config.Password, config.Timeout
+	bind := bindingOf(linkConfig)
+	switch linkConfig.Type {
+	case LinkUDP:
+		if linkConfig.Listen {
+			listening, err := listenUdp(linkConfig.Connect, password, linkConfig.Padding, linkConfig.FEC, bind)
+			if err != nil {
+				return nil, err
+			}
+			self.listeners = append(self.listeners, listening.conn)
+			return listening.accept, nil
+		}
+		var schedule *hop.Schedule
+		if !linkConfig.HopPorts.Empty() {
+			var err error
+			if schedule, err = hop.NewSchedule(password, linkConfig.HopPorts, linkConfig.HopInterval); err != nil {
+				return nil, err
+			}
+		}
+		return func() (transport, error) {
+			return dialUdp(linkConfig.Connect, password, linkConfig.Padding, linkConfig.FEC, upstream, bind, schedule, self.ip, timeout)
+		}, nil
+	case LinkTCP:
+		if linkConfig.Listen {
+			listener, err := bind.listen("tcp", linkConfig.Connect)
+			if err != nil {
+				return nil, err
+			}
+			self.listeners = append(self.listeners, listener)
+			return func() (transport, error) {
+				return acceptTcp(listener, password, linkConfig.Compress)
+			}, nil
+		}
+		return func() (transport, error) {
+			return dialTcp(linkConfig.Connect, password, linkConfig.Compress, upstream, bind, timeout)
+		}, nil
+	case LinkPlugin:
+		process, err := plugin.StartClient(config.Plugin, linkConfig.Connect)
+		if err != nil {
+			return nil, err
+		}
+		self.plugins = append(self.plugins, process)
+		return func() (transport, error) {
+			return dialPlugin(process, password, linkConfig.Compress, timeout)
+		}, nil
+	case LinkFakeTCP:
+		return func() (transport, error) {
+			return dialFakeTcp(linkConfig.Connect, password, linkConfig.Padding, bind, timeout)
+		}, nil
+	case LinkICMP:
+		connect := linkConfig.Connect
+		if _, _, err := net.SplitHostPort(connect); err != nil {
+			connect = net.JoinHostPort(connect, "0")
+		}
+		return func() (transport, error) {
+			return dialIcmp(connect, password, linkConfig.Padding, bind)
+		}, nil
+	case LinkHTTP:
+		return func() (transport, error) {
+			return dialHttp(linkConfig.Connect, password, linkConfig.Padding, upstream, bind, timeout)
+		}, nil
+	}
+	return nil, fmt.Errorf("client: unknown link type: %q", linkConfig.Type)
+}
+
+func newClient(device tun.TUN, ip net.IP, links []*link) *Client {
 	self := &Client{
 		ip:      ip,
 		tun:     device,
 		links:   links,
+		sender:  multipath.NewSender(),
 		closing: make(chan struct{}),
 	}
-	self.active.Store(links[0])
-	return self, nil
+	self.receiver = multipath.NewReceiver(self.writeTun)
+	self.SetPolicy(lowestLatency{PolicyThresholds{}.withDefaults()})
+	if len(links) > 0 {
+		self.active.Store(links[0])
+	}
+	return self
+}
+
+// setDemand brings the links up and down with traffic.
+func (self *Client) setDemand(demand *demand) {
+	self.demand = demand
+	for _, current := range self.links {
+		current.demand = demand
+	}
+}
+
+// SetPolicy makes policy choose the active link from the next reselection on.
+// The links time capacity trains only while it is a CapacityPolicy.
+func (self *Client) SetPolicy(policy Policy) {
+	self.policy.Store(&policy)
+	_, measure := policy.(CapacityPolicy)
+	for _, current := range self.links {
+		current.measure.Store(measure)
+	}
 }
 
 func (self *Client) Interface() string {
@@ -92,6 +537,20 @@ func (self *Client) Run(signaling chan os.Signal) error {
 		self.readTun()
 	}()
 
+	if self.peers != nil {
+		self.group.Add(2)
+		go func() {
+			defer deferutil.Recover()
+			defer self.group.Done()
+			self.peers.readLoop(self.tun)
+		}()
+		go func() {
+			defer deferutil.Recover()
+			defer self.group.Done()
+			self.peers.maintain(self.closing)
+		}()
+	}
+
 	for _, current := range self.links {
 		current := current
 		self.group.Add(1)
@@ -109,6 +568,15 @@ func (self *Client) Run(signaling chan os.Signal) error {
 		self.monitor()
 	}()
 
+	if self.watchNetwork {
+		self.group.Add(1)
+		go func() {
+			defer deferutil.Recover()
+			defer self.group.Done()
+			self.redialOnChange()
+		}()
+	}
+
 	<-signaling
 
 	self.stop()
@@ -119,13 +587,31 @@ func (self *Client) stop() {
 	self.closeOnce.Do(func() {
 		close(self.closing)
 		_ = self.tun.Close()
+		self.closeListeners() // unblock links waiting for the server
 		for _, current := range self.links {
 			current.stop()
 		}
+		self.stopPlugins()
+		if self.peers != nil {
+			self.peers.close()
+		}
+		self.receiver.Close()
 	})
 	self.group.Wait()
 }
 
+func (self *Client) stopPlugins() {
+	for _, process := range self.plugins {
+		_ = process.Close()
+	}
+}
+
+func (self *Client) closeListeners() {
+	for _, listener := range self.listeners {
+		_ = listener.Close()
+	}
+}
+
 func (self *Client) readTun() {
 	buffer := make([]byte, 65536)
 	for {
@@ -143,16 +629,120 @@ func (self *Client) readTun() {
 		}
 		// Forward whatever the host routed into the tunnel — including traffic
 		// from networks behind this client when it acts as a relay.
-		if active := self.active.Load(); active != nil {
-			active.Send(frame.Copy())
+		if self.peers != nil && self.peers.send(frame) {
+			continue
+		}
+		// On demand, the first frame wakes the links, and waits in the
+		// active link's queue until it is up.
+		self.demand.touch()
+		self.send(frame.Copy())
+	}
+}
+
+// send sends a frame over the link its rule prefers, else over the active
+// link or, in the redundant and bonded modes, over the healthy links.
+func (self *Client) send(frame ipv4.Frame) {
+	if preferred := self.rules.classify(frame); preferred != nil {
+		preferred.Send(frame)
+		return
+	}
+	if self.multipath != multipath.Active {
+		var healthy []*link
+		for _, current := range self.links {
+			if current.healthy() {
+				healthy = append(healthy, current)
+			}
+		}
+		if len(healthy) > 0 {
+			self.spread(frame, healthy)
+			return
 		}
 	}
+	if active := self.active.Load(); active != nil {
+		self.pinned(frame, active).Send(frame)
+	}
+}
+
+// pinned returns the link frame's flow is pinned to, first pinning it to active
+// if it is new, idle or on a link that has failed.
+func (self *Client) pinned(frame ipv4.Frame, active *link) *link {
+	if self.flows == nil {
+		return active
+	}
+	key := flow.KeyOf(frame)
+	if current, ok := self.flows.Lookup(key); ok && (current == active || current.healthy()) {
+		return current
+	}
+	self.flows.Pin(key, active)
+	return active
+}
+
+// spread wraps frame and sends a copy over each healthy link, or, bonded, over
+// one of them chosen by weight.
+func (self *Client) spread(frame ipv4.Frame, healthy []*link) {
+	header := self.sender.Next(self.multipath)
+	if self.multipath == multipath.Bonded {
+		healthy = []*link{self.stripe.Pick(healthy, func(current *link) int { return current.weight })}
+	}
+	for _, current := range healthy {
+		server := current.server.Load()
+		if server == nil {
+			continue
+		}
+		header.Weight = byte(min(current.weight, 255))
+		wrapped, ok := multipath.Wrap(self.ip, *server, header, frame)
+		if !ok {
+			current.Send(frame)
+			continue
+		}
+		current.Send(wrapped)
+	}
 }
 
 func (self *Client) deliverFrames(current *link) {
 	for frame := range current.frames {
-		if _, err := self.tun.Write(frame); err != nil {
-			log.Warningf("failed to write to tun: %s", err)
+		if !multipath.IsWrapped(frame) || !self.ip.Equal(frame.Destination()) {
+			self.writeTun(frame)
+			continue
+		}
+		header, inner, err := multipath.Unwrap(frame)
+		if err != nil {
+			log.Debugf("link %s: dropped wrapped frame: %s", current.name(), err)
+			continue
+		}
+		self.receiver.Receive(header, inner)
+	}
+}
+
+func (self *Client) writeTun(frame ipv4.Frame) {
+	if _, err := self.tun.Write(frame); err != nil {
+		log.Warningf("failed to write to tun: %s", err)
+	}
+}
+
+// redialOnChange redials the links whose route to the server moved whenever
+// the host's addresses or routes change, and nudges the others, until the
+// client stops.
+func (self *Client) redialOnChange() {
+	watcher, err := netwatch.New(self.tun.Interface())
+	if err != nil {
+		log.Warningf("failed to watch for network changes: %s", err)
+		return
+	}
+	defer watcher.Close()
+	for {
+		select {
+		case <-watcher.Changes():
+			log.Noticef("network changed")
+			for _, current := range self.links {
+				if current.moved() {
+					current.redial()
+				} else {
+					current.nudge()
+				}
+			}
+		case <-self.closing:
+			return
 		}
 	}
 }
@@ -172,20 +762,33 @@ func (self *Client) monitor() {
 	}
 }
 
-// reselect updates the active link. It prefers the healthy link with the lowest
-// round-trip time, but sticks with the current link unless it becomes unhealthy
-// or another link is faster by the hysteresis margin. When no link is healthy it
-// moves to the one that replied most recently, the best guess at what will
-// recover first.
+// reselect updates the active link: the policy chooses among the healthy links
+// (by default preferring the lowest priority, unmetered over metered, and
+// among those the lowest weighted round-trip time, but sticking with the
+// current link unless it becomes unhealthy, a link of a better rank recovers,
+// or another link of its rank is cheaper by the hysteresis margin). When no
+// link is healthy it moves to the one that replied most recently, the best
+// guess at what will recover first.
 func (self *Client) reselect() {
 	current := self.active.Load()
 
-	if best := self.bestHealthy(); best != nil {
-		switch {
-		case current == nil || !current.healthy():
-			self.setActive(best)
-		case best != current && best.rtt()*latencySwitchFactor < current.rtt():
-			self.setActive(best)
+	var healthy []*link
+	var stats []LinkStats
+	index := -1
+	for _, candidate := range self.links {
+		if !candidate.healthy() {
+			continue
+		}
+		if candidate == current {
+			index = len(healthy)
+		}
+		healthy = append(healthy, candidate)
+		stats = append(stats, candidate.stats())
+	}
+	if len(healthy) > 0 {
+		policy := *self.policy.Load()
+		if chosen := policy.Choose(stats, index); chosen >= 0 && chosen < len(healthy) {
+			self.setActive(healthy[chosen])
 		}
 		return
 	}
@@ -195,19 +798,6 @@ func (self *Client) reselect() {
 	}
 }
 
-func (self *Client) bestHealthy() *link {
-	var best *link
-	for _, current := range self.links {
-		if !current.healthy() {
-			continue
-		}
-		if best == nil || current.rtt() < best.rtt() {
-			best = current
-		}
-	}
-	return best
-}
-
 func (self *Client) freshestLink() *link {
 	var freshest *link
 	newest := int64(-1)
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxIdlePingInterval bounds how far an on-demand link's keepalives back off
+// while the tunnel carries nothing: well within healthTimeout, so that an
+// idle link still counts as healthy.
+const maxIdlePingInterval = healthTimeout / 2
+
+// always is the closed channel a nil demand is ready with.
+var always = func() chan struct{} {
+	ready := make(chan struct{})
+	close(ready)
+	return ready
+}()
+
+// demand runs the links of an on-demand client (see Config.OnDemand): they
+// dial only once the tunnel has traffic, ping less often the longer it has
+// none, and close once it has had none for idle, until the next frame. A nil
+// demand keeps every link up and pinging at pingInterval.
+type demand struct {
+	idle time.Duration // zero never closes the links
+
+	last     atomic.Int64 // UnixNano of the last data frame either way
+	sleeping atomic.Bool  // the links are down until the next frame
+
+	mutex sync.Mutex
+	awake chan struct{} // closed when a frame wakes the links
+
+	now func() time.Time // injectable clock for tests; defaults to time.Now
+}
+
+func newDemand(idle time.Duration) *demand {
+	self := &demand{idle: idle, awake: make(chan struct{}), now: time.Now}
+	self.sleeping.Store(true)
+	return self
+}
+
+// touch records a data frame, waking the links if they sleep.
+func (self *demand) touch() {
+	if self == nil {
+		return
+	}
+	self.last.Store(self.now().UnixNano())
+	if !self.sleeping.Load() {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.sleeping.Load() {
+		self.sleeping.Store(false)
+		close(self.awake)
+	}
+}
+
+// ready returns a channel that is closed while the links are wanted. Once the
+// tunnel has been idle too long it puts them to sleep, and the channel it
+// returns then is closed by the next frame.
+func (self *demand) ready() <-chan struct{} {
+	if self == nil {
+		return always
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.sleeping.Load() && self.expired() {
+		self.sleeping.Store(true)
+		if self.expired() {
+			self.awake = make(chan struct{})
+		} else {
+			self.sleeping.Store(false) // a frame came in meanwhile, and did not wait for the lock
+		}
+	}
+	return self.awake
+}
+
+// expired reports whether the tunnel has been idle long enough for the links
+// to close.
+func (self *demand) expired() bool {
+	return self != nil && self.idle > 0 && self.quiet() >= self.idle
+}
+
+// quiet returns how long the tunnel has carried no data frame.
+func (self *demand) quiet() time.Duration {
+	return time.Duration(self.now().UnixNano() - self.last.Load())
+}
+
+// pingInterval returns how long a link waits before its next keepalive: half
+// the time the tunnel has been quiet, between pingInterval and
+// maxIdlePingInterval, so that keepalives back off geometrically.
+func (self *demand) pingInterval() time.Duration {
+	if self == nil {
+		return pingInterval
+	}
+	return min(max(self.quiet()/2, pingInterval), maxIdlePingInterval)
+}
+
+// idling reports whether the tunnel has been quiet long enough for the
+// keepalives to back off, which is no time to spend bytes on measuring.
+func (self *demand) idling() bool {
+	return self != nil && self.pingInterval() > pingInterval
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func isClosed(ready <-chan struct{}) bool {
+	select {
+	case <-ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDemand(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := newDemand(time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	// Links sleep until the first frame.
+	asleep := tracker.ready()
+	if isClosed(asleep) {
+		t.Fatal("ready before any traffic")
+	}
+	tracker.touch()
+	if !isClosed(asleep) || !isClosed(tracker.ready()) {
+		t.Fatal("a frame did not wake the links")
+	}
+
+	// They stay up until the tunnel has been idle for the timeout.
+	now = now.Add(time.Minute - time.Second)
+	if tracker.expired() || !isClosed(tracker.ready()) {
+		t.Fatal("links put to sleep before the idle timeout")
+	}
+	now = now.Add(time.Second)
+	if !tracker.expired() {
+		t.Fatal("not expired after the idle timeout")
+	}
+	asleep = tracker.ready()
+	if isClosed(asleep) {
+		t.Fatal("links still wanted after the idle timeout")
+	}
+	if tracker.ready() != asleep {
+		t.Error("a second call while asleep returned another channel")
+	}
+
+	// The next frame wakes them again.
+	tracker.touch()
+	if !isClosed(asleep) || tracker.expired() {
+		t.Error("a frame did not wake the links after they slept")
+	}
+}
+
+func TestDemandWithoutIdleTimeout(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := newDemand(0)
+	tracker.now = func() time.Time { return now }
+	tracker.touch()
+	now = now.Add(24 * time.Hour)
+	if tracker.expired() || !isClosed(tracker.ready()) {
+		t.Error("links put to sleep without an idle timeout")
+	}
+
+	var none *demand
+	if none.expired() || !isClosed(none.ready()) || none.pingInterval() != pingInterval || none.idling() {
+		t.Error("a nil demand does not keep the links up")
+	}
+	none.touch()
+}
+
+func TestDemandPingInterval(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := newDemand(time.Hour)
+	tracker.now = func() time.Time { return now }
+	tracker.touch()
+
+	cases := []struct {
+		quiet, want time.Duration
+	}{
+		{0, pingInterval},
+		{pingInterval, pingInterval},
+		{4 * pingInterval, 2 * pingInterval},
+		{maxIdlePingInterval, maxIdlePingInterval / 2},
+		{time.Hour, maxIdlePingInterval},
+	}
+	for _, c := range cases {
+		tracker.last.Store(now.Add(-c.quiet).UnixNano())
+		if got := tracker.pingInterval(); got != c.want {
+			t.Errorf("pingInterval after %s quiet = %s, want %s", c.quiet, got, c.want)
+		}
+		if idling := tracker.idling(); idling != (c.want > pingInterval) {
+			t.Errorf("idling after %s quiet = %t", c.quiet, idling)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+)
+
+// attemptDelay is how long a happy-eyeballs dial waits for one address before
+// also trying the next (RFC 8305's recommended connection attempt delay).
+const attemptDelay = 250 * time.Millisecond
+
+// resolveEndpoint resolves the host of connect (host:port) to every address it
+// has, ordered for happy eyeballs (RFC 8305): families interleaved, IPv6 first.
+// An address literal resolves to itself.
+func resolveEndpoint(connect string, timeout time.Duration) ([]string, error) {
+	host, port, err := net.SplitHostPort(connect)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{connect}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var inet6, inet []string
+	for _, address := range addresses {
+		if address.IP.To4() != nil {
+			inet = append(inet, net.JoinHostPort(address.IP.String(), port))
+		} else {
+			inet6 = append(inet6, net.JoinHostPort(address.IP.String(), port))
+		}
+	}
+	ordered := make([]string, 0, len(addresses))
+	for len(inet6) > 0 || len(inet) > 0 {
+		if len(inet6) > 0 {
+			ordered, inet6 = append(ordered, inet6[0]), inet6[1:]
+		}
+		if len(inet) > 0 {
+			ordered, inet = append(ordered, inet[0]), inet[1:]
+		}
+	}
+	return ordered, nil
+}
+
+// race dials addresses in order with attempt, starting the next one whenever
+// the previous has failed or attemptDelay has passed without an answer, and
+// returns the first transport to succeed. Transports from attempts that finish
+// after the winner are closed.
+func race(addresses []string, attempt func(address string) (transport, error)) (transport, error) {
+	type result struct {
+		transport transport
+		err       error
+	}
+	results := make(chan result, len(addresses))
+	started, failed := 0, 0
+	next := func() {
+		address := addresses[started]
+		started++
+		go func() {
+			defer deferutil.Recover()
+			transport, err := attempt(address)
+			results <- result{transport, err}
+		}()
+	}
+
+	next()
+	delay := time.NewTimer(attemptDelay)
+	defer delay.Stop()
+	var lastErr error
+	for {
+		select {
+		case outcome := <-results:
+			if outcome.err == nil {
+				pending := started - failed - 1
+				go func() {
+					defer deferutil.Recover()
+					for ; pending > 0; pending-- {
+						if late := <-results; late.err == nil {
+							_ = late.transport.close()
+						}
+					}
+				}()
+				return outcome.transport, nil
+			}
+			failed++
+			lastErr = outcome.err
+			if started < len(addresses) {
+				next()
+				delay.Reset(attemptDelay)
+			} else if failed == started {
+				return nil, lastErr
+			}
+		case <-delay.C:
+			if started < len(addresses) {
+				next()
+				delay.Reset(attemptDelay)
+			}
+		}
+	}
+}
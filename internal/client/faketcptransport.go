@@ -0,0 +1,178 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/faketcp"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+// synRetryInterval is how long a fake TCP dial waits for a SYN-ACK before
+// sending its SYN again.
+const synRetryInterval = 500 * time.Millisecond
+
+// fakeTcpTransport is a fake TCP path to the server: each frame travels as one
+// obfuscated datagram inside a TCP-shaped segment on a raw socket (see
+// internal/faketcp), so delivery is unordered like UDP.
+type fakeTcpTransport struct {
+	conn       net.PacketConn
+	server     *net.IPAddr
+	connection *faketcp.Connection
+	codec      *obfuscate.Codec
+	sequence   uint64
+	replay     obfuscate.ReplayWindow
+	recvBuffer []byte
+}
+
+// dialFakeTcp opens a raw TCP socket (which needs CAP_NET_RAW) and performs a
+// forged three-way handshake with the server's fake TCP port, from the uplink
+// bind selects.
+func dialFakeTcp(connect string, password []byte, maxPadding int, bind binding, timeout time.Duration) (*fakeTcpTransport, error) {
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := obfuscate.NewCodec(key, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	host, rawPort, err := net.SplitHostPort(connect)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	address, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	local, err := bind.sourceFor(address.IP)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := bind.listenPacket("ip4:tcp", local.String())
+	if err != nil {
+		return nil, err
+	}
+
+	localPort := uint16(32768 + rand.IntN(28232)) // the Linux ephemeral port range
+	isn := rand.Uint32()
+	self := &fakeTcpTransport{
+		conn:       conn,
+		server:     address,
+		connection: faketcp.NewConnection(local, localPort, address.IP, uint16(port), isn),
+		codec:      codec,
+		recvBuffer: make([]byte, 65536),
+	}
+	if err := self.handshake(isn, timeout); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+// handshake sends SYNs until the server answers with a SYN-ACK, then completes
+// the handshake with an ACK.
+func (self *fakeTcpTransport) handshake(isn uint32, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	defer func() { _ = self.conn.SetReadDeadline(time.Time{}) }()
+
+	syn := self.connection.Segment(faketcp.FlagSyn, nil)
+	for time.Now().Before(deadline) {
+		if _, err := self.conn.WriteTo(syn, self.server); err != nil {
+			return err
+		}
+		retry := time.Now().Add(synRetryInterval)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		_ = self.conn.SetReadDeadline(retry)
+		for {
+			segment, err := self.read()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if segment.Flags&(faketcp.FlagSyn|faketcp.FlagAck) == faketcp.FlagSyn|faketcp.FlagAck && segment.Acknowledgment == isn+1 {
+				self.connection.Receive(segment)
+				_, err := self.conn.WriteTo(self.connection.Segment(faketcp.FlagAck, nil), self.server)
+				return err
+			}
+		}
+	}
+	return errors.New("client: faketcp handshake timed out")
+}
+
+// read returns the next segment of this connection, skipping RSTs (the server
+// kernel's, which knows nothing of the connection) and unrelated TCP traffic.
+func (self *fakeTcpTransport) read() (*faketcp.Segment, error) {
+	for {
+		size, address, err := self.conn.ReadFrom(self.recvBuffer)
+		if err != nil {
+			return nil, err
+		}
+		source, ok := address.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		segment, err := faketcp.ParseSegment(self.recvBuffer[:size])
+		if err != nil || !self.connection.Matches(source.IP, segment) || segment.Flags&faketcp.FlagRst != 0 {
+			continue
+		}
+		return segment, nil
+	}
+}
+
+func (self *fakeTcpTransport) name() string { return "faketcp" }
+
+func (self *fakeTcpTransport) remote() net.IP { return self.server.IP }
+
+func (self *fakeTcpTransport) send(frame ipv4.Frame) error {
+	sequence := atomic.AddUint64(&self.sequence, 1)
+	datagram, err := self.codec.Seal(sequence, obfuscate.StreamFrame, frame)
+	if err != nil {
+		return err
+	}
+	_, err = self.conn.WriteTo(self.connection.Segment(faketcp.FlagPsh|faketcp.FlagAck, datagram), self.server)
+	return err
+}
+
+func (self *fakeTcpTransport) receive() (ipv4.Frame, error) {
+	for {
+		segment, err := self.read()
+		if err != nil {
+			return nil, err
+		}
+		if len(segment.Payload) == 0 {
+			continue
+		}
+		sequence, streamId, payload, err := self.codec.Open(segment.Payload)
+		if err != nil || streamId != obfuscate.StreamFrame {
+			continue
+		}
+		if !self.replay.Accept(sequence) {
+			continue
+		}
+		self.connection.Receive(segment)
+		frame := ipv4.DecodeFrame(payload)
+		if frame == nil {
+			continue
+		}
+		return frame.Copy(), nil
+	}
+}
+
+func (self *fakeTcpTransport) close() error {
+	return self.conn.Close()
+}
@@ -0,0 +1,271 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/meek"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+	"github.com/ziyan/shadowgate/internal/proxy"
+)
+
+const (
+	// httpMaxInflight is how many requests an HTTP link keeps open at once. One is
+	// always a long-poll waiting for return traffic; the others carry upstream
+	// frames without waiting for it to come back.
+	httpMaxInflight = 4
+
+	// httpMaxRequestSize bounds the datagrams batched into one request; frames
+	// queued beyond it are dropped, as a congested UDP socket would.
+	httpMaxRequestSize = 1 << 16
+
+	// httpQueueSize bounds the sealed frames waiting for a request and the
+	// received ones waiting for the link.
+	httpQueueSize = 256
+)
+
+// httpTransport is an HTTP polling path to the server (see internal/meek): each
+// frame travels as an obfuscated datagram in the body of a POST, and return
+// traffic arrives in the responses. A dispatcher keeps one request always
+// waiting on the server and starts more as upstream frames queue up, so
+// requests are pipelined. Any failed request fails the transport; the link
+// then redials with a fresh session.
+type httpTransport struct {
+	client  *http.Client
+	url     string
+	session string
+	codec   *obfuscate.Codec
+
+	sequence uint64 // atomic
+	replay   obfuscate.ReplayWindow
+
+	outbound chan []byte // sealed datagrams waiting for a request
+	inbound  chan []byte // datagrams received in responses
+	released chan struct{}
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	failed    chan struct{}
+	failOnce  sync.Once
+	failure   error
+	closeOnce sync.Once
+	group     sync.WaitGroup
+}
+
+// dialHttp starts a session with the HTTP polling endpoint at url, through
+// upstream when it is not nil and otherwise through any proxy named in the
+// environment, with connections bound as bind says. Nothing is sent until the
+// dispatcher's first poll, so a bad url shows up as a failed link rather than
+// a failed dial.
+func dialHttp(url string, password []byte, maxPadding int, upstream *proxy.Proxy, bind binding, timeout time.Duration) (*httpTransport, error) {
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := obfuscate.NewCodec(key, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	session := make([]byte, 16)
+	if _, err := rand.Read(session); err != nil {
+		return nil, err
+	}
+
+	proxyFunc := http.ProxyFromEnvironment
+	if upstream != nil {
+		proxyFunc = http.ProxyURL(upstream.URL())
+	}
+
+	roundTripper := &http.Transport{
+		Proxy:               proxyFunc,
+		MaxIdleConnsPerHost: httpMaxInflight,
+		TLSHandshakeTimeout: timeout,
+	}
+	if bind.bound() {
+		roundTripper.DialContext = bind.dialer("tcp", timeout).DialContext
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	self := &httpTransport{
+		client: &http.Client{
+			Transport: roundTripper,
+			Timeout:   meek.PollTimeout + timeout,
+		},
+		url:      url,
+		session:  hex.EncodeToString(session),
+		codec:    codec,
+		outbound: make(chan []byte, httpQueueSize),
+		inbound:  make(chan []byte, httpQueueSize),
+		released: make(chan struct{}, httpMaxInflight),
+		ctx:      ctx,
+		cancel:   cancel,
+		failed:   make(chan struct{}),
+	}
+	self.group.Add(1)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.dispatch()
+	}()
+	return self, nil
+}
+
+func (self *httpTransport) name() string { return "http" }
+
+// unpaced marks the transport as delivering frames in batches (see
+// unpacedTransport).
+func (self *httpTransport) unpaced() {}
+
+// send queues a frame for the next request. When the queue is full the frame is
+// dropped rather than stalling the tun reader.
+func (self *httpTransport) send(frame ipv4.Frame) error {
+	datagram, err := self.codec.Seal(atomic.AddUint64(&self.sequence, 1), obfuscate.StreamFrame, frame)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-self.failed:
+		return self.failure
+	default:
+	}
+	select {
+	case self.outbound <- datagram:
+	default:
+	}
+	return nil
+}
+
+func (self *httpTransport) receive() (ipv4.Frame, error) {
+	for {
+		var datagram []byte
+		select {
+		case datagram = <-self.inbound:
+		case <-self.failed:
+			return nil, self.failure
+		}
+		sequence, streamId, payload, err := self.codec.Open(datagram)
+		if err != nil || streamId != obfuscate.StreamFrame {
+			continue
+		}
+		if !self.replay.Accept(sequence) {
+			continue
+		}
+		frame := ipv4.DecodeFrame(payload)
+		if frame == nil {
+			continue
+		}
+		return frame.Copy(), nil
+	}
+}
+
+func (self *httpTransport) close() error {
+	self.closeOnce.Do(func() {
+		self.fail(net.ErrClosed)
+		self.cancel()
+		self.group.Wait()
+		self.client.CloseIdleConnections()
+	})
+	return nil
+}
+
+// fail records the transport's first error and wakes everything waiting on it.
+func (self *httpTransport) fail(err error) {
+	self.failOnce.Do(func() {
+		self.failure = err
+		close(self.failed)
+	})
+}
+
+// dispatch starts requests: one whenever none is in flight, so the server always
+// holds a poll, and more while upstream datagrams are waiting and fewer than
+// httpMaxInflight requests are open. The server only learns of a session from an
+// authenticated datagram, so polling starts with the link's first keepalive.
+func (self *httpTransport) dispatch() {
+	inflight := 0
+	started := false
+	var pending []byte
+	for {
+		for (inflight == 0 && started) || (len(pending) > 0 && inflight < httpMaxInflight) {
+			body := pending
+			pending = nil
+			if len(body) == 0 {
+				// The server answers only polls that authenticate.
+				poll, err := self.codec.Seal(atomic.AddUint64(&self.sequence, 1), obfuscate.StreamPoll, nil)
+				if err != nil {
+					self.fail(err)
+					return
+				}
+				body = meek.AppendDatagram(nil, poll)
+			}
+			started = true
+			inflight++
+			self.group.Add(1)
+			go func() {
+				defer deferutil.Recover()
+				defer self.group.Done()
+				self.request(body)
+			}()
+		}
+		select {
+		case datagram := <-self.outbound:
+			if len(pending)+len(datagram) <= httpMaxRequestSize {
+				pending = meek.AppendDatagram(pending, datagram)
+			}
+		case <-self.released:
+			inflight--
+		case <-self.failed:
+			return
+		}
+	}
+}
+
+// request posts one body and hands the datagrams in the response to receive.
+func (self *httpTransport) request(body []byte) {
+	defer func() { self.released <- struct{}{} }()
+
+	request, err := http.NewRequestWithContext(self.ctx, http.MethodPost, self.url, bytes.NewReader(body))
+	if err != nil {
+		self.fail(err)
+		return
+	}
+	request.Header.Set(meek.SessionHeader, self.session)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := self.client.Do(request)
+	if err != nil {
+		self.fail(err)
+		return
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		self.fail(fmt.Errorf("client: http poll returned %s", response.Status))
+		return
+	}
+	payload, err := io.ReadAll(response.Body)
+	if err != nil {
+		self.fail(err)
+		return
+	}
+	datagrams, err := meek.SplitBody(payload)
+	if err != nil {
+		self.fail(err)
+		return
+	}
+	for _, datagram := range datagrams {
+		select {
+		case self.inbound <- datagram:
+		case <-self.failed:
+			return
+		}
+	}
+}
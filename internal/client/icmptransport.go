@@ -0,0 +1,220 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/icmp"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+// icmpPollInterval is how often an ICMP link sends an empty poll, so the server
+// always holds a few requests it can answer the moment return traffic arrives.
+const icmpPollInterval = 200 * time.Millisecond
+
+// icmpTransport is an ICMP path to the server: each frame travels as the
+// obfuscated payload of an echo request, and return traffic arrives in echo
+// replies (see internal/icmp). A reply can only answer a request, so besides the
+// link's sends the transport keeps empty polls flowing to the server, and sends
+// a fresh poll for every frame it receives so a burst of return traffic is not
+// starved of requests to ride on. Writes to the raw socket are safe to make from
+// both goroutines.
+type icmpTransport struct {
+	conn        net.PacketConn
+	server      *net.IPAddr
+	destination net.Addr // server, as conn addresses it
+	codec       *obfuscate.Codec
+	identifier  uint16
+
+	sequence     uint64 // atomic; obfuscated datagram sequence
+	echoSequence uint32 // atomic; ICMP echo sequence (truncated to 16 bits)
+
+	replay     obfuscate.ReplayWindow
+	recvBuffer []byte
+
+	polled    chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	group     sync.WaitGroup
+}
+
+// dialIcmp opens a raw ICMP socket (which needs CAP_NET_RAW) toward the host of
+// connect, bound as bind says; the port is ignored. Without the capability it
+// falls back to a ping socket (see listenPing).
+func dialIcmp(connect string, password []byte, maxPadding int, bind binding) (*icmpTransport, error) {
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := obfuscate.NewCodec(key, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(connect)
+	if err != nil {
+		return nil, err
+	}
+	address, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	local := "0.0.0.0"
+	if bind.source != nil {
+		local = bind.source.String()
+	}
+	self := &icmpTransport{
+		server:      address,
+		destination: address,
+		codec:       codec,
+		identifier:  uint16(rand.Uint32()),
+		recvBuffer:  make([]byte, 65536),
+		polled:      make(chan struct{}, 64),
+		closing:     make(chan struct{}),
+	}
+	self.conn, err = bind.listenPacket("ip4:icmp", local)
+	if errors.Is(err, syscall.EPERM) {
+		if self.conn, err = listenPing(bind); err == nil {
+			// The kernel sets the identifier of our requests to the socket's
+			// port, and hands it only the replies that carry it.
+			self.identifier = uint16(self.conn.LocalAddr().(*net.UDPAddr).Port)
+			self.destination = &net.UDPAddr{IP: address.IP}
+			log.Infof("link icmp: no raw sockets; using a ping socket")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	self.group.Add(1)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.pollLoop()
+	}()
+	return self, nil
+}
+
+// listenPing opens an unprivileged ICMP socket, as ping does, with the options
+// of bind. It needs the process's group within net.ipv4.ping_group_range, and
+// sends only echo requests and receives only the replies to them.
+func listenPing(bind binding) (net.PacketConn, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	file := os.NewFile(uintptr(fd), "ping")
+	defer func() { _ = file.Close() }()
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if err := bind.options.Control("ping4", "", raw); err != nil {
+		return nil, err
+	}
+	local := &unix.SockaddrInet4{}
+	if bind.source != nil {
+		copy(local.Addr[:], bind.source.To4())
+	}
+	if err := unix.Bind(fd, local); err != nil { // assigns the identifier
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return net.FilePacketConn(file)
+}
+
+func (self *icmpTransport) name() string { return "icmp" }
+
+func (self *icmpTransport) remote() net.IP { return self.server.IP }
+
+func (self *icmpTransport) send(frame ipv4.Frame) error {
+	return self.request(frame)
+}
+
+// request sends one echo request carrying payload; an empty payload is a poll.
+func (self *icmpTransport) request(payload []byte) error {
+	sealed, err := self.codec.Seal(atomic.AddUint64(&self.sequence, 1), obfuscate.StreamEchoRequest, payload)
+	if err != nil {
+		return err
+	}
+	echo := &icmp.Echo{
+		Type:       icmp.TypeEchoRequest,
+		Identifier: self.identifier,
+		Sequence:   uint16(atomic.AddUint32(&self.echoSequence, 1)),
+		Payload:    sealed,
+	}
+	_, err = self.conn.WriteTo(echo.Marshal(), self.destination)
+	return err
+}
+
+func (self *icmpTransport) receive() (ipv4.Frame, error) {
+	for {
+		size, address, err := self.conn.ReadFrom(self.recvBuffer)
+		if err != nil {
+			return nil, err
+		}
+		if !addressIP(address).Equal(self.server.IP) {
+			continue
+		}
+		echo, err := icmp.ParseEcho(self.recvBuffer[:size])
+		if err != nil || echo.Type != icmp.TypeEchoReply || echo.Identifier != self.identifier {
+			continue
+		}
+		// The server's kernel also answers our requests, echoing their payload;
+		// those open as requests, not replies, and are dropped here.
+		sequence, streamId, payload, err := self.codec.Open(echo.Payload)
+		if err != nil || streamId != obfuscate.StreamEchoReply {
+			continue
+		}
+		if !self.replay.Accept(sequence) {
+			continue
+		}
+		frame := ipv4.DecodeFrame(payload)
+		if frame == nil {
+			continue
+		}
+		if !frame.Source().Equal(frame.Destination()) {
+			// the server spent one of its held requests; replace it
+			select {
+			case self.polled <- struct{}{}:
+			default:
+			}
+		}
+		return frame.Copy(), nil
+	}
+}
+
+func (self *icmpTransport) close() error {
+	self.closeOnce.Do(func() {
+		close(self.closing)
+	})
+	err := self.conn.Close()
+	self.group.Wait()
+	return err
+}
+
+// pollLoop keeps empty polls flowing so the server has requests to answer with
+// return traffic.
+func (self *icmpTransport) pollLoop() {
+	ticker := time.NewTicker(icmpPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.polled:
+		case <-self.closing:
+			return
+		}
+		if err := self.request(nil); err != nil {
+			log.Debugf("link icmp: poll failed: %s", err)
+		}
+	}
+}
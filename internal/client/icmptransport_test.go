@@ -0,0 +1,37 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/icmp"
+)
+
+func TestListenPing(t *testing.T) {
+	conn, err := listenPing(binding{})
+	if err != nil {
+		t.Skipf("no ping sockets (see net.ipv4.ping_group_range): %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// The kernel stamps the socket's port as the identifier, and answers.
+	identifier := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	request := &icmp.Echo{Type: icmp.TypeEchoRequest, Sequence: 7, Payload: []byte("probe")}
+	if _, err := conn.WriteTo(request.Marshal(), &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}); err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 1500)
+	size, address, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	reply, err := icmp.ParseEcho(buffer[:size])
+	if err != nil || reply.Type != icmp.TypeEchoReply || reply.Identifier != identifier || reply.Sequence != 7 || string(reply.Payload) != "probe" {
+		t.Errorf("reply = %+v, %v; want the echo of identifier %d", reply, err, identifier)
+	}
+	if !addressIP(address).Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("reply from %s", address)
+	}
+}
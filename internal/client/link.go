@@ -6,8 +6,11 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/ziyan/shadowgate/internal/batch"
 	"github.com/ziyan/shadowgate/internal/deferutil"
 	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/netwatch"
+	"github.com/ziyan/shadowgate/internal/pmtu"
 )
 
 const (
@@ -27,6 +30,31 @@ const (
 	// keeps 1 - 1/2^shift of the old value and 1/2^shift of the new sample.
 	rttSmoothingShift = 3 // alpha = 1/8
 
+	// jitterSmoothing and lossSmoothing weigh each new sample in the jitter
+	// (as RFC 3550 does) and loss estimates.
+	jitterSmoothing = 1.0 / 16
+	lossSmoothing   = 1.0 / 8
+
+	// capacityInterval is how often a link measures its capacity with a train
+	// of trainLength keepalives padded to trainFrameSize bytes, sent back to
+	// back in place of a ping. The server answers each as it arrives, so the
+	// replies come back spaced as the path's bottleneck let the train through.
+	capacityInterval = 10 * time.Second
+	trainLength      = 8
+	trainFrameSize   = 1024
+
+	// minDispersion bounds the spacing a train's replies are timed at, and so
+	// the capacity measured: a link faster than about 70 MB/s reads as that.
+	minDispersion = 100 * time.Microsecond
+
+	// capacitySmoothing weighs each new capacity sample.
+	capacitySmoothing = 1.0 / 4
+
+	// maxSequenceGap bounds the gap in the server's sequence numbers taken
+	// for lost datagrams: a wider one is the server numbering afresh, as it
+	// does for a client it forgot.
+	maxSequenceGap = 1 << 20
+
 	// reconnect backoff bounds for re-dialing a failed transport.
 	minReconnectBackoff = 1 * time.Second
 	maxReconnectBackoff = 30 * time.Second
@@ -45,13 +73,61 @@ type link struct {
 	label string
 	ip    net.IP
 
+	// priority ranks the link: it carries traffic only while no healthy link
+	// has a lower priority. weight (at least 1) divides its round-trip time
+	// when it is compared with links of the same priority.
+	priority int
+	weight   int
+	// metered links rank below unmetered ones of the same priority.
+	metered bool
+
 	outbound chan ipv4.Frame
 	frames   chan ipv4.Frame
 
+	// batch packs the frames queued together into one send, over transports
+	// that can (see batchSender), waiting up to batchDelay for more.
+	batch      bool
+	batchDelay time.Duration
+
+	// demand, when set, keeps the link down while the tunnel is idle.
+	demand *demand
+	// measure sends capacity trains, for a policy that weighs capacity (see
+	// Client.SetPolicy).
+	measure atomic.Bool
+	// redialing asks the link to drop its transport and dial afresh at once
+	// (see redial), and nudging to probe the server at once (see nudge).
+	redialing chan struct{}
+	nudging   chan struct{}
+	// bind is how the link's sockets are bound, and path where the current
+	// transport's packets go, so that a network change that leaves the path
+	// alone does not redial the link (see moved).
+	bind binding
+	path atomic.Pointer[linkPath]
+
 	rttNanos       int64 // atomic; nanoseconds, 0 means unknown
 	lastReplyNanos int64 // atomic; UnixNano of the last keepalive reply
 	lastPingNanos  int64 // atomic; UnixNano of the most recent probe sent
 
+	// server is the tunnel address of the server, learned from its keepalive
+	// replies.
+	server atomic.Pointer[net.IP]
+
+	// metrics guards the measurements a Policy weighs besides the round-trip
+	// time (see LinkStats).
+	metrics     sync.Mutex
+	jitter      time.Duration
+	lastSample  time.Duration // the previous round trip, for jitter
+	loss        float64
+	probing     bool // a keepalive was sent over the current transport
+	outstanding bool // the latest keepalive is unanswered
+	counted     bool // arrived and highest hold the current transport's counts
+	arrived     uint64
+	highest     uint64
+	capacity    float64
+	lastTrain   time.Time // when the latest capacity train was sent
+	train       int       // replies of the latest train still expected
+	trainFirst  time.Time // when its first reply arrived
+
 	closing   chan struct{}
 	closeOnce sync.Once
 	group     sync.WaitGroup
@@ -61,13 +137,16 @@ type link struct {
 
 func newLink(label string, dial dialer, ip net.IP) *link {
 	return &link{
-		dial:     dial,
-		label:    label,
-		ip:       ip,
-		outbound: make(chan ipv4.Frame, 1024),
-		frames:   make(chan ipv4.Frame, 1024),
-		closing:  make(chan struct{}),
-		now:      time.Now,
+		dial:      dial,
+		label:     label,
+		ip:        ip,
+		weight:    1,
+		outbound:  make(chan ipv4.Frame, 1024),
+		frames:    make(chan ipv4.Frame, 1024),
+		redialing: make(chan struct{}, 1),
+		nudging:   make(chan struct{}, 1),
+		closing:   make(chan struct{}),
+		now:       time.Now,
 	}
 }
 
@@ -100,14 +179,34 @@ func (self *link) supervise() {
 			return
 		default:
 		}
+		select {
+		case <-self.demand.ready():
+		default:
+			log.Infof("link %s: idle, waiting for traffic", self.label)
+			select {
+			case <-self.demand.ready():
+				backoff = minReconnectBackoff
+			case <-self.closing:
+				return
+			}
+		}
+
+		select {
+		case <-self.redialing: // about to dial anyway
+		default:
+		}
 
 		transport, err := self.dial()
 		if err != nil {
 			log.Warningf("link %s: dial failed: %s", self.label, err)
-			if !self.sleep(backoff) {
+			redialed, ok := self.sleep(backoff)
+			if !ok {
 				return
 			}
 			backoff = nextBackoff(backoff)
+			if redialed {
+				backoff = minReconnectBackoff
+			}
 			continue
 		}
 		backoff = minReconnectBackoff
@@ -128,23 +227,86 @@ func nextBackoff(current time.Duration) time.Duration {
 	return next
 }
 
-// sleep waits for the given duration, returning false if the link is closed
-// before it elapses.
-func (self *link) sleep(duration time.Duration) bool {
+// sleep waits for the given duration, or until a redial or nudge (redialed),
+// returning ok false if the link is closed before then.
+func (self *link) sleep(duration time.Duration) (redialed, ok bool) {
 	timer := time.NewTimer(duration)
 	defer timer.Stop()
 	select {
 	case <-timer.C:
-		return true
+		return false, true
+	case <-self.redialing:
+		return true, true
+	case <-self.nudging:
+		return true, true
 	case <-self.closing:
-		return false
+		return false, false
 	}
 }
 
+// redial makes the link drop its transport, or cut its backoff short, and
+// dial afresh, as after the host's addresses or routes change: a transport
+// over the old path may look healthy for up to healthTimeout while it carries
+// nothing.
+func (self *link) redial() {
+	select {
+	case self.redialing <- struct{}{}:
+	default:
+	}
+}
+
+// nudge makes the link send a keepalive at once, or cut its backoff short and
+// dial, as after the host's addresses or routes change without moving its
+// route: the reply measures the path as the change left it, without waiting
+// out the ping interval.
+func (self *link) nudge() {
+	select {
+	case self.nudging <- struct{}{}:
+	default:
+	}
+}
+
+// linkPath is the route a link's transport was dialed over.
+type linkPath struct {
+	remote net.IP
+	route  netwatch.Route
+}
+
+// route returns where transport's packets go, or nil when it cannot tell.
+func (self *link) route(transport transport) *linkPath {
+	routed, ok := transport.(routedTransport)
+	if !ok || routed.remote() == nil {
+		return nil
+	}
+	route, err := self.bind.route(routed.remote())
+	if err != nil {
+		log.Debugf("link %s: failed to look up the route to %s: %s", self.label, routed.remote(), err)
+		return nil
+	}
+	return &linkPath{remote: routed.remote(), route: route}
+}
+
+// moved reports whether the host's route to where the link's transport goes
+// differs from the one it was dialed over: another source address, next hop
+// or interface. A link that cannot tell, or has no transport, has moved.
+func (self *link) moved() bool {
+	path := self.path.Load()
+	if path == nil {
+		return true
+	}
+	route, err := self.bind.route(path.remote)
+	return err != nil || !route.Equal(path.route)
+}
+
 // serve runs the send and receive loops over one transport until either fails or
 // the link is closed, then closes the transport.
 func (self *link) serve(transport transport) {
 	atomic.StoreInt64(&self.lastPingNanos, 0) // measure RTT fresh on this connection
+	self.metrics.Lock()
+	self.probing, self.outstanding, self.counted, self.lastSample = false, false, false, 0
+	self.train, self.lastTrain = 0, time.Time{} // measure capacity at once
+	self.metrics.Unlock()
+	self.path.Store(self.route(transport))
 
 	failed := make(chan struct{})
 	var failOnce sync.Once
@@ -167,10 +329,14 @@ func (self *link) serve(transport transport) {
 
 	select {
 	case <-failed:
+	case <-self.redialing:
+		log.Infof("link %s: redialing", self.label)
+		fail() // the loops are to stop, not to report the transport as broken
 	case <-self.closing:
 	}
 	_ = transport.close() // unblock a receive blocked in transport.receive
 	group.Wait()
+	self.path.Store(nil)
 }
 
 // Send queues a data frame for transmission, dropping it if the queue is full.
@@ -201,9 +367,18 @@ func (self *link) rtt() time.Duration {
 }
 
 // recordRtt folds a new round-trip sample into an exponential moving average so
-// per-sample jitter does not make transport selection flap. Only the receive
-// loop calls this, so the load/store is free of a competing writer.
+// per-sample jitter does not make transport selection flap, and the difference
+// from the previous sample into the jitter. Only the receive loop calls this,
+// so the load/store is free of a competing writer.
 func (self *link) recordRtt(sample int64) {
+	self.metrics.Lock()
+	if self.lastSample != 0 {
+		difference := time.Duration(sample) - self.lastSample
+		self.jitter += time.Duration(jitterSmoothing * float64(max(difference, -difference)-self.jitter))
+	}
+	self.lastSample = time.Duration(sample)
+	self.metrics.Unlock()
+
 	previous := atomic.LoadInt64(&self.rttNanos)
 	if previous == 0 {
 		atomic.StoreInt64(&self.rttNanos, sample)
@@ -212,14 +387,119 @@ func (self *link) recordRtt(sample int64) {
 	atomic.StoreInt64(&self.rttNanos, previous-(previous>>rttSmoothingShift)+(sample>>rttSmoothingShift))
 }
 
+// recordProbe counts a keepalive about to be sent, taking the previous one as
+// lost if it is still unanswered, unless the link is too slow to tell.
+func (self *link) recordProbe() {
+	self.metrics.Lock()
+	defer self.metrics.Unlock()
+	switch {
+	case !self.probing:
+		self.probing = true
+	case !self.outstanding:
+		self.loss -= lossSmoothing * self.loss
+	case self.rtt() < pingInterval:
+		self.loss += lossSmoothing * (1 - self.loss)
+	}
+	self.outstanding = true
+}
+
+// recordGaps takes the counts of a sequencedTransport at a keepalive, and
+// folds in the share of the server's datagrams since the previous one that
+// its sequence numbers skipped and never arrived.
+func (self *link) recordGaps(count, top uint64) {
+	self.metrics.Lock()
+	defer self.metrics.Unlock()
+	expected, arrived := top-self.highest, count-self.arrived
+	counted := self.counted
+	self.counted, self.arrived, self.highest = true, count, top
+	if !counted || expected == 0 || expected > maxSequenceGap {
+		return
+	}
+	// Datagrams that arrive out of order may make up for earlier gaps.
+	lost := float64(expected-min(arrived, expected)) / float64(expected)
+	self.loss += lossSmoothing * (lost - self.loss)
+}
+
+func (self *link) recordReply() {
+	self.metrics.Lock()
+	defer self.metrics.Unlock()
+	self.outstanding = false
+}
+
+// startTrain reports whether the next keepalive should be a capacity train:
+// one is due, and no keepalive is unanswered whose reply could be taken for
+// the train's. A train whose first reply came a ping ago but not all the
+// others lost one, and is given up, so that the replies to later keepalives
+// are not taken for its.
+func (self *link) startTrain() bool {
+	self.metrics.Lock()
+	defer self.metrics.Unlock()
+	if self.outstanding {
+		return false
+	}
+	self.train = 0
+	now := self.now()
+	if now.Sub(self.lastTrain) < capacityInterval {
+		return false
+	}
+	self.lastTrain, self.train = now, trainLength
+	return true
+}
+
+// recordTrainReply times a keepalive reply that may belong to the latest
+// train, and once all of them have arrived, folds the capacity they show
+// into the estimate. It reports whether the reply is to one of the train's
+// keepalives after the first, which only the train's timing may take: the
+// first serves as the ping.
+func (self *link) recordTrainReply() bool {
+	self.metrics.Lock()
+	defer self.metrics.Unlock()
+	if self.train == 0 {
+		return false
+	}
+	now := self.now()
+	first := self.train == trainLength
+	if first {
+		self.trainFirst = now
+	}
+	self.train--
+	if self.train > 0 {
+		return !first
+	}
+	dispersion := max(now.Sub(self.trainFirst), minDispersion)
+	sample := float64((trainLength-1)*trainFrameSize) / dispersion.Seconds()
+	if self.capacity == 0 {
+		self.capacity = sample
+	} else {
+		self.capacity += capacitySmoothing * (sample - self.capacity)
+	}
+	return true
+}
+
+// stats returns the link's measurements for a Policy.
+func (self *link) stats() LinkStats {
+	self.metrics.Lock()
+	defer self.metrics.Unlock()
+	return LinkStats{
+		Name:     self.label,
+		Priority: self.priority,
+		Weight:   self.weight,
+		Metered:  self.metered,
+		RTT:      self.rtt(),
+		Jitter:   self.jitter,
+		Loss:     self.loss,
+		Capacity: self.capacity,
+	}
+}
+
 // lastReply returns the UnixNano timestamp of the last keepalive reply, or 0.
 func (self *link) lastReply() int64 {
 	return atomic.LoadInt64(&self.lastReplyNanos)
 }
 
 func (self *link) sendLoop(transport transport, failed <-chan struct{}) {
-	ticker := time.NewTicker(pingInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(self.demand.pingInterval())
+	defer timer.Stop()
 
 	if !self.ping(transport) { // probe immediately so health is learned quickly
 		return
@@ -228,14 +508,23 @@ func (self *link) sendLoop(transport transport, failed <-chan struct{}) {
 	for {
 		select {
 		case frame := <-self.outbound:
-			if err := transport.send(frame); err != nil {
+			if err := self.send(transport, frame, failed); err != nil {
 				log.Warningf("link %s: send failed: %s", self.label, err)
 				return
 			}
-		case <-ticker.C:
+		case <-timer.C:
+			if self.demand.expired() {
+				return // the tunnel is idle; supervise waits for traffic
+			}
 			if !self.ping(transport) {
 				return
 			}
+			timer.Reset(self.demand.pingInterval())
+		case <-self.nudging:
+			// Out of turn: loss is counted at the regular keepalives only.
+			if !self.keepalive(transport) {
+				return
+			}
 		case <-failed:
 			return
 		case <-self.closing:
@@ -244,15 +533,49 @@ func (self *link) sendLoop(transport transport, failed <-chan struct{}) {
 	}
 }
 
-// ping sends a keepalive over the transport, returning false if the send failed
-// (which means the transport is dead and the link should be re-dialed).
+// send sends frame over the transport, together with the frames queued
+// behind it when the link batches.
+func (self *link) send(transport transport, frame ipv4.Frame, failed <-chan struct{}) error {
+	sender, ok := transport.(batchSender)
+	if !self.batch || !ok {
+		return transport.send(frame)
+	}
+	frames := batch.Gather(self.outbound, frame, self.batchDelay, failed)
+	if len(frames) == 1 {
+		return transport.send(frame)
+	}
+	return sender.sendBatch(frames)
+}
+
+// ping sends a keepalive over the transport, or a capacity train when one is
+// due and the link measures capacity, short of an idle on-demand tunnel,
+// returning false if the send failed (which means the transport is dead and
+// the link should be re-dialed).
 func (self *link) ping(transport transport) bool {
-	// Only begin a new round-trip measurement when the previous probe has been
-	// answered; otherwise keep timing against the oldest outstanding probe so a
-	// link slower than the ping interval is not under-measured.
-	if atomic.LoadInt64(&self.lastPingNanos) <= atomic.LoadInt64(&self.lastReplyNanos) {
-		atomic.StoreInt64(&self.lastPingNanos, self.now().UnixNano())
+	_, unpaced := transport.(unpacedTransport)
+	train := !unpaced && self.measure.Load() && !self.demand.idling() && self.startTrain()
+	self.timePing()
+	self.recordProbe()
+	if sequenced, ok := transport.(sequencedTransport); ok {
+		self.recordGaps(sequenced.received())
+	}
+	if !train {
+		return self.keepalive(transport)
 	}
+	// The train's first keepalive serves as the ping.
+	for range trainLength {
+		if err := transport.send(pmtu.Train(self.ip, 0, trainFrameSize)); err != nil {
+			log.Debugf("link %s: keepalive send failed: %s", self.label, err)
+			return false
+		}
+	}
+	return true
+}
+
+// keepalive sends a plain keepalive over the transport, returning false if
+// the send failed.
+func (self *link) keepalive(transport transport) bool {
+	self.timePing()
 	if err := transport.send(ipv4.MakeFrame(self.ip, self.ip)); err != nil {
 		log.Debugf("link %s: keepalive send failed: %s", self.label, err)
 		return false
@@ -260,6 +583,16 @@ func (self *link) ping(transport transport) bool {
 	return true
 }
 
+// timePing starts timing a round trip at a keepalive about to be sent, but
+// only when the previous one has been answered; otherwise it keeps timing
+// against the oldest outstanding one so a link slower than the ping interval
+// is not under-measured.
+func (self *link) timePing() {
+	if atomic.LoadInt64(&self.lastPingNanos) <= atomic.LoadInt64(&self.lastReplyNanos) {
+		atomic.StoreInt64(&self.lastPingNanos, self.now().UnixNano())
+	}
+}
+
 func (self *link) receiveLoop(transport transport, failed <-chan struct{}) {
 	for {
 		frame, err := transport.receive()
@@ -277,18 +610,27 @@ func (self *link) receiveLoop(transport transport, failed <-chan struct{}) {
 		}
 
 		if frame.Source().Equal(frame.Destination()) {
-			// keepalive reply from the server: update the smoothed round-trip time
-			ping := atomic.LoadInt64(&self.lastPingNanos)
-			now := self.now().UnixNano()
-			if ping != 0 && now >= ping {
-				self.recordRtt(now - ping)
+			// keepalive reply from the server: update the smoothed round-trip
+			// time, unless it answers a capacity train past its first keepalive
+			if !self.recordTrainReply() {
+				ping := atomic.LoadInt64(&self.lastPingNanos)
+				now := self.now().UnixNano()
+				if ping != 0 && now >= ping {
+					self.recordRtt(now - ping)
+				}
+				atomic.StoreInt64(&self.lastReplyNanos, now)
+				self.recordReply()
+			}
+			if server := self.server.Load(); server == nil || !server.Equal(frame.Source()) {
+				source := frame.Source()
+				self.server.Store(&source)
 			}
-			atomic.StoreInt64(&self.lastReplyNanos, now)
 			continue
 		}
 
 		// Deliver everything else to the tun; the host routes it (to this node,
 		// or onward when this node forwards for a network behind it).
+		self.demand.touch()
 		select {
 		case self.frames <- frame:
 		case <-self.closing:
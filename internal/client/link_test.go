@@ -0,0 +1,118 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+// routedStub is a transport that only reports where it goes.
+type routedStub struct {
+	transport
+	address net.IP
+}
+
+func (self routedStub) remote() net.IP { return self.address }
+
+// sentStub is a transport that hands what is sent over it to sent.
+type sentStub struct {
+	transport
+	sent chan ipv4.Frame
+}
+
+func (self sentStub) send(frame ipv4.Frame) error {
+	self.sent <- frame
+	return nil
+}
+
+func TestLinkMoved(t *testing.T) {
+	current := newLink("udp", nil, nil)
+	if !current.moved() {
+		t.Error("a link without a transport has not moved")
+	}
+
+	current.path.Store(current.route(routedStub{address: net.ParseIP("127.0.0.1")}))
+	if current.path.Load() == nil {
+		t.Fatal("no route to the loopback address")
+	}
+	if current.moved() {
+		t.Error("the route to the loopback address moved")
+	}
+	current.path.Load().route.Device++
+	if !current.moved() {
+		t.Error("a route over another interface has not moved")
+	}
+
+	// A transport that cannot tell where it goes has always moved.
+	current.path.Store(current.route(routedStub{}))
+	if !current.moved() {
+		t.Error("a link whose transport has no address has not moved")
+	}
+	var unrouted struct{ transport }
+	if current.route(unrouted) != nil {
+		t.Error("a route for a transport that reports none")
+	}
+}
+
+func TestLinkCountsSequenceGaps(t *testing.T) {
+	current := newLink("udp", nil, nil)
+	current.recordGaps(10, 5000) // the first counts only set the baseline
+	if loss := current.stats().Loss; loss != 0 {
+		t.Fatalf("loss = %f after the first counts, want 0", loss)
+	}
+
+	// A quarter of the datagrams numbered since went missing.
+	current.recordGaps(40, 5040)
+	if loss, want := current.stats().Loss, lossSmoothing/4; loss != want {
+		t.Errorf("loss = %f, want %f", loss, want)
+	}
+	// Late ones make up for it, and no more.
+	current.recordGaps(90, 5080)
+	if loss, want := current.stats().Loss, lossSmoothing/4*(1-lossSmoothing); loss != want {
+		t.Errorf("loss = %f after late datagrams, want %f", loss, want)
+	}
+
+	// The server numbering afresh is no loss.
+	before := current.stats().Loss
+	current.recordGaps(91, 5080+maxSequenceGap+1)
+	if loss := current.stats().Loss; loss != before {
+		t.Errorf("loss = %f after the server numbered afresh, want %f", loss, before)
+	}
+}
+
+func TestLinkNudge(t *testing.T) {
+	current := newLink("udp", nil, net.ParseIP("172.18.0.2"))
+	stub := sentStub{sent: make(chan ipv4.Frame, 4)}
+	failed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		current.sendLoop(stub, failed)
+	}()
+	defer func() {
+		close(failed)
+		<-done
+	}()
+
+	<-stub.sent // the keepalive a transport starts with
+	current.nudge()
+	select {
+	case frame := <-stub.sent:
+		if !frame.Source().Equal(frame.Destination()) {
+			t.Error("a nudge sent no keepalive")
+		}
+	case <-time.After(pingInterval / 2):
+		t.Error("a nudge sent nothing before the ping interval")
+	}
+
+}
+
+func TestLinkNudgeCutsBackoffShort(t *testing.T) {
+	current := newLink("udp", nil, nil)
+	current.nudge()
+	if redialed, ok := current.sleep(time.Hour); !redialed || !ok {
+		t.Errorf("sleep after a nudge = %t, %t, want true, true", redialed, ok)
+	}
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/fec"
+	"github.com/ziyan/shadowgate/internal/hop"
+	"github.com/ziyan/shadowgate/internal/sockopt"
+)
+
+// Link types accepted in LinkConfig.Type.
+const (
+	LinkUDP     = "udp"
+	LinkTCP     = "tcp"
+	LinkFakeTCP = "faketcp"
+	LinkICMP    = "icmp"
+	LinkHTTP    = "http"
+	LinkPlugin  = "plugin"
+)
+
+// LinkConfig declares one link to the server.
+type LinkConfig struct {
+	// Name labels the link in logs; it defaults to Type, numbered when several
+	// links share a type.
+	Name string
+	Type string
+	// Connect is the server endpoint: host:port, or the URL of an http link.
+	// The port of an icmp link is ignored.
+	Connect  string
+	Padding  int  // udp, faketcp, icmp, http: maximum random padding bytes per datagram
+	Compress bool // tcp, plugin: Snappy-compress the stream
+	// Priority ranks the link: it carries traffic only while no link of a lower
+	// priority is healthy.
+	Priority int
+	// Weight biases the choice between healthy links of equal priority, whose
+	// round-trip times are compared after dividing by their weights. Zero
+	// counts as one.
+	Weight int
+	// Metered marks a link that costs money per byte, such as LTE: between
+	// healthy links of equal priority, an unmetered one is always preferred.
+	Metered bool
+	// Source and Socket.Device pin the link's sockets to one uplink of a
+	// multi-homed host: a local address to send from, and/or a network
+	// interface to bind to with SO_BINDTODEVICE (which needs CAP_NET_RAW).
+	// Neither works through a proxy or a plugin.
+	Source net.IP
+	// Socket tunes the link's sockets, raw ones included (see
+	// internal/sockopt): besides the device, a firewall mark to keep a full
+	// tunnel from routing them into itself, and the TCP congestion control,
+	// user timeout, keepalives and buffer sizes.
+	Socket sockopt.Options
+	// HopPorts, unless empty, makes a udp link hop across this range of server
+	// ports every HopInterval, on a schedule derived from the password (see
+	// internal/hop); the port of Connect is then ignored.
+	HopPorts    hop.Range
+	HopInterval time.Duration
+
+	// Listen inverts a tcp or udp link for a site that cannot dial out: Connect
+	// is then a local address on which the link accepts the server's
+	// connection, or learns its address from its first datagram, and the
+	// server dials this client (see server.Config.DialClients).
+	Listen bool
+
+	// FEC, when enabled, sends a udp link's frames in forward error
+	// correction groups with parity shards (see internal/fec), so that the
+	// server rebuilds lost frames rather than the flows inside the tunnel
+	// retransmitting them; the server answers in kind.
+	FEC fec.Ratio
+}
+
+// ParseLink parses a link specification of the form
+// type:endpoint[,key=value...], such as "udp:203.0.113.1:3389,weight=2" or
+// "http:https://cdn.example.com/tunnel,priority=1". The keys are name,
+// padding, compress, priority, weight, metered, source, hop-ports,
+// hop-interval, listen, fec (data:parity) and fec-adaptive, and the socket
+// options of sockopt.Options.Set (device, mark, congestion, user-timeout,
+// keepalive, sndbuf and rcvbuf); a bare "compress", "metered", "listen" or
+// "fec-adaptive" means true. Options not given are taken from defaults.
+func ParseLink(spec string, defaults LinkConfig) (LinkConfig, error) {
+	config := defaults
+	fields := strings.Split(spec, ",")
+	kind, endpoint, found := strings.Cut(fields[0], ":")
+	if !found || endpoint == "" {
+		return config, fmt.Errorf("client: invalid link: %q", spec)
+	}
+	config.Type = kind
+	config.Connect = endpoint
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "name":
+			config.Name = value
+		case "padding":
+			config.Padding, err = strconv.Atoi(value)
+		case "compress":
+			config.Compress = value == "" || value == "true"
+		case "priority":
+			config.Priority, err = strconv.Atoi(value)
+		case "weight":
+			config.Weight, err = strconv.Atoi(value)
+		case "metered":
+			config.Metered = value == "" || value == "true"
+		case "source":
+			if config.Source = net.ParseIP(value); config.Source == nil {
+				err = fmt.Errorf("invalid source address %q", value)
+			}
+		case "hop-ports":
+			config.HopPorts, err = hop.ParseRange(value)
+		case "hop-interval":
+			config.HopInterval, err = time.ParseDuration(value)
+		case "listen":
+			config.Listen = value == "" || value == "true"
+		case "fec":
+			adaptive := config.FEC.Adaptive
+			config.FEC, err = fec.ParseRatio(value)
+			config.FEC.Adaptive = adaptive
+		case "fec-adaptive":
+			config.FEC.Adaptive = value == "" || value == "true"
+		default:
+			var ok bool
+			if ok, err = config.Socket.Set(key, value); !ok {
+				err = fmt.Errorf("unknown option %q", key)
+			}
+		}
+		if err != nil {
+			return config, fmt.Errorf("client: invalid link %q: %s", spec, err)
+		}
+	}
+	return config, config.validate()
+}
+
+// validate checks the type and endpoint syntax without resolving anything.
+func (self LinkConfig) validate() error {
+	if self.Weight < 0 {
+		return fmt.Errorf("client: link %s: negative weight", self.Connect)
+	}
+	if self.Type == LinkPlugin && (self.Source != nil || self.Socket != sockopt.Options{}) {
+		return fmt.Errorf("client: plugin link %s cannot be bound to a source or device, or have socket options", self.Connect)
+	}
+	if self.Type == LinkUDP && !self.HopPorts.Empty() && self.HopInterval <= 0 {
+		return fmt.Errorf("client: udp link %s: port hopping needs a positive interval", self.Connect)
+	}
+	if self.Listen && (self.Type != LinkUDP && self.Type != LinkTCP || !self.HopPorts.Empty() || self.Source != nil || self.Socket.Device != "") {
+		return fmt.Errorf("client: only a plain tcp or udp link can listen, not %s link %s", self.Type, self.Connect)
+	}
+	switch self.Type {
+	case LinkUDP, LinkTCP, LinkFakeTCP, LinkPlugin:
+		_, _, err := net.SplitHostPort(self.Connect)
+		return err
+	case LinkICMP:
+		return nil // a bare host or host:port
+	case LinkHTTP:
+		_, err := url.Parse(self.Connect)
+		return err
+	}
+	return fmt.Errorf("client: unknown link type: %q", self.Type)
+}
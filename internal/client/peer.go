@@ -0,0 +1,353 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+	"github.com/ziyan/shadowgate/internal/rendezvous"
+	"github.com/ziyan/shadowgate/internal/tun"
+)
+
+const (
+	// registerInterval is how often the peer socket registers with the server,
+	// which also keeps its NAT mapping toward the server open.
+	registerInterval = 10 * time.Second
+
+	// lookupInterval is the least time between two lookups of one destination
+	// while no direct path to it works.
+	lookupInterval = 5 * time.Second
+
+	// peerPathTimeout is how long a direct path stays usable after the peer's
+	// last probe reply. It is short because frames sent into a dead path are
+	// lost, while the server remains a working fallback.
+	peerPathTimeout = 3 * time.Second
+
+	// peerIdleTimeout is how long a direct path is kept (and probed) without
+	// carrying a frame either way.
+	peerIdleTimeout = 60 * time.Second
+)
+
+// peers finds direct UDP paths to the other clients of the tunnel network, with
+// the server as rendezvous (see internal/rendezvous), and carries frames over
+// them. It keeps its own socket, separate from the links, so that the NAT
+// mapping the server observes is the one the other clients are told to punch.
+type peers struct {
+	ip      net.IP
+	network *net.IPNet
+	server  *net.UDPAddr
+	local   netip.AddrPort
+	conn    *net.UDPConn
+	codec   *obfuscate.Codec
+
+	sequence uint64
+
+	mutex   sync.Mutex
+	paths   map[string]*peerPath               // by tunnel IP
+	lookups map[string]time.Time               // last lookup, by tunnel IP
+	replays map[string]*obfuscate.ReplayWindow // by endpoint, kept while a path has it
+}
+
+// peerPath is what is known of one other client: the endpoints to probe and
+// the one that answered last.
+type peerPath struct {
+	candidates     []netip.AddrPort
+	endpoint       netip.AddrPort
+	lastReplyNanos int64
+	lastUsedNanos  int64
+}
+
+// newPeers opens the peer socket, with the options of bind, as are the sockets
+// of the links.
+func newPeers(ip net.IP, network *net.IPNet, connect string, password []byte, maxPadding int, bind binding, timeout time.Duration) (*peers, error) {
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := obfuscate.NewCodec(key, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	server, err := net.ResolveUDPAddr("udp", connect)
+	if err != nil {
+		return nil, err
+	}
+	// The address the host routes toward the server from is the one a peer
+	// behind the same NAT can reach.
+	route, err := bind.dialer("udp", timeout).Dial("udp", server.String())
+	if err != nil {
+		return nil, err
+	}
+	source := route.LocalAddr().(*net.UDPAddr).IP
+	_ = route.Close()
+
+	packetConn, err := bind.listenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	conn := packetConn.(*net.UDPConn)
+	address, _ := netip.AddrFromSlice(source)
+	return &peers{
+		ip:      ip,
+		network: network,
+		server:  server,
+		local:   netip.AddrPortFrom(address.Unmap(), uint16(conn.LocalAddr().(*net.UDPAddr).Port)),
+		conn:    conn,
+		codec:   codec,
+		paths:   make(map[string]*peerPath),
+		lookups: make(map[string]time.Time),
+		replays: make(map[string]*obfuscate.ReplayWindow),
+	}, nil
+}
+
+// send carries frame over a working direct path to its destination and reports
+// whether it did. For another client without one, it asks the server for an
+// introduction, at most every lookupInterval.
+func (self *peers) send(frame ipv4.Frame) bool {
+	destination := frame.Destination()
+	if !self.network.Contains(destination) || destination.Equal(self.ip) {
+		return false
+	}
+	key := destination.String()
+	now := time.Now()
+
+	self.mutex.Lock()
+	path := self.paths[key]
+	if path != nil {
+		path.lastUsedNanos = now.UnixNano()
+		if now.UnixNano()-path.lastReplyNanos < int64(peerPathTimeout) {
+			endpoint := path.endpoint
+			self.mutex.Unlock()
+			self.write(obfuscate.StreamPeerFrame, frame, endpoint)
+			return true
+		}
+	}
+	lookup := now.Sub(self.lookups[key]) >= lookupInterval
+	if lookup {
+		self.lookups[key] = now
+	}
+	self.mutex.Unlock()
+
+	if lookup {
+		self.message(rendezvous.Message{Kind: rendezvous.Lookup, IP: self.ip, Target: destination})
+	}
+	return false
+}
+
+// maintain registers with the server and probes every known path until closing
+// is closed.
+func (self *peers) maintain(closing <-chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	var registered time.Time
+	for {
+		if time.Since(registered) >= registerInterval {
+			registered = time.Now()
+			self.message(rendezvous.Message{Kind: rendezvous.Register, IP: self.ip, Target: net.IPv4zero, Local: self.local})
+		}
+		self.probe()
+
+		select {
+		case <-ticker.C:
+		case <-closing:
+			return
+		}
+	}
+}
+
+// probe sends a probe to every candidate endpoint of every path, forgetting the
+// paths that have carried nothing for peerIdleTimeout, and the replay windows
+// of their endpoints.
+func (self *peers) probe() {
+	cutoff := time.Now().UnixNano() - int64(peerIdleTimeout)
+	var endpoints []netip.AddrPort
+	self.mutex.Lock()
+	for key, path := range self.paths {
+		if path.lastUsedNanos < cutoff {
+			delete(self.paths, key)
+			self.forget(path.endpoint)
+			for _, candidate := range path.candidates {
+				self.forget(candidate)
+			}
+			continue
+		}
+		endpoints = append(endpoints, path.candidates...)
+	}
+	self.mutex.Unlock()
+
+	for _, endpoint := range endpoints {
+		self.write(obfuscate.StreamPeerProbe, self.ip.To4(), endpoint)
+	}
+}
+
+// readLoop handles the datagrams of the peer socket, writing the frames of
+// other clients to device, until the socket is closed.
+func (self *peers) readLoop(device tun.TUN) {
+	buffer := make([]byte, 65536)
+	for {
+		size, address, err := self.conn.ReadFromUDPAddrPort(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Debugf("failed to read peer datagram: %s", err)
+			continue
+		}
+		address = netip.AddrPortFrom(address.Addr().Unmap(), address.Port())
+		sequence, streamId, payload, err := self.codec.Open(buffer[:size])
+		if err != nil || !self.accept(address, sequence) {
+			continue
+		}
+
+		switch streamId {
+		case obfuscate.StreamRendezvous:
+			if message, err := rendezvous.Parse(payload); err == nil && message.Kind == rendezvous.Introduce {
+				self.introduce(message)
+			}
+		case obfuscate.StreamPeerProbe:
+			if peer := net.IP(payload); len(payload) == net.IPv4len && self.network.Contains(peer) {
+				self.learn(peer, address)
+				self.write(obfuscate.StreamPeerReply, self.ip.To4(), address)
+			}
+		case obfuscate.StreamPeerReply:
+			if len(payload) == net.IPv4len {
+				self.answered(net.IP(payload), address)
+			}
+		case obfuscate.StreamPeerFrame:
+			frame := ipv4.DecodeFrame(payload)
+			if frame == nil {
+				continue
+			}
+			self.used(frame.Source())
+			if _, err := device.Write(frame); err != nil {
+				log.Warningf("failed to write to tun: %s", err)
+			}
+		}
+	}
+}
+
+// accept applies the replay window of the endpoint a datagram came from.
+func (self *peers) accept(address netip.AddrPort, sequence uint64) bool {
+	key := address.String()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	replay, ok := self.replays[key]
+	if !ok {
+		replay = &obfuscate.ReplayWindow{}
+		self.replays[key] = replay
+	}
+	return replay.Accept(sequence)
+}
+
+// forget drops the replay window of an endpoint that no path uses any more,
+// unless it is the server's. The caller holds the mutex.
+func (self *peers) forget(endpoint netip.AddrPort) {
+	server := self.server.AddrPort()
+	if endpoint.Addr() != server.Addr().Unmap() || endpoint.Port() != server.Port() {
+		delete(self.replays, endpoint.String())
+	}
+}
+
+// introduce records the endpoints the server gave for another client and probes
+// them at once, as the other client is doing toward us.
+func (self *peers) introduce(message rendezvous.Message) {
+	if !self.network.Contains(message.IP) || message.IP.Equal(self.ip) {
+		return
+	}
+	log.Debugf("introduced to %s at %s (local %s)", message.IP, message.Observed, message.Local)
+	candidates := []netip.AddrPort{message.Observed}
+	if message.Local.IsValid() && message.Local != message.Observed {
+		candidates = append(candidates, message.Local)
+	}
+	self.mutex.Lock()
+	path := self.path(message.IP.String())
+	for _, candidate := range candidates {
+		path.add(candidate)
+	}
+	self.mutex.Unlock()
+
+	for _, candidate := range candidates {
+		self.write(obfuscate.StreamPeerProbe, self.ip.To4(), candidate)
+	}
+}
+
+// learn adds the endpoint another client probed us from, which is where its
+// NAT now accepts our replies.
+func (self *peers) learn(peer net.IP, address netip.AddrPort) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.path(peer.String()).add(address)
+}
+
+// answered marks the path to peer as working through address.
+func (self *peers) answered(peer net.IP, address netip.AddrPort) {
+	key := peer.String()
+	now := time.Now().UnixNano()
+	self.mutex.Lock()
+	path, ok := self.paths[key]
+	if !ok {
+		self.mutex.Unlock()
+		return
+	}
+	revived := now-path.lastReplyNanos >= int64(peerPathTimeout) || path.endpoint != address
+	path.endpoint = address
+	path.lastReplyNanos = now
+	self.mutex.Unlock()
+
+	if revived {
+		log.Noticef("direct path to %s via %s", peer, address)
+	}
+}
+
+func (self *peers) used(peer net.IP) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if path, ok := self.paths[peer.String()]; ok {
+		path.lastUsedNanos = time.Now().UnixNano()
+	}
+}
+
+// path returns the path to a tunnel IP, creating it on first sight. The caller
+// holds the mutex.
+func (self *peers) path(key string) *peerPath {
+	path, ok := self.paths[key]
+	if !ok {
+		path = &peerPath{lastUsedNanos: time.Now().UnixNano()}
+		self.paths[key] = path
+	}
+	return path
+}
+
+func (self *peerPath) add(candidate netip.AddrPort) {
+	for _, existing := range self.candidates {
+		if existing == candidate {
+			return
+		}
+	}
+	self.candidates = append(self.candidates, candidate)
+}
+
+func (self *peers) message(message rendezvous.Message) {
+	self.write(obfuscate.StreamRendezvous, message.Marshal(), self.server.AddrPort())
+}
+
+func (self *peers) write(streamId uint16, payload []byte, address netip.AddrPort) {
+	datagram, err := self.codec.Seal(atomic.AddUint64(&self.sequence, 1), streamId, payload)
+	if err != nil {
+		log.Warningf("failed to seal peer datagram: %s", err)
+		return
+	}
+	if _, err := self.conn.WriteToUDPAddrPort(datagram, address); err != nil {
+		log.Debugf("failed to send peer datagram to %s: %s", address, err)
+	}
+}
+
+func (self *peers) close() {
+	_ = self.conn.Close()
+}
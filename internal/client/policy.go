@@ -0,0 +1,210 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Link-selection policies accepted by ParsePolicy; prefer takes a link name,
+// as in "prefer:wired".
+const (
+	PolicyLowestLatency   = "lowest-latency"
+	PolicyPrefer          = "prefer"
+	PolicyLossAware       = "loss-aware"
+	PolicyJitterAware     = "jitter-aware"
+	PolicyThroughputAware = "throughput-aware"
+)
+
+// LinkStats is what a Policy knows of a healthy link.
+type LinkStats struct {
+	Name     string
+	Priority int
+	Weight   int
+	Metered  bool
+	// RTT and Jitter are the smoothed round-trip time of keepalives and the
+	// smoothed difference between consecutive round trips.
+	RTT    time.Duration
+	Jitter time.Duration
+	// Loss is the smoothed fraction of keepalives that went unanswered until
+	// the next one was sent, which links slower than the ping interval do not
+	// measure, and over udp also of the server's datagrams skipped in its
+	// sequence numbers between keepalives.
+	Loss float64
+	// Capacity is the smoothed rate, in bytes per second, at which the path
+	// toward the server let through a train of padded keepalives, timed by
+	// the server's replies; zero until measured, and for HTTP polling, whose
+	// replies come in batches. Links measure it only for a CapacityPolicy, such
+	// as throughput-aware, and not while an on-demand tunnel is idle.
+	Capacity float64
+}
+
+// Policy chooses the link that carries outbound traffic while any link is
+// healthy.
+type Policy interface {
+	// Choose returns the index in healthy (never empty) of the link to use.
+	// current is the index of the link in use, or -1 when it is not healthy.
+	Choose(healthy []LinkStats, current int) int
+}
+
+// CapacityPolicy is a Policy that weighs LinkStats.Capacity. The links
+// measure capacity only while one is in use, as each measurement costs a
+// train of padded keepalives.
+type CapacityPolicy interface {
+	Policy
+	WeighsCapacity()
+}
+
+// PolicyThresholds tune the policies. A zero field takes its default.
+type PolicyThresholds struct {
+	// SwitchFactor is the hysteresis margin: a healthy link in use is left
+	// for another of its rank only if the other scores better by this factor
+	// (default 2, see latencySwitchFactor).
+	SwitchFactor float64
+	// MaxLoss is the fraction of lost keepalives above which the loss-aware
+	// policy avoids a link while another is below it (default 0.05).
+	MaxLoss float64
+	// MaxJitter is the jitter above which the jitter-aware policy avoids a
+	// link while another is below it (default 30ms).
+	MaxJitter time.Duration
+}
+
+func (self PolicyThresholds) withDefaults() PolicyThresholds {
+	if self.SwitchFactor <= 0 {
+		self.SwitchFactor = latencySwitchFactor
+	}
+	if self.MaxLoss <= 0 {
+		self.MaxLoss = 0.05
+	}
+	if self.MaxJitter <= 0 {
+		self.MaxJitter = 30 * time.Millisecond
+	}
+	return self
+}
+
+// ParsePolicy returns the policy named by spec: lowest-latency,
+// prefer:NAME, loss-aware, jitter-aware or throughput-aware.
+func ParsePolicy(spec string, thresholds PolicyThresholds) (Policy, error) {
+	thresholds = thresholds.withDefaults()
+	name, argument, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	switch {
+	case name == PolicyLowestLatency && argument == "":
+		return lowestLatency{thresholds}, nil
+	case name == PolicyPrefer && argument != "":
+		return prefer{name: argument, fallback: lowestLatency{thresholds}}, nil
+	case name == PolicyLossAware && argument == "":
+		return lossAware{thresholds}, nil
+	case name == PolicyJitterAware && argument == "":
+		return jitterAware{thresholds}, nil
+	case name == PolicyThroughputAware && argument == "":
+		return throughputAware{thresholds}, nil
+	}
+	return nil, fmt.Errorf("client: unknown link policy: %q", spec)
+}
+
+// choose returns the healthy link of the best rank (the lowest priority, then
+// unmetered over metered) and among those the lowest cost, but sticks with the
+// current link unless a link outranks it or costs less by the switch factor.
+func choose(healthy []LinkStats, current int, switchFactor float64, cost func(LinkStats) float64) int {
+	best := 0
+	for index, candidate := range healthy[1:] {
+		if outranks(candidate, healthy[best]) || !outranks(healthy[best], candidate) && cost(candidate) < cost(healthy[best]) {
+			best = index + 1
+		}
+	}
+	switch {
+	case current < 0 || best == current:
+		return best
+	case outranks(healthy[best], healthy[current]):
+		return best
+	case !outranks(healthy[current], healthy[best]) && cost(healthy[best])*switchFactor < cost(healthy[current]):
+		return best
+	}
+	return current
+}
+
+// outranks reports whether a link is preferred to other regardless of its
+// measurements: it has a lower priority, or the same priority and is
+// unmetered where other is metered.
+func outranks(link, other LinkStats) bool {
+	if link.Priority != other.Priority {
+		return link.Priority < other.Priority
+	}
+	return !link.Metered && other.Metered
+}
+
+// weighted scales a duration down by the link's weight, as links of the same
+// rank are compared.
+func weighted(link LinkStats, duration time.Duration) float64 {
+	return float64(duration) / float64(max(link.Weight, 1))
+}
+
+// lowestLatency compares round-trip times: the original behavior.
+type lowestLatency struct{ thresholds PolicyThresholds }
+
+func (self lowestLatency) Choose(healthy []LinkStats, current int) int {
+	return choose(healthy, current, self.thresholds.SwitchFactor, func(link LinkStats) float64 {
+		return weighted(link, link.RTT)
+	})
+}
+
+// prefer uses the named link whenever it is healthy, and otherwise falls back.
+type prefer struct {
+	name     string
+	fallback Policy
+}
+
+func (self prefer) Choose(healthy []LinkStats, current int) int {
+	for index, link := range healthy {
+		if link.Name == self.name {
+			return index
+		}
+	}
+	return self.fallback.Choose(healthy, current)
+}
+
+// lossAware avoids links losing more than MaxLoss of their keepalives, and
+// otherwise compares round-trip times stretched by the loss (1 / (1 - loss),
+// the expected number of tries).
+type lossAware struct{ thresholds PolicyThresholds }
+
+func (self lossAware) Choose(healthy []LinkStats, current int) int {
+	return choose(healthy, current, self.thresholds.SwitchFactor, func(link LinkStats) float64 {
+		cost := weighted(link, link.RTT) / max(1-link.Loss, 0.01)
+		if link.Loss > self.thresholds.MaxLoss {
+			cost *= 1e6
+		}
+		return cost
+	})
+}
+
+// jitterAware avoids links whose jitter exceeds MaxJitter, and otherwise
+// compares round-trip times plus twice the jitter, roughly what a jitter
+// buffer for real-time traffic adds.
+type jitterAware struct{ thresholds PolicyThresholds }
+
+func (self jitterAware) Choose(healthy []LinkStats, current int) int {
+	return choose(healthy, current, self.thresholds.SwitchFactor, func(link LinkStats) float64 {
+		cost := weighted(link, link.RTT+2*link.Jitter)
+		if link.Jitter > self.thresholds.MaxJitter {
+			cost *= 1e6
+		}
+		return cost
+	})
+}
+
+// throughputAware prefers the link with the most capacity, multiplied by its
+// weight, so that bulk traffic goes where it moves fastest. Links not yet
+// measured rank below those that are, by round-trip time among themselves.
+type throughputAware struct{ thresholds PolicyThresholds }
+
+func (self throughputAware) Choose(healthy []LinkStats, current int) int {
+	return choose(healthy, current, self.thresholds.SwitchFactor, func(link LinkStats) float64 {
+		if link.Capacity >= 1 {
+			return 1 / (link.Capacity * float64(max(link.Weight, 1))) // at most 1
+		}
+		return 1 + weighted(link, link.RTT)
+	})
+}
+
+func (throughputAware) WeighsCapacity() {}
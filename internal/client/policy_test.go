@@ -0,0 +1,182 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	defaults := PolicyThresholds{}.withDefaults()
+	valid := map[string]Policy{
+		"lowest-latency":   lowestLatency{defaults},
+		" loss-aware ":     lossAware{defaults},
+		"jitter-aware":     jitterAware{defaults},
+		"throughput-aware": throughputAware{defaults},
+		"prefer:wired":     prefer{name: "wired", fallback: lowestLatency{defaults}},
+	}
+	for spec, want := range valid {
+		if policy, err := ParsePolicy(spec, PolicyThresholds{}); err != nil || policy != want {
+			t.Errorf("ParsePolicy(%q) = %#v, %v; want %#v", spec, policy, err, want)
+		}
+	}
+
+	for _, spec := range []string{"", "fastest", "prefer", "prefer:", "loss-aware:5", "lowest-latency:x"} {
+		if _, err := ParsePolicy(spec, PolicyThresholds{}); err == nil {
+			t.Errorf("ParsePolicy(%q) succeeded", spec)
+		}
+	}
+
+	// Thresholds left zero take their defaults.
+	policy, err := ParsePolicy("loss-aware", PolicyThresholds{MaxJitter: time.Second})
+	if err != nil {
+		t.Fatalf("ParsePolicy: %s", err)
+	}
+	thresholds := policy.(lossAware).thresholds
+	if thresholds.SwitchFactor != latencySwitchFactor || thresholds.MaxLoss != 0.05 || thresholds.MaxJitter != time.Second {
+		t.Errorf("thresholds = %+v", thresholds)
+	}
+}
+
+func TestOutranks(t *testing.T) {
+	cases := []struct {
+		link, other LinkStats
+		want        bool
+	}{
+		{LinkStats{Priority: 0}, LinkStats{Priority: 1}, true},
+		{LinkStats{Priority: 1}, LinkStats{Priority: 0}, false},
+		{LinkStats{Priority: 0, Metered: true}, LinkStats{Priority: 1}, true},
+		{LinkStats{}, LinkStats{Metered: true}, true},
+		{LinkStats{Metered: true}, LinkStats{}, false},
+		{LinkStats{}, LinkStats{}, false},
+	}
+	for _, c := range cases {
+		if got := outranks(c.link, c.other); got != c.want {
+			t.Errorf("outranks(%+v, %+v) = %v, want %v", c.link, c.other, got, c.want)
+		}
+	}
+}
+
+func TestChoose(t *testing.T) {
+	rtt := func(link LinkStats) float64 { return weighted(link, link.RTT) }
+	link := func(priority int, metered bool, rtt time.Duration) LinkStats {
+		return LinkStats{Priority: priority, Metered: metered, RTT: rtt, Weight: 1}
+	}
+	cases := []struct {
+		name    string
+		healthy []LinkStats
+		current int
+		want    int
+	}{
+		{"cheapest without a current link", []LinkStats{link(0, false, 50*time.Millisecond), link(0, false, 10*time.Millisecond)}, -1, 1},
+		{"keeps current within the factor", []LinkStats{link(0, false, 15*time.Millisecond), link(0, false, 10*time.Millisecond)}, 0, 0},
+		{"leaves current beyond the factor", []LinkStats{link(0, false, 25*time.Millisecond), link(0, false, 10*time.Millisecond)}, 0, 1},
+		{"rank over cost", []LinkStats{link(1, false, time.Millisecond), link(0, false, time.Second)}, 0, 1},
+		{"unmetered over metered", []LinkStats{link(0, true, time.Millisecond), link(0, false, time.Second)}, 0, 1},
+		{"current outranks cheaper", []LinkStats{link(0, false, time.Second), link(0, true, time.Millisecond)}, 0, 0},
+		{"weight divides the cost", []LinkStats{link(0, false, 10*time.Millisecond), {RTT: 30 * time.Millisecond, Weight: 4}}, -1, 1},
+	}
+	for _, c := range cases {
+		if got := choose(c.healthy, c.current, latencySwitchFactor, rtt); got != c.want {
+			t.Errorf("%s: choose = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestThroughputAware(t *testing.T) {
+	policy := throughputAware{PolicyThresholds{}.withDefaults()}
+	healthy := []LinkStats{
+		{Name: "slow", RTT: 5 * time.Millisecond, Capacity: 1e6},
+		{Name: "fast", RTT: 50 * time.Millisecond, Capacity: 1e7},
+		{Name: "unmeasured", RTT: time.Millisecond},
+	}
+	// An idle link that measures faster by more than the factor wins.
+	if got := policy.Choose(healthy, 0); got != 1 {
+		t.Errorf("Choose = %s, want fast", healthy[got].Name)
+	}
+	// One faster by less does not.
+	healthy[1].Capacity = 1.5e6
+	if got := policy.Choose(healthy, 0); got != 0 {
+		t.Errorf("Choose = %s, want slow", healthy[got].Name)
+	}
+}
+
+func TestLinkMeasuresCapacity(t *testing.T) {
+	now := time.Unix(1000, 0)
+	current := newLink("udp", nil, nil)
+	current.now = func() time.Time { return now }
+
+	if !current.startTrain() {
+		t.Fatal("first train not started")
+	}
+	current.recordProbe()
+	if current.startTrain() {
+		t.Fatal("second train started within capacityInterval")
+	}
+	// Replies 1ms apart: 7 frames' worth of bytes in 7ms. Only the first
+	// answers the ping.
+	for index := range trainLength {
+		if later := current.recordTrainReply(); later != (index > 0) {
+			t.Errorf("reply %d taken as a later one of the train: %t", index, later)
+		}
+		now = now.Add(time.Millisecond)
+	}
+	want := float64((trainLength-1)*trainFrameSize) / (time.Duration(trainLength-1) * time.Millisecond).Seconds()
+	if got := current.stats().Capacity; got != want {
+		t.Errorf("capacity = %.0f, want %.0f", got, want)
+	}
+
+	// A later train folds in, smoothed, and replies beyond a train are not
+	// taken for one.
+	now = now.Add(capacityInterval)
+	current.recordReply()
+	if !current.startTrain() {
+		t.Fatal("train not started after capacityInterval")
+	}
+	for range trainLength {
+		current.recordTrainReply() // all at once: timed at minDispersion
+	}
+	if current.recordTrainReply() {
+		t.Error("a reply beyond the train taken for one of it")
+	}
+	fastest := float64((trainLength-1)*trainFrameSize) / minDispersion.Seconds()
+	if got := current.stats().Capacity; got != want+capacitySmoothing*(fastest-want) {
+		t.Errorf("capacity = %.0f, want %.0f", got, want+capacitySmoothing*(fastest-want))
+	}
+
+	// A train that lost a reply is given up by the next ping, whose reply
+	// is then its own.
+	now = now.Add(capacityInterval)
+	if !current.startTrain() {
+		t.Fatal("train not started after capacityInterval")
+	}
+	current.recordProbe()
+	current.recordTrainReply()
+	current.recordReply()
+	current.startTrain()
+	if current.recordTrainReply() {
+		t.Error("a ping's reply taken for one of a train that lost a reply")
+	}
+
+	// No train starts while a keepalive is unanswered.
+	now = now.Add(capacityInterval)
+	current.recordProbe()
+	if current.startTrain() {
+		t.Error("train started with a keepalive outstanding")
+	}
+}
+
+func TestSetPolicyMeasuresCapacity(t *testing.T) {
+	current := newLink("udp", nil, nil)
+	client := newClient(nil, nil, []*link{current})
+	if current.measure.Load() {
+		t.Error("capacity measured for lowest-latency")
+	}
+	client.SetPolicy(throughputAware{PolicyThresholds{}.withDefaults()})
+	if !current.measure.Load() {
+		t.Error("capacity not measured for throughput-aware")
+	}
+	client.SetPolicy(lossAware{PolicyThresholds{}.withDefaults()})
+	if current.measure.Load() {
+		t.Error("capacity still measured after leaving throughput-aware")
+	}
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+// Rule sends the frames that match it over the first healthy link of Links,
+// whichever link the policy has chosen. Criteria left zero match every frame.
+type Rule struct {
+	// Protocol is the IP protocol number, such as 6 (TCP) or 17 (UDP).
+	Protocol byte
+	// Ports matches a TCP or UDP frame whose source or destination port is in
+	// the inclusive range, so that a rule for port 53 covers both queries and
+	// the answers of a DNS server behind the client. Fragments after the
+	// first carry no ports and do not match.
+	Ports PortRange
+	// DSCP lists the DiffServ code points to match, such as 46 (EF).
+	DSCP []byte
+	// Destination matches frames addressed into the prefix.
+	Destination *net.IPNet
+	// Links names the links to use, in order of preference. A frame whose
+	// links are all unhealthy goes over the active link.
+	Links []string
+}
+
+// PortRange is an inclusive range of ports; the zero PortRange matches all.
+type PortRange struct {
+	First, Last uint16
+}
+
+func (self PortRange) contains(port uint16) bool {
+	return self.First <= port && port <= self.Last
+}
+
+// dscpNames are the code point names ParseRule accepts besides numbers.
+var dscpNames = map[string]byte{
+	"ef": 46, "va": 44,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14, "af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30, "af41": 34, "af42": 36, "af43": 38,
+}
+
+// ParseRule parses a rule of the form key=value[,key=value...], such as
+// "protocol=udp,dscp=ef,via=udp/tcp". The keys are protocol (tcp, udp, icmp
+// or a number), port (N or A-B, from 1), dscp (numbers or names such as ef,
+// af41 or cs1, separated by /), to (a destination prefix) and via (link names
+// in order of preference, separated by /), which is required.
+func ParseRule(spec string) (Rule, error) {
+	var rule Rule
+	for _, field := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		var err error
+		switch key {
+		case "protocol":
+			rule.Protocol, err = parseProtocol(value)
+		case "port":
+			rule.Ports, err = parsePortRange(value)
+		case "dscp":
+			for _, name := range strings.Split(value, "/") {
+				point, ok := dscpNames[strings.ToLower(name)]
+				if !ok {
+					number, parseErr := strconv.ParseUint(name, 10, 6)
+					if parseErr != nil {
+						err = fmt.Errorf("invalid dscp %q", name)
+						break
+					}
+					point = byte(number)
+				}
+				rule.DSCP = append(rule.DSCP, point)
+			}
+		case "to":
+			_, rule.Destination, err = net.ParseCIDR(value)
+			if err == nil && rule.Destination.IP.To4() == nil {
+				err = fmt.Errorf("not an IPv4 prefix: %q", value)
+			}
+		case "via":
+			rule.Links = strings.Split(value, "/")
+			if slices.Contains(rule.Links, "") {
+				err = fmt.Errorf("empty link name in %q", value)
+			}
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("client: invalid rule %q: %s", spec, err)
+		}
+	}
+	if len(rule.Links) == 0 {
+		return rule, fmt.Errorf("client: rule %q names no links (via=)", spec)
+	}
+	return rule, nil
+}
+
+func parseProtocol(value string) (byte, error) {
+	switch strings.ToLower(value) {
+	case "icmp":
+		return 1, nil
+	case "tcp":
+		return 6, nil
+	case "udp":
+		return 17, nil
+	}
+	number, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || number == 0 {
+		return 0, fmt.Errorf("invalid protocol %q", value)
+	}
+	return byte(number), nil
+}
+
+// parsePortRange parses "N" or "A-B". Port 0 is refused: the zero PortRange
+// stands for any port.
+func parsePortRange(value string) (PortRange, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	if !isRange {
+		last = first
+	}
+	low, err := strconv.ParseUint(first, 10, 16)
+	if err != nil || low == 0 {
+		return PortRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	high, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || high < low {
+		return PortRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	return PortRange{First: uint16(low), Last: uint16(high)}, nil
+}
+
+// Matches reports whether the frame meets all of the rule's criteria.
+func (self Rule) Matches(frame ipv4.Frame) bool {
+	if self.Protocol != 0 && frame.Protocol() != self.Protocol {
+		return false
+	}
+	if self.Ports != (PortRange{}) {
+		protocol := frame.Protocol()
+		if protocol != 6 && protocol != 17 || frame.FragmentOffset() != 0 || len(frame.Payload()) < 4 {
+			return false
+		}
+		if !self.Ports.contains(frame.SourcePort()) && !self.Ports.contains(frame.DestinationPort()) {
+			return false
+		}
+	}
+	if len(self.DSCP) > 0 && !slices.Contains(self.DSCP, frame.DSCP()) {
+		return false
+	}
+	if self.Destination != nil && !self.Destination.Contains(frame.Destination()) {
+		return false
+	}
+	return true
+}
+
+// classifier holds a client's rules with their link names resolved.
+type classifier struct {
+	rules []Rule
+	links [][]*link
+}
+
+// newClassifier resolves the links each rule names among links.
+func newClassifier(rules []Rule, links []*link) (*classifier, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	self := &classifier{rules: rules}
+	for _, rule := range rules {
+		var resolved []*link
+		for _, name := range rule.Links {
+			index := slices.IndexFunc(links, func(candidate *link) bool { return candidate.label == name })
+			if index < 0 {
+				return nil, fmt.Errorf("client: rule names unknown link %q", name)
+			}
+			resolved = append(resolved, links[index])
+		}
+		self.links = append(self.links, resolved)
+	}
+	return self, nil
+}
+
+// classify returns the link the first rule matching frame prefers, or nil
+// when no rule matches or all of its links are unhealthy.
+func (self *classifier) classify(frame ipv4.Frame) *link {
+	if self == nil {
+		return nil
+	}
+	for index, rule := range self.rules {
+		if !rule.Matches(frame) {
+			continue
+		}
+		for _, candidate := range self.links[index] {
+			if candidate.healthy() {
+				return candidate
+			}
+		}
+		return nil
+	}
+	return nil
+}
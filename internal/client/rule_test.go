@@ -0,0 +1,92 @@
+package client
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+func TestParseRule(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/8")
+	cases := []struct {
+		spec string
+		want Rule
+	}{
+		{"via=udp", Rule{Links: []string{"udp"}}},
+		{"protocol=udp,port=53,via=udp/tcp", Rule{Protocol: 17, Ports: PortRange{53, 53}, Links: []string{"udp", "tcp"}}},
+		{"protocol=47, port=1000-2000 ,via=a", Rule{Protocol: 47, Ports: PortRange{1000, 2000}, Links: []string{"a"}}},
+		{"dscp=EF/af41/8,via=a", Rule{DSCP: []byte{46, 34, 8}, Links: []string{"a"}}},
+		{"to=10.1.2.3/8,via=a", Rule{Destination: prefix, Links: []string{"a"}}},
+	}
+	for _, c := range cases {
+		if rule, err := ParseRule(c.spec); err != nil || !reflect.DeepEqual(rule, c.want) {
+			t.Errorf("ParseRule(%q) = %+v, %v; want %+v", c.spec, rule, err, c.want)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"protocol=udp",
+		"via=",
+		"via=a//b",
+		"protocol=0,via=a",
+		"protocol=gre,via=a",
+		"port=0,via=a",
+		"port=0-100,via=a",
+		"port=20-10,via=a",
+		"port=65536,via=a",
+		"dscp=64,via=a",
+		"dscp=best,via=a",
+		"to=10.0.0.1,via=a",
+		"to=2001:db8::/32,via=a",
+		"color=red,via=a",
+	} {
+		if _, err := ParseRule(spec); err == nil {
+			t.Errorf("ParseRule(%q) succeeded", spec)
+		}
+	}
+}
+
+// ruleFrame builds a frame to 10.1.2.3 with the given protocol, DSCP and
+// fragment offset, carrying ports 1234 to 53.
+func ruleFrame(protocol, dscp byte, fragmentOffset uint16) ipv4.Frame {
+	frame := append(ipv4.MakeFrame(net.ParseIP("172.18.0.2"), net.ParseIP("10.1.2.3")), 0x04, 0xd2, 0x00, 0x35, 0, 0, 0, 0)
+	frame.SetTotalLength(uint16(len(frame)))
+	frame[1] = dscp << 2
+	frame[6], frame[7] = byte(fragmentOffset>>8), byte(fragmentOffset)
+	frame[9] = protocol
+	return frame
+}
+
+func TestRuleMatches(t *testing.T) {
+	_, inside, _ := net.ParseCIDR("10.0.0.0/8")
+	_, outside, _ := net.ParseCIDR("192.168.0.0/16")
+	udp := ruleFrame(17, 0, 0)
+	cases := []struct {
+		name  string
+		rule  Rule
+		frame ipv4.Frame
+		want  bool
+	}{
+		{"no criteria", Rule{}, udp, true},
+		{"protocol", Rule{Protocol: 17}, udp, true},
+		{"other protocol", Rule{Protocol: 6}, udp, false},
+		{"destination port", Rule{Ports: PortRange{53, 53}}, udp, true},
+		{"source port", Rule{Ports: PortRange{1000, 2000}}, udp, true},
+		{"port outside the range", Rule{Ports: PortRange{80, 443}}, udp, false},
+		{"ports of a frame without them", Rule{Ports: PortRange{53, 53}}, ruleFrame(1, 0, 0), false},
+		{"ports of a later fragment", Rule{Ports: PortRange{53, 53}}, ruleFrame(17, 0, 100), false},
+		{"dscp", Rule{DSCP: []byte{34, 46}}, ruleFrame(17, 46, 0), true},
+		{"other dscp", Rule{DSCP: []byte{46}}, udp, false},
+		{"destination", Rule{Destination: inside}, udp, true},
+		{"other destination", Rule{Destination: outside}, udp, false},
+		{"all criteria", Rule{Protocol: 17, Ports: PortRange{53, 53}, DSCP: []byte{0}, Destination: inside}, udp, true},
+	}
+	for _, c := range cases {
+		if got := c.rule.Matches(c.frame); got != c.want {
+			t.Errorf("%s: Matches = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -6,42 +6,115 @@ import (
 	"net"
 	"time"
 
+	"github.com/ziyan/shadowgate/internal/batch"
 	"github.com/ziyan/shadowgate/internal/compress"
 	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/plugin"
+	"github.com/ziyan/shadowgate/internal/proxy"
 	"github.com/ziyan/shadowgate/internal/secure"
+	"github.com/ziyan/shadowgate/internal/stdio"
 )
 
-// tcpTransport is a TCP path to the server: a stream of length-delimited IPv4
-// frames beneath the encryption (and optional compression) layer.
+// tcpTransport is a stream path to the server — a TCP connection, or any other
+// byte pipe such as a spawned command (see dialCommand): a stream of
+// length-delimited IPv4 frames beneath the encryption (and optional
+// compression) layer.
 type tcpTransport struct {
+	label   string
 	conn    io.ReadWriteCloser
 	scanner *bufio.Scanner
+	address net.IP // the server's or the proxy's, for a direct connection
 }
 
-func dialTcp(connect string, password []byte, useCompression bool, timeout time.Duration) (*tcpTransport, error) {
-	conn, err := net.DialTimeout("tcp", connect, timeout)
+// dialTcp connects to the server directly, racing its addresses happy-eyeballs
+// style from the source bind selects, or through upstream when it is not nil.
+func dialTcp(connect string, password []byte, useCompression bool, upstream *proxy.Proxy, bind binding, timeout time.Duration) (transport, error) {
+	if upstream != nil {
+		conn, err := upstream.Dial(connect, timeout)
+		if err != nil {
+			return nil, err
+		}
+		stream := newStreamTransport("tcp", conn, password, useCompression)
+		stream.address = addressIP(conn.RemoteAddr())
+		return stream, nil
+	}
+	addresses, err := resolveEndpoint(connect, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return race(addresses, func(address string) (transport, error) {
+		conn, err := bind.dialer("tcp", timeout).Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		_ = conn.(*net.TCPConn).SetNoDelay(true)
+		stream := newStreamTransport("tcp", conn, password, useCompression)
+		stream.address = addressIP(conn.RemoteAddr())
+		return stream, nil
+	})
+}
+
+// acceptTcp waits for the server to connect to a listening link. The client
+// remains the initiator of the encrypted session, whichever end dialed.
+func acceptTcp(listener net.Listener, password []byte, useCompression bool) (transport, error) {
+	conn, err := listener.Accept()
 	if err != nil {
 		return nil, err
 	}
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		_ = tcpConn.SetNoDelay(true)
 	}
+	log.Infof("server connected from %s", conn.RemoteAddr())
+	stream := newStreamTransport("tcp", conn, password, useCompression)
+	stream.address = addressIP(conn.RemoteAddr())
+	return stream, nil
+}
 
+// dialPlugin connects through a running client plugin, which carries the
+// stream to the server.
+func dialPlugin(process *plugin.Process, password []byte, useCompression bool, timeout time.Duration) (*tcpTransport, error) {
+	conn, err := process.Dial(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamTransport("plugin", conn, password, useCompression), nil
+}
+
+// dialCommand starts command and runs the tunnel over its standard input and
+// output, as an SSH ProxyCommand does for one connection.
+func dialCommand(command string, password []byte, useCompression bool) (*tcpTransport, error) {
+	conn, err := stdio.Command(command)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamTransport("command", conn, password, useCompression), nil
+}
+
+func newStreamTransport(label string, conn io.ReadWriteCloser, password []byte, useCompression bool) *tcpTransport {
 	wrapped := wrapConnection(conn, password, useCompression)
 	scanner := bufio.NewScanner(wrapped)
 	scanner.Buffer(make([]byte, 65536), 65536)
 	scanner.Split(ipv4.ScanFrame)
 
-	return &tcpTransport{conn: wrapped, scanner: scanner}, nil
+	return &tcpTransport{label: label, conn: wrapped, scanner: scanner}
 }
 
-func (self *tcpTransport) name() string { return "tcp" }
+func (self *tcpTransport) name() string { return self.label }
+
+func (self *tcpTransport) remote() net.IP { return self.address }
 
 func (self *tcpTransport) send(frame ipv4.Frame) error {
 	_, err := self.conn.Write(frame)
 	return err
 }
 
+// sendBatch writes frames back to back in one write, and so in one record of
+// the encrypted stream; the server splits them as it splits any stream.
+func (self *tcpTransport) sendBatch(frames []ipv4.Frame) error {
+	_, err := self.conn.Write(batch.Join(frames))
+	return err
+}
+
 func (self *tcpTransport) receive() (ipv4.Frame, error) {
 	if !self.scanner.Scan() {
 		if err := self.scanner.Err(); err != nil {
@@ -1,6 +1,10 @@
 package client
 
-import "github.com/ziyan/shadowgate/internal/ipv4"
+import (
+	"net"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
 
 // transport is one physical path to the server that sends and receives whole
 // IPv4 frames. A link serialises all sends through a single goroutine and reads
@@ -11,3 +15,49 @@ type transport interface {
 	receive() (ipv4.Frame, error)
 	close() error
 }
+
+// batchSender is implemented by transports that can send several frames for
+// the cost of one: in one record of the encrypted stream, or in one datagram.
+// A link batches only over such transports (see LinkConfig.Batch).
+type batchSender interface {
+	sendBatch(frames []ipv4.Frame) error
+}
+
+// unpacedTransport is implemented by transports that deliver the server's
+// frames in batches rather than as they are sent, as HTTP polling does, so
+// that the spacing of the replies to a capacity train shows nothing. A link
+// measures no capacity over them.
+type unpacedTransport interface {
+	unpaced()
+}
+
+// routedTransport is implemented by transports that know the address their
+// packets are routed to: the server's, or a proxy's. When the host's network
+// changes, a link redials over them only if the route there moved (see
+// link.moved), and over other transports always.
+type routedTransport interface {
+	remote() net.IP
+}
+
+// sequencedTransport is implemented by transports whose server numbers its
+// datagrams to the link one after another, as the udp server does, so that
+// the gaps among those that arrive count toward the link's loss (see
+// link.recordGaps).
+type sequencedTransport interface {
+	// received returns how many of the server's datagrams have arrived, and
+	// the highest sequence number among them.
+	received() (count, top uint64)
+}
+
+// addressIP returns the IP address of a socket address, or nil.
+func addressIP(address net.Addr) net.IP {
+	switch address := address.(type) {
+	case *net.UDPAddr:
+		return address.IP
+	case *net.TCPAddr:
+		return address.IP
+	case *net.IPAddr:
+		return address.IP
+	}
+	return nil
+}
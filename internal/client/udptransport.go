@@ -1,25 +1,49 @@
 package client
 
 import (
+	"errors"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ziyan/shadowgate/internal/batch"
+	"github.com/ziyan/shadowgate/internal/fec"
+	"github.com/ziyan/shadowgate/internal/hop"
 	"github.com/ziyan/shadowgate/internal/ipv4"
 	"github.com/ziyan/shadowgate/internal/obfuscate"
+	"github.com/ziyan/shadowgate/internal/pmtu"
+	"github.com/ziyan/shadowgate/internal/proxy"
 )
 
 // udpTransport is a UDP path to the server: each frame travels as one obfuscated
-// datagram (see internal/obfuscate).
+// datagram (see internal/obfuscate), or several when it is too long for the
+// path, or shares one with other frames when the link batches.
 type udpTransport struct {
-	conn       *net.UDPConn
-	codec      *obfuscate.Codec
-	sequence   uint64
-	replay     obfuscate.ReplayWindow
+	conn       net.Conn
+	path       *udpPath
+	fec        *udpFec // nil unless the link uses forward error correction
 	recvBuffer []byte
 }
 
-func dialUdp(connect string, password []byte, maxPadding int, timeout time.Duration) (*udpTransport, error) {
+func newUdpTransport(conn net.Conn, codec *obfuscate.Codec, ratio fec.Ratio) *udpTransport {
+	self := &udpTransport{conn: conn, recvBuffer: make([]byte, 65536)}
+	self.path = newUdpPath(codec, conn, func(datagram []byte) error {
+		_, err := conn.Write(datagram)
+		return err
+	})
+	self.fec = newUdpFec(ratio, func(payload []byte) error { return self.path.write(obfuscate.StreamFecShard, payload) })
+	return self
+}
+
+// dialUdp opens a UDP socket to the server directly, or a SOCKS5 UDP
+// association through upstream when it is not nil, its socket bound as bind
+// says. When the server's name
+// resolves to several addresses, each is probed with a keepalive (from ip),
+// happy-eyeballs style, and the first to answer is used. With a schedule the
+// socket hops across the server's ports, ignoring connect's port. Unless
+// ratio is disabled, frames travel in forward error correction groups.
+func dialUdp(connect string, password []byte, maxPadding int, ratio fec.Ratio, upstream *proxy.Proxy, bind binding, schedule *hop.Schedule, ip net.IP, timeout time.Duration) (transport, error) {
 	key, err := obfuscate.DeriveKey(password)
 	if err != nil {
 		return nil, err
@@ -28,50 +52,451 @@ func dialUdp(connect string, password []byte, maxPadding int, timeout time.Durat
 	if err != nil {
 		return nil, err
 	}
-	address, err := net.ResolveUDPAddr("udp", connect)
+	if upstream != nil {
+		conn, err := upstream.ListenUDP(connect, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return newUdpTransport(conn, codec, ratio), nil
+	}
+	addresses, err := resolveEndpoint(connect, timeout)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialUDP("udp", nil, address)
+	if len(addresses) == 1 {
+		return openUdp(addresses[0], codec, ratio, bind, schedule, timeout)
+	}
+	return race(addresses, func(address string) (transport, error) {
+		transport, err := openUdp(address, codec, ratio, bind, schedule, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := transport.probe(ip, timeout); err != nil {
+			_ = transport.close()
+			return nil, err
+		}
+		return transport, nil
+	})
+}
+
+// openUdp opens a connected UDP socket to address (ip:port), or a hopping one
+// to its host when schedule is not nil.
+func openUdp(address string, codec *obfuscate.Codec, ratio fec.Ratio, bind binding, schedule *hop.Schedule, timeout time.Duration) (*udpTransport, error) {
+	if schedule != nil {
+		return openHoppingUdp(address, codec, ratio, bind, schedule)
+	}
+	conn, err := bind.dialer("udp", timeout).Dial("udp", address)
 	if err != nil {
 		return nil, err
 	}
-	return &udpTransport{conn: conn, codec: codec, recvBuffer: make([]byte, 65536)}, nil
+	if conn.LocalAddr().String() == conn.RemoteAddr().String() {
+		// The kernel picked the server's own port as our ephemeral port on the same
+		// host, so every keepalive would come straight back as its own "reply".
+		_ = conn.Close()
+		return nil, errors.New("client: udp socket connected to itself")
+	}
+	return newUdpTransport(conn, codec, ratio), nil
 }
 
-func (self *udpTransport) name() string { return "udp" }
+func openHoppingUdp(address string, codec *obfuscate.Codec, ratio fec.Ratio, bind binding, schedule *hop.Schedule) (*udpTransport, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	local := ""
+	if bind.source != nil {
+		local = bind.source.String()
+	}
+	conn, err := bind.listenPacket("udp", net.JoinHostPort(local, "0"))
+	if err != nil {
+		return nil, err
+	}
+	server := net.ParseIP(host)
+	if port := conn.LocalAddr().(*net.UDPAddr).Port; schedule.Covers(port) && isLocalAddress(server) {
+		// Hopping onto our own port would send keepalives to ourselves.
+		_ = conn.Close()
+		return nil, errors.New("client: udp socket port is inside the hopping range")
+	}
+	return newUdpTransport(hop.NewConn(conn.(*net.UDPConn), server, schedule), codec, ratio), nil
+}
 
-func (self *udpTransport) send(frame ipv4.Frame) error {
-	sequence := atomic.AddUint64(&self.sequence, 1)
-	datagram, err := self.codec.Seal(sequence, 0, frame)
+// isLocalAddress reports whether ip is an address of this host, as a server
+// on the same host has.
+func isLocalAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addresses, err := net.InterfaceAddrs()
 	if err != nil {
+		return true // assume the worst
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe sends a keepalive and waits up to timeout for the server's reply.
+func (self *udpTransport) probe(ip net.IP, timeout time.Duration) error {
+	_ = self.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = self.conn.SetReadDeadline(time.Time{}) }()
+	if err := self.send(ipv4.MakeFrame(ip, ip)); err != nil {
 		return err
 	}
-	_, err = self.conn.Write(datagram)
-	return err
+	for {
+		frame, err := self.receive()
+		if err != nil {
+			return err
+		}
+		if frame.Source().Equal(frame.Destination()) {
+			return nil
+		}
+	}
 }
 
+func (self *udpTransport) name() string { return "udp" }
+
+func (self *udpTransport) remote() net.IP { return addressIP(self.conn.RemoteAddr()) }
+
+func (self *udpTransport) send(frame ipv4.Frame) error {
+	return self.path.send(self.fec, frame)
+}
+
+func (self *udpTransport) sendBatch(frames []ipv4.Frame) error {
+	return self.path.sendBatch(self.fec, frames)
+}
+
+func (self *udpTransport) received() (uint64, uint64) { return self.path.received() }
+
 func (self *udpTransport) receive() (ipv4.Frame, error) {
+	if frame := self.path.next(); frame != nil {
+		return frame, nil
+	}
+	if frame := self.fec.next(); frame != nil {
+		return frame, nil
+	}
 	for {
 		size, err := self.conn.Read(self.recvBuffer)
 		if err != nil {
 			return nil, err
 		}
-		sequence, _, payload, err := self.codec.Open(self.recvBuffer[:size])
+		if frame, _ := self.path.open(self.fec, self.recvBuffer[:size]); frame != nil {
+			return frame, nil
+		}
+	}
+}
+
+func (self *udpTransport) close() error {
+	self.fec.close()
+	return self.conn.Close()
+}
+
+// udpPath seals frames into datagrams no longer than the path to the server
+// carries, splitting those that do not fit, probes for that length with
+// padded keepalives (see internal/pmtu), and opens the server's datagrams,
+// putting split ones back together and splitting batched ones apart.
+type udpPath struct {
+	codec       *obfuscate.Codec
+	sequence    uint64
+	replay      obfuscate.ReplayWindow
+	reassembler obfuscate.Reassembler
+	prober      *pmtu.Prober
+	output      func(datagram []byte) error
+	batched     []ipv4.Frame // frames opened from a batch but not yet handed out
+
+	// arrived counts the server's datagrams accepted, and highest is the
+	// largest sequence number among them (see sequencedTransport).
+	arrived atomic.Uint64
+	highest atomic.Uint64
+
+	// socket gets the Don't Fragment bit once the server answers a probe.
+	socket       any
+	dontFragment sync.Once
+}
+
+func newUdpPath(codec *obfuscate.Codec, socket any, output func(datagram []byte) error) *udpPath {
+	return &udpPath{codec: codec, prober: pmtu.NewProber(), output: output, socket: socket}
+}
+
+// send sends a frame, through correction unless it is nil or the frame is a
+// keepalive, which reports the datagram length confirmed so far and is
+// followed by a probe when one is due.
+func (self *udpPath) send(correction *udpFec, frame ipv4.Frame) error {
+	if !frame.Source().Equal(frame.Destination()) {
+		if correction != nil {
+			return correction.encoder.Add(frame)
+		}
+		return self.write(obfuscate.StreamFrame, frame)
+	}
+	if _, _, train := pmtu.Parse(frame); train {
+		// Of a capacity train: sent at its length, and never followed by a
+		// probe, which would stretch the train.
+		return self.write(obfuscate.StreamFrame, pmtu.Train(frame.Source(), self.prober.Limit(), len(frame)))
+	}
+	if err := self.write(obfuscate.StreamFrame, pmtu.Keepalive(frame.Source(), self.prober.Limit(), 0)); err != nil {
+		return err
+	}
+	if size := self.prober.Next(); size > 0 {
+		probe := pmtu.Keepalive(frame.Source(), self.prober.Limit(), size-self.codec.Overhead())
+		datagram, err := self.codec.SealWithin(atomic.AddUint64(&self.sequence, 1), obfuscate.StreamFrame, probe, size)
 		if err != nil {
-			continue // undecryptable; drop
+			return err
 		}
-		if !self.replay.Accept(sequence) {
-			continue
+		// A probe longer than the interface allows fails to send, and
+		// counts as lost.
+		if err := self.output(datagram); err != nil {
+			log.Debugf("path mtu probe of %d bytes failed: %s", size, err)
+		}
+	}
+	return nil
+}
+
+// sendBatch sends frames packed into as few datagrams as the path carries.
+// Until the server has answered a probe, which a server that splits batches
+// does, and under forward error correction, whose shards are sized for one
+// frame each, the frames go one by one.
+func (self *udpPath) sendBatch(correction *udpFec, frames []ipv4.Frame) error {
+	limit := self.prober.Limit()
+	if correction != nil || limit == 0 {
+		for _, frame := range frames {
+			if err := self.send(correction, frame); err != nil {
+				return err
+			}
 		}
-		frame := ipv4.DecodeFrame(payload)
-		if frame == nil {
+		return nil
+	}
+	for _, run := range batch.Pack(frames, limit-self.codec.Overhead()) {
+		if len(run) == 1 {
+			if err := self.write(obfuscate.StreamFrame, run[0]); err != nil {
+				return err
+			}
 			continue
 		}
-		return frame.Copy(), nil
+		datagram, err := self.codec.SealWithin(atomic.AddUint64(&self.sequence, 1), obfuscate.StreamFrames, batch.Join(run), limit)
+		if err != nil {
+			return err
+		}
+		if err := self.output(datagram); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (self *udpTransport) close() error {
-	return self.conn.Close()
+// write seals payload into one datagram, or several when it is too long for
+// the path, and sends them.
+func (self *udpPath) write(streamId uint16, payload []byte) error {
+	limit := self.prober.Limit()
+	count := uint64(self.codec.Fragments(len(payload), limit))
+	last := atomic.AddUint64(&self.sequence, count)
+	datagrams, err := self.codec.SealFragments(last-count+1, streamId, payload, limit)
+	if err != nil {
+		return err
+	}
+	for _, datagram := range datagrams {
+		if err := self.output(datagram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open returns the frame a datagram from the server carries or completes, if
+// any, and whether the datagram was the server's at all. The server's
+// answers to probes are taken in here.
+func (self *udpPath) open(correction *udpFec, datagram []byte) (ipv4.Frame, bool) {
+	sequence, streamId, payload, err := self.codec.Open(datagram)
+	if err != nil || !obfuscate.IsFragment(streamId) && streamId != obfuscate.StreamFrame && streamId != obfuscate.StreamFrames && (streamId != obfuscate.StreamFecShard || correction == nil) {
+		return nil, false // undecryptable or not a frame; drop
+	}
+	if !self.replay.Accept(sequence) {
+		return nil, false
+	}
+	self.arrived.Add(1)
+	if sequence > self.highest.Load() {
+		self.highest.Store(sequence) // open is only called from the receiving goroutine
+	}
+	if streamId == obfuscate.StreamFrames {
+		self.batched = append(self.batched, batch.Split(payload)...)
+		return self.next(), true
+	}
+	streamId, payload, whole := self.reassembler.Add(sequence, streamId, payload)
+	switch {
+	case !whole:
+		return nil, true
+	case streamId == obfuscate.StreamFecShard && correction != nil:
+		return correction.receive(payload), true
+	case streamId != obfuscate.StreamFrame:
+		return nil, true
+	}
+	frame := ipv4.DecodeFrame(payload)
+	if frame == nil {
+		return nil, true
+	}
+	if frame.Source().Equal(frame.Destination()) {
+		// The server reports the length of the probe it answers, and marks
+		// its answers to a capacity train's keepalives, which go to the link.
+		if size, _, train := pmtu.Parse(frame); size > 0 && !train {
+			self.prober.Confirm(size + self.codec.Overhead())
+			self.dontFragment.Do(func() { pmtu.DontFragment(self.socket) })
+			return nil, true
+		}
+	}
+	return frame.Copy(), true
+}
+
+func (self *udpPath) received() (uint64, uint64) {
+	return self.arrived.Load(), self.highest.Load()
+}
+
+// next returns the next frame opened from a batch but not yet handed out, if
+// any.
+func (self *udpPath) next() ipv4.Frame {
+	if len(self.batched) == 0 {
+		return nil
+	}
+	frame := self.batched[0]
+	self.batched = self.batched[1:]
+	return frame
+}
+
+// udpFec sends a udp link's frames as the data shards of forward error
+// correction groups, each followed by parity shards (see internal/fec), and
+// takes in the shards the server sends back in kind, rebuilding lost frames.
+type udpFec struct {
+	encoder   *fec.Encoder
+	decoder   *fec.Decoder
+	recovered []ipv4.Frame // frames taken in but not yet handed out
+}
+
+// newUdpFec returns nil for a disabled ratio, which the methods of a nil
+// udpFec treat as no error correction.
+func newUdpFec(ratio fec.Ratio, emit func(payload []byte) error) *udpFec {
+	if !ratio.Enabled() {
+		return nil
+	}
+	return &udpFec{encoder: fec.NewEncoder(ratio, emit), decoder: fec.NewDecoder()}
+}
+
+// receive takes one shard, returning the next frame taken in, if any. The
+// parity sent follows the loss the shards taken in suffer, under an adaptive
+// ratio; the server mirrors it.
+func (self *udpFec) receive(payload []byte) ipv4.Frame {
+	frames, err := self.decoder.Receive(payload)
+	if err != nil {
+		return nil
+	}
+	self.encoder.Adapt(self.decoder.Loss())
+	for _, frame := range frames {
+		if decoded := ipv4.DecodeFrame(frame); decoded != nil {
+			self.recovered = append(self.recovered, decoded.Copy())
+		}
+	}
+	return self.next()
+}
+
+func (self *udpFec) next() ipv4.Frame {
+	if self == nil || len(self.recovered) == 0 {
+		return nil
+	}
+	frame := self.recovered[0]
+	self.recovered = self.recovered[1:]
+	return frame
+}
+
+func (self *udpFec) close() {
+	if self != nil {
+		self.encoder.Close()
+	}
+}
+
+// listeningUdp is the socket of a listening udp link (see LinkConfig.Listen).
+// The server knocks on it until the link answers, and the link then talks to
+// wherever the server's datagrams come from. The socket, and with it the
+// sequence and replay window, outlives each transport served over it, so that
+// the server does not take a redialed link's datagrams for replays.
+type listeningUdp struct {
+	conn       *net.UDPConn
+	path       *udpPath
+	fec        *udpFec
+	remote     atomic.Pointer[net.UDPAddr]
+	recvBuffer []byte
+}
+
+func listenUdp(listen string, password []byte, maxPadding int, ratio fec.Ratio, bind binding) (*listeningUdp, error) {
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := obfuscate.NewCodec(key, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	packetConn, err := bind.listenPacket("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn := packetConn.(*net.UDPConn)
+	self := &listeningUdp{conn: conn, recvBuffer: make([]byte, 65536)}
+	self.path = newUdpPath(codec, conn, func(datagram []byte) error {
+		_, err := conn.WriteToUDP(datagram, self.remote.Load())
+		return err
+	})
+	self.fec = newUdpFec(ratio, func(payload []byte) error { return self.path.write(obfuscate.StreamFecShard, payload) })
+	return self, nil
+}
+
+// accept waits for a datagram from the server, which it then serves as the
+// link's transport.
+func (self *listeningUdp) accept() (transport, error) {
+	_ = self.conn.SetReadDeadline(time.Time{})
+	if _, err := self.receive(); err != nil {
+		return nil, err
+	}
+	log.Infof("server knocked from %s", self.remote.Load())
+	return self, nil
+}
+
+func (self *listeningUdp) name() string { return "udp" }
+
+func (self *listeningUdp) send(frame ipv4.Frame) error {
+	return self.path.send(self.fec, frame)
+}
+
+func (self *listeningUdp) sendBatch(frames []ipv4.Frame) error {
+	return self.path.sendBatch(self.fec, frames)
+}
+
+func (self *listeningUdp) received() (uint64, uint64) { return self.path.received() }
+
+// receive returns the next frame from the server, following it to the address
+// of each datagram that opens.
+func (self *listeningUdp) receive() (ipv4.Frame, error) {
+	if frame := self.path.next(); frame != nil {
+		return frame, nil
+	}
+	if frame := self.fec.next(); frame != nil {
+		return frame, nil
+	}
+	for {
+		size, address, err := self.conn.ReadFromUDP(self.recvBuffer)
+		if err != nil {
+			return nil, err
+		}
+		frame, ok := self.path.open(self.fec, self.recvBuffer[:size])
+		if ok {
+			self.remote.Store(address)
+		}
+		if frame != nil {
+			return frame, nil
+		}
+	}
+}
+
+// close interrupts a receive but keeps the socket open for the next accept; the
+// client closes it when it stops.
+func (self *listeningUdp) close() error {
+	return self.conn.SetReadDeadline(time.Unix(1, 0))
 }
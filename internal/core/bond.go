@@ -0,0 +1,166 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/flow"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/multipath"
+)
+
+// memberTimeout is how long a link stays in a client's bond after the last
+// wrapped frame the client sent over it.
+const memberTimeout = 10 * time.Second
+
+// Receive routes a data frame a client sent over sink: it learns the route back
+// to the frame's source through sink, then routes the frame as Inbound does.
+// When flows are pinned (see PinFlows), the replies to the frame's flow go
+// back over sink while the flow is live, even once the route has moved to
+// another of the client's links, so that a client switching links moves only
+// its new flows.
+// A frame wrapped by a client that sends over several links at once (see
+// internal/multipath) also makes sink a member of the client's bond, and is
+// unwrapped, rid of duplicates and put back in order first; frames to the
+// client then go out over the bond's members in its mode.
+func (self *Router) Receive(frame ipv4.Frame, sink Sink) {
+	if !multipath.IsWrapped(frame) || !self.ip.Equal(frame.Destination()) {
+		if self.flows != nil {
+			self.flows.Pin(flow.KeyOf(frame).Reverse(), sink)
+		}
+		self.Register(frame.Source(), sink)
+		self.Inbound(frame)
+		return
+	}
+	header, inner, err := multipath.Unwrap(frame)
+	if err != nil || self.ip.Equal(inner.Source()) {
+		log.Debugf("dropped wrapped frame from %s", frame.Source())
+		return
+	}
+	bond := self.join(frame.Source(), sink, header)
+	if bond == nil {
+		return
+	}
+	self.Register(inner.Source(), sink)
+	bond.receiver.Receive(header, inner)
+}
+
+// join adds sink to the bond of the client at ip, creating it if need be.
+func (self *Router) join(ip net.IP, sink Sink, header multipath.Header) *bond {
+	key := ip.String()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	existing, ok := self.bonds[key]
+	if !ok {
+		if len(self.bonds) >= maxRoutes {
+			return nil
+		}
+		existing = &bond{
+			ip:      ip,
+			source:  self.ip,
+			sender:  multipath.NewSender(),
+			members: make(map[Sink]*member),
+		}
+		existing.receiver = multipath.NewReceiver(func(frame ipv4.Frame) { self.inbound(frame, true) })
+		self.bonds[key] = existing
+		log.Debugf("client %s sends over several links (%s)", key, header.Mode)
+	}
+	self.members[sink] = existing
+	existing.join(sink, header)
+	return existing
+}
+
+// leave removes sink from its bond, returning the bond if that was its last
+// member. The caller holds the mutex.
+func (self *Router) leave(sink Sink) *bond {
+	existing, ok := self.members[sink]
+	if !ok {
+		return nil
+	}
+	delete(self.members, sink)
+	if !existing.leave(sink) {
+		return nil
+	}
+	delete(self.bonds, existing.ip.String())
+	return existing
+}
+
+// bond is a client that sends over several links at once: the sinks of those
+// links, and the numbering of the frames each way.
+type bond struct {
+	ip       net.IP // the client's tunnel address
+	source   net.IP // the server's
+	sender   *multipath.Sender
+	receiver *multipath.Receiver
+	stripe   multipath.Stripe[Sink]
+
+	mutex   sync.Mutex
+	mode    multipath.Mode
+	members map[Sink]*member
+}
+
+type member struct {
+	weight   int
+	lastSeen time.Time
+}
+
+func (self *bond) join(sink Sink, header multipath.Header) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.mode = header.Mode
+	self.members[sink] = &member{weight: int(header.Weight), lastSeen: time.Now()}
+}
+
+// leave removes sink, reporting whether it was the last member.
+func (self *bond) leave(sink Sink) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.members, sink)
+	return len(self.members) == 0
+}
+
+func (self *bond) close() {
+	self.receiver.Close()
+}
+
+// Send wraps frame and sends it over every link the client has used lately, or
+// over one of them chosen by weight when bonded. With no such link, it goes
+// unwrapped over the one used last.
+func (self *bond) Send(frame ipv4.Frame) {
+	now := time.Now()
+	var fresh []Sink
+	var latest Sink
+	var latestSeen time.Time
+	weights := make(map[Sink]int)
+	self.mutex.Lock()
+	mode := self.mode
+	for sink, current := range self.members {
+		if now.Sub(current.lastSeen) < memberTimeout {
+			fresh = append(fresh, sink)
+			weights[sink] = current.weight
+		}
+		if current.lastSeen.After(latestSeen) {
+			latest, latestSeen = sink, current.lastSeen
+		}
+	}
+	self.mutex.Unlock()
+
+	if len(fresh) == 0 {
+		if latest != nil {
+			latest.Send(frame)
+		}
+		return
+	}
+	wrapped, ok := multipath.Wrap(self.source, self.ip, self.sender.Next(mode), frame)
+	if !ok {
+		latest.Send(frame)
+		return
+	}
+	if mode == multipath.Bonded {
+		fresh = []Sink{self.stripe.Pick(fresh, func(sink Sink) int { return weights[sink] })}
+	}
+	for _, sink := range fresh {
+		sink.Send(wrapped)
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"net"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+// maxHeldFrames bounds how many frames are held for one expected address;
+// later ones are dropped.
+const maxHeldFrames = 64
+
+// heldFrames are the frames waiting for one expected address to reconnect.
+type heldFrames struct {
+	frames []ipv4.Frame
+	until  time.Time
+}
+
+// Expect holds frames for addresses that have no route yet — the clients of a
+// failed server of an active/standby pair, say — for up to hold, and delivers
+// them as soon as each one's route appears.
+func (self *Router) Expect(addresses []net.IP, hold time.Duration) {
+	until := time.Now().Add(hold)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, address := range addresses {
+		key := address.String()
+		if _, ok := self.routes[key]; ok || len(self.held) >= maxRoutes {
+			continue
+		}
+		self.held[key] = &heldFrames{until: until}
+	}
+}
+
+// hold keeps frame if its destination is expected, reporting whether it did.
+func (self *Router) hold(destination net.IP, frame ipv4.Frame) bool {
+	key := destination.String()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	waiting, ok := self.held[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(waiting.until) {
+		delete(self.held, key)
+		return false
+	}
+	if len(waiting.frames) < maxHeldFrames {
+		waiting.frames = append(waiting.frames, frame)
+	}
+	return true
+}
+
+// release returns (and forgets) the frames held for key, whose route has just
+// appeared. The caller holds the mutex.
+func (self *Router) release(key string) []ipv4.Frame {
+	waiting, ok := self.held[key]
+	if !ok {
+		return nil
+	}
+	delete(self.held, key)
+	if time.Now().After(waiting.until) {
+		return nil
+	}
+	if len(waiting.frames) > 0 {
+		log.Debugf("delivering %d held frames to %s", len(waiting.frames), key)
+	}
+	return waiting.frames
+}
+
+func flush(sink Sink, frames []ipv4.Frame) {
+	for _, frame := range frames {
+		sink.Send(frame)
+	}
+}
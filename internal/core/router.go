@@ -1,17 +1,19 @@
 // Package core holds the transport-agnostic heart of a shadowgate server: the
 // tun device and the routing table that maps a tunnel address to the transport
-// peer that owns it. Transports (TCP, UDP) plug into a Router by registering a
-// Sink per peer and calling Inbound for frames they receive; the Router moves
-// frames between the tun device and those sinks.
+// peer that owns it. Transports (TCP, UDP) plug into a Router by handing it
+// the frames they receive with the Sink of the peer that sent them (see
+// Receive); the Router moves frames between the tun device and those sinks.
 package core
 
 import (
 	"net"
 	"sync"
+	"time"
 
 	"github.com/op/go-logging"
 
 	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/flow"
 	"github.com/ziyan/shadowgate/internal/ipv4"
 	"github.com/ziyan/shadowgate/internal/tun"
 )
@@ -34,6 +36,13 @@ type Sink interface {
 	Send(frame ipv4.Frame)
 }
 
+// PrefixRoutes resolves a destination that no registered route covers to the
+// sink of a peer router that advertises a prefix containing it (see
+// internal/mesh).
+type PrefixRoutes interface {
+	Lookup(destination net.IP) (Sink, bool)
+}
+
 // Router owns the tun device and the routing table shared by all transports.
 type Router struct {
 	ip      net.IP
@@ -48,11 +57,27 @@ type Router struct {
 	// routing table would forward it through.
 	resolver *nextHopResolver
 
+	// prefixes reaches the subnets of peer routers; nil outside a mesh.
+	prefixes PrefixRoutes
+
 	mutex  sync.Mutex
 	routes map[string]Sink
 	// sinkKeys is the reverse index (sink -> its route keys), used to bound and
 	// unregister a sink's routes without scanning the whole table.
 	sinkKeys map[Sink]map[string]struct{}
+	// fallback reaches the other server of an active/standby pair, for
+	// in-subnet addresses with no route here; nil otherwise.
+	fallback Sink
+	// held keeps frames for expected addresses until their route appears (see
+	// Expect).
+	held map[string]*heldFrames
+	// bonds are the clients that send over several links at once (see
+	// Receive), by tunnel address and by each link's sink.
+	bonds   map[string]*bond
+	members map[Sink]*bond
+	// flows pins the replies of each flow clients send to the sink the flow
+	// came in over (see Receive); nil unless PinFlows was called.
+	flows *flow.Table[Sink]
 
 	toTun chan ipv4.Frame
 	done  chan struct{}
@@ -72,6 +97,9 @@ func NewRouter(device tun.TUN, ip net.IP, network *net.IPNet, gateway net.IP) *R
 		resolver: newNextHopResolver(netlinkNextHop),
 		routes:   make(map[string]Sink),
 		sinkKeys: make(map[Sink]map[string]struct{}),
+		held:     make(map[string]*heldFrames),
+		bonds:    make(map[string]*bond),
+		members:  make(map[Sink]*bond),
 		toTun:    make(chan ipv4.Frame, 1024),
 		done:     make(chan struct{}),
 	}
@@ -92,6 +120,30 @@ func (self *Router) Network() *net.IPNet {
 	return self.network
 }
 
+// SetPrefixRoutes makes the router forward frames for destinations outside its
+// subnet and its routes through prefixes. It must be called before Start.
+func (self *Router) SetPrefixRoutes(prefixes PrefixRoutes) {
+	self.prefixes = prefixes
+}
+
+// PinFlows makes the router send the replies to each flow clients send back
+// over the sink the flow came in on, until the flow has been idle for idle
+// (see Receive). It must be called before Start.
+func (self *Router) PinFlows(idle time.Duration) {
+	self.flows = flow.NewTable[Sink](idle, maxRoutes)
+}
+
+// Addresses lists the tunnel addresses that have a route.
+func (self *Router) Addresses() []net.IP {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	addresses := make([]net.IP, 0, len(self.routes))
+	for key := range self.routes {
+		addresses = append(addresses, net.ParseIP(key))
+	}
+	return addresses
+}
+
 // Start launches the tun read and write loops.
 func (self *Router) Start() {
 	self.group.Add(2)
@@ -121,23 +173,28 @@ func (self *Router) Stop() {
 // addresses, the number of routes is bounded per sink and overall so one client
 // cannot exhaust memory; excess routes are dropped.
 func (self *Router) Register(ip net.IP, sink Sink) {
+	flush(sink, self.register(ip, sink))
+}
+
+func (self *Router) register(ip net.IP, sink Sink) []ipv4.Frame {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
 
 	key := ip.String()
 	existing, present := self.routes[key]
 	if present && existing == sink {
-		return
+		return nil
 	}
 	if !self.hasCapacity(sink, present) {
 		log.Debugf("route table full; dropping route for %s", key)
-		return
+		return nil
 	}
 	if present {
 		self.detach(existing, key)
 	}
 	self.attach(sink, key)
 	log.Debugf("route registered: %s", key)
+	return self.release(key)
 }
 
 // EnsureRoute associates a tunnel address with a sink only if no route exists
@@ -145,18 +202,23 @@ func (self *Router) Register(ip net.IP, sink Sink) {
 // whichever transport is still alive) without a keepalive on one transport
 // stealing the return path from the transport actually carrying data.
 func (self *Router) EnsureRoute(ip net.IP, sink Sink) {
+	flush(sink, self.ensureRoute(ip, sink))
+}
+
+func (self *Router) ensureRoute(ip net.IP, sink Sink) []ipv4.Frame {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
 
 	key := ip.String()
 	if _, ok := self.routes[key]; ok {
-		return
+		return nil
 	}
 	if !self.hasCapacity(sink, false) {
-		return
+		return nil
 	}
 	self.attach(sink, key)
 	log.Debugf("route registered: %s", key)
+	return self.release(key)
 }
 
 // hasCapacity reports whether a route may be added for sink. movingKey is true
@@ -196,52 +258,138 @@ func (self *Router) detach(sink Sink, key string) {
 // router while holding the lock.
 func (self *Router) Unregister(sink Sink) {
 	self.mutex.Lock()
-	defer self.mutex.Unlock()
 	for key := range self.sinkKeys[sink] {
 		delete(self.routes, key)
 	}
 	delete(self.sinkKeys, sink)
+	abandoned := self.leave(sink)
+	self.mutex.Unlock()
+	if self.flows != nil {
+		self.flows.Remove(sink)
+	}
+
+	if abandoned != nil {
+		abandoned.close()
+	}
 }
 
+// sink returns the sink that reaches ip: the bond of a client sending over
+// several links, or the sink of its route.
 func (self *Router) sink(ip string) (Sink, bool) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
 	existing, ok := self.routes[ip]
+	if bond, bonded := self.members[existing]; ok && bonded {
+		return bond, true
+	}
 	return existing, ok
 }
 
+// route returns the sink toward frame's destination: the sink its flow came
+// in over, while the flow is live, or else the sink of the destination.
+func (self *Router) route(frame ipv4.Frame) (Sink, bool) {
+	if self.flows == nil {
+		return self.sink(frame.Destination().String())
+	}
+	pinned, ok := self.flows.Lookup(flow.KeyOf(frame))
+	if !ok {
+		return self.sink(frame.Destination().String())
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if bond, bonded := self.members[pinned]; bonded {
+		return bond, true
+	}
+	return pinned, true
+}
+
 // Inbound routes a frame received from a transport peer (a client). Frames for
 // the server's own tunnel address, and frames for destinations outside the
 // tunnel subnet, are handed to the local tun so the server host forwards them
 // per its own routing table (server acting as a gateway). Frames for another
-// connected client are relayed to that client; frames for an unconnected
-// in-subnet address are dropped.
+// connected client are relayed to that client, and frames for a peer router's
+// subnet to that router; frames for an unconnected in-subnet address go to the
+// fallback server if there is one, are held if the address is expected, and
+// are dropped otherwise.
 func (self *Router) Inbound(frame ipv4.Frame) {
+	self.inbound(frame, true)
+}
+
+// Relayed routes a frame that the other server of an active/standby pair has
+// forwarded, as Inbound does except that it never returns it to the fallback.
+func (self *Router) Relayed(frame ipv4.Frame) {
+	self.inbound(frame, false)
+}
+
+func (self *Router) inbound(frame ipv4.Frame, fallback bool) {
 	destination := frame.Destination()
 	if self.ip.Equal(destination) {
 		self.deliverLocal(frame)
 		return
 	}
-	if sink, ok := self.sink(destination.String()); ok {
+	if sink, ok := self.route(frame); ok {
 		sink.Send(frame)
 		return
 	}
 	if self.network.Contains(destination) {
-		return // an in-subnet peer that is not connected; drop
+		self.divert(destination, frame, fallback)
+		return
+	}
+	if sink, ok := self.prefixSink(destination); ok {
+		sink.Send(frame)
+		return
 	}
 	self.deliverLocal(frame)
 }
 
+// SetFallback makes the router send frames for in-subnet addresses it has no
+// route for to sink, the other server of an active/standby pair; nil stops it.
+func (self *Router) SetFallback(sink Sink) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.fallback = sink
+}
+
+// divert handles a frame for an in-subnet address with no route: it goes to the
+// fallback server (when allowed), or is held for an expected address. It
+// reports whether the frame was taken.
+func (self *Router) divert(destination net.IP, frame ipv4.Frame, fallback bool) bool {
+	self.mutex.Lock()
+	sink := self.fallback
+	self.mutex.Unlock()
+	if fallback && sink != nil {
+		sink.Send(frame)
+		return true
+	}
+	return self.hold(destination, frame)
+}
+
+// prefixSink returns the peer router toward a destination outside the subnet.
+func (self *Router) prefixSink(destination net.IP) (Sink, bool) {
+	if self.prefixes == nil || self.network.Contains(destination) {
+		return nil, false
+	}
+	return self.prefixes.Lookup(destination)
+}
+
 // forwardToClient routes a frame read from the server's OWN tun toward the
 // connected client that should carry it. It tries, in order: a client that owns
-// the destination directly; the client that is the host's own next hop toward
-// the destination (so a route such as "default via <client> dev <tun>" makes
-// egress through a client work); and the configured --gateway client. A frame
-// with no match is dropped rather than written back to the tun (which would
-// loop).
+// the destination directly; for an in-subnet destination, the fallback server
+// or a hold for an expected client; a peer router advertising the destination;
+// the client that is the host's own next hop toward the destination (so a
+// route such as "default via <client> dev <tun>" makes egress through a client
+// work); and the configured --gateway client. A frame with no match is dropped
+// rather than written back to the tun (which would loop).
 func (self *Router) forwardToClient(frame ipv4.Frame) {
 	destination := frame.Destination()
-	if sink, ok := self.sink(destination.String()); ok {
+	if sink, ok := self.route(frame); ok {
+		sink.Send(frame)
+		return
+	}
+	if self.network.Contains(destination) && self.divert(destination, frame, true) {
+		return
+	}
+	if sink, ok := self.prefixSink(destination); ok {
 		sink.Send(frame)
 		return
 	}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/multipath"
 	"github.com/ziyan/shadowgate/internal/tuntest"
 )
 
@@ -223,3 +224,219 @@ func TestRouterDeliversLocal(t *testing.T) {
 		t.Errorf("tun received %x, want %x", got, toServer)
 	}
 }
+
+type staticPrefixes struct {
+	network *net.IPNet
+	sink    Sink
+}
+
+func (self staticPrefixes) Lookup(destination net.IP) (Sink, bool) {
+	return self.sink, self.network.Contains(destination)
+}
+
+func TestRouterPrefixRoutes(t *testing.T) {
+	device := tuntest.New()
+	serverIP := net.ParseIP("172.18.0.1")
+	_, network, _ := net.ParseCIDR("172.18.0.0/24")
+	_, remote, _ := net.ParseCIDR("172.18.1.0/24")
+	router := NewRouter(device, serverIP, network, nil)
+	peer := &recordingSink{}
+	router.SetPrefixRoutes(staticPrefixes{network: remote, sink: peer})
+	router.Start()
+	defer router.Stop()
+
+	// A client's frame for a peer router's subnet goes to that router, as does
+	// one read from the server's own tun.
+	router.Inbound(ipv4.MakeFrame(net.ParseIP("172.18.0.2"), net.ParseIP("172.18.1.2")))
+	router.forwardToClient(ipv4.MakeFrame(serverIP, net.ParseIP("172.18.1.3")))
+	if peer.received() != 2 {
+		t.Fatalf("peer router received %d, want 2", peer.received())
+	}
+
+	// A destination outside every prefix still leaves through the tun.
+	external := ipv4.MakeFrame(net.ParseIP("172.18.0.2"), net.ParseIP("1.1.1.1"))
+	router.Inbound(external)
+	if got, ok := device.Observe(time.Second); !ok || !bytes.Equal(got, external) {
+		t.Fatalf("external frame not delivered to tun")
+	}
+	if peer.received() != 2 {
+		t.Fatalf("peer router received %d after external frame, want 2", peer.received())
+	}
+}
+
+func TestRouterFallback(t *testing.T) {
+	device := tuntest.New()
+	serverIP := net.ParseIP("172.18.0.1")
+	_, network, _ := net.ParseCIDR("172.18.0.0/24")
+	router := NewRouter(device, serverIP, network, nil)
+	other := &recordingSink{}
+	router.SetFallback(other)
+
+	// An in-subnet address with no route here goes to the other server, unless
+	// the frame came from it.
+	toUnknown := ipv4.MakeFrame(net.ParseIP("172.18.0.2"), net.ParseIP("172.18.0.3"))
+	router.Inbound(toUnknown)
+	router.Relayed(toUnknown)
+	if other.received() != 1 {
+		t.Fatalf("fallback received %d, want 1", other.received())
+	}
+
+	router.SetFallback(nil)
+	router.Inbound(toUnknown)
+	if other.received() != 1 {
+		t.Fatalf("fallback received %d after clearing it, want 1", other.received())
+	}
+}
+
+func TestRouterHoldsFramesForExpectedAddresses(t *testing.T) {
+	device := tuntest.New()
+	serverIP := net.ParseIP("172.18.0.1")
+	expected := net.ParseIP("172.18.0.3")
+	_, network, _ := net.ParseCIDR("172.18.0.0/24")
+	router := NewRouter(device, serverIP, network, nil)
+	router.Expect([]net.IP{expected}, time.Minute)
+
+	for range maxHeldFrames + 10 {
+		router.Inbound(ipv4.MakeFrame(net.ParseIP("172.18.0.2"), expected))
+	}
+	router.Inbound(ipv4.MakeFrame(net.ParseIP("172.18.0.2"), net.ParseIP("172.18.0.4")))
+
+	// The held frames, up to the bound, follow the route as soon as it appears.
+	sink := &recordingSink{}
+	router.EnsureRoute(expected, sink)
+	if sink.received() != maxHeldFrames {
+		t.Fatalf("sink received %d held frames, want %d", sink.received(), maxHeldFrames)
+	}
+	router.Unregister(sink)
+	router.Register(expected, sink)
+	if sink.received() != maxHeldFrames {
+		t.Fatalf("frames were held again after delivery: %d", sink.received())
+	}
+
+	// An expectation lapses.
+	router.Expect([]net.IP{net.ParseIP("172.18.0.5")}, -time.Second)
+	if router.hold(net.ParseIP("172.18.0.5"), ipv4.MakeFrame(serverIP, net.ParseIP("172.18.0.5"))) {
+		t.Fatal("held a frame after the expectation lapsed")
+	}
+}
+
+func TestRouterBonds(t *testing.T) {
+	device := tuntest.New()
+	serverIP := net.ParseIP("172.18.0.1")
+	clientIP := net.ParseIP("172.18.0.2")
+	_, network, _ := net.ParseCIDR("172.18.0.0/24")
+
+	router := NewRouter(device, serverIP, network, nil)
+	router.Start()
+	defer router.Stop()
+
+	first, second := &recordingSink{}, &recordingSink{}
+	toServer := ipv4.MakeFrame(clientIP, serverIP)
+	toClient := ipv4.MakeFrame(serverIP, clientIP)
+	send := func(header multipath.Header, sinks ...Sink) {
+		wrapped, _ := multipath.Wrap(clientIP, serverIP, header, toServer)
+		for _, sink := range sinks {
+			router.Receive(wrapped, sink)
+		}
+	}
+
+	// A redundant client's copies reach the tun once, and frames back go over
+	// both of its links.
+	send(multipath.Header{Session: 1, Sequence: 1, Mode: multipath.Redundant, Weight: 1}, first, second)
+	if got, ok := device.Observe(time.Second); !ok || !bytes.Equal(got, toServer) {
+		t.Fatalf("tun received %x, want %x", got, toServer)
+	}
+	if _, ok := device.Observe(100 * time.Millisecond); ok {
+		t.Fatal("a duplicate reached the tun")
+	}
+	router.Inbound(toClient)
+	if first.received() != 1 || second.received() != 1 {
+		t.Fatalf("redundant: first=%d second=%d, want 1 and 1", first.received(), second.received())
+	}
+
+	// Bonded, frames back alternate between links of equal weight.
+	send(multipath.Header{Session: 1, Sequence: 2, Mode: multipath.Bonded, Weight: 1}, first, second)
+	router.Inbound(toClient)
+	router.Inbound(toClient)
+	if first.received() != 2 || second.received() != 2 {
+		t.Fatalf("bonded: first=%d second=%d, want 2 and 2", first.received(), second.received())
+	}
+
+	// Once its links are gone, so is the bond.
+	router.Unregister(first)
+	router.Unregister(second)
+	router.Inbound(toClient)
+	if first.received() != 2 || second.received() != 2 {
+		t.Fatalf("frame delivered after unregister: first=%d second=%d", first.received(), second.received())
+	}
+}
+
+// segment returns a TCP frame from one port to another.
+func segment(source, destination net.IP, sourcePort, destinationPort uint16) ipv4.Frame {
+	frame := append(ipv4.MakeFrame(source, destination), byte(sourcePort>>8), byte(sourcePort), byte(destinationPort>>8), byte(destinationPort))
+	frame[9] = 6
+	frame.SetTotalLength(uint16(len(frame)))
+	return frame
+}
+
+func TestRouterFollowsRouteWithoutPinning(t *testing.T) {
+	device := tuntest.New()
+	serverIP := net.ParseIP("172.18.0.1")
+	clientIP := net.ParseIP("172.18.0.2")
+	_, network, _ := net.ParseCIDR("172.18.0.0/24")
+
+	router := NewRouter(device, serverIP, network, nil)
+	router.Start()
+	defer router.Stop()
+
+	// Unless flows are pinned, every reply follows the client's route.
+	first, second := &recordingSink{}, &recordingSink{}
+	router.Receive(segment(clientIP, serverIP, 40000, 443), first)
+	router.Receive(segment(clientIP, serverIP, 40001, 443), second)
+	router.Inbound(segment(serverIP, clientIP, 443, 40000))
+	router.Inbound(segment(serverIP, clientIP, 443, 40001))
+	if first.received() != 0 || second.received() != 2 {
+		t.Fatalf("first=%d second=%d, want 0 and 2", first.received(), second.received())
+	}
+}
+
+func TestRouterPinsFlows(t *testing.T) {
+	device := tuntest.New()
+	serverIP := net.ParseIP("172.18.0.1")
+	clientIP := net.ParseIP("172.18.0.2")
+	_, network, _ := net.ParseCIDR("172.18.0.0/24")
+
+	router := NewRouter(device, serverIP, network, nil)
+	router.PinFlows(30 * time.Second)
+	router.Start()
+	defer router.Stop()
+
+	// The client starts a flow over its first link, then switches links and
+	// starts another.
+	first, second := &recordingSink{}, &recordingSink{}
+	router.Receive(segment(clientIP, serverIP, 40000, 443), first)
+	router.Receive(segment(clientIP, serverIP, 40001, 443), second)
+
+	// Each flow's replies go back the way it came; a new flow follows the route.
+	router.Inbound(segment(serverIP, clientIP, 443, 40000))
+	router.Inbound(segment(serverIP, clientIP, 443, 40001))
+	router.Inbound(segment(serverIP, clientIP, 443, 40002))
+	if first.received() != 1 || second.received() != 2 {
+		t.Fatalf("first=%d second=%d, want 1 and 2", first.received(), second.received())
+	}
+
+	// The old flow moves once its frames arrive over the new link, or its link
+	// goes away.
+	router.Receive(segment(clientIP, serverIP, 40000, 443), second)
+	router.Inbound(segment(serverIP, clientIP, 443, 40000))
+	if first.received() != 1 || second.received() != 3 {
+		t.Fatalf("after the flow moved: first=%d second=%d, want 1 and 3", first.received(), second.received())
+	}
+	router.Receive(segment(clientIP, serverIP, 40003, 443), first)
+	router.Unregister(first)
+	router.EnsureRoute(clientIP, second) // a keepalive over the remaining link
+	router.Inbound(segment(serverIP, clientIP, 443, 40003))
+	if first.received() != 1 || second.received() != 4 {
+		t.Fatalf("after the link went away: first=%d second=%d, want 1 and 4", first.received(), second.received())
+	}
+}
@@ -3,15 +3,23 @@ package e2e
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/ziyan/shadowgate/internal/client"
+	"github.com/ziyan/shadowgate/internal/fec"
+	"github.com/ziyan/shadowgate/internal/hop"
 	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/multipath"
+	"github.com/ziyan/shadowgate/internal/relay"
 	"github.com/ziyan/shadowgate/internal/server"
+	"github.com/ziyan/shadowgate/internal/sockopt"
 	"github.com/ziyan/shadowgate/internal/tuntest"
 )
 
@@ -20,6 +28,24 @@ var (
 	clientIP = net.ParseIP("172.18.0.2")
 )
 
+// bridgeEnvironment, when set in the environment of this test binary, makes it
+// act as a connect command: it relays its standard input and output to the TCP
+// address in the variable instead of running the tests.
+const bridgeEnvironment = "SHADOWGATE_E2E_BRIDGE"
+
+func TestMain(m *testing.M) {
+	if address := os.Getenv(bridgeEnvironment); address != "" {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			os.Exit(1)
+		}
+		go func() { _, _ = io.Copy(conn, os.Stdin) }()
+		_, _ = io.Copy(os.Stdout, conn)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
 func mustCIDR(t *testing.T, cidr string) (net.IP, *net.IPNet) {
 	t.Helper()
 	ip, network, err := net.ParseCIDR(cidr)
@@ -50,10 +76,6 @@ func setup(t *testing.T, tcpEnabled, udpEnabled bool) (*tuntest.FakeTUN, *tuntes
 	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
 	password := []byte("shared-secret")
 
-	serverAddress, serverNetwork := mustCIDR(t, "172.18.0.1/24")
-	clientAddress, clientNetwork := mustCIDR(t, "172.18.0.2/24")
-
-	serverTun := tuntest.New()
 	config := server.Config{Password: password, Padding: 128, Timeout: time.Second}
 	if tcpEnabled {
 		config.TCPListen = address
@@ -61,6 +83,18 @@ func setup(t *testing.T, tcpEnabled, udpEnabled bool) (*tuntest.FakeTUN, *tuntes
 	if udpEnabled {
 		config.UDPListen = address
 	}
+	return start(t, config, client.Config{Connect: address, Password: password, Padding: 128, Timeout: time.Second})
+}
+
+// start runs a server and a client with the given configurations, returning
+// their in-memory tun devices. Both are stopped when the test ends.
+func start(t *testing.T, config server.Config, clientConfig client.Config) (*tuntest.FakeTUN, *tuntest.FakeTUN) {
+	t.Helper()
+
+	serverAddress, serverNetwork := mustCIDR(t, "172.18.0.1/24")
+	clientAddress, clientNetwork := mustCIDR(t, "172.18.0.2/24")
+
+	serverTun := tuntest.New()
 	serverRunner, err := server.NewServer(serverTun, serverAddress, serverNetwork, config)
 	if err != nil {
 		t.Fatalf("NewServer: %s", err)
@@ -74,7 +108,7 @@ func setup(t *testing.T, tcpEnabled, udpEnabled bool) (*tuntest.FakeTUN, *tuntes
 	go func() { defer group.Done(); _ = serverRunner.Run(serverSignal) }()
 
 	clientTun := tuntest.New()
-	clientRunner, err := client.NewClient(clientTun, clientAddress, clientNetwork, address, password, false, 128, time.Second)
+	clientRunner, err := client.NewClient(clientTun, clientAddress, clientNetwork, clientConfig)
 	if err != nil {
 		close(serverSignal)
 		group.Wait()
@@ -128,6 +162,292 @@ func TestTCPOnlyServerClientFallsBack(t *testing.T) {
 	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
 }
 
+func TestICMPOnlyServer(t *testing.T) {
+	// The server answers only ICMP echo, as on a network that blocks TCP and UDP;
+	// the client's ICMP fallback link carries traffic both ways.
+	probe, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("raw ICMP sockets unavailable: %s", err)
+	}
+	_ = probe.Close()
+
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	password := []byte("shared-secret")
+	config := server.Config{ICMPListen: "127.0.0.1", Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{Connect: address, Password: password, Padding: 128, ICMP: true, Timeout: time.Second}
+
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
+func TestFakeTCPOnlyServer(t *testing.T) {
+	// The server serves only fake TCP, as on a network that drops UDP and where
+	// the real TCP link is not offered; the client's fake TCP link carries traffic.
+	probe, err := net.ListenPacket("ip4:tcp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("raw TCP sockets unavailable: %s", err)
+	}
+	_ = probe.Close()
+
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	fakePort := freePort(t)
+	password := []byte("shared-secret")
+	config := server.Config{FakeTCPListen: fmt.Sprintf("127.0.0.1:%d", fakePort), Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{Connect: address, Password: password, Padding: 128, FakeTCPPort: fakePort, Timeout: time.Second}
+
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
+func TestHTTPOnlyServer(t *testing.T) {
+	// The server offers only HTTP polling, as behind a proxy that passes nothing
+	// but web requests; the client's HTTP fallback link carries traffic both ways.
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	httpAddress := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	password := []byte("shared-secret")
+	config := server.Config{HTTPListen: httpAddress, Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{Connect: address, Password: password, Padding: 128, HTTPURL: "http://" + httpAddress + "/", Timeout: time.Second}
+
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
+func TestConnectCommandToStdioServer(t *testing.T) {
+	// The client spawns a command (this test binary, relaying to a socket) whose
+	// standard input and output reach a server serving a single stdio peer, as
+	// with `--connect-command "ssh host shadowgate server --stdio"`.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer func() { _ = listener.Close() }()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %s", err)
+	}
+	password := []byte("shared-secret")
+	clientConfig := client.Config{
+		Password:       password,
+		Timeout:        time.Second,
+		ConnectCommand: fmt.Sprintf("%s=%s exec '%s'", bridgeEnvironment, listener.Addr(), executable),
+	}
+
+	// The server only exists once the command has connected, so start it with a
+	// stream that waits for the connection.
+	config := server.Config{Stdio: &acceptedStream{accepted: accepted, closed: make(chan struct{})}, Password: password, Timeout: time.Second}
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
+// acceptedStream is a stream over the first connection delivered on accepted,
+// waiting for it on first use.
+type acceptedStream struct {
+	accepted  chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	once      sync.Once
+	conn      net.Conn
+}
+
+// get returns the connection, or nil once the stream is closed without one.
+func (self *acceptedStream) get() net.Conn {
+	self.once.Do(func() {
+		select {
+		case self.conn = <-self.accepted:
+		case <-self.closed:
+		}
+	})
+	return self.conn
+}
+
+func (self *acceptedStream) Read(buffer []byte) (int, error) {
+	if conn := self.get(); conn != nil {
+		return conn.Read(buffer)
+	}
+	return 0, io.EOF
+}
+
+func (self *acceptedStream) Write(buffer []byte) (int, error) {
+	if conn := self.get(); conn != nil {
+		return conn.Write(buffer)
+	}
+	return 0, io.ErrClosedPipe
+}
+
+func (self *acceptedStream) Close() error {
+	self.closeOnce.Do(func() { close(self.closed) })
+	if conn := self.get(); conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func TestExplicitLinks(t *testing.T) {
+	// The preferred link points at a port nobody serves, so the client falls
+	// back to the lower-priority links, which reach the server by name and race
+	// its addresses (localhost may also resolve to ::1, which is not served).
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	_, port, _ := net.SplitHostPort(address)
+	password := []byte("shared-secret")
+	config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{
+		Links: []client.LinkConfig{
+			{Type: client.LinkUDP, Connect: fmt.Sprintf("127.0.0.1:%d", freePort(t)), Padding: 128},
+			{Type: client.LinkUDP, Connect: net.JoinHostPort("localhost", port), Padding: 128, Priority: 1},
+			{Type: client.LinkTCP, Connect: net.JoinHostPort("localhost", port), Priority: 1, Weight: 2},
+		},
+		Password: password,
+		Timeout:  time.Second,
+	}
+
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
+func TestBoundLinks(t *testing.T) {
+	// A metered UDP link sent from a fixed source and an unmetered TCP link
+	// bound to the loopback device, as on a host with LTE and wired uplinks.
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	raw, _ := probe.(*net.UDPConn).SyscallConn()
+	var bindErr error
+	_ = raw.Control(func(fd uintptr) {
+		bindErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, "lo")
+	})
+	_ = probe.Close()
+	if bindErr != nil {
+		t.Skipf("SO_BINDTODEVICE unavailable: %s", bindErr)
+	}
+
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	password := []byte("shared-secret")
+	config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{
+		Links: []client.LinkConfig{
+			{Type: client.LinkUDP, Connect: address, Padding: 128, Metered: true, Source: net.ParseIP("127.0.0.1")},
+			{Type: client.LinkTCP, Connect: address, Socket: sockopt.Options{Device: "lo"}},
+		},
+		Password: password,
+		Timeout:  time.Second,
+	}
+
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
+func TestUDPPortHopping(t *testing.T) {
+	// The client's UDP link hops across four server ports every 100ms; traffic
+	// keeps flowing both ways across many hops, on the same peer and route.
+	base := freePort(t)
+	ports := hop.Range{First: base, Last: base + 3}
+	address := fmt.Sprintf("127.0.0.1:%d", base)
+	password := []byte("shared-secret")
+	config := server.Config{UDPListen: address, UDPHopPorts: ports, Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{
+		Links:    []client.LinkConfig{{Type: client.LinkUDP, Connect: address, Padding: 128, HopPorts: ports, HopInterval: 100 * time.Millisecond}},
+		Password: password,
+		Timeout:  time.Second,
+	}
+	for port := ports.First; port <= ports.Last; port++ {
+		probe, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Skipf("hopping ports unavailable: %s", err)
+		}
+		_ = probe.Close()
+	}
+
+	serverTun, clientTun := start(t, config, clientConfig)
+	for range 5 {
+		deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+		deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+		time.Sleep(150 * time.Millisecond)
+	}
+}
+
+func TestThroughRelay(t *testing.T) {
+	// The client reaches the server only through a relay that holds no
+	// password; both links are forwarded as they are.
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	runner, err := relay.NewRelay(relay.Config{Listen: fmt.Sprintf("127.0.0.1:%d", freePort(t)), Upstream: address, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewRelay: %s", err)
+	}
+	signaling := make(chan os.Signal, 1)
+	finished := make(chan struct{})
+	go func() { defer close(finished); _ = runner.Run(signaling) }()
+	defer func() { close(signaling); <-finished }()
+
+	password := []byte("shared-secret")
+	config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+	for _, kind := range []string{client.LinkUDP, client.LinkTCP} {
+		t.Run(kind, func(t *testing.T) {
+			clientConfig := client.Config{
+				Links:    []client.LinkConfig{{Type: kind, Connect: runner.TCPAddr().String(), Padding: 128}},
+				Password: password,
+				Timeout:  time.Second,
+			}
+			serverTun, clientTun := start(t, config, clientConfig)
+			deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+			deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+		})
+	}
+}
+
+func TestTCPBehindProxyProtocolBalancer(t *testing.T) {
+	// A load balancer on loopback prefixes each connection with a PROXY protocol
+	// header; the server trusts loopback, so it reads the header before the
+	// encrypted stream instead of mistaking it for tunnel traffic.
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	balancer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer func() { _ = balancer.Close() }()
+	go func() {
+		for {
+			conn, err := balancer.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				upstream, err := net.Dial("tcp", address)
+				if err != nil {
+					return
+				}
+				defer func() { _ = upstream.Close() }()
+				_, _ = fmt.Fprintf(upstream, "PROXY TCP4 192.0.2.1 %s 56324 %d\r\n", serverIP, balancer.Addr().(*net.TCPAddr).Port)
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	_, loopback := mustCIDR(t, "127.0.0.0/8")
+	password := []byte("shared-secret")
+	config := server.Config{TCPListen: address, ProxyProtocolFrom: []*net.IPNet{loopback}, Password: password, Timeout: time.Second}
+	clientConfig := client.Config{Connect: balancer.Addr().String(), Password: password, Timeout: time.Second}
+
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
 func TestClientReconnectsAfterServerRestart(t *testing.T) {
 	password := []byte("shared-secret")
 	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
@@ -152,7 +472,8 @@ func TestClientReconnectsAfterServerRestart(t *testing.T) {
 	firstSignal, firstGroup := startServer(firstTun)
 
 	clientTun := tuntest.New()
-	clientRunner, err := client.NewClient(clientTun, clientAddress, clientNetwork, address, password, false, 128, time.Second)
+	clientConfig := client.Config{Connect: address, Password: password, Padding: 128, Timeout: time.Second}
+	clientRunner, err := client.NewClient(clientTun, clientAddress, clientNetwork, clientConfig)
 	if err != nil {
 		t.Fatalf("NewClient: %s", err)
 	}
@@ -191,3 +512,617 @@ func TestRouteThroughClient(t *testing.T) {
 	// and the client must accept it (not drop the foreign destination).
 	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, behindClient))
 }
+
+func TestPeerToPeer(t *testing.T) {
+	// Two clients find a direct path through the server's introduction, which
+	// keeps carrying their frames once the server is gone.
+	password := []byte("shared-secret")
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	serverAddress, serverNetwork := mustCIDR(t, "172.18.0.1/24")
+	config := server.Config{UDPListen: address, Rendezvous: true, Password: password, Padding: 128, Timeout: time.Second}
+	runner, err := server.NewServer(tuntest.New(), serverAddress, serverNetwork, config)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	serverSignal := make(chan os.Signal, 1)
+	var serverGroup sync.WaitGroup
+	serverGroup.Add(1)
+	go func() { defer serverGroup.Done(); _ = runner.Run(serverSignal) }()
+	stopServer := sync.OnceFunc(func() { close(serverSignal); serverGroup.Wait() })
+	t.Cleanup(stopServer)
+
+	peerIP := net.ParseIP("172.18.0.3")
+	devices := make(map[string]*tuntest.FakeTUN)
+	for _, cidr := range []string{"172.18.0.2/24", "172.18.0.3/24"} {
+		ip, network := mustCIDR(t, cidr)
+		device := tuntest.New()
+		clientConfig := client.Config{Connect: address, Password: password, Padding: 128, PeerToPeer: true, Timeout: time.Second}
+		runner, err := client.NewClient(device, ip, network, clientConfig)
+		if err != nil {
+			t.Fatalf("NewClient: %s", err)
+		}
+		signal := make(chan os.Signal, 1)
+		var group sync.WaitGroup
+		group.Add(1)
+		go func() { defer group.Done(); _ = runner.Run(signal) }()
+		t.Cleanup(func() { close(signal); group.Wait() })
+		devices[ip.String()] = device
+	}
+	first, second := devices[clientIP.String()], devices[peerIP.String()]
+
+	deliver(t, first, second, ipv4.MakeFrame(clientIP, peerIP))
+	deliver(t, second, first, ipv4.MakeFrame(peerIP, clientIP))
+
+	// The first frames may have gone through the server while the path was
+	// punched; give the probes a moment before taking the server away.
+	time.Sleep(500 * time.Millisecond)
+	stopServer()
+
+	deliver(t, first, second, ipv4.MakeFrame(clientIP, peerIP))
+	deliver(t, second, first, ipv4.MakeFrame(peerIP, clientIP))
+}
+
+func TestServerMesh(t *testing.T) {
+	// Two servers with their own subnets federate; a client of each reaches the
+	// client of the other through both.
+	password := []byte("shared-secret")
+	first := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	second := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	_, loopback := mustCIDR(t, "127.0.0.0/8")
+
+	run := func(runner interface{ Run(chan os.Signal) error }) {
+		signal := make(chan os.Signal, 1)
+		var group sync.WaitGroup
+		group.Add(1)
+		go func() { defer group.Done(); _ = runner.Run(signal) }()
+		t.Cleanup(func() { close(signal); group.Wait() })
+	}
+	for _, current := range []struct {
+		cidr   string
+		config server.Config
+	}{
+		{"172.18.0.1/24", server.Config{TCPListen: first, MeshPeers: []string{second}}},
+		{"172.18.1.1/24", server.Config{TCPListen: second, MeshFrom: []*net.IPNet{loopback}}},
+	} {
+		ip, network := mustCIDR(t, current.cidr)
+		current.config.Password, current.config.Timeout = password, time.Second
+		runner, err := server.NewServer(tuntest.New(), ip, network, current.config)
+		if err != nil {
+			t.Fatalf("NewServer: %s", err)
+		}
+		run(runner)
+	}
+
+	remoteIP := net.ParseIP("172.18.1.2")
+	devices := make(map[string]*tuntest.FakeTUN)
+	for cidr, connect := range map[string]string{"172.18.0.2/16": first, "172.18.1.2/16": second} {
+		ip, network := mustCIDR(t, cidr)
+		device := tuntest.New()
+		runner, err := client.NewClient(device, ip, network, client.Config{Connect: connect, Password: password, Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("NewClient: %s", err)
+		}
+		run(runner)
+		devices[ip.String()] = device
+	}
+	local, remote := devices[clientIP.String()], devices[remoteIP.String()]
+
+	// The remote client's route is learned from its first frame, so send from
+	// it first.
+	deliver(t, remote, local, ipv4.MakeFrame(remoteIP, clientIP))
+	deliver(t, local, remote, ipv4.MakeFrame(clientIP, remoteIP))
+}
+
+func TestActiveStandbyPair(t *testing.T) {
+	// A primary and its standby share the tunnel address. A client of each
+	// reaches the other through the pair, and the primary's clients fail over
+	// to the standby when it dies.
+	password := []byte("shared-secret")
+	primary := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	standby := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	_, loopback := mustCIDR(t, "127.0.0.0/8")
+	serverAddress, serverNetwork := mustCIDR(t, "172.18.0.1/24")
+
+	run := func(runner interface{ Run(chan os.Signal) error }) func() {
+		signal := make(chan os.Signal, 1)
+		var group sync.WaitGroup
+		group.Add(1)
+		go func() { defer group.Done(); _ = runner.Run(signal) }()
+		stop := sync.OnceFunc(func() { close(signal); group.Wait() })
+		t.Cleanup(stop)
+		return stop
+	}
+	var stopPrimary func()
+	var serverTuns []*tuntest.FakeTUN
+	for _, config := range []server.Config{
+		{TCPListen: primary, UDPListen: primary, StandbyFrom: []*net.IPNet{loopback}},
+		{TCPListen: standby, UDPListen: standby, StandbyOf: primary},
+	} {
+		config.Password, config.Timeout = password, time.Second
+		device := tuntest.New()
+		runner, err := server.NewServer(device, serverAddress, serverNetwork, config)
+		if err != nil {
+			t.Fatalf("NewServer: %s", err)
+		}
+		serverTuns = append(serverTuns, device)
+		stop := run(runner)
+		if stopPrimary == nil {
+			stopPrimary = stop
+		}
+	}
+
+	peerIP, standbyIP := net.ParseIP("172.18.0.3"), net.ParseIP("172.18.0.4")
+	devices := make(map[string]*tuntest.FakeTUN)
+	for _, current := range []struct {
+		cidr   string
+		config client.Config
+	}{
+		{"172.18.0.2/24", client.Config{Connect: primary, Failover: standby}},
+		{"172.18.0.3/24", client.Config{Connect: primary, Failover: standby}},
+		{"172.18.0.4/24", client.Config{Connect: standby}},
+	} {
+		ip, network := mustCIDR(t, current.cidr)
+		device := tuntest.New()
+		current.config.Password, current.config.Timeout = password, time.Second
+		runner, err := client.NewClient(device, ip, network, current.config)
+		if err != nil {
+			t.Fatalf("NewClient: %s", err)
+		}
+		run(runner)
+		devices[ip.String()] = device
+	}
+	first, second, third := devices[clientIP.String()], devices[peerIP.String()], devices[standbyIP.String()]
+
+	deliver(t, first, second, ipv4.MakeFrame(clientIP, peerIP))
+	deliver(t, first, third, ipv4.MakeFrame(clientIP, standbyIP))
+	deliver(t, third, first, ipv4.MakeFrame(standbyIP, clientIP))
+	// Each server's own host reaches the other's clients, though it sends
+	// from the address the pair shares.
+	deliver(t, serverTuns[0], third, ipv4.MakeFrame(serverIP, standbyIP))
+	deliver(t, serverTuns[1], first, ipv4.MakeFrame(serverIP, clientIP))
+
+	stopPrimary()
+	deliver(t, first, second, ipv4.MakeFrame(clientIP, peerIP))
+	deliver(t, second, first, ipv4.MakeFrame(peerIP, clientIP))
+	deliver(t, third, second, ipv4.MakeFrame(standbyIP, peerIP))
+}
+
+func TestInvertedRoles(t *testing.T) {
+	// The client only listens and the server dials it: over TCP, or over UDP
+	// once the server's knock reveals its address.
+	password := []byte("shared-secret")
+	for _, kind := range []string{client.LinkUDP, client.LinkTCP} {
+		t.Run(kind, func(t *testing.T) {
+			listen := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			config := server.Config{UDPListen: address, DialClients: []string{listen}, Password: password, Padding: 128, Timeout: time.Second}
+			clientConfig := client.Config{
+				Links:    []client.LinkConfig{{Type: kind, Connect: listen, Padding: 128, Listen: true}},
+				Password: password,
+				Timeout:  time.Second,
+			}
+			serverTun, clientTun := start(t, config, clientConfig)
+			deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+			deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+		})
+	}
+}
+
+func TestMultipathModes(t *testing.T) {
+	// Frames are copied over, or striped across, the UDP and TCP links, and
+	// arrive once and in order at either end.
+	password := []byte("shared-secret")
+	for _, mode := range []multipath.Mode{multipath.Redundant, multipath.Bonded} {
+		t.Run(mode.String(), func(t *testing.T) {
+			address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+			clientConfig := client.Config{Connect: address, Password: password, Padding: 128, Multipath: mode, Timeout: time.Second}
+			serverTun, clientTun := start(t, config, clientConfig)
+			deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+			deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+
+			// Once both links answer, a frame still arrives exactly once.
+			time.Sleep(2 * time.Second)
+			for {
+				if _, ok := serverTun.Observe(100 * time.Millisecond); !ok {
+					break // drained the retries of deliver
+				}
+			}
+			frame := ipv4.MakeFrame(clientIP, serverIP)
+			clientTun.Inject(frame)
+			if got, ok := serverTun.Observe(2 * time.Second); !ok || !bytes.Equal(got, frame) {
+				t.Fatalf("server received %x, want %x", got, frame)
+			}
+			if got, ok := serverTun.Observe(300 * time.Millisecond); ok {
+				t.Fatalf("server received a second frame %x", got)
+			}
+		})
+	}
+}
+
+func TestForwardErrorCorrection(t *testing.T) {
+	// The UDP link sends in groups with parity shards, and the server answers
+	// in kind, whether the link dials or listens.
+	password := []byte("shared-secret")
+	ratio := fec.Ratio{Data: 4, Parity: 2, Adaptive: true}
+	for _, listen := range []bool{false, true} {
+		t.Run(fmt.Sprintf("listen=%t", listen), func(t *testing.T) {
+			address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			config := server.Config{UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+			link := client.LinkConfig{Type: client.LinkUDP, Connect: address, Padding: 128, FEC: ratio}
+			if listen {
+				link.Connect, link.Listen = fmt.Sprintf("127.0.0.1:%d", freePort(t)), true
+				config.DialClients = []string{link.Connect}
+			}
+			clientConfig := client.Config{Links: []client.LinkConfig{link}, Password: password, Timeout: time.Second}
+			serverTun, clientTun := start(t, config, clientConfig)
+			for range 6 {
+				deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+				deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+			}
+		})
+	}
+}
+
+func TestPinnedFlows(t *testing.T) {
+	// With flows pinned to their links at both ends, a flow's segments and
+	// its replies still get through.
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	password := []byte("shared-secret")
+	config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, FlowIdle: 30 * time.Second, Timeout: time.Second}
+	clientConfig := client.Config{Connect: address, Password: password, Padding: 128, FlowIdle: 30 * time.Second, Timeout: time.Second}
+	serverTun, clientTun := start(t, config, clientConfig)
+	request := append(ipv4.MakeFrame(clientIP, serverIP), 0x9c, 0x40, 0x01, 0xbb)
+	request[9] = 6 // TCP
+	request.SetTotalLength(uint16(len(request)))
+	reply := append(ipv4.MakeFrame(serverIP, clientIP), 0x01, 0xbb, 0x9c, 0x40)
+	reply[9] = 6
+	reply.SetTotalLength(uint16(len(reply)))
+	for range 3 {
+		deliver(t, clientTun, serverTun, request)
+		deliver(t, serverTun, clientTun, reply)
+	}
+}
+
+func TestLinkPolicies(t *testing.T) {
+	// Whichever policy chooses between the UDP and TCP links, and when it is
+	// switched at runtime, traffic gets through.
+	password := []byte("shared-secret")
+	for _, spec := range []string{"lowest-latency", "prefer:tcp", "loss-aware", "jitter-aware", "throughput-aware"} {
+		t.Run(spec, func(t *testing.T) {
+			policy, err := client.ParsePolicy(spec, client.PolicyThresholds{})
+			if err != nil {
+				t.Fatalf("ParsePolicy: %s", err)
+			}
+			address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+			clientConfig := client.Config{Connect: address, Password: password, Padding: 128, Policy: policy, Timeout: time.Second}
+			serverTun, clientTun := start(t, config, clientConfig)
+			deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+			deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+		})
+	}
+	if _, err := client.ParsePolicy("fastest", client.PolicyThresholds{}); err == nil {
+		t.Error("ParsePolicy accepted an unknown policy")
+	}
+}
+
+func TestTrafficRules(t *testing.T) {
+	// The active link reaches one server and the TCP link a rule prefers for
+	// UDP frames marked EF reaches another, so where a frame arrives shows the
+	// link it took.
+	password := []byte("shared-secret")
+	main := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	voice := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	voiceAddress, voiceNetwork := mustCIDR(t, "172.18.0.1/24")
+	voiceTun := tuntest.New()
+	runner, err := server.NewServer(voiceTun, voiceAddress, voiceNetwork, server.Config{TCPListen: voice, Password: password, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	signal := make(chan os.Signal, 1)
+	var group sync.WaitGroup
+	group.Add(1)
+	go func() { defer group.Done(); _ = runner.Run(signal) }()
+	t.Cleanup(func() { close(signal); group.Wait() })
+
+	rule, err := client.ParseRule("protocol=udp,dscp=ef,via=voice/main")
+	if err != nil {
+		t.Fatalf("ParseRule: %s", err)
+	}
+	config := server.Config{UDPListen: main, Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{
+		Links: []client.LinkConfig{
+			{Name: "main", Type: client.LinkUDP, Connect: main, Padding: 128},
+			{Name: "voice", Type: client.LinkTCP, Connect: voice, Priority: 1},
+		},
+		Rules:    []client.Rule{rule},
+		Password: password,
+		Timeout:  time.Second,
+	}
+	mainTun, clientTun := start(t, config, clientConfig)
+
+	datagram := func(dscp byte) ipv4.Frame {
+		frame := append(ipv4.MakeFrame(clientIP, serverIP), 0x13, 0xc4, 0x13, 0xc4, 0, 8, 0, 0)
+		frame[1] = dscp << 2
+		frame[9] = 17
+		frame.SetTotalLength(uint16(len(frame)))
+		return frame
+	}
+	plain, marked := datagram(0), datagram(46)
+	deliver(t, clientTun, mainTun, plain)
+	deliver(t, clientTun, voiceTun, marked)
+
+	// Until the voice link was up, marked frames fell back to the active link;
+	// now they take the voice link only.
+	for {
+		if _, ok := mainTun.Observe(300 * time.Millisecond); !ok {
+			break
+		}
+	}
+	clientTun.Inject(marked)
+	if got, ok := voiceTun.Observe(2 * time.Second); !ok || !bytes.Equal(got, marked) {
+		t.Error("the marked frame did not take the voice link")
+	}
+	if got, ok := mainTun.Observe(300 * time.Millisecond); ok && bytes.Equal(got, marked) {
+		t.Error("the marked frame took the active link")
+	}
+
+	if _, err := client.ParseRule("protocol=udp"); err == nil {
+		t.Error("ParseRule accepted a rule without links")
+	}
+}
+
+// narrowPath forwards UDP datagrams between one client and upstream, dropping
+// those longer than mtu bytes as a path with a small MTU and the Don't
+// Fragment bit set would, and returns the address to send to.
+func narrowPath(t *testing.T, upstream string, mtu int) string {
+	t.Helper()
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	server, err := net.ResolveUDPAddr("udp", upstream)
+	if err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+	back, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { _ = front.Close(); _ = back.Close() })
+
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			size, address, err := front.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			client.Store(address)
+			if size <= mtu {
+				_, _ = back.Write(buffer[:size])
+			}
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			size, err := back.Read(buffer)
+			if err != nil {
+				return
+			}
+			if address := client.Load(); address != nil && size <= mtu {
+				_, _ = front.WriteToUDP(buffer[:size], address)
+			}
+		}
+	}()
+	return front.LocalAddr().String()
+}
+
+func TestPathMtuFragmentation(t *testing.T) {
+	// Over a path carrying datagrams of at most 1300 bytes, full-size frames
+	// get through both ways, split and put back together, with or without
+	// error correction.
+	for _, ratio := range []fec.Ratio{{}, {Data: 4, Parity: 2}} {
+		t.Run(ratio.String(), func(t *testing.T) {
+			address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			password := []byte("shared-secret")
+			config := server.Config{UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+			clientConfig := client.Config{
+				Links:    []client.LinkConfig{{Type: client.LinkUDP, Connect: narrowPath(t, address, 1300), Padding: 128, FEC: ratio}},
+				Password: password,
+				Timeout:  time.Second,
+			}
+			serverTun, clientTun := start(t, config, clientConfig)
+
+			full := func(source, destination net.IP) ipv4.Frame {
+				frame := append(ipv4.MakeFrame(source, destination), bytes.Repeat([]byte{0xa5}, 1480)...)
+				frame.SetTotalLength(uint16(len(frame)))
+				return frame
+			}
+			deliver(t, clientTun, serverTun, full(clientIP, serverIP))
+			deliver(t, serverTun, clientTun, full(serverIP, clientIP))
+		})
+	}
+}
+
+func TestBatching(t *testing.T) {
+	// A burst of frames, packed into shared records or datagrams both ways,
+	// arrives whole and in order, over UDP and over TCP.
+	for _, kind := range []string{client.LinkUDP, client.LinkTCP} {
+		t.Run(kind, func(t *testing.T) {
+			address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			password := []byte("shared-secret")
+			config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Batch: true, BatchDelay: 20 * time.Millisecond, Timeout: time.Second}
+			clientConfig := client.Config{
+				Links:      []client.LinkConfig{{Type: kind, Connect: address, Padding: 128}},
+				Password:   password,
+				Batch:      true,
+				BatchDelay: 20 * time.Millisecond,
+				Timeout:    time.Second,
+			}
+			serverTun, clientTun := start(t, config, clientConfig)
+			deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+			deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+			// The server batches UDP datagrams only once a keepalive reports
+			// the datagram size the path carries.
+			time.Sleep(1500 * time.Millisecond)
+			for {
+				if _, ok := serverTun.Observe(100 * time.Millisecond); !ok {
+					break // drained the retries of deliver
+				}
+			}
+			for {
+				if _, ok := clientTun.Observe(100 * time.Millisecond); !ok {
+					break
+				}
+			}
+
+			burst := func(from, to *tuntest.FakeTUN, source, destination net.IP) {
+				t.Helper()
+				var frames []ipv4.Frame
+				for index := range 20 {
+					frame := append(ipv4.MakeFrame(source, destination), bytes.Repeat([]byte{byte(index)}, 100+index)...)
+					frame.SetTotalLength(uint16(len(frame)))
+					frames = append(frames, frame)
+					from.Inject(frame)
+				}
+				for index, frame := range frames {
+					if got, ok := to.Observe(2 * time.Second); !ok || !bytes.Equal(got, frame) {
+						t.Fatalf("frame %d of the burst: got %x, want %x", index, got, frame)
+					}
+				}
+			}
+			burst(clientTun, serverTun, clientIP, serverIP)
+			burst(serverTun, clientTun, serverIP, clientIP)
+		})
+	}
+}
+
+func TestOnDemand(t *testing.T) {
+	// The links stay down until the client has a frame to send, which waits
+	// for them, and close again once the tunnel has been idle.
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	password := []byte("shared-secret")
+	config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{Connect: address, Password: password, Padding: 128, OnDemand: true, IdleTimeout: 2 * time.Second, Timeout: time.Second}
+	serverTun, clientTun := start(t, config, clientConfig)
+
+	unreachable := func() {
+		t.Helper()
+		for {
+			if _, ok := clientTun.Observe(100 * time.Millisecond); !ok {
+				break // drained the retries of deliver
+			}
+		}
+		serverTun.Inject(ipv4.MakeFrame(serverIP, clientIP))
+		if got, ok := clientTun.Observe(500 * time.Millisecond); ok {
+			t.Fatalf("client received %x with its links down", got)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+	unreachable()
+
+	frame := ipv4.MakeFrame(clientIP, serverIP)
+	clientTun.Inject(frame)
+	if got, ok := serverTun.Observe(3 * time.Second); !ok || !bytes.Equal(got, frame) {
+		t.Fatalf("server received %x, want the first frame %x", got, frame)
+	}
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+
+	time.Sleep(4 * time.Second)
+	unreachable()
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
+func TestWatchNetwork(t *testing.T) {
+	// Watching the host's addresses and routes for changes leaves a client's
+	// links to carry traffic as before.
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	password := []byte("shared-secret")
+	config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{Connect: address, Password: password, Padding: 128, WatchNetwork: true, Timeout: time.Second}
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+	deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+}
+
+func TestSocketOptions(t *testing.T) {
+	// Links and listeners whose sockets carry a user timeout, keepalives,
+	// buffer sizes and a congestion control algorithm still carry traffic
+	// both ways, over UDP and over TCP.
+	socket := sockopt.Options{
+		Congestion:    "reno",
+		UserTimeout:   5 * time.Second,
+		KeepAlive:     net.KeepAliveConfig{Enable: true, Idle: 10 * time.Second},
+		SendBuffer:    256 * 1024,
+		ReceiveBuffer: 256 * 1024,
+	}
+	for _, kind := range []string{client.LinkUDP, client.LinkTCP} {
+		t.Run(kind, func(t *testing.T) {
+			address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			password := []byte("shared-secret")
+			config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Socket: socket, Timeout: time.Second}
+			clientConfig := client.Config{
+				Links:    []client.LinkConfig{{Type: kind, Connect: address, Padding: 128, Socket: socket}},
+				Password: password,
+				Timeout:  time.Second,
+			}
+			serverTun, clientTun := start(t, config, clientConfig)
+			deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+			deliver(t, serverTun, clientTun, ipv4.MakeFrame(serverIP, clientIP))
+		})
+	}
+}
+
+// capacityPolicy records the largest capacity each link reports.
+type capacityPolicy struct {
+	mutex      sync.Mutex
+	capacities map[string]float64
+}
+
+func (self *capacityPolicy) Choose(healthy []client.LinkStats, current int) int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, link := range healthy {
+		self.capacities[link.Name] = max(self.capacities[link.Name], link.Capacity)
+	}
+	return max(current, 0)
+}
+
+func (self *capacityPolicy) WeighsCapacity() {}
+
+func (self *capacityPolicy) measured(names ...string) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, name := range names {
+		if self.capacities[name] <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLinkCapacity(t *testing.T) {
+	// Links measure their capacity whether or not they carry traffic, so that
+	// a policy can weigh it for every healthy link.
+	password := []byte("shared-secret")
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	policy := &capacityPolicy{capacities: make(map[string]float64)}
+	config := server.Config{TCPListen: address, UDPListen: address, Password: password, Padding: 128, Timeout: time.Second}
+	clientConfig := client.Config{Connect: address, Password: password, Padding: 128, Policy: policy, Timeout: time.Second}
+	serverTun, clientTun := start(t, config, clientConfig)
+	deliver(t, clientTun, serverTun, ipv4.MakeFrame(clientIP, serverIP))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !policy.measured("udp", "tcp") {
+		if time.Now().After(deadline) {
+			t.Fatalf("capacities = %v, want both links measured", policy.capacities)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,83 @@
+package faketcp
+
+import (
+	"net"
+	"sync"
+)
+
+// Connection tracks one end of a fake TCP connection: the addresses and ports
+// that identify it and the sequence space on both sides, so every outgoing
+// segment carries numbers a middlebox would expect. It is safe for concurrent
+// use.
+type Connection struct {
+	local      net.IP
+	localPort  uint16
+	remote     net.IP
+	remotePort uint16
+
+	mutex          sync.Mutex
+	sequence       uint32 // next sequence number to send
+	acknowledgment uint32 // next sequence number expected from the peer
+}
+
+// NewConnection starts a connection whose first segment will carry the initial
+// sequence number isn.
+func NewConnection(local net.IP, localPort uint16, remote net.IP, remotePort uint16, isn uint32) *Connection {
+	return &Connection{
+		local:      local,
+		localPort:  localPort,
+		remote:     remote,
+		remotePort: remotePort,
+		sequence:   isn,
+	}
+}
+
+// Segment builds the next outgoing segment with the given flags and payload and
+// advances the send sequence past it. A SYN or FIN consumes one sequence number,
+// as in TCP. Every segment after the handshake carries an ACK.
+func (self *Connection) Segment(flags byte, payload []byte) []byte {
+	self.mutex.Lock()
+	segment := &Segment{
+		SourcePort:      self.localPort,
+		DestinationPort: self.remotePort,
+		Sequence:        self.sequence,
+		Flags:           flags,
+		Payload:         payload,
+	}
+	if flags&FlagAck != 0 {
+		segment.Acknowledgment = self.acknowledgment
+	}
+	self.sequence += uint32(len(payload))
+	if flags&(FlagSyn|FlagFin) != 0 {
+		self.sequence++
+	}
+	self.mutex.Unlock()
+	return segment.Marshal(self.local, self.remote)
+}
+
+// Next returns the sequence number of the next segment to send: the one a peer
+// that has received everything so far acknowledges.
+func (self *Connection) Next() uint32 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.sequence
+}
+
+// Receive records a segment from the peer, advancing the acknowledgment number
+// to cover it. Segments that arrive out of order never move it backwards.
+func (self *Connection) Receive(segment *Segment) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	end := segment.Sequence + uint32(len(segment.Payload))
+	if segment.Flags&(FlagSyn|FlagFin) != 0 {
+		end++
+	}
+	if segment.Flags&FlagSyn != 0 || After(end, self.acknowledgment) {
+		self.acknowledgment = end
+	}
+}
+
+// Matches reports whether a segment from address belongs to this connection.
+func (self *Connection) Matches(address net.IP, segment *Segment) bool {
+	return address.Equal(self.remote) && segment.SourcePort == self.remotePort && segment.DestinationPort == self.localPort
+}
@@ -0,0 +1,370 @@
+package faketcp
+
+import (
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/core"
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+var log = logging.MustGetLogger("faketcp")
+
+const (
+	// peerIdleTimeout is how long a fake TCP peer may go without any received
+	// segment before it is reaped. There is no reliable close event (FINs and
+	// RSTs are not trusted), so idle peers are expired as on the UDP listener.
+	peerIdleTimeout = 60 * time.Second
+
+	// reapInterval is how often idle peers are swept.
+	reapInterval = 15 * time.Second
+
+	// maxHalfOpen bounds the handshakes answered but not yet followed by an
+	// authenticated segment; a SYN beyond it evicts an arbitrary one.
+	maxHalfOpen = 256
+
+	// halfOpenTimeout is how long a handshake may wait for its first
+	// authenticated segment.
+	halfOpenTimeout = 10 * time.Second
+)
+
+// Listener is the server-side fake TCP transport. It reads TCP segments for its
+// port on a raw socket, answers forged handshakes, and feeds the frames carried
+// in data segments into a core.Router; it registers a Sink per peer so the
+// router can route frames back.
+type Listener struct {
+	router *core.Router
+	conn   net.PacketConn
+	codec  *obfuscate.Codec
+	local  net.IP // nil when listening on all addresses
+	port   uint16
+
+	sequence uint64
+
+	mutex    sync.Mutex
+	peers    map[string]*segmentPeer
+	halfOpen map[string]*handshake // answered SYNs, keyed as peers
+
+	done  chan struct{}
+	group sync.WaitGroup
+}
+
+// segmentPeer is one client connection, keyed by its address and port.
+type segmentPeer struct {
+	listener   *Listener
+	address    *net.IPAddr
+	connection *Connection
+
+	replay        obfuscate.ReplayWindow // read loop only
+	lastSeenNanos int64                  // atomic; UnixNano of the last segment
+}
+
+// handshake is a SYN answered with a SYN-ACK. Anyone can forge a SYN, so it
+// becomes a peer, replacing any with the same address and port, only once an
+// authenticated segment acknowledges the SYN-ACK.
+type handshake struct {
+	connection *Connection
+	ack        uint32 // the acknowledgment number that completes it
+	created    time.Time
+}
+
+// NewListener opens a raw TCP socket that serves fake connections to the port of
+// listen (host:port). The port must not also have a real TCP listener, or the
+// kernel would answer the handshakes itself. It needs CAP_NET_RAW.
+func NewListener(router *core.Router, listen string, password []byte, maxPadding int) (*Listener, error) {
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := obfuscate.NewCodec(key, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	host, rawPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var local net.IP
+	if host != "" {
+		address, err := net.ResolveIPAddr("ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		if !address.IP.IsUnspecified() {
+			local = address.IP
+		}
+	}
+	bind := "0.0.0.0"
+	if local != nil {
+		bind = local.String()
+	}
+	conn, err := net.ListenPacket("ip4:tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		router:   router,
+		conn:     conn,
+		codec:    codec,
+		local:    local,
+		port:     uint16(port),
+		peers:    make(map[string]*segmentPeer),
+		halfOpen: make(map[string]*handshake),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Addr reports the local address and port the listener serves.
+func (self *Listener) Addr() net.Addr {
+	address := &net.TCPAddr{IP: self.local, Port: int(self.port)}
+	if address.IP == nil {
+		address.IP = net.IPv4zero
+	}
+	return address
+}
+
+func (self *Listener) Start() {
+	self.group.Add(2)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.readLoop()
+	}()
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.reapLoop()
+	}()
+}
+
+func (self *Listener) Stop() {
+	close(self.done)
+	_ = self.conn.Close()
+	self.group.Wait()
+}
+
+func (self *Listener) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.reap()
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// reap removes peers that have gone silent, unregistering their routes, and
+// handshakes that were never completed.
+func (self *Listener) reap() {
+	now := time.Now()
+	cutoff := now.UnixNano() - int64(peerIdleTimeout)
+
+	var expired []core.Sink
+	self.mutex.Lock()
+	for key, handshake := range self.halfOpen {
+		if now.Sub(handshake.created) >= halfOpenTimeout {
+			delete(self.halfOpen, key)
+		}
+	}
+	for key, peer := range self.peers {
+		if atomic.LoadInt64(&peer.lastSeenNanos) < cutoff {
+			expired = append(expired, peer)
+			delete(self.peers, key)
+			log.Debugf("faketcp peer expired: %s", key)
+		}
+	}
+	self.mutex.Unlock()
+
+	for _, sink := range expired {
+		self.router.Unregister(sink)
+	}
+}
+
+func (self *Listener) readLoop() {
+	buffer := make([]byte, 65536)
+	for {
+		size, address, err := self.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-self.done:
+			default:
+				log.Warningf("failed to read segment: %s", err)
+			}
+			return
+		}
+
+		segment, err := ParseSegment(buffer[:size])
+		if err != nil || segment.DestinationPort != self.port {
+			continue // some other TCP traffic on this host
+		}
+		if segment.Flags&FlagRst != 0 {
+			continue // the client's kernel rejecting our segments; ignore it
+		}
+		source := address.(*net.IPAddr)
+
+		if segment.Flags&FlagSyn != 0 && segment.Flags&FlagAck == 0 {
+			self.accept(source, segment)
+			continue
+		}
+		if len(segment.Payload) == 0 {
+			continue // the handshake's final ACK
+		}
+
+		sequence, streamId, payload, err := self.codec.Open(segment.Payload)
+		if err != nil || streamId != obfuscate.StreamFrame {
+			continue
+		}
+		frame := ipv4.DecodeFrame(payload)
+		if frame == nil {
+			continue
+		}
+		origin := frame.Source()
+		if self.router.IP().Equal(origin) {
+			continue // a client must not claim the server's own address
+		}
+
+		// An authenticated segment completes its handshake, or, from an unknown
+		// peer (say, one that connected before a server restart), is adopted
+		// rather than refused, so the client keeps working without a fresh
+		// handshake.
+		peer, previous, err := self.peer(source, segment)
+		if err != nil {
+			log.Debugf("failed to adopt faketcp peer %s: %s", source, err)
+			continue
+		}
+		if previous != nil {
+			self.router.Unregister(previous)
+		}
+		if !peer.replay.Accept(sequence) {
+			continue
+		}
+		peer.connection.Receive(segment)
+		atomic.StoreInt64(&peer.lastSeenNanos, time.Now().UnixNano())
+
+		if origin.Equal(frame.Destination()) {
+			// keepalive; keep a route available and reply
+			self.router.EnsureRoute(origin, peer)
+			peer.Send(ipv4.MakeFrame(self.router.IP(), self.router.IP()))
+			continue
+		}
+
+		// A data frame: learn a route back to its source via this peer, then
+		// forward it.
+		self.router.Receive(frame.Copy(), peer)
+	}
+}
+
+// accept answers a SYN with a SYN-ACK from a half-open connection for the
+// client's address and port, leaving any established peer there in place
+// until the client completes the handshake (see peer).
+func (self *Listener) accept(address *net.IPAddr, syn *Segment) {
+	connection, err := self.connection(address, syn)
+	if err != nil {
+		log.Debugf("failed to accept faketcp peer %s: %s", address, err)
+		return
+	}
+	connection.Receive(syn)
+	reply := connection.Segment(FlagSyn|FlagAck, nil)
+
+	key := peerKey(address, syn.SourcePort)
+	self.mutex.Lock()
+	if _, ok := self.halfOpen[key]; !ok && len(self.halfOpen) >= maxHalfOpen {
+		for evicted := range self.halfOpen {
+			delete(self.halfOpen, evicted)
+			break
+		}
+	}
+	self.halfOpen[key] = &handshake{connection: connection, ack: connection.Next(), created: time.Now()}
+	self.mutex.Unlock()
+
+	self.writeTo(reply, address)
+	log.Debugf("faketcp handshake from %s:%d", address, syn.SourcePort)
+}
+
+// peer returns the peer for an authenticated data segment, and the peer it
+// replaced, if any. A segment acknowledging a half-open connection's SYN-ACK
+// makes that connection the peer; otherwise the established peer is kept, or
+// the connection adopted if there is none.
+func (self *Listener) peer(address *net.IPAddr, segment *Segment) (*segmentPeer, *segmentPeer, error) {
+	key := peerKey(address, segment.SourcePort)
+	self.mutex.Lock()
+	existing := self.peers[key]
+	handshake := self.halfOpen[key]
+	if handshake != nil && segment.Flags&FlagAck != 0 && segment.Acknowledgment == handshake.ack {
+		delete(self.halfOpen, key)
+		peer := &segmentPeer{listener: self, address: address, connection: handshake.connection}
+		self.peers[key] = peer
+		self.mutex.Unlock()
+		return peer, existing, nil
+	}
+	self.mutex.Unlock()
+	if existing != nil {
+		return existing, nil, nil
+	}
+
+	connection, err := self.connection(address, segment)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer := &segmentPeer{listener: self, address: address, connection: connection}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if existing := self.peers[key]; existing != nil {
+		return existing, nil, nil // adopted meanwhile
+	}
+	self.peers[key] = peer
+	return peer, nil, nil
+}
+
+// connection starts a connection to the client's address and port with a
+// random initial sequence number.
+func (self *Listener) connection(address *net.IPAddr, segment *Segment) (*Connection, error) {
+	local := self.local
+	if local == nil {
+		var err error
+		if local, err = SourceAddress(address.IP); err != nil {
+			return nil, err
+		}
+	}
+	return NewConnection(local, self.port, address.IP, segment.SourcePort, rand.Uint32()), nil
+}
+
+func peerKey(address *net.IPAddr, port uint16) string {
+	return net.JoinHostPort(address.IP.String(), strconv.Itoa(int(port)))
+}
+
+// Send routes a frame toward the peer as one data segment.
+func (self *segmentPeer) Send(frame ipv4.Frame) {
+	listener := self.listener
+	datagram, err := listener.codec.Seal(atomic.AddUint64(&listener.sequence, 1), obfuscate.StreamFrame, frame)
+	if err != nil {
+		log.Warningf("failed to seal frame: %s", err)
+		return
+	}
+	self.write(self.connection.Segment(FlagPsh|FlagAck, datagram))
+}
+
+func (self *segmentPeer) write(segment []byte) {
+	self.listener.writeTo(segment, self.address)
+}
+
+func (self *Listener) writeTo(segment []byte, address *net.IPAddr) {
+	if _, err := self.conn.WriteTo(segment, address); err != nil {
+		log.Warningf("failed to send segment to %s: %s", address, err)
+	}
+}
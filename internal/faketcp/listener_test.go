@@ -0,0 +1,93 @@
+package faketcp
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardConn is a net.PacketConn that counts what is written to it.
+type discardConn struct {
+	net.PacketConn
+	mutex   sync.Mutex
+	written int
+}
+
+func (self *discardConn) WriteTo(data []byte, address net.Addr) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.written++
+	return len(data), nil
+}
+
+func newTestListener() (*Listener, *discardConn) {
+	conn := &discardConn{}
+	return &Listener{
+		conn:     conn,
+		local:    net.ParseIP("192.0.2.1"),
+		port:     443,
+		peers:    make(map[string]*segmentPeer),
+		halfOpen: make(map[string]*handshake),
+		done:     make(chan struct{}),
+	}, conn
+}
+
+func TestListenerSynDoesNotReplacePeer(t *testing.T) {
+	listener, conn := newTestListener()
+	client := &net.IPAddr{IP: net.ParseIP("198.51.100.2")}
+	syn := &Segment{SourcePort: 40000, DestinationPort: 443, Sequence: 1000, Flags: FlagSyn}
+
+	// A client that never completed a handshake is adopted by its first
+	// authenticated segment.
+	data := &Segment{SourcePort: 40000, DestinationPort: 443, Sequence: 1001, Acknowledgment: 1, Flags: FlagPsh | FlagAck, Payload: []byte("x")}
+	established, previous, err := listener.peer(client, data)
+	if err != nil || previous != nil {
+		t.Fatalf("peer = %v, %v", previous, err)
+	}
+
+	// A forged SYN for its address and port is answered, but leaves it alone.
+	listener.accept(client, syn)
+	if conn.written != 1 {
+		t.Errorf("wrote %d segments, want the SYN-ACK", conn.written)
+	}
+	if listener.peers[peerKey(client, 40000)] != established {
+		t.Fatalf("SYN replaced the established peer")
+	}
+	peer, previous, err := listener.peer(client, data)
+	if err != nil || peer != established || previous != nil {
+		t.Errorf("segment not acknowledging the SYN-ACK moved to a new peer")
+	}
+
+	// A segment acknowledging the SYN-ACK completes the handshake, replacing it.
+	data.Acknowledgment = listener.halfOpen[peerKey(client, 40000)].ack
+	peer, previous, err = listener.peer(client, data)
+	if err != nil || peer == established || previous != established {
+		t.Errorf("completed handshake: peer = %p, previous = %p, want a new peer replacing %p", peer, previous, established)
+	}
+	if len(listener.halfOpen) != 0 {
+		t.Errorf("%d half-open connections left", len(listener.halfOpen))
+	}
+}
+
+func TestListenerBoundsHalfOpen(t *testing.T) {
+	listener, _ := newTestListener()
+	client := &net.IPAddr{IP: net.ParseIP("198.51.100.2")}
+	for port := range 2 * maxHalfOpen {
+		listener.accept(client, &Segment{SourcePort: uint16(10000 + port), DestinationPort: 443, Flags: FlagSyn})
+	}
+	if len(listener.halfOpen) != maxHalfOpen {
+		t.Errorf("%d half-open connections, want %d", len(listener.halfOpen), maxHalfOpen)
+	}
+	if len(listener.peers) != 0 {
+		t.Errorf("SYNs created %d peers", len(listener.peers))
+	}
+
+	for _, handshake := range listener.halfOpen {
+		handshake.created = time.Now().Add(-halfOpenTimeout)
+	}
+	listener.reap()
+	if len(listener.halfOpen) != 0 {
+		t.Errorf("%d half-open connections survived the reap", len(listener.halfOpen))
+	}
+}
@@ -0,0 +1,125 @@
+// Package faketcp carries obfuscated datagrams inside TCP-shaped packets sent on
+// raw sockets, for networks that drop or throttle UDP. A client and the server
+// exchange a forged three-way handshake and then stamp every datagram with
+// plausible sequence and acknowledgment numbers, so middleboxes track what looks
+// like an ordinary TCP connection. No kernel TCP stack is involved: there are no
+// retransmissions and no ordering, so delivery stays unordered like UDP and a
+// lost packet never stalls the ones behind it.
+//
+// Because neither kernel has a socket for the connection, each answers the other
+// side's segments with a RST. The transport ignores RSTs, but stateful firewalls
+// on the path may not, so production deployments drop the outgoing RSTs with a
+// firewall rule on both ends (see the README).
+package faketcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+// TCP header flags.
+const (
+	FlagFin = 0x01
+	FlagSyn = 0x02
+	FlagRst = 0x04
+	FlagPsh = 0x08
+	FlagAck = 0x10
+)
+
+const (
+	// headerSize is the size of a TCP header without options.
+	headerSize = 20
+
+	// protocolTcp is the IPv4 protocol number of TCP, used in the pseudo-header.
+	protocolTcp = 6
+
+	// window is the receive window advertised on every segment.
+	window = 0xffff
+
+	// maximumSegmentSize is advertised in the SYN options, as a real stack would.
+	maximumSegmentSize = 1460
+)
+
+// ErrInvalidSegment is returned by ParseSegment for anything that is not a
+// well-formed TCP segment.
+var ErrInvalidSegment = errors.New("faketcp: invalid segment")
+
+// Segment is a TCP segment with the fields the transport uses.
+type Segment struct {
+	SourcePort      uint16
+	DestinationPort uint16
+	Sequence        uint32
+	Acknowledgment  uint32
+	Flags           byte
+	Payload         []byte
+}
+
+// Marshal encodes the segment for a raw socket (the kernel adds the IPv4
+// header), computing the checksum over the pseudo-header for the given source
+// and destination addresses. A SYN carries an MSS option, as real SYNs do.
+func (self *Segment) Marshal(source, destination net.IP) []byte {
+	var options []byte
+	if self.Flags&FlagSyn != 0 {
+		options = []byte{2, 4, byte(maximumSegmentSize >> 8), byte(maximumSegmentSize & 0xff)}
+	}
+	size := headerSize + len(options)
+	segment := make([]byte, size+len(self.Payload))
+	binary.BigEndian.PutUint16(segment[0:], self.SourcePort)
+	binary.BigEndian.PutUint16(segment[2:], self.DestinationPort)
+	binary.BigEndian.PutUint32(segment[4:], self.Sequence)
+	binary.BigEndian.PutUint32(segment[8:], self.Acknowledgment)
+	segment[12] = byte(size/4) << 4
+	segment[13] = self.Flags
+	binary.BigEndian.PutUint16(segment[14:], window)
+	copy(segment[headerSize:], options)
+	copy(segment[size:], self.Payload)
+
+	pseudoHeader := make([]byte, 12)
+	copy(pseudoHeader[0:], source.To4())
+	copy(pseudoHeader[4:], destination.To4())
+	pseudoHeader[9] = protocolTcp
+	binary.BigEndian.PutUint16(pseudoHeader[10:], uint16(len(segment)))
+	binary.BigEndian.PutUint16(segment[16:], ipv4.Checksum(pseudoHeader, segment))
+	return segment
+}
+
+// ParseSegment decodes a TCP segment as read from a raw socket (without the IPv4
+// header). The checksum is not verified: every payload the transport accepts is
+// authenticated by the obfuscation layer instead. The returned payload aliases
+// data.
+func ParseSegment(data []byte) (*Segment, error) {
+	if len(data) < headerSize {
+		return nil, ErrInvalidSegment
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < headerSize || offset > len(data) {
+		return nil, ErrInvalidSegment
+	}
+	return &Segment{
+		SourcePort:      binary.BigEndian.Uint16(data[0:]),
+		DestinationPort: binary.BigEndian.Uint16(data[2:]),
+		Sequence:        binary.BigEndian.Uint32(data[4:]),
+		Acknowledgment:  binary.BigEndian.Uint32(data[8:]),
+		Flags:           data[13],
+		Payload:         data[offset:],
+	}, nil
+}
+
+// SourceAddress returns the local address the host would use to reach remote,
+// which the pseudo-header checksum needs because a raw socket does not report it.
+func SourceAddress(remote net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: remote, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// After reports whether sequence number a comes after b, modulo 2^32.
+func After(a, b uint32) bool {
+	return int32(a-b) > 0
+}
@@ -0,0 +1,108 @@
+package faketcp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+func TestSegmentRoundTrip(t *testing.T) {
+	source := net.ParseIP("192.0.2.1")
+	destination := net.ParseIP("198.51.100.2")
+	segment := &Segment{
+		SourcePort:      40000,
+		DestinationPort: 443,
+		Sequence:        0xfffffff0,
+		Acknowledgment:  17,
+		Flags:           FlagPsh | FlagAck,
+		Payload:         []byte("datagram"),
+	}
+	data := segment.Marshal(source, destination)
+
+	parsed, err := ParseSegment(data)
+	if err != nil {
+		t.Fatalf("ParseSegment: %s", err)
+	}
+	if parsed.SourcePort != 40000 || parsed.DestinationPort != 443 || parsed.Sequence != 0xfffffff0 || parsed.Acknowledgment != 17 || parsed.Flags != FlagPsh|FlagAck {
+		t.Errorf("parsed header = %+v", parsed)
+	}
+	if !bytes.Equal(parsed.Payload, segment.Payload) {
+		t.Errorf("payload = %q, want %q", parsed.Payload, segment.Payload)
+	}
+
+	// The checksum covers the pseudo-header, so summing it back in yields zero.
+	pseudoHeader := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0, protocolTcp, 0, byte(len(data))}
+	if sum := ipv4.Checksum(pseudoHeader, data); sum != 0 {
+		t.Errorf("checksum does not verify: %#04x", sum)
+	}
+}
+
+func TestSynCarriesOptions(t *testing.T) {
+	data := (&Segment{Flags: FlagSyn}).Marshal(net.IPv4zero, net.IPv4zero)
+	parsed, err := ParseSegment(data)
+	if err != nil {
+		t.Fatalf("ParseSegment: %s", err)
+	}
+	if len(data) != headerSize+4 || len(parsed.Payload) != 0 {
+		t.Errorf("SYN is %d bytes with %d payload, want %d with none", len(data), len(parsed.Payload), headerSize+4)
+	}
+}
+
+func TestParseSegmentRejectsMalformed(t *testing.T) {
+	valid := (&Segment{Flags: FlagAck}).Marshal(net.IPv4zero, net.IPv4zero)
+	badOffset := append([]byte{}, valid...)
+	badOffset[12] = 15 << 4
+
+	for name, data := range map[string][]byte{"too short": valid[:10], "offset beyond data": badOffset} {
+		if _, err := ParseSegment(data); !errors.Is(err, ErrInvalidSegment) {
+			t.Errorf("%s: ParseSegment error = %v, want ErrInvalidSegment", name, err)
+		}
+	}
+}
+
+func TestConnectionSequenceSpace(t *testing.T) {
+	client := NewConnection(net.ParseIP("192.0.2.1"), 40000, net.ParseIP("198.51.100.2"), 443, 1000)
+	server := NewConnection(net.ParseIP("198.51.100.2"), 443, net.ParseIP("192.0.2.1"), 40000, 5000)
+
+	exchange := func(from, to *Connection, flags byte, payload []byte) *Segment {
+		t.Helper()
+		segment, err := ParseSegment(from.Segment(flags, payload))
+		if err != nil {
+			t.Fatalf("ParseSegment: %s", err)
+		}
+		to.Receive(segment)
+		return segment
+	}
+
+	exchange(client, server, FlagSyn, nil)
+	synAck := exchange(server, client, FlagSyn|FlagAck, nil)
+	if synAck.Acknowledgment != 1001 {
+		t.Fatalf("SYN-ACK acknowledges %d, want 1001", synAck.Acknowledgment)
+	}
+	ack := exchange(client, server, FlagAck, nil)
+	if ack.Sequence != 1001 || ack.Acknowledgment != 5001 {
+		t.Fatalf("ACK = seq %d ack %d, want 1001 and 5001", ack.Sequence, ack.Acknowledgment)
+	}
+
+	// Data advances the sequence by its length; a reordered (older) segment never
+	// moves the peer's acknowledgment backwards.
+	first, err := ParseSegment(client.Segment(FlagPsh|FlagAck, []byte("abc")))
+	if err != nil {
+		t.Fatalf("ParseSegment: %s", err)
+	}
+	second := exchange(client, server, FlagPsh|FlagAck, []byte("defg"))
+	if second.Sequence != 1004 {
+		t.Fatalf("second data segment seq %d, want 1004", second.Sequence)
+	}
+	server.Receive(first)
+	reply := exchange(server, client, FlagPsh|FlagAck, []byte("x"))
+	if reply.Acknowledgment != 1008 {
+		t.Fatalf("server acknowledges %d, want 1008", reply.Acknowledgment)
+	}
+	if !client.Matches(net.ParseIP("198.51.100.2"), reply) {
+		t.Error("client does not match the server's segment")
+	}
+}
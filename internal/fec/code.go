@@ -0,0 +1,171 @@
+// Package fec implements the forward error correction of the UDP transport: a
+// systematic Reed-Solomon code over GF(2^8), and the groups in which frames
+// travel with parity shards, so that a receiver rebuilds the frames of a group
+// it lost as long as it got as many shards of the group as it has frames.
+package fec
+
+import "errors"
+
+const (
+	// MaxData and MaxParity bound the data and parity shards of a group: the
+	// code's Cauchy matrix draws the data shards' points from [0, 128) and the
+	// parity shards' from [128, 255).
+	MaxData   = 128
+	MaxParity = 127
+
+	// polynomial generates GF(2^8): x^8 + x^4 + x^3 + x^2 + 1.
+	polynomial = 0x11d
+)
+
+// ErrTooFewShards is returned by Reconstruct when fewer shards survive than
+// there are data shards.
+var ErrTooFewShards = errors.New("fec: too few shards to reconstruct")
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	value := 1
+	for power := range 255 {
+		expTable[power] = byte(value)
+		logTable[value] = byte(power)
+		value <<= 1
+		if value&0x100 != 0 {
+			value ^= polynomial
+		}
+	}
+	for power := 255; power < len(expTable); power++ {
+		expTable[power] = expTable[power-255]
+	}
+}
+
+func multiply(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// inverse returns 1/a for a non-zero a.
+func inverse(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// multiplyAdd adds coefficient × source to destination.
+func multiplyAdd(destination, source []byte, coefficient byte) {
+	if coefficient == 0 {
+		return
+	}
+	for index, value := range source {
+		destination[index] ^= multiply(coefficient, value)
+	}
+}
+
+// coefficient is the weight of data shard column in parity shard row: an entry
+// of a Cauchy matrix, every square submatrix of which is invertible, so any
+// data shards can be rebuilt from as many parity shards.
+func coefficient(row, column int) byte {
+	return inverse(byte(MaxData+row) ^ byte(column))
+}
+
+// Encode returns parity shards for data, whose shards must all have the same
+// length.
+func Encode(data [][]byte, parity int) [][]byte {
+	shards := make([][]byte, parity)
+	for row := range shards {
+		shards[row] = make([]byte, len(data[0]))
+		for column, shard := range data {
+			multiplyAdd(shards[row], shard, coefficient(row, column))
+		}
+	}
+	return shards
+}
+
+// Reconstruct rebuilds the missing (nil) shards of data from the others and
+// the parity shards that survive (the rest nil). Every shard present must have
+// the same length.
+func Reconstruct(data, parity [][]byte) error {
+	var missing, rows []int
+	length := 0
+	for column, shard := range data {
+		if shard == nil {
+			missing = append(missing, column)
+		} else {
+			length = len(shard)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for row, shard := range parity {
+		if shard != nil && len(rows) < len(missing) {
+			rows = append(rows, row)
+			length = len(shard)
+		}
+	}
+	if len(rows) < len(missing) {
+		return ErrTooFewShards
+	}
+
+	// Each parity shard, less what the surviving data shards contribute to
+	// it, is a combination of the missing ones alone; inverting the matrix of
+	// that combination recovers them.
+	residuals := make([][]byte, len(rows))
+	matrix := make([][]byte, len(rows))
+	for index, row := range rows {
+		residuals[index] = append([]byte{}, parity[row]...)
+		for column, shard := range data {
+			if shard != nil {
+				multiplyAdd(residuals[index], shard, coefficient(row, column))
+			}
+		}
+		matrix[index] = make([]byte, len(missing))
+		for position, column := range missing {
+			matrix[index][position] = coefficient(row, column)
+		}
+	}
+	inverted := invert(matrix)
+	for position, column := range missing {
+		shard := make([]byte, length)
+		for index := range rows {
+			multiplyAdd(shard, residuals[index], inverted[position][index])
+		}
+		data[column] = shard
+	}
+	return nil
+}
+
+// invert returns the inverse of a square matrix, which must be invertible (as
+// every square submatrix of a Cauchy matrix is), by Gauss-Jordan elimination.
+func invert(matrix [][]byte) [][]byte {
+	size := len(matrix)
+	work := make([][]byte, size)
+	for row := range work {
+		work[row] = make([]byte, 2*size)
+		copy(work[row], matrix[row])
+		work[row][size+row] = 1
+	}
+	for column := range size {
+		pivot := column
+		for work[pivot][column] == 0 {
+			pivot++
+		}
+		work[column], work[pivot] = work[pivot], work[column]
+		scale := inverse(work[column][column])
+		for index := range work[column] {
+			work[column][index] = multiply(work[column][index], scale)
+		}
+		for row := range size {
+			if row != column && work[row][column] != 0 {
+				multiplyAdd(work[row], work[column], work[row][column])
+			}
+		}
+	}
+	inverted := make([][]byte, size)
+	for row := range inverted {
+		inverted[row] = work[row][size:]
+	}
+	return inverted
+}
@@ -0,0 +1,182 @@
+package fec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconstructAnyDataShards(t *testing.T) {
+	data := make([][]byte, 10)
+	for index := range data {
+		data[index] = bytes.Repeat([]byte{byte(index*37 + 1)}, 16)
+	}
+	parity := Encode(data, 3)
+
+	// Every way of losing three of the thirteen shards can be undone.
+	for first := range 13 {
+		for second := first + 1; second < 13; second++ {
+			for third := second + 1; third < 13; third++ {
+				survivingData := append([][]byte{}, data...)
+				survivingParity := append([][]byte{}, parity...)
+				for _, lost := range []int{first, second, third} {
+					if lost < 10 {
+						survivingData[lost] = nil
+					} else {
+						survivingParity[lost-10] = nil
+					}
+				}
+				if err := Reconstruct(survivingData, survivingParity); err != nil {
+					t.Fatalf("losing %d %d %d: %s", first, second, third, err)
+				}
+				for index := range data {
+					if !bytes.Equal(survivingData[index], data[index]) {
+						t.Fatalf("losing %d %d %d: shard %d rebuilt wrong", first, second, third, index)
+					}
+				}
+			}
+		}
+	}
+
+	lost := append([][]byte{nil, nil}, data[2:]...)
+	if err := Reconstruct(lost, [][]byte{parity[0], nil, nil}); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("err = %v, want %v", err, ErrTooFewShards)
+	}
+}
+
+func TestParseRatio(t *testing.T) {
+	ratio, err := ParseRatio("10:3")
+	if err != nil || ratio != (Ratio{Data: 10, Parity: 3}) {
+		t.Errorf("ParseRatio = %+v, %v", ratio, err)
+	}
+	for _, value := range []string{"10", "10:0", "0:3", "200:3", "a:b"} {
+		if _, err := ParseRatio(value); err == nil {
+			t.Errorf("ParseRatio(%q) accepted", value)
+		}
+	}
+}
+
+// link carries an Encoder's shards to a Decoder, dropping those lose says.
+type link struct {
+	mutex     sync.Mutex
+	decoder   *Decoder
+	sent      int
+	lose      func(shard int) bool
+	delivered []string
+}
+
+func (self *link) emit(payload []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.sent++
+	if self.lose(self.sent) {
+		return nil
+	}
+	frames, err := self.decoder.Receive(append([]byte{}, payload...))
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		self.delivered = append(self.delivered, string(frame))
+	}
+	return nil
+}
+
+func (self *link) frames() []string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]string{}, self.delivered...)
+}
+
+func TestGroupsRecoverLostFrames(t *testing.T) {
+	// Each group of 4 data and 2 parity shards loses its second and third.
+	channel := &link{decoder: NewDecoder(), lose: func(shard int) bool { return shard%6 == 2 || shard%6 == 3 }}
+	encoder := NewEncoder(Ratio{Data: 4, Parity: 2}, channel.emit)
+	defer encoder.Close()
+	var want []string
+	for index := range 12 {
+		frame := fmt.Sprintf("frame %d%s", index, bytes.Repeat([]byte{'.'}, index))
+		want = append(want, frame)
+		if err := encoder.Add([]byte(frame)); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+	}
+	got := channel.frames()
+	if len(got) != len(want) {
+		t.Fatalf("delivered %d frames, want %d: %q", len(got), len(want), got)
+	}
+	seen := make(map[string]bool)
+	for _, frame := range got {
+		seen[frame] = true
+	}
+	for _, frame := range want {
+		if !seen[frame] {
+			t.Errorf("%q was not delivered", frame)
+		}
+	}
+	if shape := channel.decoder.Shape(); shape != (Ratio{Data: 4, Parity: 2}) {
+		t.Errorf("Shape = %+v", shape)
+	}
+}
+
+func TestPartialGroupFlushes(t *testing.T) {
+	channel := &link{decoder: NewDecoder(), lose: func(shard int) bool { return shard == 1 }}
+	encoder := NewEncoder(Ratio{Data: 10, Parity: 1}, channel.emit)
+	defer encoder.Close()
+	for _, frame := range []string{"lost", "kept"} {
+		if err := encoder.Add([]byte(frame)); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+	}
+	deadline := time.Now().Add(20 * FlushTimeout)
+	for len(channel.frames()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(FlushTimeout / 4)
+	}
+	if got := channel.frames(); len(got) != 2 || got[1] != "lost" {
+		t.Errorf("delivered %q, want the lost frame rebuilt once the group flushed", got)
+	}
+}
+
+func TestAdaptiveParityFollowsLoss(t *testing.T) {
+	var parities []int
+	encoder := NewEncoder(Ratio{Data: 10, Parity: 4, Adaptive: true}, func(payload []byte) error {
+		parsed, _, err := parseHeader(payload)
+		if err == nil && parsed.index >= parsed.data {
+			parities = append(parities, parsed.parity)
+		}
+		return err
+	})
+	defer encoder.Close()
+	send := func(loss float64) int {
+		encoder.Adapt(loss)
+		parities = nil
+		for range 10 {
+			_ = encoder.Add([]byte("frame"))
+		}
+		return len(parities)
+	}
+	if sent := send(0); sent != 1 {
+		t.Errorf("no loss: %d parity shards, want 1", sent)
+	}
+	if sent := send(0.1); sent != 2 {
+		t.Errorf("10%% loss: %d parity shards, want 2", sent)
+	}
+	if sent := send(0.5); sent != 4 {
+		t.Errorf("50%% loss: %d parity shards, want the ceiling of 4", sent)
+	}
+}
+
+func TestDecoderMeasuresLoss(t *testing.T) {
+	channel := &link{decoder: NewDecoder(), lose: func(shard int) bool { return shard%5 == 0 }}
+	encoder := NewEncoder(Ratio{Data: 4, Parity: 1}, channel.emit)
+	defer encoder.Close()
+	for range 4 * 3 * decodeGroups {
+		_ = encoder.Add([]byte("frame"))
+	}
+	if loss := channel.decoder.Loss(); loss < 0.15 || loss > 0.25 {
+		t.Errorf("Loss = %.2f, want about 0.2", loss)
+	}
+}
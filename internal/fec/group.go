@@ -0,0 +1,427 @@
+package fec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+)
+
+var log = logging.MustGetLogger("fec")
+
+const (
+	// HeaderLength is the length of the header before each shard: the group
+	// number (4 bytes), the shard's index in the group, the group's data and
+	// parity shard counts, and, on parity shards, how many data shards the
+	// group ended up with (a group sent before it filled has fewer).
+	HeaderLength = 8
+
+	// FlushTimeout is how long a group that has not filled waits for more
+	// frames before its parity shards are sent anyway.
+	FlushTimeout = 20 * time.Millisecond
+
+	// decodeGroups bounds how many groups a Decoder holds shards of.
+	decodeGroups = 32
+
+	// lossSmoothing weighs each group's loss in a Decoder's running estimate.
+	lossSmoothing = 0.1
+)
+
+// ErrInvalidShard is returned for a payload that is not a well-formed shard.
+var ErrInvalidShard = errors.New("fec: invalid shard")
+
+// Ratio is the shape of the groups an Encoder sends: Data frames followed by
+// Parity shards, any Data of which rebuild the group's frames. When Adaptive,
+// Parity is a ceiling, and the encoder sends just enough to cover the loss the
+// link measures.
+type Ratio struct {
+	Data     int
+	Parity   int
+	Adaptive bool
+}
+
+// ParseRatio parses a ratio of the form data:parity, such as "10:3".
+func ParseRatio(value string) (Ratio, error) {
+	dataText, parityText, found := strings.Cut(value, ":")
+	data, dataErr := strconv.Atoi(dataText)
+	parity, parityErr := strconv.Atoi(parityText)
+	if !found || dataErr != nil || parityErr != nil {
+		return Ratio{}, fmt.Errorf("fec: invalid ratio %q, want data:parity", value)
+	}
+	ratio := Ratio{Data: data, Parity: parity}
+	return ratio, ratio.validate()
+}
+
+// Enabled reports whether the ratio asks for error correction at all.
+func (self Ratio) Enabled() bool {
+	return self.Data > 0
+}
+
+func (self Ratio) String() string {
+	return fmt.Sprintf("%d:%d", self.Data, self.Parity)
+}
+
+func (self Ratio) validate() error {
+	if self.Data < 1 || self.Data > MaxData || self.Parity < 1 || self.Parity > MaxParity {
+		return fmt.Errorf("fec: ratio %s out of range: 1 to %d data and 1 to %d parity shards", self, MaxData, MaxParity)
+	}
+	return nil
+}
+
+type header struct {
+	group  uint32
+	index  int
+	data   int
+	parity int
+	count  int
+}
+
+func (self header) append(payload []byte) []byte {
+	payload = binary.BigEndian.AppendUint32(payload, self.group)
+	return append(payload, byte(self.index), byte(self.data), byte(self.parity), byte(self.count))
+}
+
+func parseHeader(payload []byte) (header, []byte, error) {
+	if len(payload) < HeaderLength {
+		return header{}, nil, ErrInvalidShard
+	}
+	parsed := header{
+		group:  binary.BigEndian.Uint32(payload),
+		index:  int(payload[4]),
+		data:   int(payload[5]),
+		parity: int(payload[6]),
+		count:  int(payload[7]),
+	}
+	if parsed.data < 1 || parsed.data > MaxData || parsed.parity > MaxParity ||
+		parsed.index >= parsed.data+parsed.parity || parsed.count > parsed.data {
+		return header{}, nil, ErrInvalidShard
+	}
+	return parsed, payload[HeaderLength:], nil
+}
+
+// Encoder groups the frames sent over a link, each sent at once as a data
+// shard, and sends parity shards for every group as it fills, or FlushTimeout
+// after its first frame.
+type Encoder struct {
+	emit func(payload []byte) error
+
+	mutex   sync.Mutex
+	ratio   Ratio
+	parity  int // the parity shards of the next group, under an adaptive ratio
+	group   uint32
+	current int // the parity shards of the current group
+	shards  [][]byte
+	timer   *time.Timer
+	armed   uint64 // counts timers, so that a stopped one that fires anyway is ignored
+	closed  bool
+}
+
+// NewEncoder sends shards, each a payload of a header and a frame or parity
+// shard, by calling emit.
+func NewEncoder(ratio Ratio, emit func(payload []byte) error) *Encoder {
+	// A random first group keeps a restarted sender's groups apart from the
+	// ones the receiver remembers.
+	return &Encoder{emit: emit, ratio: ratio, parity: ratio.Parity, group: rand.Uint32()}
+}
+
+// Add sends frame as the next data shard.
+func (self *Encoder) Add(frame []byte) error {
+	if len(frame) > math.MaxUint16 {
+		return ErrInvalidShard
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	index := len(self.shards)
+	if index == 0 {
+		self.current = self.parity
+	}
+	shard := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(frame)), uint16(len(frame)))
+	self.shards = append(self.shards, append(shard, frame...))
+	payload := header{group: self.group, index: index, data: self.ratio.Data, parity: self.current}.append(nil)
+	if err := self.emit(append(payload, frame...)); err != nil {
+		return err
+	}
+	if len(self.shards) >= self.ratio.Data {
+		return self.flush()
+	}
+	if index == 0 {
+		self.arm()
+	}
+	return nil
+}
+
+// Reshape changes the ratio, flushing the current group first.
+func (self *Encoder) Reshape(ratio Ratio) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if ratio == self.ratio {
+		return nil
+	}
+	err := self.flush()
+	self.ratio, self.parity = ratio, ratio.Parity
+	return err
+}
+
+// Adapt sets the parity shards of the next groups for the fraction of shards
+// measured lost, twice what covering it takes on average, under an adaptive
+// ratio.
+func (self *Encoder) Adapt(loss float64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.ratio.Adaptive {
+		self.parity = min(max(int(math.Ceil(2*loss*float64(self.ratio.Data))), 1), self.ratio.Parity)
+	}
+}
+
+// Close stops the flush timer; the encoder sends nothing more.
+func (self *Encoder) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.closed = true
+	self.stop()
+	self.shards = nil
+}
+
+// flush sends the current group's parity shards and starts the next group.
+// The caller holds the mutex.
+func (self *Encoder) flush() error {
+	self.stop()
+	if len(self.shards) == 0 || self.closed {
+		return nil
+	}
+	length := 0
+	for _, shard := range self.shards {
+		length = max(length, len(shard))
+	}
+	data := make([][]byte, len(self.shards))
+	for index, shard := range self.shards {
+		data[index] = append(shard, make([]byte, length-len(shard))...)
+	}
+	count := len(self.shards)
+	group := self.group
+	self.group++
+	self.shards = nil
+	for index, shard := range Encode(data, self.current) {
+		payload := header{group: group, index: self.ratio.Data + index, data: self.ratio.Data, parity: self.current, count: count}.append(nil)
+		if err := self.emit(append(payload, shard...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arm starts the flush timer. The caller holds the mutex.
+func (self *Encoder) arm() {
+	self.stop()
+	self.armed++
+	armed := self.armed
+	self.timer = time.AfterFunc(FlushTimeout, func() { self.expire(armed) })
+}
+
+func (self *Encoder) stop() {
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+}
+
+func (self *Encoder) expire(armed uint64) {
+	defer deferutil.Recover()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed || armed != self.armed || self.timer == nil {
+		return
+	}
+	self.timer = nil
+	if err := self.flush(); err != nil {
+		log.Debugf("failed to send parity shards: %s", err)
+	}
+}
+
+// Decoder takes the shards of one sender's groups, returning each frame once:
+// as its own data shard arrives, or rebuilt from the others once enough
+// shards of its group have.
+type Decoder struct {
+	mutex   sync.Mutex
+	groups  map[uint32]*group
+	order   []uint32 // the groups held, oldest first
+	retired []uint32 // groups recently let go of, whose late shards are dropped
+	shape   Ratio
+	loss    float64
+	sampled bool
+}
+
+type group struct {
+	data     [][]byte // length-prefixed frames, by index, once received or rebuilt
+	parity   [][]byte
+	count    int // data shards the group ended up with; 0 until a parity shard says
+	highest  int // one past the highest data shard index received
+	received int
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{groups: make(map[uint32]*group)}
+}
+
+// Receive takes one shard's payload and returns the frames it completes: its
+// own frame for a data shard the first time, and any frames rebuilt.
+func (self *Decoder) Receive(payload []byte) ([][]byte, error) {
+	parsed, body, err := parseHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	current := self.group(parsed)
+	if current == nil {
+		return nil, nil // a group already let go of
+	}
+	self.shape = Ratio{Data: parsed.data, Parity: parsed.parity}
+
+	var frames [][]byte
+	if parsed.index < parsed.data {
+		if current.data[parsed.index] != nil {
+			return nil, nil // rebuilt already
+		}
+		shard := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(body)), uint16(len(body)))
+		current.data[parsed.index] = append(shard, body...)
+		current.highest = max(current.highest, parsed.index+1)
+		current.received++
+		frames = append(frames, current.data[parsed.index][2:])
+	} else {
+		index := parsed.index - parsed.data
+		if index >= len(current.parity) || current.parity[index] != nil || parsed.count == 0 {
+			return nil, ErrInvalidShard
+		}
+		current.parity[index] = append([]byte{}, body...)
+		current.count = parsed.count
+		current.received++
+	}
+	return append(frames, current.rebuild()...), nil
+}
+
+// Loss returns the running estimate of the fraction of shards lost.
+func (self *Decoder) Loss() float64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.loss
+}
+
+// Shape returns the ratio of the sender's latest group.
+func (self *Decoder) Shape() Ratio {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.shape
+}
+
+// group returns the group a shard belongs to, creating it and letting go of the
+// oldest if need be, or nil for a group already let go of. The caller holds the
+// mutex.
+func (self *Decoder) group(parsed header) *group {
+	if existing, ok := self.groups[parsed.group]; ok {
+		if len(existing.data) == parsed.data && len(existing.parity) == parsed.parity {
+			return existing
+		}
+		return nil // a shape that contradicts the group's other shards
+	}
+	for _, retired := range self.retired {
+		if retired == parsed.group {
+			return nil
+		}
+	}
+	created := &group{
+		data:   make([][]byte, parsed.data),
+		parity: make([][]byte, parsed.parity),
+	}
+	self.groups[parsed.group] = created
+	self.order = append(self.order, parsed.group)
+	if len(self.order) > decodeGroups {
+		self.retire(self.order[0])
+		self.order = self.order[1:]
+	}
+	return created
+}
+
+// retire lets go of a group, counting the shards it lost. The caller holds the
+// mutex.
+func (self *Decoder) retire(number uint32) {
+	retired := self.groups[number]
+	delete(self.groups, number)
+	self.retired = append(self.retired, number)
+	if len(self.retired) > decodeGroups {
+		self.retired = self.retired[1:]
+	}
+	count := retired.count
+	if count == 0 {
+		count = retired.highest // no parity shard arrived to say
+	}
+	expected := count + len(retired.parity)
+	if expected == 0 {
+		return
+	}
+	loss := 1 - min(float64(retired.received)/float64(expected), 1)
+	if !self.sampled {
+		self.loss, self.sampled = loss, true
+	} else {
+		self.loss += lossSmoothing * (loss - self.loss)
+	}
+}
+
+// rebuild returns the frames of the group's missing data shards once enough
+// shards have arrived to rebuild them.
+func (self *group) rebuild() [][]byte {
+	if self.count == 0 {
+		return nil
+	}
+	missing := 0
+	for index := range self.count {
+		if self.data[index] == nil {
+			missing++
+		}
+	}
+	parities := 0
+	length := 0
+	for _, shard := range self.parity {
+		if shard != nil {
+			parities++
+			length = len(shard)
+		}
+	}
+	if missing == 0 || parities < missing {
+		return nil
+	}
+	data := make([][]byte, self.count)
+	for index := range data {
+		if shard := self.data[index]; shard != nil {
+			if len(shard) > length {
+				return nil // longer than the parity shards it was encoded with
+			}
+			data[index] = append(shard[:len(shard):len(shard)], make([]byte, length-len(shard))...)
+		}
+	}
+	if err := Reconstruct(data, self.parity); err != nil {
+		return nil
+	}
+	var frames [][]byte
+	for index := range self.count {
+		if self.data[index] != nil {
+			continue
+		}
+		size := int(binary.BigEndian.Uint16(data[index]))
+		if size > len(data[index])-2 {
+			continue
+		}
+		self.data[index] = data[index][:2+size]
+		frames = append(frames, self.data[index][2:])
+	}
+	return frames
+}
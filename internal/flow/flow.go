@@ -0,0 +1,155 @@
+// Package flow tells the flows of frames apart by their 5-tuple, and pins each
+// flow to the path it took, so that a flow keeps its path while new flows
+// follow a newly chosen one: moving a live TCP flow to another path reorders
+// its segments.
+package flow
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+const (
+	protocolTCP = 6
+	protocolUDP = 17
+)
+
+// Key is the 5-tuple of a frame. The ports are zero for protocols other than
+// TCP and UDP, and for fragments after the first.
+type Key struct {
+	Source          [4]byte
+	Destination     [4]byte
+	Protocol        byte
+	SourcePort      uint16
+	DestinationPort uint16
+}
+
+// KeyOf returns the key of frame's flow.
+func KeyOf(frame ipv4.Frame) Key {
+	key := Key{Protocol: frame.Protocol()}
+	copy(key.Source[:], frame.Source().To4())
+	copy(key.Destination[:], frame.Destination().To4())
+	if (key.Protocol == protocolTCP || key.Protocol == protocolUDP) && frame.FragmentOffset() == 0 {
+		key.SourcePort, key.DestinationPort = frame.SourcePort(), frame.DestinationPort()
+	}
+	return key
+}
+
+// Reverse returns the key of the replies to the flow.
+func (self Key) Reverse() Key {
+	return Key{
+		Source:          self.Destination,
+		Destination:     self.Source,
+		Protocol:        self.Protocol,
+		SourcePort:      self.DestinationPort,
+		DestinationPort: self.SourcePort,
+	}
+}
+
+// Table pins flows to paths of type V. A flow's pin lapses once it has gone
+// unused for the idle timeout.
+type Table[V comparable] struct {
+	idle     time.Duration
+	capacity int
+
+	mutex   sync.Mutex
+	pins    map[Key]*pin[V]
+	byValue map[V]map[Key]struct{} // the keys pinned to each value, for Remove
+}
+
+type pin[V comparable] struct {
+	value    V
+	lastUsed time.Time
+}
+
+// NewTable returns a table that holds up to capacity flows.
+func NewTable[V comparable](idle time.Duration, capacity int) *Table[V] {
+	return &Table[V]{idle: idle, capacity: capacity, pins: make(map[Key]*pin[V]), byValue: make(map[V]map[Key]struct{})}
+}
+
+// Lookup returns the path key is pinned to, if its pin has not lapsed, and
+// counts the flow as used.
+func (self *Table[V]) Lookup(key Key) (V, bool) {
+	now := time.Now()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	existing, ok := self.pins[key]
+	if !ok || now.Sub(existing.lastUsed) >= self.idle {
+		var zero V
+		return zero, false
+	}
+	existing.lastUsed = now
+	return existing.value, true
+}
+
+// Pin pins key to value, in place of any earlier pin. When the table is full
+// of flows still in use, the flow is left unpinned.
+func (self *Table[V]) Pin(key Key, value V) {
+	now := time.Now()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if existing, ok := self.pins[key]; ok {
+		if existing.value != value {
+			self.unindex(key, existing.value)
+			self.index(key, value)
+		}
+		existing.value, existing.lastUsed = value, now
+		return
+	}
+	if len(self.pins) >= self.capacity {
+		self.sweep(now)
+		if len(self.pins) >= self.capacity {
+			return
+		}
+	}
+	self.pins[key] = &pin[V]{value: value, lastUsed: now}
+	self.index(key, value)
+}
+
+// Remove drops every pin to value, such as a path that has closed.
+func (self *Table[V]) Remove(value V) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for key := range self.byValue[value] {
+		delete(self.pins, key)
+	}
+	delete(self.byValue, value)
+}
+
+// index and unindex keep byValue in step with pins. The caller holds the
+// mutex.
+func (self *Table[V]) index(key Key, value V) {
+	keys, ok := self.byValue[value]
+	if !ok {
+		keys = make(map[Key]struct{})
+		self.byValue[value] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (self *Table[V]) unindex(key Key, value V) {
+	keys := self.byValue[value]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(self.byValue, value)
+	}
+}
+
+// Len returns the number of pins held, lapsed or not.
+func (self *Table[V]) Len() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return len(self.pins)
+}
+
+// sweep drops the pins that have lapsed. The caller holds the mutex.
+func (self *Table[V]) sweep(now time.Time) {
+	for key, existing := range self.pins {
+		if now.Sub(existing.lastUsed) >= self.idle {
+			delete(self.pins, key)
+			self.unindex(key, existing.value)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package flow
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+var (
+	clientIP = net.ParseIP("172.18.0.2")
+	serverIP = net.ParseIP("172.18.0.1")
+)
+
+// segment returns a frame of protocol from one port to another.
+func segment(source, destination net.IP, protocol byte, sourcePort, destinationPort uint16) ipv4.Frame {
+	frame := append(ipv4.MakeFrame(source, destination), byte(sourcePort>>8), byte(sourcePort), byte(destinationPort>>8), byte(destinationPort))
+	frame[9] = protocol
+	frame.SetTotalLength(uint16(len(frame)))
+	return frame
+}
+
+func TestKeyOf(t *testing.T) {
+	request := KeyOf(segment(clientIP, serverIP, protocolTCP, 40000, 443))
+	reply := KeyOf(segment(serverIP, clientIP, protocolTCP, 443, 40000))
+	if request.Reverse() != reply || reply.Reverse() != request {
+		t.Errorf("the reply's key %+v is not the reverse of the request's %+v", reply, request)
+	}
+	if other := KeyOf(segment(clientIP, serverIP, protocolTCP, 40001, 443)); other == request {
+		t.Error("flows from different ports share a key")
+	}
+	if KeyOf(segment(clientIP, serverIP, protocolUDP, 5000, 53)) == KeyOf(segment(clientIP, serverIP, protocolTCP, 5000, 53)) {
+		t.Error("TCP and UDP flows share a key")
+	}
+	if icmp := KeyOf(segment(clientIP, serverIP, 1, 0x0800, 1)); icmp.SourcePort != 0 || icmp.DestinationPort != 0 {
+		t.Errorf("an ICMP frame's key has ports: %+v", icmp)
+	}
+}
+
+func TestTablePinsUntilIdle(t *testing.T) {
+	table := NewTable[string](50*time.Millisecond, 2)
+	first := KeyOf(segment(clientIP, serverIP, protocolTCP, 40000, 443))
+	second := KeyOf(segment(clientIP, serverIP, protocolTCP, 40001, 443))
+	third := KeyOf(segment(clientIP, serverIP, protocolTCP, 40002, 443))
+
+	table.Pin(first, "udp")
+	table.Pin(second, "tcp")
+	if path, ok := table.Lookup(first); !ok || path != "udp" {
+		t.Errorf("Lookup = %q %t, want udp", path, ok)
+	}
+	table.Pin(third, "udp")
+	if _, ok := table.Lookup(third); ok {
+		t.Error("a full table pinned another flow")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := table.Lookup(first); ok {
+		t.Error("an idle flow is still pinned")
+	}
+	table.Pin(third, "udp")
+	if path, ok := table.Lookup(third); !ok || path != "udp" || table.Len() != 1 {
+		t.Errorf("Lookup = %q %t with %d pins, want udp after idle pins were swept", path, ok, table.Len())
+	}
+
+	table.Remove("udp")
+	if _, ok := table.Lookup(third); ok {
+		t.Error("a removed path is still pinned")
+	}
+}
+
+func TestTableRemovesOnlyThePath(t *testing.T) {
+	table := NewTable[string](time.Minute, 8)
+	first := KeyOf(segment(clientIP, serverIP, protocolTCP, 40000, 443))
+	second := KeyOf(segment(clientIP, serverIP, protocolTCP, 40001, 443))
+	table.Pin(first, "udp")
+	table.Pin(second, "udp")
+	table.Pin(first, "tcp") // the flow moved
+
+	table.Remove("udp")
+	if path, ok := table.Lookup(first); !ok || path != "tcp" {
+		t.Errorf("Lookup = %q %t, want the moved flow still on tcp", path, ok)
+	}
+	if _, ok := table.Lookup(second); ok {
+		t.Error("a flow on the removed path is still pinned")
+	}
+	table.Remove("tcp")
+	if table.Len() != 0 || len(table.byValue) != 0 {
+		t.Errorf("%d pins and %d paths left", table.Len(), len(table.byValue))
+	}
+}
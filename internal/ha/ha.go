@@ -0,0 +1,200 @@
+// Package ha pairs two servers sharing one tunnel subnet, an active one and a
+// standby, so that clients can fail over from one to the other with little
+// loss. The standby keeps a session open to the primary over the TCP
+// transport, and each sends the other a snapshot of the tunnel addresses
+// attached to it every second. A frame for an in-subnet address one server has
+// no route for goes to the other; when the session ends, the survivor holds
+// frames for the other's clients until they reconnect to it.
+package ha
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/core"
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+var log = logging.MustGetLogger("ha")
+
+const (
+	// Protocol is the IPv4 protocol number of a snapshot frame, one of those
+	// reserved for experimentation (RFC 3692). Snapshots travel between the
+	// two servers of a pair only and are never routed.
+	Protocol = 254
+
+	// MaxAddresses bounds the addresses of one snapshot, so that it fits in a
+	// frame.
+	MaxAddresses = 16000
+
+	// syncInterval is how often each server sends the other a snapshot.
+	syncInterval = 1 * time.Second
+
+	// takeoverHold is how long the survivor holds frames for the clients of the
+	// other server while they fail over to it.
+	takeoverHold = 30 * time.Second
+)
+
+// ErrInvalidSnapshot is returned by ParseSnapshot for a frame that is not a
+// well-formed snapshot.
+var ErrInvalidSnapshot = errors.New("ha: invalid snapshot")
+
+// IsSnapshot reports whether frame is a snapshot.
+func IsSnapshot(frame ipv4.Frame) bool {
+	return frame.Protocol() == Protocol && frame.Destination().Equal(net.IPv4bcast)
+}
+
+// MakeSnapshot encodes the addresses attached to the server at source.
+func MakeSnapshot(source net.IP, addresses []net.IP) ipv4.Frame {
+	payload := make([]byte, 2, 2+4*len(addresses))
+	count := 0
+	for _, address := range addresses {
+		if address.To4() == nil || count == MaxAddresses {
+			continue
+		}
+		payload = append(payload, address.To4()...)
+		count++
+	}
+	binary.BigEndian.PutUint16(payload, uint16(count))
+
+	frame := append(ipv4.MakeFrame(source, net.IPv4bcast), payload...)
+	frame.SetTotalLength(uint16(len(frame)))
+	frame[9] = Protocol
+	return frame
+}
+
+// ParseSnapshot decodes the addresses of a snapshot frame.
+func ParseSnapshot(frame ipv4.Frame) ([]net.IP, error) {
+	if !IsSnapshot(frame) {
+		return nil, ErrInvalidSnapshot
+	}
+	payload := frame.Payload()
+	if len(payload) < 2 {
+		return nil, ErrInvalidSnapshot
+	}
+	count := int(binary.BigEndian.Uint16(payload))
+	if count > MaxAddresses || len(payload) != 2+4*count {
+		return nil, ErrInvalidSnapshot
+	}
+	addresses := make([]net.IP, count)
+	for index := range addresses {
+		offset := 2 + 4*index
+		addresses[index] = net.IP(append([]byte{}, payload[offset:offset+4]...))
+	}
+	return addresses, nil
+}
+
+// Pair is one server's side of an active/standby pair: the session with the
+// other server (known by the core.Sink that reaches it) and the addresses
+// attached there at its last snapshot.
+type Pair struct {
+	router *core.Router
+
+	mutex     sync.Mutex
+	other     core.Sink
+	addresses []net.IP
+
+	done  chan struct{}
+	group sync.WaitGroup
+}
+
+func New(router *core.Router) *Pair {
+	return &Pair{router: router, done: make(chan struct{})}
+}
+
+func (self *Pair) Start() {
+	self.group.Add(1)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.syncLoop()
+	}()
+}
+
+func (self *Pair) Stop() {
+	close(self.done)
+	self.group.Wait()
+}
+
+// Connect takes a session dialed to the other server and sends it a snapshot
+// at once.
+func (self *Pair) Connect(sink core.Sink) {
+	self.attach(sink)
+	self.sync(sink)
+}
+
+// Receive takes a snapshot arriving over the session with the other server.
+func (self *Pair) Receive(sink core.Sink, frame ipv4.Frame) {
+	addresses, err := ParseSnapshot(frame)
+	if err != nil {
+		log.Warningf("dropped snapshot: %s", err)
+		return
+	}
+	if self.attach(sink) {
+		log.Noticef("paired with %s", frame.Source())
+		self.sync(sink)
+	}
+	self.mutex.Lock()
+	self.addresses = addresses
+	self.mutex.Unlock()
+}
+
+// attach makes sink the session with the other server, reporting whether it is
+// new.
+func (self *Pair) attach(sink core.Sink) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.other == sink {
+		return false
+	}
+	self.other = sink
+	self.router.SetFallback(sink)
+	return true
+}
+
+// Disconnect ends the session with the other server, if sink is it: this
+// server takes over the other's clients, holding frames for them while they
+// reconnect.
+func (self *Pair) Disconnect(sink core.Sink) {
+	self.mutex.Lock()
+	if self.other != sink {
+		self.mutex.Unlock()
+		return
+	}
+	self.other = nil
+	addresses := self.addresses
+	self.addresses = nil
+	self.mutex.Unlock()
+
+	self.router.SetFallback(nil)
+	self.router.Expect(addresses, takeoverHold)
+	log.Warningf("lost the other server of the pair; taking over its %d clients", len(addresses))
+}
+
+func (self *Pair) sync(sink core.Sink) {
+	sink.Send(MakeSnapshot(self.router.IP(), self.router.Addresses()))
+}
+
+func (self *Pair) syncLoop() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.done:
+			return
+		}
+		self.mutex.Lock()
+		other := self.other
+		self.mutex.Unlock()
+		if other != nil {
+			self.sync(other)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package ha
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/ziyan/shadowgate/internal/core"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/tuntest"
+)
+
+type recordingSink struct {
+	mutex  sync.Mutex
+	frames []ipv4.Frame
+}
+
+func (self *recordingSink) Send(frame ipv4.Frame) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.frames = append(self.frames, frame)
+}
+
+// data counts the frames other than snapshots.
+func (self *recordingSink) data() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	count := 0
+	for _, frame := range self.frames {
+		if !IsSnapshot(frame) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	addresses := []net.IP{net.ParseIP("172.18.0.2"), net.ParseIP("10.9.9.9"), net.ParseIP("2001:db8::1")}
+	frame := MakeSnapshot(net.ParseIP("172.18.0.1"), addresses)
+	if ipv4.DecodeFrame(frame) == nil || !IsSnapshot(frame) {
+		t.Fatal("snapshot is not a valid snapshot frame")
+	}
+	parsed, err := ParseSnapshot(frame)
+	if err != nil {
+		t.Fatalf("ParseSnapshot: %s", err)
+	}
+	if len(parsed) != 2 || !parsed[0].Equal(addresses[0]) || !parsed[1].Equal(addresses[1]) {
+		t.Errorf("parsed %v, want the IPv4 addresses of %v", parsed, addresses)
+	}
+
+	truncated := frame[:len(frame)-1].Copy()
+	truncated.SetTotalLength(uint16(len(truncated)))
+	if _, err := ParseSnapshot(truncated); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("truncated: err = %v, want %v", err, ErrInvalidSnapshot)
+	}
+}
+
+func TestPairFallbackAndTakeover(t *testing.T) {
+	serverIP, network, _ := net.ParseCIDR("172.18.0.1/24")
+	router := core.NewRouter(tuntest.New(), serverIP, network, nil)
+	pair := New(router)
+	other := &recordingSink{}
+
+	theirs := net.ParseIP("172.18.0.3")
+	pair.Receive(other, MakeSnapshot(serverIP, []net.IP{theirs}))
+
+	// While paired, a frame for an address with no route here goes to the other
+	// server.
+	toTheirs := ipv4.MakeFrame(net.ParseIP("172.18.0.2"), theirs)
+	router.Inbound(toTheirs)
+	if other.data() != 1 {
+		t.Fatalf("other server received %d frames, want 1", other.data())
+	}
+
+	// Once the other server is gone, frames for its clients are held until they
+	// reconnect here.
+	pair.Disconnect(other)
+	router.Inbound(toTheirs)
+	if other.data() != 1 {
+		t.Fatalf("frame went to the lost server")
+	}
+	reconnected := &recordingSink{}
+	router.EnsureRoute(theirs, reconnected)
+	if reconnected.data() != 1 {
+		t.Fatalf("reconnected client received %d held frames, want 1", reconnected.data())
+	}
+}
@@ -0,0 +1,179 @@
+// Package hop implements UDP port hopping: the client's UDP link moves to a new
+// server port at a fixed interval, chosen from a range by a schedule derived
+// from the password, so no single port carries a flow for long. The server
+// listens on every port of the range (or has a DNAT rule redirect the range to
+// one port). The client keeps its own socket while hopping, so the server still
+// sees the same peer, with its replay window and routes, on each new port.
+package hop
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+var log = logging.MustGetLogger("hop")
+
+// MaxPorts bounds the size of a range, since the server holds a socket per port.
+const MaxPorts = 1024
+
+// Range is an inclusive range of ports. The zero Range is empty and disables
+// hopping.
+type Range struct {
+	First int
+	Last  int
+}
+
+// ParseRange parses "first-last", such as "40000-40099".
+func ParseRange(raw string) (Range, error) {
+	first, last, found := strings.Cut(raw, "-")
+	if !found {
+		return Range{}, fmt.Errorf("hop: invalid port range: %q", raw)
+	}
+	var ports Range
+	var err error
+	if ports.First, err = strconv.Atoi(first); err != nil {
+		return Range{}, fmt.Errorf("hop: invalid port range: %q", raw)
+	}
+	if ports.Last, err = strconv.Atoi(last); err != nil {
+		return Range{}, fmt.Errorf("hop: invalid port range: %q", raw)
+	}
+	if ports.First < 1 || ports.Last > 65535 || ports.First > ports.Last {
+		return Range{}, fmt.Errorf("hop: invalid port range: %q", raw)
+	}
+	if ports.Size() > MaxPorts {
+		return Range{}, fmt.Errorf("hop: port range %q has more than %d ports", raw, MaxPorts)
+	}
+	return ports, nil
+}
+
+// Empty reports whether the range holds no ports.
+func (self Range) Empty() bool {
+	return self.First == 0
+}
+
+// Size returns the number of ports in the range.
+func (self Range) Size() int {
+	if self.Empty() {
+		return 0
+	}
+	return self.Last - self.First + 1
+}
+
+func (self Range) String() string {
+	return fmt.Sprintf("%d-%d", self.First, self.Last)
+}
+
+// Schedule picks the port for each interval: an HMAC of the interval number,
+// keyed by the password, indexes the range. Observers without the password
+// cannot predict the next port.
+type Schedule struct {
+	key      []byte
+	ports    Range
+	interval time.Duration
+}
+
+// NewSchedule returns the schedule for ports, moving every interval.
+func NewSchedule(password []byte, ports Range, interval time.Duration) (*Schedule, error) {
+	if ports.Empty() || interval <= 0 {
+		return nil, fmt.Errorf("hop: invalid schedule: ports %s every %s", ports, interval)
+	}
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("shadowgate port hopping"))
+	return &Schedule{key: mac.Sum(nil), ports: ports, interval: interval}, nil
+}
+
+// Covers reports whether port is one the schedule may pick.
+func (self *Schedule) Covers(port int) bool {
+	return port >= self.ports.First && port <= self.ports.Last
+}
+
+// Port returns the port in use at the given time.
+func (self *Schedule) Port(at time.Time) int {
+	var epoch [8]byte
+	binary.BigEndian.PutUint64(epoch[:], uint64(at.UnixNano()/int64(self.interval)))
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write(epoch[:])
+	index := binary.BigEndian.Uint64(mac.Sum(nil)) % uint64(self.ports.Size())
+	return self.ports.First + int(index)
+}
+
+// Conn is a UDP connection to one host whose destination port follows a
+// schedule. It reads datagrams from any port of that host.
+type Conn struct {
+	conn     *net.UDPConn
+	host     net.IP
+	schedule *Schedule
+
+	port atomic.Int64 // the port last written to
+}
+
+// NewConn hops conn, an unconnected UDP socket, across host's ports.
+func NewConn(conn *net.UDPConn, host net.IP, schedule *Schedule) *Conn {
+	return &Conn{conn: conn, host: host, schedule: schedule}
+}
+
+func (self *Conn) Read(buffer []byte) (int, error) {
+	for {
+		size, address, err := self.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return 0, err
+		}
+		if address.IP.Equal(self.host) {
+			return size, nil
+		}
+	}
+}
+
+func (self *Conn) Write(buffer []byte) (int, error) {
+	port := self.schedule.Port(time.Now())
+	if previous := self.port.Swap(int64(port)); previous != int64(port) && previous != 0 {
+		log.Debugf("hopping from port %d to %d", previous, port)
+	}
+	return self.conn.WriteToUDP(buffer, &net.UDPAddr{IP: self.host, Port: port})
+}
+
+// SyscallConn gives access to the underlying socket, as net.UDPConn does.
+func (self *Conn) SyscallConn() (syscall.RawConn, error) {
+	return self.conn.SyscallConn()
+}
+
+func (self *Conn) Close() error {
+	return self.conn.Close()
+}
+
+func (self *Conn) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+// RemoteAddr returns the host at the port currently scheduled.
+func (self *Conn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: self.host, Port: self.schedule.Port(time.Now())}
+}
+
+func (self *Conn) SetDeadline(deadline time.Time) error {
+	return self.conn.SetDeadline(deadline)
+}
+
+func (self *Conn) SetReadDeadline(deadline time.Time) error {
+	return self.conn.SetReadDeadline(deadline)
+}
+
+func (self *Conn) SetWriteDeadline(deadline time.Time) error {
+	return self.conn.SetWriteDeadline(deadline)
+}
@@ -0,0 +1,113 @@
+package hop
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	ports, err := ParseRange("40000-40099")
+	if err != nil {
+		t.Fatalf("ParseRange: %s", err)
+	}
+	if ports.First != 40000 || ports.Last != 40099 || ports.Size() != 100 {
+		t.Errorf("ParseRange = %+v (size %d), want 40000-40099 (size 100)", ports, ports.Size())
+	}
+	for _, raw := range []string{"", "40000", "2-1", "0-10", "65000-65536", "1-2000", "a-b"} {
+		if _, err := ParseRange(raw); err == nil {
+			t.Errorf("ParseRange(%q) succeeded, want an error", raw)
+		}
+	}
+	if !(Range{}).Empty() {
+		t.Error("zero Range is not empty")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	ports := Range{First: 40000, Last: 40099}
+	schedule, err := NewSchedule([]byte("secret"), ports, time.Minute)
+	if err != nil {
+		t.Fatalf("NewSchedule: %s", err)
+	}
+	other, err := NewSchedule([]byte("other"), ports, time.Minute)
+	if err != nil {
+		t.Fatalf("NewSchedule: %s", err)
+	}
+
+	start := time.Unix(1700000000, 0).Truncate(time.Minute)
+	if schedule.Port(start) != schedule.Port(start.Add(59*time.Second)) {
+		t.Error("port changed within one interval")
+	}
+	seen := make(map[int]bool)
+	differs := false
+	for epoch := range 50 {
+		at := start.Add(time.Duration(epoch) * time.Minute)
+		port := schedule.Port(at)
+		if port < ports.First || port > ports.Last {
+			t.Fatalf("Port = %d, outside %s", port, ports)
+		}
+		seen[port] = true
+		differs = differs || port != other.Port(at)
+	}
+	if len(seen) < 10 {
+		t.Errorf("only %d distinct ports in 50 intervals", len(seen))
+	}
+	if !differs {
+		t.Error("schedules for different passwords agree")
+	}
+}
+
+func TestConnFollowsSchedule(t *testing.T) {
+	// Two servers stand in for two ports of one host; the schedule's interval
+	// is short enough that the connection reaches both.
+	first, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer func() { _ = first.Close() }()
+	firstPort := first.LocalAddr().(*net.UDPAddr).Port
+	second, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: firstPort + 1})
+	if err != nil {
+		t.Skipf("adjacent port unavailable: %s", err)
+	}
+	defer func() { _ = second.Close() }()
+
+	schedule, err := NewSchedule([]byte("secret"), Range{First: firstPort, Last: firstPort + 1}, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewSchedule: %s", err)
+	}
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	conn := NewConn(local, net.IPv4(127, 0, 0, 1), schedule)
+	defer func() { _ = conn.Close() }()
+
+	reached := map[*net.UDPConn]bool{}
+	buffer := make([]byte, 16)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(reached) < 2 && time.Now().Before(deadline) {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		for _, server := range []*net.UDPConn{first, second} {
+			_ = server.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+			if _, from, err := server.ReadFromUDP(buffer); err == nil {
+				reached[server] = true
+				// The same local socket is seen on every port.
+				if from.String() != local.LocalAddr().String() {
+					t.Fatalf("datagram from %s, want %s", from, local.LocalAddr())
+				}
+				_, _ = server.WriteToUDP([]byte("pong"), from)
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				if size, err := conn.Read(buffer); err != nil || string(buffer[:size]) != "pong" {
+					t.Fatalf("Read = %q, %v; want pong", buffer[:size], err)
+				}
+			}
+		}
+	}
+	if len(reached) < 2 {
+		t.Fatalf("reached %d of 2 ports", len(reached))
+	}
+}
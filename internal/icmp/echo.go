@@ -0,0 +1,71 @@
+// Package icmp carries obfuscated frames inside ICMP echo messages, for networks
+// that block TCP and UDP but still let ping through. A client sends each frame
+// (or an empty poll) as the payload of an echo request; the server answers
+// requests with echo replies that carry return traffic. Because a reply can only
+// follow a request, the server holds on to recent requests and answers them as
+// frames for the client arrive, and the client keeps a supply of polls in flight.
+//
+// Every payload is an obfuscated datagram (see internal/obfuscate), so the only
+// plaintext on the wire is the 8-byte ICMP header.
+package icmp
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+// ICMP message types for echo (RFC 792).
+const (
+	TypeEchoReply   = 0
+	TypeEchoRequest = 8
+)
+
+// echoHeaderSize is the size of an ICMP echo header:
+//
+//	type uint8 | code uint8 | checksum uint16 | identifier uint16 | sequence uint16
+const echoHeaderSize = 8
+
+// ErrInvalidMessage is returned by ParseEcho for anything that is not a
+// well-formed echo request or reply.
+var ErrInvalidMessage = errors.New("icmp: invalid message")
+
+// Echo is a parsed ICMP echo request or reply.
+type Echo struct {
+	Type       byte
+	Identifier uint16
+	Sequence   uint16
+	Payload    []byte
+}
+
+// Marshal encodes the echo message with a valid checksum.
+func (self *Echo) Marshal() []byte {
+	message := make([]byte, echoHeaderSize+len(self.Payload))
+	message[0] = self.Type
+	binary.BigEndian.PutUint16(message[4:], self.Identifier)
+	binary.BigEndian.PutUint16(message[6:], self.Sequence)
+	copy(message[echoHeaderSize:], self.Payload)
+	binary.BigEndian.PutUint16(message[2:], ipv4.Checksum(message))
+	return message
+}
+
+// ParseEcho decodes an ICMP echo request or reply, verifying its checksum. The
+// returned payload aliases message.
+func ParseEcho(message []byte) (*Echo, error) {
+	if len(message) < echoHeaderSize {
+		return nil, ErrInvalidMessage
+	}
+	if message[0] != TypeEchoRequest && message[0] != TypeEchoReply || message[1] != 0 {
+		return nil, ErrInvalidMessage
+	}
+	if ipv4.Checksum(message) != 0 {
+		return nil, ErrInvalidMessage
+	}
+	return &Echo{
+		Type:       message[0],
+		Identifier: binary.BigEndian.Uint16(message[4:]),
+		Sequence:   binary.BigEndian.Uint16(message[6:]),
+		Payload:    message[echoHeaderSize:],
+	}, nil
+}
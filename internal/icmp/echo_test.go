@@ -0,0 +1,119 @@
+package icmp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+func TestEchoRoundTrip(t *testing.T) {
+	echo := &Echo{Type: TypeEchoRequest, Identifier: 0x1234, Sequence: 7, Payload: []byte("payload")}
+	message := echo.Marshal()
+
+	parsed, err := ParseEcho(message)
+	if err != nil {
+		t.Fatalf("ParseEcho: %s", err)
+	}
+	if parsed.Type != TypeEchoRequest || parsed.Identifier != 0x1234 || parsed.Sequence != 7 {
+		t.Errorf("parsed header = %+v, want type 8 identifier 0x1234 sequence 7", parsed)
+	}
+	if !bytes.Equal(parsed.Payload, echo.Payload) {
+		t.Errorf("payload = %q, want %q", parsed.Payload, echo.Payload)
+	}
+}
+
+func TestParseEchoRejectsMalformed(t *testing.T) {
+	valid := (&Echo{Type: TypeEchoReply, Identifier: 1, Sequence: 1, Payload: []byte("x")}).Marshal()
+	corrupt := append([]byte{}, valid...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	unreachable := append([]byte{}, valid...)
+	unreachable[0] = 3
+
+	cases := map[string][]byte{
+		"too short":    valid[:4],
+		"bad checksum": corrupt,
+		"not an echo":  unreachable,
+	}
+	for name, message := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseEcho(message); !errors.Is(err, ErrInvalidMessage) {
+				t.Errorf("ParseEcho error = %v, want ErrInvalidMessage", err)
+			}
+		})
+	}
+}
+
+// recordingConn is a net.PacketConn that records the echo sequence of every
+// reply written to it.
+type recordingConn struct {
+	net.PacketConn
+
+	mutex     sync.Mutex
+	sequences []uint16
+}
+
+func (self *recordingConn) WriteTo(message []byte, address net.Addr) (int, error) {
+	echo, err := ParseEcho(message)
+	if err != nil {
+		return 0, err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.sequences = append(self.sequences, echo.Sequence)
+	return len(message), nil
+}
+
+func (self *recordingConn) replies() []uint16 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]uint16(nil), self.sequences...)
+}
+
+func TestPeerAnswersHeldRequests(t *testing.T) {
+	key, err := obfuscate.DeriveKey([]byte("password"))
+	if err != nil {
+		t.Fatalf("DeriveKey: %s", err)
+	}
+	codec, err := obfuscate.NewCodec(key, 0)
+	if err != nil {
+		t.Fatalf("NewCodec: %s", err)
+	}
+	conn := &recordingConn{}
+	listener := &Listener{conn: conn, codec: codec, peers: make(map[string]*echoPeer)}
+	peer := listener.peer(&net.IPAddr{IP: net.ParseIP("192.0.2.1")}, 99)
+	frame := ipv4.MakeFrame(net.ParseIP("172.18.0.1"), net.ParseIP("172.18.0.2"))
+
+	// A frame with no request to ride on waits in the queue ...
+	peer.Send(frame)
+	if got := conn.replies(); len(got) != 0 {
+		t.Fatalf("replied %v with no request held, want nothing", got)
+	}
+	// ... until the next request arrives and carries it.
+	peer.hold(1)
+	if got := conn.replies(); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("replies = %v, want [1]", got)
+	}
+
+	// Held requests are answered oldest first as frames arrive.
+	peer.hold(2)
+	peer.hold(3)
+	peer.Send(frame)
+	if got := conn.replies(); len(got) != 2 || got[1] != 2 {
+		t.Fatalf("replies = %v, want [1 2]", got)
+	}
+
+	// A request held past the timeout is no longer answered.
+	peer.mutex.Lock()
+	peer.pending[0].receivedNanos = time.Now().Add(-2 * pendingTimeout).UnixNano()
+	peer.mutex.Unlock()
+	peer.Send(frame)
+	if got := conn.replies(); len(got) != 2 {
+		t.Fatalf("replies = %v, want the stale request skipped", got)
+	}
+}
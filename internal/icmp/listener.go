@@ -0,0 +1,292 @@
+package icmp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/core"
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+var log = logging.MustGetLogger("icmp")
+
+const (
+	// peerIdleTimeout is how long an ICMP peer may go without any request before
+	// it is reaped, releasing its route and any frames still queued for it.
+	peerIdleTimeout = 60 * time.Second
+
+	// reapInterval is how often idle ICMP peers are swept.
+	reapInterval = 15 * time.Second
+
+	// maxPendingRequests bounds how many unanswered echo requests are held per
+	// peer, waiting for a frame to carry back.
+	maxPendingRequests = 64
+
+	// pendingTimeout is how long a held request stays answerable. Stateful
+	// firewalls forget an echo request after a while (Linux conntrack: 30s), and a
+	// reply after that point would be dropped on the way back.
+	pendingTimeout = 10 * time.Second
+
+	// maxQueuedFrames bounds the frames waiting for a request to ride on when the
+	// client has no poll outstanding.
+	maxQueuedFrames = 256
+)
+
+// Listener is the server-side ICMP transport. It reads echo requests on a raw
+// socket, feeds the frames they carry into a core.Router, and registers a Sink
+// per peer that answers the peer's held requests with return traffic.
+type Listener struct {
+	router *core.Router
+	conn   net.PacketConn
+	codec  *obfuscate.Codec
+
+	sequence uint64
+
+	mutex sync.Mutex
+	peers map[string]*echoPeer
+
+	done  chan struct{}
+	group sync.WaitGroup
+}
+
+// echoPeer is one client, identified by its address and echo identifier (a NAT
+// may rewrite the identifier, so it is taken as observed).
+type echoPeer struct {
+	listener   *Listener
+	address    *net.IPAddr
+	identifier uint16
+
+	replay        obfuscate.ReplayWindow // read loop only
+	lastSeenNanos int64                  // atomic; UnixNano of the last request
+
+	mutex   sync.Mutex
+	pending []pendingRequest
+	queue   []ipv4.Frame
+}
+
+// pendingRequest is an echo request held so its reply can carry a later frame.
+type pendingRequest struct {
+	sequence      uint16
+	receivedNanos int64
+}
+
+// NewListener opens a raw ICMP socket on the given local IPv4 address ("0.0.0.0"
+// for all). It needs CAP_NET_RAW.
+func NewListener(router *core.Router, listen string, password []byte, maxPadding int) (*Listener, error) {
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := obfuscate.NewCodec(key, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("ip4:icmp", listen)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		router: router,
+		conn:   conn,
+		codec:  codec,
+		peers:  make(map[string]*echoPeer),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Addr reports the local address the listener is bound to.
+func (self *Listener) Addr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *Listener) Start() {
+	self.group.Add(2)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.readLoop()
+	}()
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.reapLoop()
+	}()
+}
+
+func (self *Listener) Stop() {
+	close(self.done)
+	_ = self.conn.Close()
+	self.group.Wait()
+}
+
+func (self *Listener) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.reap()
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// reap removes ICMP peers that have stopped sending requests.
+func (self *Listener) reap() {
+	cutoff := time.Now().UnixNano() - int64(peerIdleTimeout)
+
+	var expired []core.Sink
+	self.mutex.Lock()
+	for key, peer := range self.peers {
+		if atomic.LoadInt64(&peer.lastSeenNanos) < cutoff {
+			expired = append(expired, peer)
+			delete(self.peers, key)
+			log.Debugf("icmp peer expired: %s", key)
+		}
+	}
+	self.mutex.Unlock()
+
+	for _, sink := range expired {
+		self.router.Unregister(sink)
+	}
+}
+
+func (self *Listener) readLoop() {
+	buffer := make([]byte, 65536)
+	for {
+		size, address, err := self.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-self.done:
+			default:
+				log.Warningf("failed to read icmp message: %s", err)
+			}
+			return
+		}
+
+		echo, err := ParseEcho(buffer[:size])
+		if err != nil || echo.Type != TypeEchoRequest {
+			continue // ordinary ICMP traffic (or our own replies); not for us
+		}
+		sequence, streamId, payload, err := self.codec.Open(echo.Payload)
+		if err != nil || streamId != obfuscate.StreamEchoRequest {
+			continue // an ordinary ping; the kernel answers it
+		}
+
+		peer := self.peer(address.(*net.IPAddr), echo.Identifier)
+		if !peer.replay.Accept(sequence) {
+			continue
+		}
+		atomic.StoreInt64(&peer.lastSeenNanos, time.Now().UnixNano())
+
+		if len(payload) == 0 {
+			peer.hold(echo.Sequence) // a poll: answer it when there is something to send
+			continue
+		}
+
+		frame := ipv4.DecodeFrame(payload)
+		if frame == nil {
+			continue
+		}
+		source := frame.Source()
+		if self.router.IP().Equal(source) {
+			continue // a client must not claim the server's own address
+		}
+
+		if source.Equal(frame.Destination()) {
+			// keepalive; keep a route available and answer it right away
+			self.router.EnsureRoute(source, peer)
+			peer.reply(echo.Sequence, ipv4.MakeFrame(self.router.IP(), self.router.IP()))
+			continue
+		}
+
+		// A data frame: learn a route back to its source via this peer, forward the
+		// frame, and keep the request to carry return traffic.
+		self.router.Receive(frame.Copy(), peer)
+		peer.hold(echo.Sequence)
+	}
+}
+
+// peer returns the peer for an address and echo identifier, creating it on first
+// sight.
+func (self *Listener) peer(address *net.IPAddr, identifier uint16) *echoPeer {
+	key := address.String() + "/" + strconv.Itoa(int(identifier))
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	existing, ok := self.peers[key]
+	if !ok {
+		existing = &echoPeer{listener: self, address: address, identifier: identifier}
+		self.peers[key] = existing
+	}
+	return existing
+}
+
+// Send routes a frame toward the peer: it answers the oldest held request if
+// there is one, and otherwise queues the frame for the next request to arrive.
+func (self *echoPeer) Send(frame ipv4.Frame) {
+	self.mutex.Lock()
+	sequence, ok := self.takeRequest()
+	if !ok {
+		if len(self.queue) < maxQueuedFrames {
+			self.queue = append(self.queue, frame)
+		}
+		self.mutex.Unlock()
+		return
+	}
+	self.mutex.Unlock()
+	self.reply(sequence, frame)
+}
+
+// hold keeps a request so its reply can carry return traffic, answering it at
+// once if a frame is already queued.
+func (self *echoPeer) hold(sequence uint16) {
+	self.mutex.Lock()
+	if len(self.queue) > 0 {
+		frame := self.queue[0]
+		self.queue = self.queue[1:]
+		self.mutex.Unlock()
+		self.reply(sequence, frame)
+		return
+	}
+	if len(self.pending) >= maxPendingRequests {
+		self.pending = self.pending[1:]
+	}
+	self.pending = append(self.pending, pendingRequest{sequence: sequence, receivedNanos: time.Now().UnixNano()})
+	self.mutex.Unlock()
+}
+
+// takeRequest pops the oldest held request that is still answerable. The caller
+// holds the mutex.
+func (self *echoPeer) takeRequest() (uint16, bool) {
+	cutoff := time.Now().UnixNano() - int64(pendingTimeout)
+	for len(self.pending) > 0 {
+		request := self.pending[0]
+		self.pending = self.pending[1:]
+		if request.receivedNanos >= cutoff {
+			return request.sequence, true
+		}
+	}
+	return 0, false
+}
+
+// reply answers one echo request with a frame.
+func (self *echoPeer) reply(sequence uint16, frame ipv4.Frame) {
+	listener := self.listener
+	payload, err := listener.codec.Seal(atomic.AddUint64(&listener.sequence, 1), obfuscate.StreamEchoReply, frame)
+	if err != nil {
+		log.Warningf("failed to seal frame: %s", err)
+		return
+	}
+	echo := &Echo{Type: TypeEchoReply, Identifier: self.identifier, Sequence: sequence, Payload: payload}
+	if _, err := listener.conn.WriteTo(echo.Marshal(), self.address); err != nil {
+		log.Warningf("failed to send echo reply to %s: %s", self.address, err)
+	}
+}
@@ -0,0 +1,28 @@
+package ipv4
+
+// Checksum computes the Internet checksum (RFC 1071) over the concatenation of
+// parts, so a header and a pseudo-header can be summed without copying them into
+// one buffer. A part may have an odd length; its trailing byte is paired with
+// the first byte of the next part, exactly as if the parts were contiguous.
+func Checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	var pending byte
+	odd := false
+	for _, part := range parts {
+		for _, value := range part {
+			if odd {
+				sum += uint32(pending)<<8 | uint32(value)
+			} else {
+				pending = value
+			}
+			odd = !odd
+		}
+	}
+	if odd {
+		sum += uint32(pending) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -121,3 +121,24 @@ func TestScanFrameDiscardsGarbage(t *testing.T) {
 		t.Errorf("ScanFrame on garbage = (%d, %v), want (%d, nil)", advance, token, len(garbage))
 	}
 }
+
+func TestChecksum(t *testing.T) {
+	// The worked example from RFC 1071, section 3.
+	data := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if got := Checksum(data); got != ^uint16(0xddf2) {
+		t.Fatalf("Checksum = %#04x, want %#04x", got, ^uint16(0xddf2))
+	}
+
+	// Splitting the input, even at an odd offset, must not change the result.
+	if got := Checksum(data[:3], data[3:5], data[5:]); got != Checksum(data) {
+		t.Errorf("split Checksum = %#04x, want %#04x", got, Checksum(data))
+	}
+
+	// A buffer that embeds its own checksum sums to zero.
+	withChecksum := append(append([]byte{}, data...), 0, 0)
+	sum := Checksum(data)
+	withChecksum[8], withChecksum[9] = byte(sum>>8), byte(sum)
+	if got := Checksum(withChecksum); got != 0 {
+		t.Errorf("Checksum over embedded checksum = %#04x, want 0", got)
+	}
+}
@@ -0,0 +1,52 @@
+// Package meek carries obfuscated frames in short-lived HTTP requests, for
+// networks where only ordinary web requests get out (for example through a
+// strict corporate proxy that cuts long-lived connections). A client POSTs
+// batches of datagrams under a random session id, and the server returns
+// datagrams for that client in the responses. Each request is held open for a
+// while when there is nothing to return (long-polling), and a client keeps a few
+// requests in flight so traffic in both directions moves without waiting for a
+// round trip.
+//
+// Each datagram is sealed exactly like a UDP datagram (see internal/obfuscate),
+// so the HTTP bodies are high-entropy bytes of varying length.
+package meek
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// SessionHeader names the request header that carries the client's session id.
+const SessionHeader = "X-Session-Id"
+
+// lengthPrefixSize is the size of the length that precedes each datagram in a
+// request or response body.
+const lengthPrefixSize = 2
+
+// ErrInvalidBody is returned by SplitBody for a body that is not a sequence of
+// length-prefixed datagrams.
+var ErrInvalidBody = errors.New("meek: invalid body")
+
+// AppendDatagram appends one length-prefixed datagram to body.
+func AppendDatagram(body []byte, datagram []byte) []byte {
+	body = binary.BigEndian.AppendUint16(body, uint16(len(datagram)))
+	return append(body, datagram...)
+}
+
+// SplitBody splits a body into its datagrams, which alias body.
+func SplitBody(body []byte) ([][]byte, error) {
+	var datagrams [][]byte
+	for len(body) > 0 {
+		if len(body) < lengthPrefixSize {
+			return nil, ErrInvalidBody
+		}
+		length := int(binary.BigEndian.Uint16(body))
+		body = body[lengthPrefixSize:]
+		if length > len(body) {
+			return nil, ErrInvalidBody
+		}
+		datagrams = append(datagrams, body[:length])
+		body = body[length:]
+	}
+	return datagrams, nil
+}
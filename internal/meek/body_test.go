@@ -0,0 +1,162 @@
+package meek
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+func TestBodyRoundTrip(t *testing.T) {
+	datagrams := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, 1500)}
+	var body []byte
+	for _, datagram := range datagrams {
+		body = AppendDatagram(body, datagram)
+	}
+
+	split, err := SplitBody(body)
+	if err != nil {
+		t.Fatalf("SplitBody: %s", err)
+	}
+	if len(split) != len(datagrams) {
+		t.Fatalf("got %d datagrams, want %d", len(split), len(datagrams))
+	}
+	for index := range datagrams {
+		if !bytes.Equal(split[index], datagrams[index]) {
+			t.Errorf("datagram %d = %x, want %x", index, split[index], datagrams[index])
+		}
+	}
+}
+
+func TestSplitBodyRejectsMalformed(t *testing.T) {
+	valid := AppendDatagram(nil, []byte("datagram"))
+	cases := map[string][]byte{
+		"lone length byte": {0x00},
+		"truncated":        valid[:len(valid)-1],
+	}
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := SplitBody(body); !errors.Is(err, ErrInvalidBody) {
+				t.Errorf("SplitBody error = %v, want ErrInvalidBody", err)
+			}
+		})
+	}
+}
+
+func TestServeHTTPHidesFromProbes(t *testing.T) {
+	key, err := obfuscate.DeriveKey([]byte("shared-secret"))
+	if err != nil {
+		t.Fatalf("DeriveKey: %s", err)
+	}
+	codec, err := obfuscate.NewCodec(key, 0)
+	if err != nil {
+		t.Fatalf("NewCodec: %s", err)
+	}
+	listener := &Listener{codec: codec, sessions: make(map[string]*session), done: make(chan struct{})}
+
+	cases := map[string]*http.Request{
+		"get":            httptest.NewRequest(http.MethodGet, "/", nil),
+		"no session":     httptest.NewRequest(http.MethodPost, "/", nil),
+		"empty poll":     withSession(httptest.NewRequest(http.MethodPost, "/", nil)),
+		"garbage":        withSession(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not a body"))),
+		"unsealed frame": withSession(httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(AppendDatagram(nil, []byte("plaintext"))))),
+	}
+	for name, request := range cases {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			listener.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", recorder.Code)
+			}
+		})
+	}
+	if len(listener.sessions) != 0 {
+		t.Errorf("probes created %d sessions, want none", len(listener.sessions))
+	}
+}
+
+func withSession(request *http.Request) *http.Request {
+	request.Header.Set(SessionHeader, "session")
+	return request
+}
+
+func TestSessionBatchesQueuedFrames(t *testing.T) {
+	current := &session{id: "session", ready: make(chan struct{}, 1)}
+	frame := ipv4.MakeFrame([]byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	for range 3 {
+		current.Send(frame)
+	}
+
+	frames := current.wait(context.Background(), nil)
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3 in one response", len(frames))
+	}
+
+	// A response never grows past maxResponseSize; the remainder waits for the
+	// next request, which is woken for it.
+	large := make(ipv4.Frame, maxResponseSize/2+1)
+	copy(large, frame)
+	current.Send(large)
+	current.Send(large)
+	if frames := current.wait(context.Background(), nil); len(frames) != 1 {
+		t.Fatalf("got %d large frames, want 1", len(frames))
+	}
+	select {
+	case <-current.ready:
+	default:
+		t.Fatal("remaining frame did not wake another request")
+	}
+	if frames := current.take(); len(frames) != 1 {
+		t.Fatalf("got %d remaining frames, want 1", len(frames))
+	}
+}
+
+func TestServeHTTPAnswersOnlyFreshPolls(t *testing.T) {
+	key, err := obfuscate.DeriveKey([]byte("shared-secret"))
+	if err != nil {
+		t.Fatalf("DeriveKey: %s", err)
+	}
+	codec, err := obfuscate.NewCodec(key, 0)
+	if err != nil {
+		t.Fatalf("NewCodec: %s", err)
+	}
+	listener := &Listener{codec: codec, sessions: make(map[string]*session), done: make(chan struct{})}
+	current := listener.create("session")
+	current.Send(ipv4.MakeFrame([]byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}))
+
+	poll, err := codec.Seal(1, obfuscate.StreamPoll, nil)
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	serve := func(body []byte) int {
+		recorder := httptest.NewRecorder()
+		listener.ServeHTTP(recorder, withSession(httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))))
+		return recorder.Code
+	}
+
+	// Knowing the session id is not enough to collect its frames.
+	if code := serve(nil); code != http.StatusNotFound {
+		t.Errorf("unauthenticated poll status = %d, want 404", code)
+	}
+	if code := serve(AppendDatagram(nil, poll)); code != http.StatusOK {
+		t.Errorf("authenticated poll status = %d, want 200", code)
+	}
+	if len(current.queue) != 0 {
+		t.Errorf("%d frames left after the authenticated poll", len(current.queue))
+	}
+
+	// Nor is replaying a poll the client already made.
+	current.Send(ipv4.MakeFrame([]byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}))
+	if code := serve(AppendDatagram(nil, poll)); code != http.StatusNotFound {
+		t.Errorf("replayed poll status = %d, want 404", code)
+	}
+	if len(current.queue) != 1 {
+		t.Errorf("replayed poll took the queued frame")
+	}
+}
@@ -0,0 +1,336 @@
+package meek
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/core"
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+var log = logging.MustGetLogger("meek")
+
+const (
+	// PollTimeout is how long the server holds a request open waiting for return
+	// traffic before answering it empty. It stays well under the idle timeouts of
+	// common proxies.
+	PollTimeout = 10 * time.Second
+
+	// sessionIdleTimeout is how long a session may go without any request before
+	// it is reaped, releasing its route and any frames still queued for it.
+	sessionIdleTimeout = 60 * time.Second
+
+	// reapInterval is how often idle sessions are swept.
+	reapInterval = 15 * time.Second
+
+	// maxSessionIdSize bounds the session id a client may present.
+	maxSessionIdSize = 64
+
+	// maxRequestSize bounds a request body.
+	maxRequestSize = 1 << 20
+
+	// maxResponseSize bounds the datagrams batched into one response; the rest
+	// wait for the next request.
+	maxResponseSize = 1 << 16
+
+	// maxQueuedFrames bounds the frames waiting for a request to carry them.
+	maxQueuedFrames = 1024
+)
+
+// Listener is the server-side HTTP polling transport: an HTTP server whose
+// handler feeds the frames in request bodies into a core.Router and answers with
+// the frames queued for that session. Each session is a Sink.
+type Listener struct {
+	router   *core.Router
+	codec    *obfuscate.Codec
+	listener net.Listener
+	server   *http.Server
+
+	sequence uint64
+
+	mutex    sync.Mutex
+	sessions map[string]*session
+
+	done  chan struct{}
+	group sync.WaitGroup
+}
+
+// session is one client, identified by the random id it sends with every
+// request.
+type session struct {
+	id            string
+	lastSeenNanos int64 // atomic; UnixNano of the last request
+
+	mutex  sync.Mutex
+	replay obfuscate.ReplayWindow
+	queue  []ipv4.Frame
+	ready  chan struct{} // signalled when the queue becomes non-empty
+}
+
+// NewListener listens for plain HTTP on listen. Put it behind a TLS-terminating
+// reverse proxy or CDN to serve HTTPS.
+func NewListener(router *core.Router, listen string, password []byte, maxPadding int) (*Listener, error) {
+	key, err := obfuscate.DeriveKey(password)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := obfuscate.NewCodec(key, maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	self := &Listener{
+		router:   router,
+		codec:    codec,
+		listener: listener,
+		sessions: make(map[string]*session),
+		done:     make(chan struct{}),
+	}
+	self.server = &http.Server{Handler: self, ReadHeaderTimeout: PollTimeout}
+	return self, nil
+}
+
+// Addr reports the local address the HTTP server is bound to.
+func (self *Listener) Addr() net.Addr {
+	return self.listener.Addr()
+}
+
+func (self *Listener) Start() {
+	self.group.Add(2)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		if err := self.server.Serve(self.listener); err != nil && err != http.ErrServerClosed {
+			log.Warningf("failed to serve http: %s", err)
+		}
+	}()
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.reapLoop()
+	}()
+}
+
+func (self *Listener) Stop() {
+	close(self.done)
+	_ = self.server.Close()
+	_ = self.listener.Close()
+	self.group.Wait()
+}
+
+func (self *Listener) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.reap()
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// reap removes sessions that have stopped polling.
+func (self *Listener) reap() {
+	cutoff := time.Now().UnixNano() - int64(sessionIdleTimeout)
+
+	var expired []core.Sink
+	self.mutex.Lock()
+	for id, existing := range self.sessions {
+		if atomic.LoadInt64(&existing.lastSeenNanos) < cutoff {
+			expired = append(expired, existing)
+			delete(self.sessions, id)
+			log.Debugf("http session expired: %s", id)
+		}
+	}
+	self.mutex.Unlock()
+
+	for _, sink := range expired {
+		self.router.Unregister(sink)
+	}
+}
+
+// ServeHTTP handles one poll. Anything that is not an authenticated POST gets a
+// plain 404, so the server looks like an ordinary web server to a prober.
+func (self *Listener) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	id := request.Header.Get(SessionHeader)
+	if request.Method != http.MethodPost || id == "" || len(id) > maxSessionIdSize {
+		http.NotFound(writer, request)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxRequestSize))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+	datagrams, err := SplitBody(body)
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+
+	// Only an authenticated datagram may create a session, so a prober cannot
+	// fill the session table, and only a request carrying a fresh one is
+	// answered with the session's frames, so one that merely knows the id
+	// cannot take them.
+	current := self.lookup(id)
+	authenticated := false
+	for _, datagram := range datagrams {
+		sequence, streamId, payload, err := self.codec.Open(datagram)
+		if err != nil || (streamId != obfuscate.StreamFrame && streamId != obfuscate.StreamPoll) {
+			continue
+		}
+		if current == nil {
+			current = self.create(id)
+		}
+		if !current.accept(sequence) {
+			continue
+		}
+		authenticated = true
+		if streamId == obfuscate.StreamFrame {
+			self.receive(current, payload)
+		}
+	}
+	if !authenticated {
+		http.NotFound(writer, request)
+		return
+	}
+	atomic.StoreInt64(&current.lastSeenNanos, time.Now().UnixNano())
+
+	var response []byte
+	for _, frame := range current.wait(request.Context(), self.done) {
+		sealed, err := self.codec.Seal(atomic.AddUint64(&self.sequence, 1), obfuscate.StreamFrame, frame)
+		if err != nil {
+			log.Warningf("failed to seal frame: %s", err)
+			continue
+		}
+		response = AppendDatagram(response, sealed)
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := writer.Write(response); err != nil {
+		log.Debugf("failed to write http response to session %s: %s", id, err)
+	}
+}
+
+// receive handles the frame of one authenticated, fresh datagram from a
+// session.
+func (self *Listener) receive(current *session, payload []byte) {
+	frame := ipv4.DecodeFrame(payload)
+	if frame == nil {
+		return
+	}
+	source := frame.Source()
+	if self.router.IP().Equal(source) {
+		return // a client must not claim the server's own address
+	}
+
+	if source.Equal(frame.Destination()) {
+		// keepalive; keep a route available and reply
+		self.router.EnsureRoute(source, current)
+		current.Send(ipv4.MakeFrame(self.router.IP(), self.router.IP()))
+		return
+	}
+
+	// A data frame: learn a route back to its source via this session, then
+	// forward it.
+	self.router.Receive(frame.Copy(), current)
+}
+
+func (self *Listener) lookup(id string) *session {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.sessions[id]
+}
+
+func (self *Listener) create(id string) *session {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	existing, ok := self.sessions[id]
+	if !ok {
+		existing = &session{id: id, ready: make(chan struct{}, 1)}
+		self.sessions[id] = existing
+		log.Infof("http session established: %s", id)
+	}
+	return existing
+}
+
+// accept reports whether a datagram sequence is fresh. Requests of one session
+// may be handled concurrently, so the replay window is guarded.
+func (self *session) accept(sequence uint64) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.replay.Accept(sequence)
+}
+
+// Send queues a frame for the session's next response, dropping it if the queue
+// is full.
+func (self *session) Send(frame ipv4.Frame) {
+	self.mutex.Lock()
+	if len(self.queue) >= maxQueuedFrames {
+		self.mutex.Unlock()
+		return
+	}
+	self.queue = append(self.queue, frame)
+	self.mutex.Unlock()
+	self.signal()
+}
+
+func (self *session) signal() {
+	select {
+	case self.ready <- struct{}{}:
+	default:
+	}
+}
+
+// wait returns the frames queued for the session, waiting up to PollTimeout for
+// one to arrive.
+func (self *session) wait(ctx context.Context, done <-chan struct{}) []ipv4.Frame {
+	timer := time.NewTimer(PollTimeout)
+	defer timer.Stop()
+	for {
+		if frames := self.take(); len(frames) > 0 {
+			return frames
+		}
+		select {
+		case <-self.ready:
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// take removes up to a response's worth of queued frames. If frames remain, it
+// wakes another waiting request to carry them.
+func (self *session) take() []ipv4.Frame {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	size := 0
+	count := 0
+	for count < len(self.queue) && (count == 0 || size+len(self.queue[count]) <= maxResponseSize) {
+		size += len(self.queue[count])
+		count++
+	}
+	frames := self.queue[:count:count]
+	self.queue = self.queue[count:]
+	if len(self.queue) > 0 {
+		self.signal()
+	}
+	return frames
+}
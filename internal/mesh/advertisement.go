@@ -0,0 +1,104 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+const (
+	// Protocol is the IPv4 protocol number of an advertisement frame, one of
+	// those reserved for experimentation (RFC 3692). Advertisements travel
+	// between two servers only and are never routed.
+	Protocol = 253
+
+	// MaxRoutes bounds the routes of one advertisement.
+	MaxRoutes = 1024
+
+	// MaxPath bounds the routers a route may pass through, which also bounds
+	// the diameter of a mesh.
+	MaxPath = 8
+)
+
+// ErrInvalidAdvertisement is returned by ParseAdvertisement for a frame that is
+// not a well-formed advertisement.
+var ErrInvalidAdvertisement = errors.New("mesh: invalid advertisement")
+
+// Route is one prefix a router can reach, and the tunnel addresses of the
+// routers on the way to it, nearest first; the last one is where the prefix is
+// attached.
+type Route struct {
+	Network *net.IPNet
+	Path    []net.IP
+}
+
+// broadcast is the destination of every advertisement: it is addressed to
+// whichever router is on the other end of the session.
+var broadcast = net.IPv4bcast
+
+// IsAdvertisement reports whether frame is an advertisement.
+func IsAdvertisement(frame ipv4.Frame) bool {
+	return frame.Protocol() == Protocol && frame.Destination().Equal(broadcast)
+}
+
+// MakeAdvertisement encodes routes as a frame from source, the sending router.
+func MakeAdvertisement(source net.IP, routes []Route) ipv4.Frame {
+	if len(routes) > MaxRoutes {
+		routes = routes[:MaxRoutes]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(routes)))
+	for _, route := range routes {
+		ones, _ := route.Network.Mask.Size()
+		payload = append(payload, route.Network.IP.To4()...)
+		payload = append(payload, byte(ones), byte(len(route.Path)))
+		for _, hop := range route.Path {
+			payload = append(payload, hop.To4()...)
+		}
+	}
+
+	header := ipv4.MakeFrame(source, broadcast)
+	frame := append(header, payload...)
+	frame.SetTotalLength(uint16(len(frame)))
+	frame[9] = Protocol
+	return frame
+}
+
+// ParseAdvertisement decodes the routes of an advertisement frame.
+func ParseAdvertisement(frame ipv4.Frame) ([]Route, error) {
+	if !IsAdvertisement(frame) {
+		return nil, ErrInvalidAdvertisement
+	}
+	payload := frame.Payload()
+	if len(payload) < 2 {
+		return nil, ErrInvalidAdvertisement
+	}
+	count := int(binary.BigEndian.Uint16(payload))
+	if count > MaxRoutes {
+		return nil, ErrInvalidAdvertisement
+	}
+	payload = payload[2:]
+	routes := make([]Route, 0, count)
+	for range count {
+		if len(payload) < 6 {
+			return nil, ErrInvalidAdvertisement
+		}
+		ones, hops := int(payload[4]), int(payload[5])
+		if ones > 32 || hops == 0 || hops > MaxPath || len(payload) < 6+4*hops {
+			return nil, ErrInvalidAdvertisement
+		}
+		mask := net.CIDRMask(ones, 32)
+		route := Route{Network: &net.IPNet{IP: net.IP(append([]byte{}, payload[:4]...)).Mask(mask), Mask: mask}}
+		for index := range hops {
+			offset := 6 + 4*index
+			route.Path = append(route.Path, net.IP(append([]byte{}, payload[offset:offset+4]...)))
+		}
+		routes = append(routes, route)
+		payload = payload[6+4*hops:]
+	}
+	if len(payload) != 0 {
+		return nil, ErrInvalidAdvertisement
+	}
+	return routes, nil
+}
@@ -0,0 +1,254 @@
+// Package mesh federates servers: each advertises to the servers it has a
+// session with the prefixes attached to it — its tunnel subnet, and the
+// addresses of networks its clients route for — and the ones it has learned
+// from others, so that a frame for a client of another region is forwarded to
+// the server it is attached to.
+//
+// Routes carry the path of routers they were learned through (path vector, as
+// in BGP): a router ignores any route whose path already names it, so frames
+// never loop, and prefers the most specific prefix, then the shortest path.
+// Advertisements are periodic and complete; a session that goes quiet, or
+// ends, takes its routes with it.
+package mesh
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/core"
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+var log = logging.MustGetLogger("mesh")
+
+const (
+	// advertiseInterval is how often every peer is sent the full route table.
+	advertiseInterval = 10 * time.Second
+
+	// holdTime is how long a peer's routes last without a fresh advertisement.
+	holdTime = 3 * advertiseInterval
+)
+
+// Mesh is one server's view of the mesh: its sessions with peer servers (each
+// known by the core.Sink that reaches it) and the routes each advertised. It
+// implements core.PrefixRoutes for the server's router.
+type Mesh struct {
+	router *core.Router
+
+	mutex sync.Mutex
+	peers map[core.Sink]*peer
+
+	done  chan struct{}
+	group sync.WaitGroup
+}
+
+type peer struct {
+	ip      net.IP // the peer's tunnel address; nil until it advertises
+	routes  []Route
+	updated time.Time
+}
+
+func New(router *core.Router) *Mesh {
+	return &Mesh{
+		router: router,
+		peers:  make(map[core.Sink]*peer),
+		done:   make(chan struct{}),
+	}
+}
+
+func (self *Mesh) Start() {
+	self.group.Add(1)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.advertiseLoop()
+	}()
+}
+
+func (self *Mesh) Stop() {
+	close(self.done)
+	self.group.Wait()
+}
+
+// Connect adds a session with a peer server and advertises to it at once.
+func (self *Mesh) Connect(sink core.Sink) {
+	self.mutex.Lock()
+	if _, ok := self.peers[sink]; !ok {
+		self.peers[sink] = &peer{}
+	}
+	self.mutex.Unlock()
+	self.advertise(sink)
+}
+
+// Disconnect forgets a session and the routes learned through it.
+func (self *Mesh) Disconnect(sink core.Sink) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if current, ok := self.peers[sink]; ok {
+		delete(self.peers, sink)
+		if current.ip != nil {
+			log.Infof("mesh peer %s disconnected", current.ip)
+		}
+	}
+}
+
+// IsPeer reports whether sink reaches a peer server rather than a client.
+func (self *Mesh) IsPeer(sink core.Sink) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	_, ok := self.peers[sink]
+	return ok
+}
+
+// Receive takes an advertisement frame arriving over a session, replacing the
+// routes of its peer. A session seen for the first time is added, and
+// advertised to at once.
+func (self *Mesh) Receive(sink core.Sink, frame ipv4.Frame) {
+	routes, err := ParseAdvertisement(frame)
+	if err != nil {
+		log.Warningf("dropped advertisement: %s", err)
+		return
+	}
+	source := frame.Source()
+	if source.Equal(self.router.IP()) {
+		return // a session with ourselves
+	}
+	var accepted []Route
+	for _, route := range routes {
+		if !slices.ContainsFunc(route.Path, self.router.IP().Equal) && route.Path[0].Equal(source) {
+			accepted = append(accepted, route)
+		}
+	}
+
+	self.mutex.Lock()
+	current, known := self.peers[sink]
+	if !known {
+		current = &peer{}
+		self.peers[sink] = current
+	}
+	if current.ip == nil {
+		log.Infof("mesh peer %s connected", source)
+	}
+	current.ip, current.routes, current.updated = source, accepted, time.Now()
+	self.mutex.Unlock()
+
+	if !known {
+		self.advertise(sink)
+	}
+}
+
+// Lookup returns the peer toward destination: the one advertising the most
+// specific prefix containing it, by the shortest path.
+func (self *Mesh) Lookup(destination net.IP) (core.Sink, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var best core.Sink
+	var bestRoute Route
+	for sink, current := range self.peers {
+		for _, route := range current.routes {
+			if route.Network.Contains(destination) && (best == nil || better(route, bestRoute)) {
+				best, bestRoute = sink, route
+			}
+		}
+	}
+	return best, best != nil
+}
+
+// better reports whether route a is preferred over b: a longer prefix, then a
+// shorter path, then (to break ties the same way on every router) the lower
+// next-hop address.
+func better(a, b Route) bool {
+	aOnes, _ := a.Network.Mask.Size()
+	bOnes, _ := b.Network.Mask.Size()
+	if aOnes != bOnes {
+		return aOnes > bOnes
+	}
+	if len(a.Path) != len(b.Path) {
+		return len(a.Path) < len(b.Path)
+	}
+	return bytes.Compare(a.Path[0].To4(), b.Path[0].To4()) < 0
+}
+
+// routes returns what to advertise to the peer behind sink: the prefixes
+// attached here, and the best route to every prefix learned from other peers
+// that does not already pass through it, with this router prepended.
+func (self *Mesh) routes(sink core.Sink) []Route {
+	ip := self.router.IP()
+	network := self.router.Network()
+	own := []Route{{Network: network, Path: []net.IP{ip}}}
+	for _, address := range self.router.Addresses() {
+		if address.To4() != nil && !network.Contains(address) {
+			own = append(own, Route{Network: &net.IPNet{IP: address.To4(), Mask: net.CIDRMask(32, 32)}, Path: []net.IP{ip}})
+		}
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	target := self.peers[sink]
+	best := make(map[string]Route)
+	for other, current := range self.peers {
+		if other == sink {
+			continue // split horizon
+		}
+		for _, route := range current.routes {
+			if len(route.Path) >= MaxPath || (target != nil && target.ip != nil && slices.ContainsFunc(route.Path, target.ip.Equal)) {
+				continue
+			}
+			key := route.Network.String()
+			if existing, ok := best[key]; !ok || better(route, existing) {
+				best[key] = route
+			}
+		}
+	}
+	routes := own
+	for _, route := range best {
+		if route.Network.String() == network.String() {
+			continue
+		}
+		routes = append(routes, Route{Network: route.Network, Path: append([]net.IP{ip}, route.Path...)})
+	}
+	if len(routes) > MaxRoutes {
+		routes = routes[:MaxRoutes]
+	}
+	return routes
+}
+
+func (self *Mesh) advertise(sink core.Sink) {
+	sink.Send(MakeAdvertisement(self.router.IP(), self.routes(sink)))
+}
+
+// advertiseLoop advertises to every peer each advertiseInterval, and drops the
+// routes of peers that have not advertised within holdTime.
+func (self *Mesh) advertiseLoop() {
+	ticker := time.NewTicker(advertiseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.done:
+			return
+		}
+
+		cutoff := time.Now().Add(-holdTime)
+		var sinks []core.Sink
+		self.mutex.Lock()
+		for sink, current := range self.peers {
+			if current.routes != nil && current.updated.Before(cutoff) {
+				log.Warningf("mesh peer %s timed out", current.ip)
+				current.routes = nil
+			}
+			sinks = append(sinks, sink)
+		}
+		self.mutex.Unlock()
+
+		for _, sink := range sinks {
+			self.advertise(sink)
+		}
+	}
+}
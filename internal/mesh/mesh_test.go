@@ -0,0 +1,157 @@
+package mesh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/ziyan/shadowgate/internal/core"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/tuntest"
+)
+
+type recordingSink struct {
+	mutex  sync.Mutex
+	frames []ipv4.Frame
+}
+
+func (self *recordingSink) Send(frame ipv4.Frame) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.frames = append(self.frames, frame)
+}
+
+func (self *recordingSink) last(t *testing.T) []Route {
+	t.Helper()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.frames) == 0 {
+		t.Fatal("no advertisement sent")
+	}
+	routes, err := ParseAdvertisement(self.frames[len(self.frames)-1])
+	if err != nil {
+		t.Fatalf("ParseAdvertisement: %s", err)
+	}
+	return routes
+}
+
+func mustRoute(t *testing.T, cidr string, path ...string) Route {
+	t.Helper()
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %s", cidr, err)
+	}
+	route := Route{Network: network}
+	for _, hop := range path {
+		route.Path = append(route.Path, net.ParseIP(hop))
+	}
+	return route
+}
+
+func newMesh(t *testing.T, cidr string) *Mesh {
+	t.Helper()
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %s", cidr, err)
+	}
+	return New(core.NewRouter(tuntest.New(), ip, network, nil))
+}
+
+func TestAdvertisementRoundTrip(t *testing.T) {
+	routes := []Route{
+		mustRoute(t, "172.18.1.0/24", "172.18.1.1"),
+		mustRoute(t, "10.9.9.9/32", "172.18.1.1", "172.18.2.1"),
+	}
+	frame := MakeAdvertisement(net.ParseIP("172.18.1.1"), routes)
+	if ipv4.DecodeFrame(frame) == nil || !IsAdvertisement(frame) {
+		t.Fatal("advertisement is not a valid advertisement frame")
+	}
+	parsed, err := ParseAdvertisement(frame)
+	if err != nil {
+		t.Fatalf("ParseAdvertisement: %s", err)
+	}
+	if len(parsed) != len(routes) {
+		t.Fatalf("parsed %d routes, want %d", len(parsed), len(routes))
+	}
+	for index, route := range routes {
+		if parsed[index].Network.String() != route.Network.String() || len(parsed[index].Path) != len(route.Path) {
+			t.Errorf("route %d = %v %v, want %v %v", index, parsed[index].Network, parsed[index].Path, route.Network, route.Path)
+		}
+	}
+
+	truncated := frame[:len(frame)-2].Copy()
+	truncated.SetTotalLength(uint16(len(truncated)))
+	if _, err := ParseAdvertisement(truncated); !errors.Is(err, ErrInvalidAdvertisement) {
+		t.Errorf("truncated: err = %v, want %v", err, ErrInvalidAdvertisement)
+	}
+	if _, err := ParseAdvertisement(ipv4.MakeFrame(net.ParseIP("172.18.1.1"), net.ParseIP("172.18.0.1"))); !errors.Is(err, ErrInvalidAdvertisement) {
+		t.Errorf("plain frame: err = %v, want %v", err, ErrInvalidAdvertisement)
+	}
+}
+
+func TestLookupPrefersSpecificThenShortest(t *testing.T) {
+	self := newMesh(t, "172.18.0.1/24")
+	near, far := &recordingSink{}, &recordingSink{}
+	self.Receive(near, MakeAdvertisement(net.ParseIP("172.18.1.1"), []Route{
+		mustRoute(t, "172.18.1.0/24", "172.18.1.1"),
+		mustRoute(t, "172.18.0.0/16", "172.18.1.1"),
+	}))
+	self.Receive(far, MakeAdvertisement(net.ParseIP("172.18.2.1"), []Route{
+		mustRoute(t, "172.18.2.0/24", "172.18.2.1"),
+		mustRoute(t, "172.18.1.0/24", "172.18.2.1", "172.18.1.1"),
+	}))
+
+	for destination, want := range map[string]core.Sink{
+		"172.18.1.5": near, // shortest path
+		"172.18.2.5": far,  // only route
+		"172.18.9.5": near, // covering prefix
+	} {
+		if got, ok := self.Lookup(net.ParseIP(destination)); !ok || got != want {
+			t.Errorf("Lookup(%s) = %v %v, want the other sink", destination, got, ok)
+		}
+	}
+	if _, ok := self.Lookup(net.ParseIP("10.0.0.1")); ok {
+		t.Error("Lookup found a route to an unadvertised destination")
+	}
+
+	// Once a session ends, its routes go with it.
+	self.Disconnect(near)
+	if got, ok := self.Lookup(net.ParseIP("172.18.1.5")); !ok || got != far {
+		t.Errorf("after disconnect, Lookup = %v %v, want the remaining peer", got, ok)
+	}
+}
+
+func TestLoopFree(t *testing.T) {
+	self := newMesh(t, "172.18.0.1/24")
+	first, second := &recordingSink{}, &recordingSink{}
+
+	// A route that already passes through this router is ignored.
+	self.Receive(first, MakeAdvertisement(net.ParseIP("172.18.1.1"), []Route{
+		mustRoute(t, "172.18.1.0/24", "172.18.1.1"),
+		mustRoute(t, "172.18.3.0/24", "172.18.1.1", "172.18.0.1", "172.18.3.1"),
+	}))
+	if _, ok := self.Lookup(net.ParseIP("172.18.3.5")); ok {
+		t.Error("accepted a route through this router")
+	}
+
+	// The first peer is told its own prefix by nobody (split horizon), and the
+	// second learns it through this router.
+	self.Receive(second, MakeAdvertisement(net.ParseIP("172.18.2.1"), []Route{mustRoute(t, "172.18.2.0/24", "172.18.2.1")}))
+	self.Connect(first)
+	for _, route := range first.last(t) {
+		if route.Network.String() == "172.18.1.0/24" {
+			t.Errorf("advertised %v back to the peer it came from", route.Network)
+		}
+	}
+	self.Connect(second)
+	var found bool
+	for _, route := range second.last(t) {
+		if route.Network.String() == "172.18.1.0/24" {
+			found = len(route.Path) == 2 && route.Path[0].Equal(net.ParseIP("172.18.0.1"))
+		}
+	}
+	if !found {
+		t.Errorf("second peer was not told 172.18.1.0/24 through this router: %v", second.last(t))
+	}
+}
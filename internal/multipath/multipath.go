@@ -0,0 +1,147 @@
+// Package multipath lets the two ends of a tunnel use several links at once. In
+// redundant mode every frame travels over each healthy link, and the receiver
+// keeps the first copy; in bonded mode frames are striped across the links by
+// weight, and the receiver puts them back in order. Either way a frame is
+// wrapped with the sender's session and a sequence number.
+package multipath
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+const (
+	// Protocol is the IPv4 protocol number of a wrapped frame. It is the one
+	// mesh advertisements use (RFC 3692 reserves only two for experimentation),
+	// told apart by the destination: a wrapped frame is addressed to the other
+	// end of the tunnel, an advertisement to the broadcast address.
+	Protocol = 253
+
+	// headerLength is the length of the wrapping payload header: session,
+	// sequence, mode and weight.
+	headerLength = 4 + 8 + 1 + 1
+
+	// Overhead is how many bytes wrapping adds to a frame.
+	Overhead = 20 + headerLength
+)
+
+// ErrInvalidFrame is returned by Unwrap for a frame that is not a well-formed
+// wrapped frame.
+var ErrInvalidFrame = errors.New("multipath: invalid frame")
+
+// Mode selects how outbound frames are spread across links.
+type Mode byte
+
+const (
+	// Active sends every frame over the one link currently chosen, unwrapped.
+	Active Mode = iota
+	// Redundant sends a copy of every frame over each healthy link.
+	Redundant
+	// Bonded stripes frames across the healthy links by weight.
+	Bonded
+)
+
+// ParseMode parses "active", "redundant" or "bonded".
+func ParseMode(value string) (Mode, error) {
+	switch value {
+	case "active":
+		return Active, nil
+	case "redundant":
+		return Redundant, nil
+	case "bonded":
+		return Bonded, nil
+	}
+	return Active, fmt.Errorf("multipath: unknown mode: %q", value)
+}
+
+func (self Mode) String() string {
+	switch self {
+	case Active:
+		return "active"
+	case Redundant:
+		return "redundant"
+	case Bonded:
+		return "bonded"
+	}
+	return fmt.Sprintf("mode(%d)", byte(self))
+}
+
+// Header is what wrapping adds to a frame besides the outer IPv4 header.
+type Header struct {
+	// Session identifies one sender's run; a receiver starts over when it
+	// changes.
+	Session uint32
+	// Sequence numbers the frame within the session, from 1. Copies of one
+	// frame share it.
+	Sequence uint64
+	Mode     Mode
+	// Weight is that of the link the frame was sent over, for the other end to
+	// stripe its own frames by.
+	Weight byte
+}
+
+// Sender numbers the frames one end of the tunnel wraps.
+type Sender struct {
+	session  uint32
+	sequence uint64 // atomic
+}
+
+// NewSender starts a session with a random identifier.
+func NewSender() *Sender {
+	return &Sender{session: rand.Uint32()}
+}
+
+// Next returns the header of the next frame to send in mode. Each copy of the
+// frame sent in redundant mode shares it.
+func (self *Sender) Next(mode Mode) Header {
+	return Header{Session: self.session, Sequence: atomic.AddUint64(&self.sequence, 1), Mode: mode}
+}
+
+// IsWrapped reports whether frame is a wrapped frame.
+func IsWrapped(frame ipv4.Frame) bool {
+	return frame.Protocol() == Protocol && !frame.Destination().Equal(net.IPv4bcast)
+}
+
+// Wrap encloses frame in one from source to destination, the two ends of the
+// tunnel. It reports false if the result would be too large for a frame.
+func Wrap(source, destination net.IP, header Header, frame ipv4.Frame) (ipv4.Frame, bool) {
+	if len(frame)+Overhead > 0xffff {
+		return nil, false
+	}
+	wrapped := ipv4.MakeFrame(source, destination)
+	wrapped = binary.BigEndian.AppendUint32(wrapped, header.Session)
+	wrapped = binary.BigEndian.AppendUint64(wrapped, header.Sequence)
+	wrapped = append(wrapped, byte(header.Mode), header.Weight)
+	wrapped = append(wrapped, frame...)
+	wrapped.SetTotalLength(uint16(len(wrapped)))
+	wrapped[9] = Protocol
+	return wrapped, true
+}
+
+// Unwrap returns the header and the enclosed frame of a wrapped frame.
+func Unwrap(frame ipv4.Frame) (Header, ipv4.Frame, error) {
+	if !IsWrapped(frame) {
+		return Header{}, nil, ErrInvalidFrame
+	}
+	payload := frame.Payload()
+	if len(payload) < headerLength {
+		return Header{}, nil, ErrInvalidFrame
+	}
+	header := Header{
+		Session:  binary.BigEndian.Uint32(payload),
+		Sequence: binary.BigEndian.Uint64(payload[4:]),
+		Mode:     Mode(payload[12]),
+		Weight:   payload[13],
+	}
+	inner := ipv4.DecodeFrame(payload[headerLength:])
+	if inner == nil || header.Sequence == 0 || (header.Mode != Redundant && header.Mode != Bonded) {
+		return Header{}, nil, ErrInvalidFrame
+	}
+	return header, inner, nil
+}
@@ -0,0 +1,136 @@
+package multipath
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+var (
+	clientIP = net.ParseIP("172.18.0.2")
+	serverIP = net.ParseIP("172.18.0.1")
+)
+
+// collector records the frames a Receiver delivers, by destination's last
+// octet.
+type collector struct {
+	mutex  sync.Mutex
+	frames []byte
+}
+
+func (self *collector) deliver(frame ipv4.Frame) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.frames = append(self.frames, frame.Destination().To4()[3])
+}
+
+func (self *collector) delivered() []byte {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]byte{}, self.frames...)
+}
+
+func numbered(number byte) ipv4.Frame {
+	return ipv4.MakeFrame(clientIP, net.IPv4(10, 0, 0, number))
+}
+
+func TestWrapRoundTrip(t *testing.T) {
+	inner := numbered(7)
+	header := Header{Session: 42, Sequence: 9, Mode: Bonded, Weight: 3}
+	wrapped, ok := Wrap(clientIP, serverIP, header, inner)
+	if !ok || ipv4.DecodeFrame(wrapped) == nil || !IsWrapped(wrapped) {
+		t.Fatal("wrapped frame is not a valid wrapped frame")
+	}
+	if len(wrapped) != len(inner)+Overhead {
+		t.Errorf("wrapped length = %d, want %d", len(wrapped), len(inner)+Overhead)
+	}
+	parsed, unwrapped, err := Unwrap(wrapped)
+	if err != nil {
+		t.Fatalf("Unwrap: %s", err)
+	}
+	if parsed != header || string(unwrapped) != string(inner) {
+		t.Errorf("Unwrap = %+v %v, want %+v %v", parsed, unwrapped, header, inner)
+	}
+
+	truncated := wrapped[:len(wrapped)-1].Copy()
+	truncated.SetTotalLength(uint16(len(truncated)))
+	if _, _, err := Unwrap(truncated); !errors.Is(err, ErrInvalidFrame) {
+		t.Errorf("truncated: err = %v, want %v", err, ErrInvalidFrame)
+	}
+	if _, _, err := Unwrap(inner); !errors.Is(err, ErrInvalidFrame) {
+		t.Errorf("plain frame: err = %v, want %v", err, ErrInvalidFrame)
+	}
+}
+
+func TestReceiverDropsCopies(t *testing.T) {
+	var got collector
+	receiver := NewReceiver(got.deliver)
+	defer receiver.Close()
+	for _, sequence := range []uint64{1, 1, 3, 2, 3, 2} {
+		receiver.Receive(Header{Session: 1, Sequence: sequence, Mode: Redundant}, numbered(byte(sequence)))
+	}
+	if delivered := got.delivered(); string(delivered) != string([]byte{1, 3, 2}) {
+		t.Errorf("delivered %v, want each frame once as it first arrived", delivered)
+	}
+
+	// A new session starts over.
+	receiver.Receive(Header{Session: 2, Sequence: 1, Mode: Redundant}, numbered(9))
+	if delivered := got.delivered(); len(delivered) != 4 {
+		t.Errorf("a restarted sender's first frame was dropped: %v", delivered)
+	}
+}
+
+func TestReceiverReorders(t *testing.T) {
+	var got collector
+	receiver := NewReceiver(got.deliver)
+	defer receiver.Close()
+	receive := func(sequence uint64) {
+		receiver.Receive(Header{Session: 1, Sequence: sequence, Mode: Bonded}, numbered(byte(sequence)))
+	}
+
+	for _, sequence := range []uint64{1, 3, 4, 2, 2} {
+		receive(sequence)
+	}
+	if delivered := got.delivered(); string(delivered) != string([]byte{1, 2, 3, 4}) {
+		t.Fatalf("delivered %v, want 1 2 3 4", delivered)
+	}
+
+	// A frame that never comes is given up on after the reorder timeout.
+	receive(6)
+	if delivered := got.delivered(); len(delivered) != 4 {
+		t.Fatalf("delivered %v before the reorder timeout", delivered)
+	}
+	deadline := time.Now().Add(10 * ReorderTimeout)
+	for len(got.delivered()) != 5 && time.Now().Before(deadline) {
+		time.Sleep(ReorderTimeout / 5)
+	}
+	if delivered := got.delivered(); len(delivered) != 5 || delivered[4] != 6 {
+		t.Fatalf("delivered %v, want 6 after the timeout", delivered)
+	}
+}
+
+func TestStripeFollowsWeights(t *testing.T) {
+	var stripe Stripe[string]
+	weights := map[string]int{"fast": 3, "slow": 1}
+	weight := func(name string) int { return weights[name] }
+	counts := make(map[string]int)
+	var previous string
+	for range 40 {
+		pick := stripe.Pick([]string{"fast", "slow"}, weight)
+		if pick == "slow" && previous == "slow" {
+			t.Error("the lighter link was picked twice in a row")
+		}
+		counts[pick]++
+		previous = pick
+	}
+	if counts["fast"] != 30 || counts["slow"] != 10 {
+		t.Errorf("picks = %v, want 30 fast and 10 slow", counts)
+	}
+	if pick := stripe.Pick([]string{"slow"}, weight); pick != "slow" {
+		t.Errorf("Pick = %q, want the only candidate", pick)
+	}
+}
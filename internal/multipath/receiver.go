@@ -0,0 +1,170 @@
+package multipath
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+)
+
+const (
+	// ReorderFrames bounds how many bonded frames wait for an earlier one.
+	ReorderFrames = 64
+
+	// ReorderTimeout is how long bonded frames wait for an earlier one before
+	// the receiver gives up on it.
+	ReorderTimeout = 50 * time.Millisecond
+)
+
+// Receiver takes the wrapped frames of one sender, from whichever links, and
+// delivers each frame once: redundant ones as soon as the first copy arrives,
+// bonded ones in order, waiting a little for any that are late.
+type Receiver struct {
+	deliver func(ipv4.Frame)
+
+	mutex   sync.Mutex
+	started bool
+	session uint32
+	seen    obfuscate.ReplayWindow
+	next    uint64 // the bonded frame delivered next
+	pending map[uint64]ipv4.Frame
+	timer   *time.Timer
+	armed   uint64 // counts timers, so that a stopped one that fires anyway is ignored
+	closed  bool
+
+	// delivering keeps deliveries in order across the goroutines that call
+	// Receive: it is taken before mutex is released.
+	delivering sync.Mutex
+}
+
+// NewReceiver delivers frames by calling deliver, one at a time in order.
+func NewReceiver(deliver func(ipv4.Frame)) *Receiver {
+	return &Receiver{deliver: deliver, pending: make(map[uint64]ipv4.Frame)}
+}
+
+// Receive takes one wrapped frame's header and enclosed frame.
+func (self *Receiver) Receive(header Header, frame ipv4.Frame) {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return
+	}
+	if !self.started || header.Session != self.session {
+		self.reset(header.Session, header.Sequence)
+	}
+	if !self.seen.Accept(header.Sequence) {
+		self.mutex.Unlock()
+		return // a copy already delivered, or too old to tell
+	}
+	var ready []ipv4.Frame
+	if header.Mode != Bonded || header.Sequence < self.next {
+		// Redundant, or a bonded frame that was given up on: late is still
+		// better than never.
+		ready = append(ready, frame)
+		if header.Sequence >= self.next {
+			self.next = header.Sequence + 1
+			ready = append(ready, self.drain()...)
+		}
+	} else {
+		self.pending[header.Sequence] = frame
+		ready = self.drain()
+		if len(self.pending) >= ReorderFrames {
+			ready = append(ready, self.skip()...)
+		}
+		self.arm()
+	}
+	self.release(ready)
+}
+
+// release unlocks the mutex and delivers ready, in order with every other
+// delivery.
+func (self *Receiver) release(ready []ipv4.Frame) {
+	self.delivering.Lock()
+	defer self.delivering.Unlock()
+	self.mutex.Unlock()
+	for _, frame := range ready {
+		self.deliver(frame)
+	}
+}
+
+// Close stops the receiver, dropping the frames it holds.
+func (self *Receiver) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.closed = true
+	self.stop()
+	clear(self.pending)
+}
+
+// reset starts over with a new session. The caller holds the mutex.
+func (self *Receiver) reset(session uint32, sequence uint64) {
+	self.started, self.session = true, session
+	self.seen = obfuscate.ReplayWindow{}
+	self.next = sequence
+	self.stop()
+	clear(self.pending)
+}
+
+// drain removes and returns the pending frames that are next in order. The
+// caller holds the mutex.
+func (self *Receiver) drain() []ipv4.Frame {
+	var ready []ipv4.Frame
+	for {
+		frame, ok := self.pending[self.next]
+		if !ok {
+			return ready
+		}
+		delete(self.pending, self.next)
+		ready = append(ready, frame)
+		self.next++
+	}
+}
+
+// skip gives up on the frames missing before the earliest pending one. The
+// caller holds the mutex.
+func (self *Receiver) skip() []ipv4.Frame {
+	if len(self.pending) == 0 {
+		return nil
+	}
+	self.next = slices.Min(slices.Collect(maps.Keys(self.pending)))
+	return self.drain()
+}
+
+// arm starts the reorder timer while frames are pending, or stops it. The
+// caller holds the mutex.
+func (self *Receiver) arm() {
+	if len(self.pending) == 0 {
+		self.stop()
+		return
+	}
+	if self.timer == nil {
+		self.armed++
+		armed := self.armed
+		self.timer = time.AfterFunc(ReorderTimeout, func() { self.expire(armed) })
+	}
+}
+
+func (self *Receiver) stop() {
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+}
+
+// expire gives up on the frames missing once the reorder timeout passes.
+func (self *Receiver) expire(armed uint64) {
+	defer deferutil.Recover()
+	self.mutex.Lock()
+	if self.closed || armed != self.armed || self.timer == nil {
+		self.mutex.Unlock()
+		return
+	}
+	self.timer = nil
+	ready := self.skip()
+	self.arm()
+	self.release(ready)
+}
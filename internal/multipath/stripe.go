@@ -0,0 +1,31 @@
+package multipath
+
+import "sync"
+
+// Stripe spreads frames across links in proportion to their weights, evenly
+// interleaved (smooth weighted round-robin, as nginx balances upstreams). The
+// links may change from one frame to the next.
+type Stripe[K comparable] struct {
+	mutex   sync.Mutex
+	credits map[K]int
+}
+
+// Pick returns the link of candidates (not empty) to send the next frame over.
+// A weight below one counts as one.
+func (self *Stripe[K]) Pick(candidates []K, weight func(K) int) K {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	credits := make(map[K]int, len(candidates))
+	total, best := 0, candidates[0]
+	for _, candidate := range candidates {
+		current := max(weight(candidate), 1)
+		total += current
+		credits[candidate] = self.credits[candidate] + current
+		if credits[candidate] > credits[best] {
+			best = candidate
+		}
+	}
+	credits[best] -= total
+	self.credits = credits // forgets links that are no longer candidates
+	return best
+}
@@ -0,0 +1,152 @@
+// Package netwatch tells a client when the host's addresses or routes change,
+// as after Wi-Fi roaming, a cable being plugged in or a resume from suspend,
+// so that it can redial its links at once rather than wait out a reconnect
+// backoff or a health timeout. It subscribes to the kernel's rtnetlink
+// address and route notifications, leaving out those of the tunnel's own
+// interface, and reports a burst of them as one change once they settle;
+// RouteTo then tells which of the client's paths the change moved.
+package netwatch
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+)
+
+var log = logging.MustGetLogger("netwatch")
+
+// Settle is how long a change waits for the notifications that follow it,
+// such as the route that comes with a new address, before it is reported.
+const Settle = 500 * time.Millisecond
+
+// Watcher reports changes to the host's addresses and routes.
+type Watcher struct {
+	ignore  int // interface index whose notifications are left out, or 0
+	settle  time.Duration
+	changes chan struct{}
+
+	done  chan struct{}
+	group sync.WaitGroup
+}
+
+// New subscribes to address and route notifications, leaving out those of the
+// interface named ignore (the tun device) when it exists.
+func New(ignore string) (*Watcher, error) {
+	self := newWatcher(0, Settle)
+	if ignore != "" {
+		if device, err := net.InterfaceByName(ignore); err == nil {
+			self.ignore = device.Index
+		}
+	}
+	addresses := make(chan netlink.AddrUpdate, 64)
+	routes := make(chan netlink.RouteUpdate, 64)
+	errorCallback := func(err error) { log.Debugf("netlink subscription failed: %s", err) }
+	if err := netlink.AddrSubscribeWithOptions(addresses, self.done, netlink.AddrSubscribeOptions{ErrorCallback: errorCallback}); err != nil {
+		return nil, err
+	}
+	if err := netlink.RouteSubscribeWithOptions(routes, self.done, netlink.RouteSubscribeOptions{ErrorCallback: errorCallback}); err != nil {
+		close(self.done)
+		return nil, err
+	}
+	self.start(addresses, routes)
+	return self, nil
+}
+
+func newWatcher(ignore int, settle time.Duration) *Watcher {
+	return &Watcher{ignore: ignore, settle: settle, changes: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+func (self *Watcher) start(addresses <-chan netlink.AddrUpdate, routes <-chan netlink.RouteUpdate) {
+	self.group.Add(1)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.run(addresses, routes)
+	}()
+}
+
+// Changes returns a channel that receives once after each settled change.
+// Changes not yet taken from it are coalesced.
+func (self *Watcher) Changes() <-chan struct{} {
+	return self.changes
+}
+
+// Close ends the subscriptions.
+func (self *Watcher) Close() {
+	close(self.done)
+	self.group.Wait()
+}
+
+func (self *Watcher) run(addresses <-chan netlink.AddrUpdate, routes <-chan netlink.RouteUpdate) {
+	timer := time.NewTimer(self.settle)
+	timer.Stop()
+	defer timer.Stop()
+	for addresses != nil || routes != nil {
+		select {
+		case update, ok := <-addresses:
+			if !ok {
+				addresses = nil // the subscription ended
+				continue
+			}
+			if self.ignored(update.LinkIndex) || update.Scope == unix.RT_SCOPE_LINK {
+				continue // the tunnel's own, or a link-local address
+			}
+			timer.Reset(self.settle)
+		case update, ok := <-routes:
+			if !ok {
+				routes = nil
+				continue
+			}
+			if self.ignored(update.LinkIndex) {
+				continue
+			}
+			timer.Reset(self.settle)
+		case <-timer.C:
+			select {
+			case self.changes <- struct{}{}:
+			default:
+			}
+		case <-self.done:
+			return
+		}
+	}
+}
+
+func (self *Watcher) ignored(index int) bool {
+	return self.ignore != 0 && index == self.ignore
+}
+
+// Route is the way the host sends packets to one destination: the address
+// they leave from, the next hop (nil when the destination is on the link) and
+// the interface.
+type Route struct {
+	Source  net.IP
+	Gateway net.IP
+	Device  int
+}
+
+// RouteTo looks up the route to destination that a socket bound to device
+// (when not empty) and source (when not nil), and marked with mark, takes.
+func RouteTo(destination, source net.IP, device string, mark uint32) (Route, error) {
+	routes, err := netlink.RouteGetWithOptions(destination, &netlink.RouteGetOptions{Oif: device, SrcAddr: source, Mark: mark})
+	if err != nil {
+		return Route{}, err
+	}
+	if len(routes) == 0 {
+		return Route{}, errors.New("netwatch: no route to " + destination.String())
+	}
+	return Route{Source: routes[0].Src, Gateway: routes[0].Gw, Device: routes[0].LinkIndex}, nil
+}
+
+// Equal reports whether both routes leave from the same address, through the
+// same next hop and interface.
+func (self Route) Equal(other Route) bool {
+	return self.Source.Equal(other.Source) && self.Gateway.Equal(other.Gateway) && self.Device == other.Device
+}
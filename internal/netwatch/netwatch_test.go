@@ -0,0 +1,65 @@
+package netwatch
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestBurstIsOneChange(t *testing.T) {
+	addresses := make(chan netlink.AddrUpdate, 8)
+	routes := make(chan netlink.RouteUpdate, 8)
+	watcher := newWatcher(7, 50*time.Millisecond)
+	watcher.start(addresses, routes)
+	defer watcher.Close()
+
+	addresses <- netlink.AddrUpdate{LinkIndex: 2, LinkAddress: net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(24, 32)}}
+	routes <- netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 2, Gw: net.ParseIP("192.0.2.1")}}
+	select {
+	case <-watcher.Changes():
+	case <-time.After(time.Second):
+		t.Fatal("a change was not reported")
+	}
+	select {
+	case <-watcher.Changes():
+		t.Fatal("a burst was reported as more than one change")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestIgnoredUpdates(t *testing.T) {
+	addresses := make(chan netlink.AddrUpdate, 8)
+	routes := make(chan netlink.RouteUpdate, 8)
+	watcher := newWatcher(7, 50*time.Millisecond)
+	watcher.start(addresses, routes)
+	defer watcher.Close()
+
+	addresses <- netlink.AddrUpdate{LinkIndex: 7}
+	routes <- netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: netlink.Route{LinkIndex: 7}}
+	addresses <- netlink.AddrUpdate{LinkIndex: 2, Scope: unix.RT_SCOPE_LINK}
+	select {
+	case <-watcher.Changes():
+		t.Fatal("the tunnel's own or link-local updates were reported")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRouteTo(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %s", err)
+	}
+	route, err := RouteTo(net.ParseIP("127.0.0.1"), nil, "", 0)
+	if err != nil {
+		t.Fatalf("RouteTo: %s", err)
+	}
+	if !route.Source.Equal(net.ParseIP("127.0.0.1")) || route.Gateway != nil || route.Device != loopback.Index {
+		t.Errorf("route = %+v, want from 127.0.0.1 over lo", route)
+	}
+	if !route.Equal(Route{Source: net.ParseIP("127.0.0.1").To4(), Device: loopback.Index}) || route.Equal(Route{Source: route.Source, Device: loopback.Index + 1}) {
+		t.Error("Equal compares routes wrongly")
+	}
+}
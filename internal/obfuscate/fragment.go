@@ -0,0 +1,155 @@
+package obfuscate
+
+import (
+	"errors"
+	"time"
+)
+
+// A payload too long for one datagram of the path travels in up to
+// MaxFragments datagrams with consecutive sequence numbers, each carrying a
+// slice of it. Their stream id, otherwise a small number, has the top bit set
+// and numbers the fragment:
+//
+//	1 | streamId (3 bits) | count - 1 (6 bits) | index (6 bits)
+//
+// so that the receiver knows the stream of the whole, how many fragments to
+// wait for, and, from the sequence number less the index, which fragments
+// belong together.
+const (
+	MaxFragments = 64
+
+	fragmentFlag = 0x8000
+	fragmentBits = 6
+	fragmentMask = 1<<fragmentBits - 1
+
+	// maxReassemblies bounds the payloads being reassembled at once, and
+	// reassemblyTimeout how long the missing fragments of one are waited for.
+	maxReassemblies   = 32
+	reassemblyTimeout = 2 * time.Second
+)
+
+// ErrTooManyFragments is returned by SealFragments for a payload that needs
+// more than MaxFragments datagrams of the given size.
+var ErrTooManyFragments = errors.New("obfuscate: payload needs too many fragments")
+
+// IsFragment reports whether a stream id marks a fragment (see SealFragments).
+func IsFragment(streamId uint16) bool {
+	return streamId&fragmentFlag != 0
+}
+
+// Fragments returns how many datagrams of at most limit bytes SealFragments
+// splits a payload of length bytes across; 1 when it fits, or limit is 0.
+func (self *Codec) Fragments(length, limit int) int {
+	room := limit - self.Overhead()
+	if limit <= 0 || length <= room {
+		return 1
+	}
+	if room <= 0 {
+		return MaxFragments + 1
+	}
+	return (length + room - 1) / room
+}
+
+// SealFragments seals payload into as few datagrams of at most limit bytes as
+// it fits in (see Fragments), numbered from sequence on. The caller must not
+// use those sequence numbers for anything else. A payload that fits is sealed
+// as by Seal; otherwise streamId must be below 8.
+func (self *Codec) SealFragments(sequence uint64, streamId uint16, payload []byte, limit int) ([][]byte, error) {
+	count := self.Fragments(len(payload), limit)
+	if count == 1 {
+		datagram, err := self.SealWithin(sequence, streamId, payload, limit)
+		return [][]byte{datagram}, err
+	}
+	if count > MaxFragments || streamId >= 1<<(15-2*fragmentBits) {
+		return nil, ErrTooManyFragments
+	}
+	datagrams := make([][]byte, count)
+	for index := range count {
+		// equal slices, so that no fragment stands out by its size
+		part := payload[len(payload)*index/count : len(payload)*(index+1)/count]
+		fragmentId := fragmentFlag | streamId<<(2*fragmentBits) | uint16(count-1)<<fragmentBits | uint16(index)
+		datagram, err := self.SealWithin(sequence+uint64(index), fragmentId, part, limit)
+		if err != nil {
+			return nil, err
+		}
+		datagrams[index] = datagram
+	}
+	return datagrams, nil
+}
+
+// Reassembler puts fragmented payloads back together. It keeps a bounded
+// number of incomplete payloads for a bounded time, so lost fragments cost
+// little. It is not safe for concurrent use.
+type Reassembler struct {
+	partial map[uint64]*reassembly // by the sequence number of the first fragment
+
+	now func() time.Time // injectable clock for tests; nil means time.Now
+}
+
+type reassembly struct {
+	streamId uint16
+	parts    [][]byte
+	missing  int
+	started  time.Time
+}
+
+// Add takes a datagram's payload. For a fragment it returns the whole
+// payload and its stream id once the last fragment arrives, and ok false
+// until then; anything else it returns as is. Fragments must have passed the
+// replay window, so each arrives at most once.
+func (self *Reassembler) Add(sequence uint64, streamId uint16, payload []byte) (uint16, []byte, bool) {
+	if !IsFragment(streamId) {
+		return streamId, payload, true
+	}
+	index := uint64(streamId & fragmentMask)
+	count := int(streamId>>fragmentBits&fragmentMask) + 1
+	inner := streamId >> (2 * fragmentBits) & (1<<(15-2*fragmentBits) - 1)
+	if count < 2 || index >= uint64(count) || sequence <= index {
+		return 0, nil, false
+	}
+
+	now := time.Now
+	if self.now != nil {
+		now = self.now
+	}
+	if self.partial == nil {
+		self.partial = make(map[uint64]*reassembly)
+	}
+	first := sequence - index
+	current, ok := self.partial[first]
+	if !ok {
+		self.expire(now())
+		current = &reassembly{streamId: inner, parts: make([][]byte, count), missing: count, started: now()}
+		self.partial[first] = current
+	}
+	if current.streamId != inner || len(current.parts) != count || current.parts[index] != nil {
+		return 0, nil, false
+	}
+	current.parts[index] = payload
+	current.missing--
+	if current.missing > 0 {
+		return 0, nil, false
+	}
+	delete(self.partial, first)
+	var whole []byte
+	for _, part := range current.parts {
+		whole = append(whole, part...)
+	}
+	return inner, whole, true
+}
+
+// expire drops the reassemblies that have waited too long and, to make room
+// for one more, the oldest of the rest if there are too many.
+func (self *Reassembler) expire(now time.Time) {
+	var oldest uint64
+	for first, current := range self.partial {
+		if now.Sub(current.started) > reassemblyTimeout {
+			delete(self.partial, first)
+		} else if oldest == 0 || current.started.Before(self.partial[oldest].started) {
+			oldest = first
+		}
+	}
+	if len(self.partial) >= maxReassemblies {
+		delete(self.partial, oldest)
+	}
+}
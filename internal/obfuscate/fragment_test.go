@@ -0,0 +1,86 @@
+package obfuscate
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFragmentsReassemble(t *testing.T) {
+	codec := newTestCodec(t, "correct horse", 128)
+	payload := bytes.Repeat([]byte("0123456789"), 300)
+	count := codec.Fragments(len(payload), 1200)
+	if count != 3 {
+		t.Fatalf("Fragments = %d, want 3", count)
+	}
+	datagrams, err := codec.SealFragments(100, StreamFecShard, payload, 1200)
+	if err != nil {
+		t.Fatalf("SealFragments: %s", err)
+	}
+	if len(datagrams) != count {
+		t.Fatalf("sealed %d datagrams, want %d", len(datagrams), count)
+	}
+
+	// Out of order, the whole comes back with the last fragment.
+	var reassembler Reassembler
+	for step, index := range []int{2, 0, 1} {
+		if len(datagrams[index]) > 1200 {
+			t.Errorf("fragment %d is %d bytes long", index, len(datagrams[index]))
+		}
+		sequence, streamId, part, err := codec.Open(datagrams[index])
+		if err != nil || !IsFragment(streamId) || sequence != uint64(100+index) {
+			t.Fatalf("Open fragment %d: %d %#x %v", index, sequence, streamId, err)
+		}
+		streamId, whole, ok := reassembler.Add(sequence, streamId, part)
+		if ok != (step == 2) {
+			t.Fatalf("step %d: ok = %v", step, ok)
+		}
+		if ok && (streamId != StreamFecShard || !bytes.Equal(whole, payload)) {
+			t.Errorf("reassembled stream %d, %d bytes", streamId, len(whole))
+		}
+	}
+
+	// What fits is sealed whole, with its padding cut to the limit.
+	datagrams, err = codec.SealFragments(200, StreamFrame, payload[:1000], 1000+codec.Overhead())
+	if err != nil || len(datagrams) != 1 || len(datagrams[0]) != 1000+codec.Overhead() {
+		t.Fatalf("SealFragments of a fitting payload: %d datagrams, %v", len(datagrams), err)
+	}
+	if _, err := codec.SealFragments(300, StreamFrame, payload, 100); !errors.Is(err, ErrTooManyFragments) {
+		t.Errorf("err = %v, want %v", err, ErrTooManyFragments)
+	}
+}
+
+func TestReassemblerForgetsIncompletePayloads(t *testing.T) {
+	codec := newTestCodec(t, "correct horse", 0)
+	now := time.Unix(1000, 0)
+	reassembler := Reassembler{now: func() time.Time { return now }}
+	add := func(sequence uint64, payload []byte) bool {
+		datagrams, err := codec.SealFragments(sequence, StreamFrame, payload, 100)
+		if err != nil {
+			t.Fatalf("SealFragments: %s", err)
+		}
+		var ok bool
+		for index, datagram := range datagrams {
+			if index == 1 {
+				continue // lost
+			}
+			sequence, streamId, part, _ := codec.Open(datagram)
+			_, _, ok = reassembler.Add(sequence, streamId, part)
+		}
+		return ok
+	}
+	for index := range 2 * maxReassemblies {
+		if add(uint64(1+10*index), bytes.Repeat([]byte{'x'}, 200)) {
+			t.Fatal("an incomplete payload was reassembled")
+		}
+	}
+	if len(reassembler.partial) > maxReassemblies {
+		t.Errorf("%d reassemblies kept, want at most %d", len(reassembler.partial), maxReassemblies)
+	}
+	now = now.Add(2 * reassemblyTimeout)
+	add(100000, bytes.Repeat([]byte{'x'}, 200))
+	if len(reassembler.partial) != 1 {
+		t.Errorf("%d reassemblies kept after the timeout, want 1", len(reassembler.partial))
+	}
+}
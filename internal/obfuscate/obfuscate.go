@@ -80,6 +80,13 @@ func (self *Codec) Overhead() int {
 // Seal builds an obfuscated datagram carrying payload on the given stream. The
 // payload must be at most 65535 bytes.
 func (self *Codec) Seal(sequence uint64, streamId uint16, payload []byte) ([]byte, error) {
+	return self.SealWithin(sequence, streamId, payload, 0)
+}
+
+// SealWithin is Seal with the padding cut short, if need be, so that the
+// datagram is at most limit bytes long; 0 means no limit. The payload itself
+// is never cut.
+func (self *Codec) SealWithin(sequence uint64, streamId uint16, payload []byte, limit int) ([]byte, error) {
 	if len(payload) > 0xffff {
 		return nil, errors.New("obfuscate: payload too large")
 	}
@@ -88,6 +95,9 @@ func (self *Codec) Seal(sequence uint64, streamId uint16, payload []byte) ([]byt
 	if err != nil {
 		return nil, err
 	}
+	if limit > 0 {
+		paddingLength = max(min(paddingLength, limit-self.Overhead()-len(payload)), 0)
+	}
 
 	plaintext := make([]byte, headerSize+len(payload)+paddingLength)
 	binary.BigEndian.PutUint64(plaintext[0:], sequence)
@@ -0,0 +1,47 @@
+package obfuscate
+
+// Stream ids carried in the encrypted header. Each transport that shares the
+// obfuscated datagram format claims its own ids here, so a datagram sealed for
+// one purpose is never mistaken for another (for example, the kernel echoing a
+// client's own ICMP request back to it). Ids from 0x8000 up number the
+// fragments of a payload on a stream below 8 (see SealFragments).
+const (
+	// StreamFrame carries one IPv4 frame over the UDP transport.
+	StreamFrame uint16 = 0
+
+	// StreamEchoRequest carries an IPv4 frame (or nothing, for a poll) from a
+	// client to the server inside an ICMP echo request.
+	StreamEchoRequest uint16 = 1
+
+	// StreamEchoReply carries an IPv4 frame from the server to a client inside an
+	// ICMP echo reply.
+	StreamEchoReply uint16 = 2
+
+	// StreamRendezvous carries a rendezvous message (see internal/rendezvous)
+	// between a client's peer socket and the server's UDP transport.
+	StreamRendezvous uint16 = 3
+
+	// StreamPeerFrame carries one IPv4 frame directly from one client to
+	// another.
+	StreamPeerFrame uint16 = 4
+
+	// StreamPeerProbe and StreamPeerReply carry the sender's tunnel address
+	// (4 bytes) between two clients, to punch a path through their NATs and to
+	// keep checking that it works.
+	StreamPeerProbe uint16 = 5
+	StreamPeerReply uint16 = 6
+
+	// StreamFecShard carries one shard of a forward error correction group
+	// (see internal/fec) over the UDP transport: a frame, or parity for the
+	// frames of its group.
+	StreamFecShard uint16 = 7
+
+	// StreamFrames carries several IPv4 frames back to back over the UDP
+	// transport (see internal/batch). It is never fragmented.
+	StreamFrames uint16 = 8
+
+	// StreamPoll carries nothing over the HTTP polling transport: it proves
+	// that a request with no frame to send comes from its session's client
+	// (see internal/meek).
+	StreamPoll uint16 = 9
+)
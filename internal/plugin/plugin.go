@@ -0,0 +1,420 @@
+// Package plugin runs an external pluggable transport — obfs4, v2ray-plugin,
+// cloak and the like — as a child process that carries the TCP link, so
+// obfuscation does not have to be built into shadowgate. Two launch contracts
+// are supported:
+//
+//   - SIP003, the Shadowsocks plugin contract: the plugin reads SS_REMOTE_HOST,
+//     SS_REMOTE_PORT, SS_LOCAL_HOST, SS_LOCAL_PORT and SS_PLUGIN_OPTIONS from its
+//     environment and relays between the two addresses. The client plugin
+//     listens on the local address and the server plugin forwards to it.
+//   - The Tor pluggable-transport managed-proxy protocol (pt-spec version 1):
+//     the plugin reads TOR_PT_* variables and reports the addresses it listens
+//     on over its standard output. The client plugin is a SOCKS5 proxy, dialed
+//     with the transport's arguments as credentials; the server plugin forwards
+//     to shadowgate's TCP listener as if it were a Tor ORPort.
+package plugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/proxy"
+)
+
+var log = logging.MustGetLogger("plugin")
+
+const (
+	// ProtocolSIP003 launches the plugin with the Shadowsocks SIP003 contract.
+	ProtocolSIP003 = "sip003"
+
+	// ProtocolTor launches the plugin as a Tor pluggable-transport managed proxy.
+	ProtocolTor = "tor"
+
+	// startTimeout bounds how long a Tor managed proxy may take to report its
+	// methods.
+	startTimeout = 10 * time.Second
+
+	// maxArgumentSize is the longest SOCKS5 username or password, across which
+	// Tor transport arguments are split.
+	maxArgumentSize = 255
+)
+
+// Config describes the plugin to run.
+type Config struct {
+	Protocol string // ProtocolSIP003 or ProtocolTor
+	Command  string // run with /bin/sh -c
+	// Options is SS_PLUGIN_OPTIONS for SIP003, and the transport's
+	// semicolon-separated key=value arguments for Tor (for example a bridge's
+	// "cert=…;iat-mode=0" on the client).
+	Options   string
+	Transport string // Tor: the transport name, such as "obfs4"
+	State     string // Tor: TOR_PT_STATE_LOCATION; defaults to a directory under os.TempDir()
+}
+
+// Process is a running plugin. A client plugin that exits is started again by
+// the next Dial.
+type Process struct {
+	// mutex guards the current run of the plugin and, on the client side,
+	// where to connect through it.
+	mutex   sync.Mutex
+	command *exec.Cmd
+	stdin   io.WriteCloser
+	exited  chan struct{}
+
+	closing   atomic.Bool
+	closeOnce sync.Once
+
+	// client side: where to connect, and how
+	local    string       // SIP003: the plugin's local listen address
+	upstream *proxy.Proxy // Tor: the plugin's SOCKS5 listener, with arguments
+	remote   string       // the server address the plugin should reach
+	launch   func() error // starts the plugin again; the caller holds mutex
+}
+
+// StartClient starts a client-side plugin that carries connections to remote
+// (the server's host:port, or the server plugin's).
+func StartClient(config Config, remote string) (*Process, error) {
+	remoteHost, remotePort, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	self := &Process{remote: remote}
+	switch config.Protocol {
+	case ProtocolSIP003, "":
+		self.launch = func() error {
+			local, err := freeAddress()
+			if err != nil {
+				return err
+			}
+			localHost, localPort, _ := net.SplitHostPort(local)
+			if err := self.start(config, []string{
+				"SS_REMOTE_HOST=" + remoteHost,
+				"SS_REMOTE_PORT=" + remotePort,
+				"SS_LOCAL_HOST=" + localHost,
+				"SS_LOCAL_PORT=" + localPort,
+				"SS_PLUGIN_OPTIONS=" + config.Options,
+			}, nil); err != nil {
+				return err
+			}
+			self.local = local
+			return nil
+		}
+
+	case ProtocolTor:
+		if config.Transport == "" {
+			return nil, errors.New("plugin: tor managed proxy needs a transport name")
+		}
+		self.launch = func() error {
+			methods := make(chan string, 1)
+			if err := self.start(config, append(torEnvironment(config),
+				"TOR_PT_CLIENT_TRANSPORTS="+config.Transport,
+			), methods); err != nil {
+				return err
+			}
+			address, err := self.await(methods)
+			if err == nil {
+				self.upstream, err = socksProxy(address, config.Options)
+			}
+			if err != nil {
+				self.stop()
+				<-self.exited
+				return err
+			}
+			return nil
+		}
+
+	default:
+		return nil, fmt.Errorf("plugin: unknown protocol: %q", config.Protocol)
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.launch(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// StartServer starts a server-side plugin that accepts clients on listen
+// (host:port) and forwards each connection, unwrapped, to forward.
+func StartServer(config Config, listen string, forward string) (*Process, error) {
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	if listenHost == "" {
+		listenHost = "0.0.0.0"
+	}
+	switch config.Protocol {
+	case ProtocolSIP003, "":
+		forwardHost, forwardPort, err := net.SplitHostPort(forward)
+		if err != nil {
+			return nil, err
+		}
+		self := &Process{}
+		if err := self.start(config, []string{
+			"SS_REMOTE_HOST=" + listenHost,
+			"SS_REMOTE_PORT=" + listenPort,
+			"SS_LOCAL_HOST=" + forwardHost,
+			"SS_LOCAL_PORT=" + forwardPort,
+			"SS_PLUGIN_OPTIONS=" + config.Options,
+		}, nil); err != nil {
+			return nil, err
+		}
+		return self, nil
+
+	case ProtocolTor:
+		if config.Transport == "" {
+			return nil, errors.New("plugin: tor managed proxy needs a transport name")
+		}
+		var options []string
+		if config.Options != "" {
+			for _, option := range strings.Split(config.Options, ";") {
+				options = append(options, config.Transport+":"+option)
+			}
+		}
+		methods := make(chan string, 1)
+		self := &Process{}
+		if err := self.start(config, append(torEnvironment(config),
+			"TOR_PT_SERVER_TRANSPORTS="+config.Transport,
+			"TOR_PT_SERVER_BINDADDR="+config.Transport+"-"+net.JoinHostPort(listenHost, listenPort),
+			"TOR_PT_SERVER_TRANSPORT_OPTIONS="+strings.Join(options, ";"),
+			"TOR_PT_ORPORT="+forward,
+		), methods); err != nil {
+			return nil, err
+		}
+		if _, err := self.await(methods); err != nil {
+			_ = self.Close()
+			return nil, err
+		}
+		return self, nil
+	}
+	return nil, fmt.Errorf("plugin: unknown protocol: %q", config.Protocol)
+}
+
+func torEnvironment(config Config) []string {
+	state := config.State
+	if state == "" {
+		state = filepath.Join(os.TempDir(), "shadowgate-pt-state")
+	}
+	return []string{
+		"TOR_PT_MANAGED_TRANSPORT_VER=1",
+		"TOR_PT_STATE_LOCATION=" + state,
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1",
+	}
+}
+
+// start runs the plugin, as the current run of self. When methods is not nil,
+// the plugin's standard output is parsed as a Tor managed-proxy handshake and
+// the address of its method, or an error message prefixed with "error: ", is
+// delivered there.
+func (self *Process) start(config Config, environment []string, methods chan<- string) error {
+	command := exec.Command("/bin/sh", "-c", config.Command)
+	command.Env = append(os.Environ(), environment...)
+	command.Stderr = os.Stderr
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		_ = stdin.Close()
+		return err
+	}
+	if err := command.Start(); err != nil {
+		_ = stdin.Close()
+		_ = stdout.Close()
+		return err
+	}
+	log.Infof("plugin started: %s", config.Command)
+
+	exited := make(chan struct{})
+	self.command, self.stdin, self.exited = command, stdin, exited
+	scanned := make(chan struct{})
+	go func() {
+		defer deferutil.Recover()
+		defer close(scanned)
+		scanOutput(stdout, config.Transport, methods)
+	}()
+	go func() {
+		defer deferutil.Recover()
+		<-scanned
+		err := command.Wait()
+		if self.closing.Load() {
+			log.Debugf("plugin stopped: %v", err)
+		} else {
+			log.Warningf("plugin exited: %v", err)
+		}
+		close(exited)
+	}()
+	return nil
+}
+
+// scanOutput reads the plugin's standard output. A SIP003 plugin's output is
+// only logged; a Tor managed proxy's handshake lines are interpreted.
+func scanOutput(stdout io.Reader, transport string, methods chan<- string) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if methods == nil {
+			log.Debugf("plugin: %s", line)
+			continue
+		}
+		keyword, rest, _ := strings.Cut(line, " ")
+		switch keyword {
+		case "VERSION", "LOG", "STATUS", "PROXY":
+			log.Debugf("plugin: %s", line)
+		case "CMETHOD", "SMETHOD":
+			// CMETHOD <transport> socks5 <address>
+			// SMETHOD <transport> <address> [ARGS:<arguments>]
+			fields := strings.Fields(rest)
+			if len(fields) < 2 || fields[0] != transport {
+				continue
+			}
+			address := fields[1]
+			if keyword == "CMETHOD" {
+				if len(fields) < 3 || fields[1] != "socks5" {
+					methods <- "error: unsupported client method: " + rest
+					methods = nil
+					continue
+				}
+				address = fields[2]
+			} else if len(fields) > 2 {
+				// Clients need these (an obfs4 bridge's cert, say) in their options.
+				log.Infof("plugin %s listening on %s with %s", transport, address, strings.Join(fields[2:], " "))
+			}
+			methods <- address
+			methods = nil
+		case "CMETHOD-ERROR", "SMETHOD-ERROR", "ENV-ERROR", "VERSION-ERROR", "PROXY-ERROR":
+			methods <- "error: " + line
+			methods = nil
+		case "CMETHODS", "SMETHODS":
+			// "DONE" without our transport among the methods
+			methods <- "error: plugin does not offer transport " + transport
+			methods = nil
+		default:
+			log.Debugf("plugin: %s", line)
+		}
+	}
+	if methods != nil {
+		close(methods)
+	}
+}
+
+// await waits for the Tor managed-proxy handshake to name the method's address.
+func (self *Process) await(methods <-chan string) (string, error) {
+	select {
+	case address, ok := <-methods:
+		if !ok {
+			return "", errors.New("plugin: exited during the managed-proxy handshake")
+		}
+		if message, failed := strings.CutPrefix(address, "error: "); failed {
+			return "", fmt.Errorf("plugin: %s", message)
+		}
+		return address, nil
+	case <-time.After(startTimeout):
+		return "", errors.New("plugin: managed-proxy handshake timed out")
+	}
+}
+
+// socksProxy builds the SOCKS5 dialer for a Tor client method, passing the
+// transport arguments as its credentials as pt-spec describes.
+func socksProxy(address string, arguments string) (*proxy.Proxy, error) {
+	endpoint := &url.URL{Scheme: "socks5", Host: address}
+	if arguments != "" {
+		if len(arguments) > 2*maxArgumentSize {
+			return nil, errors.New("plugin: transport arguments too long")
+		}
+		username, password := arguments, "\x00"
+		if len(arguments) > maxArgumentSize {
+			username, password = arguments[:maxArgumentSize], arguments[maxArgumentSize:]
+		}
+		endpoint.User = url.UserPassword(username, password)
+	}
+	return proxy.Parse(endpoint.String())
+}
+
+// freeAddress picks a loopback address with a currently unused TCP port.
+func freeAddress() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = listener.Close() }()
+	return listener.Addr().String(), nil
+}
+
+// Dial connects to the server through a client plugin, starting the plugin
+// again first if it has exited. A link redials with backoff, so a plugin that
+// keeps failing is not restarted in a tight loop.
+func (self *Process) Dial(timeout time.Duration) (net.Conn, error) {
+	local, upstream, err := self.running()
+	if err != nil {
+		return nil, err
+	}
+	if upstream != nil {
+		return upstream.Dial(self.remote, timeout)
+	}
+	return net.DialTimeout("tcp", local, timeout)
+}
+
+// running returns where to connect through the plugin, restarting it if it
+// has exited since.
+func (self *Process) running() (string, *proxy.Proxy, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	select {
+	case <-self.exited:
+		if self.closing.Load() || self.launch == nil {
+			return "", nil, errors.New("plugin: not running")
+		}
+		log.Noticef("plugin: restarting")
+		if err := self.launch(); err != nil {
+			return "", nil, fmt.Errorf("plugin: failed to restart: %s", err)
+		}
+	default:
+	}
+	return self.local, self.upstream, nil
+}
+
+// Exited is closed once the current run of the plugin process has exited.
+func (self *Process) Exited() <-chan struct{} {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.exited
+}
+
+// stop asks the current run to exit and kills its process group. The caller
+// holds mutex.
+func (self *Process) stop() {
+	_ = self.stdin.Close()
+	_ = syscall.Kill(-self.command.Process.Pid, syscall.SIGKILL)
+}
+
+// Close stops the plugin for good: closing its standard input asks a Tor
+// managed proxy to exit, and the whole process group is then killed.
+func (self *Process) Close() error {
+	self.closeOnce.Do(func() {
+		self.closing.Store(true)
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+		self.stop()
+	})
+	<-self.Exited()
+	return nil
+}
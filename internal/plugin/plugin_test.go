@@ -0,0 +1,274 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stubEnvironment, when set in the environment of this test binary, makes it run
+// as a stub plugin instead of the tests. The stub "obfuscates" by XORing every
+// byte between the client and server plugins, so traffic only gets through when
+// both ends run it.
+const stubEnvironment = "SHADOWGATE_STUB_PLUGIN"
+
+// stubArguments are the Tor transport arguments the stub client insists on.
+const stubArguments = "cert=stub;iat-mode=0"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(stubEnvironment) != "" {
+		runStub()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runStub() {
+	if os.Getenv("TOR_PT_MANAGED_TRANSPORT_VER") == "" {
+		// SIP003: the server plugin is told so in its options.
+		local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+		remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+		if os.Getenv("SS_PLUGIN_OPTIONS") == "server" {
+			serveStub(mustListen(remote), func(net.Conn) (string, bool) { return local, true })
+		} else {
+			serveStub(mustListen(local), func(net.Conn) (string, bool) { return remote, true })
+		}
+		return
+	}
+
+	// Tor managed proxy: exit when standard input closes.
+	go func() {
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		os.Exit(0)
+	}()
+	fmt.Println("VERSION 1")
+	if transport := os.Getenv("TOR_PT_CLIENT_TRANSPORTS"); transport != "" {
+		listener := mustListen("127.0.0.1:0")
+		fmt.Printf("CMETHOD %s socks5 %s\nCMETHODS DONE\n", transport, listener.Addr())
+		serveStub(listener, acceptSocks)
+		return
+	}
+	transport, bind, _ := strings.Cut(os.Getenv("TOR_PT_SERVER_BINDADDR"), "-")
+	listener := mustListen(bind)
+	fmt.Printf("SMETHOD %s %s ARGS:cert=stub\nSMETHODS DONE\n", transport, listener.Addr())
+	serveStub(listener, func(net.Conn) (string, bool) { return os.Getenv("TOR_PT_ORPORT"), true })
+}
+
+func mustListen(address string) net.Listener {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		os.Exit(2)
+	}
+	return listener
+}
+
+// serveStub relays each accepted connection to the address target picks,
+// XORing the bytes in both directions.
+func serveStub(listener net.Listener, target func(net.Conn) (string, bool)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			address, ok := target(conn)
+			if !ok {
+				return
+			}
+			upstream, err := net.Dial("tcp", address)
+			if err != nil {
+				return
+			}
+			defer func() { _ = upstream.Close() }()
+			go func() { _, _ = io.Copy(xorWriter{upstream}, conn) }()
+			_, _ = io.Copy(xorWriter{conn}, upstream)
+		}()
+	}
+}
+
+type xorWriter struct {
+	io.Writer
+}
+
+func (self xorWriter) Write(buffer []byte) (int, error) {
+	scrambled := make([]byte, len(buffer))
+	for index, value := range buffer {
+		scrambled[index] = value ^ 0x5a
+	}
+	return self.Writer.Write(scrambled)
+}
+
+// acceptSocks answers a SOCKS5 CONNECT whose credentials carry stubArguments,
+// returning the requested address.
+func acceptSocks(conn net.Conn) (string, bool) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", false
+	}
+	if _, err := io.ReadFull(reader, make([]byte, header[1])); err != nil {
+		return "", false
+	}
+	_, _ = conn.Write([]byte{0x05, 0x02})
+	version, _ := reader.ReadByte()
+	length, _ := reader.ReadByte()
+	username := make([]byte, length)
+	_, _ = io.ReadFull(reader, username)
+	length, _ = reader.ReadByte()
+	password := make([]byte, length)
+	_, _ = io.ReadFull(reader, password)
+	if version != 0x01 || string(username) != stubArguments || string(password) != "\x00" {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return "", false
+	}
+	_, _ = conn.Write([]byte{0x01, 0x00})
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil || request[3] != 0x01 {
+		return "", false
+	}
+	address := make([]byte, 6)
+	if _, err := io.ReadFull(reader, address); err != nil {
+		return "", false
+	}
+	_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(net.IP(address[:4]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(address[4:])))), true
+}
+
+// echoServer stands in for shadowgate's TCP listener behind the server plugin.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func stubCommand(t *testing.T) string {
+	t.Helper()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %s", err)
+	}
+	return fmt.Sprintf("%s=1 exec '%s'", stubEnvironment, executable)
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	address, err := freeAddress()
+	if err != nil {
+		t.Fatalf("freeAddress: %s", err)
+	}
+	return address
+}
+
+// dialThrough dials through the client plugin, retrying while the plugins start
+// listening, and checks that an echo comes back intact.
+func dialThrough(t *testing.T, client *Process) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := client.Dial(time.Second)
+		if err == nil {
+			_ = conn.SetDeadline(time.Now().Add(time.Second))
+			reply := make([]byte, 5)
+			_, err = conn.Write([]byte("hello"))
+			if err == nil {
+				_, err = io.ReadFull(conn, reply)
+			}
+			_ = conn.Close()
+			if err == nil {
+				if string(reply) != "hello" {
+					t.Fatalf("reply = %q, want %q", reply, "hello")
+				}
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial through plugin: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestSIP003(t *testing.T) {
+	listen := freePort(t)
+	server, err := StartServer(Config{Protocol: ProtocolSIP003, Command: stubCommand(t), Options: "server"}, listen, echoServer(t))
+	if err != nil {
+		t.Fatalf("StartServer: %s", err)
+	}
+	defer func() { _ = server.Close() }()
+	client, err := StartClient(Config{Protocol: ProtocolSIP003, Command: stubCommand(t)}, listen)
+	if err != nil {
+		t.Fatalf("StartClient: %s", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	dialThrough(t, client)
+
+	// A plugin that dies is started again by the next dial, on a new port.
+	_ = syscall.Kill(-client.command.Process.Pid, syscall.SIGKILL)
+	<-client.Exited()
+	dialThrough(t, client)
+}
+
+func TestTorManagedProxy(t *testing.T) {
+	listen := freePort(t)
+	config := Config{Protocol: ProtocolTor, Command: stubCommand(t), Transport: "stub", State: t.TempDir()}
+	server, err := StartServer(config, listen, echoServer(t))
+	if err != nil {
+		t.Fatalf("StartServer: %s", err)
+	}
+	defer func() { _ = server.Close() }()
+
+	config.Options = stubArguments
+	client, err := StartClient(config, listen)
+	if err != nil {
+		t.Fatalf("StartClient: %s", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	dialThrough(t, client)
+
+	// Closing standard input is enough for a managed proxy to exit.
+	_ = client.stdin.Close()
+	select {
+	case <-client.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("managed proxy did not exit when its standard input closed")
+	}
+
+	// The next dial starts it again.
+	dialThrough(t, client)
+}
+
+func TestTorManagedProxyWithoutTransport(t *testing.T) {
+	config := Config{Protocol: ProtocolTor, Command: "echo VERSION 1; echo CMETHODS DONE; sleep 60", Transport: "obfs4", State: t.TempDir()}
+	if client, err := StartClient(config, "127.0.0.1:1"); err == nil {
+		_ = client.Close()
+		t.Fatal("StartClient succeeded, want an error for a missing transport")
+	}
+}
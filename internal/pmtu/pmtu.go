@@ -0,0 +1,207 @@
+// Package pmtu finds the largest datagram a UDP link can send to the server
+// without it being fragmented or lost on the way, so that the link can split
+// longer frames across several datagrams (see obfuscate.SealFragments) and the
+// tun device keep its 1500-byte MTU.
+//
+// The client probes with keepalives padded to the size under test, one with
+// each keepalive, searching between MinDatagram and MaxDatagram. A server
+// that reassembles fragments answers a probe with a keepalive reporting the
+// probe's length; one that does not answers as it answers any keepalive, and
+// the link then never fragments. Every keepalive of the client reports the
+// size it has confirmed, which the server uses for its datagrams back,
+// taking the path to be symmetric.
+//
+// A keepalive, whose source equals its destination, is laid out as
+//
+//	IPv4 header | size uint16 | flags uint8 | zero padding
+//
+// where size is the confirmed datagram size from the client, or the length
+// of the probe answered from the server, and 0 or absent when there is none.
+// flags, absent from a keepalive no longer than KeepaliveLength, mark one
+// of a capacity train (see Train), which is padded but no probe, or the
+// server's answer to one.
+package pmtu
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+const (
+	// MinDatagram is the size assumed to cross any path, as QUIC assumes; the
+	// first probe tests it and proves the server reassembles fragments.
+	MinDatagram = 1200
+
+	// MaxDatagram is the largest size probed: a 1500-byte Ethernet frame less
+	// the IPv4 and UDP headers.
+	MaxDatagram = 1472
+
+	// KeepaliveLength is the length of a keepalive reporting a size; a longer
+	// one is a probe.
+	KeepaliveLength = 20 + 2
+
+	// ResearchInterval is how often the search starts over, in case the path
+	// now carries larger datagrams.
+	ResearchInterval = 10 * time.Minute
+
+	// revalidateInterval is how often the confirmed size is probed again once
+	// the search is over, so that a path that shrank is noticed.
+	revalidateInterval = 30 * time.Second
+
+	// precision ends the search when the largest size that passed and the
+	// smallest that did not are this close.
+	precision = 8
+
+	// probeAttempts is how many probes of one size must go unanswered before
+	// it is taken as too large, rather than lost.
+	probeAttempts = 2
+
+	// trainFlag marks a keepalive of a capacity train.
+	trainFlag = 1 << 0
+)
+
+// Keepalive returns a keepalive from ip reporting size, padded to length
+// bytes when that is more than KeepaliveLength.
+func Keepalive(ip net.IP, size, length int) ipv4.Frame {
+	frame := ipv4.MakeFrame(ip, ip)
+	frame = append(frame, make([]byte, max(length, KeepaliveLength)-len(frame))...)
+	frame.SetTotalLength(uint16(len(frame)))
+	binary.BigEndian.PutUint16(frame.Payload(), uint16(size))
+	return frame
+}
+
+// Train returns a keepalive of a capacity train from ip reporting size,
+// padded to length bytes, or just long enough to be marked as one.
+func Train(ip net.IP, size, length int) ipv4.Frame {
+	frame := Keepalive(ip, size, max(length, KeepaliveLength+1))
+	frame.Payload()[2] |= trainFlag
+	return frame
+}
+
+// Parse returns the size a keepalive reports, 0 if none, and whether it is
+// a probe, or of a capacity train.
+func Parse(frame ipv4.Frame) (size int, probe, train bool) {
+	payload := frame.Payload()
+	if len(payload) < 2 {
+		return 0, false, false
+	}
+	train = len(payload) > 2 && payload[2]&trainFlag != 0
+	return int(binary.BigEndian.Uint16(payload)), len(frame) > KeepaliveLength && !train, train
+}
+
+// Prober runs the client's side of the search. It is safe for concurrent
+// use: Next is called from the link's sending goroutine and Confirm from its
+// receiving one.
+type Prober struct {
+	mutex sync.Mutex
+	// supported is set once the server answers a probe: only then may
+	// datagrams be fragmented.
+	supported   bool
+	confirmed   int // the largest size answered
+	ceiling     int // the largest size not known to be too large
+	pending     int // the size of the probe awaiting an answer, or 0
+	attempts    int // probes of pending sent so far
+	confirmedAt time.Time
+	searchedAt  time.Time
+
+	now func() time.Time // injectable clock for tests; defaults to time.Now
+}
+
+func NewProber() *Prober {
+	return &Prober{now: time.Now}
+}
+
+// Limit returns the largest datagram to send, or 0 while the server is not
+// known to reassemble fragments.
+func (self *Prober) Limit() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.supported {
+		return 0
+	}
+	return self.confirmed
+}
+
+// Next returns the size of the probe to send along with a keepalive, or 0
+// for none. A probe still unanswered by the next keepalive counts as lost.
+func (self *Prober) Next() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	now := self.now()
+	if self.pending != 0 {
+		if self.attempts < probeAttempts {
+			self.attempts++
+			return self.pending
+		}
+		if self.supported && self.pending <= self.confirmed {
+			// The confirmed size no longer passes: the path shrank.
+			self.confirmed = MinDatagram
+		}
+		self.ceiling = self.pending - 1
+		self.pending = 0
+	}
+	if now.Sub(self.searchedAt) >= ResearchInterval {
+		self.searchedAt = now
+		self.ceiling = MaxDatagram
+	}
+
+	var size int
+	switch {
+	case !self.supported:
+		if self.ceiling < MinDatagram {
+			return 0 // until the search starts over
+		}
+		size = MinDatagram
+	case self.ceiling-self.confirmed >= precision:
+		size = (self.confirmed + self.ceiling + 1) / 2
+	case now.Sub(self.confirmedAt) >= revalidateInterval:
+		size = self.confirmed
+	default:
+		return 0
+	}
+	self.pending, self.attempts = size, 1
+	return size
+}
+
+// Confirm records that the server answered a probe of size bytes.
+func (self *Prober) Confirm(size int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if size <= 0 || size > MaxDatagram {
+		return
+	}
+	self.supported = true
+	self.confirmed = max(self.confirmed, size)
+	self.ceiling = max(self.ceiling, self.confirmed)
+	self.confirmedAt = self.now()
+	if size == self.pending {
+		self.pending = 0
+	}
+}
+
+// DontFragment makes the kernel send conn's datagrams with the Don't Fragment
+// bit and without regard to the path MTU it has learned (IP_PMTUDISC_PROBE),
+// so that a probe too large for the path is lost rather than fragmented on
+// the way. Sending a datagram larger than the interface then fails with
+// EMSGSIZE. It does nothing to a conn without a socket, such as one through a
+// proxy.
+func DontFragment(conn any) {
+	socket, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := socket.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = raw.Control(func(fd uintptr) {
+		// Only the option of the socket's family takes; the other fails.
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	})
+}
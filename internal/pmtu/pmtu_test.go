@@ -0,0 +1,99 @@
+package pmtu
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/ipv4"
+)
+
+// path answers the probes a Prober sends over a path carrying datagrams of up
+// to mtu bytes, once a second, and returns how many keepalives went by.
+type path struct {
+	prober *Prober
+	now    time.Time
+	mtu    int
+}
+
+func newPath(mtu int) *path {
+	self := &path{prober: NewProber(), now: time.Unix(1000, 0), mtu: mtu}
+	self.prober.now = func() time.Time { return self.now }
+	return self
+}
+
+func (self *path) run(keepalives int) {
+	for range keepalives {
+		if size := self.prober.Next(); size != 0 && size <= self.mtu {
+			self.prober.Confirm(size)
+		}
+		self.now = self.now.Add(time.Second)
+	}
+}
+
+func TestProberFindsThePathMtu(t *testing.T) {
+	path := newPath(1400)
+	if limit := path.prober.Limit(); limit != 0 {
+		t.Errorf("Limit before any answer = %d, want 0", limit)
+	}
+	path.run(30)
+	if limit := path.prober.Limit(); limit > 1400 || limit < 1400-precision {
+		t.Errorf("Limit = %d, want just under 1400", limit)
+	}
+
+	// The path shrinks; revalidation notices and the search starts again.
+	path.mtu = 1300
+	path.run(int(revalidateInterval/time.Second) + 30)
+	if limit := path.prober.Limit(); limit > 1300 || limit < 1300-precision {
+		t.Errorf("Limit after the path shrank = %d, want just under 1300", limit)
+	}
+
+	// It grows again; the search starts over every ResearchInterval.
+	path.mtu = MaxDatagram
+	path.run(int(ResearchInterval/time.Second) + 30)
+	if limit := path.prober.Limit(); limit < MaxDatagram-precision {
+		t.Errorf("Limit after the path grew = %d, want about %d", limit, MaxDatagram)
+	}
+}
+
+func TestProberWithoutSupportNeverFragments(t *testing.T) {
+	path := newPath(0) // answers no probe, as a server that does not reassemble
+	path.run(10)
+	if limit := path.prober.Limit(); limit != 0 {
+		t.Errorf("Limit = %d, want 0", limit)
+	}
+	if size := path.prober.Next(); size != 0 {
+		t.Errorf("Next = %d after the first probe failed, want 0 until the search starts over", size)
+	}
+}
+
+func TestKeepaliveReportsSize(t *testing.T) {
+	ip := net.ParseIP("172.18.0.2")
+	frame := Keepalive(ip, 1400, 0)
+	if size, probe, train := Parse(frame); size != 1400 || probe || train || len(frame) != KeepaliveLength || int(frame.TotalLength()) != len(frame) {
+		t.Errorf("Parse(keepalive) = %d, %v, %v (%d bytes)", size, probe, train, len(frame))
+	}
+	probe := Keepalive(ip, 1200, 1300)
+	if size, isProbe, train := Parse(probe); size != 1200 || !isProbe || train || len(probe) != 1300 {
+		t.Errorf("Parse(probe) = %d, %v, %v (%d bytes)", size, isProbe, train, len(probe))
+	}
+	if !probe.Source().Equal(probe.Destination()) {
+		t.Error("a probe is not a keepalive")
+	}
+	if size, _, _ := Parse(ipv4.MakeFrame(ip, ip)); size != 0 {
+		t.Errorf("Parse(plain keepalive) = %d, want 0", size)
+	}
+}
+
+func TestTrainIsNoProbe(t *testing.T) {
+	ip := net.ParseIP("172.18.0.2")
+	frame := Train(ip, 1400, 1024)
+	if size, probe, train := Parse(frame); size != 1400 || probe || !train || len(frame) != 1024 || int(frame.TotalLength()) != len(frame) {
+		t.Errorf("Parse(train) = %d, %v, %v (%d bytes)", size, probe, train, len(frame))
+	}
+	// The server's answer is as short as the mark allows.
+	answer := Train(ip, 0, 0)
+	if size, probe, train := Parse(answer); size != 0 || probe || !train || len(answer) != KeepaliveLength+1 {
+		t.Errorf("Parse(answer) = %d, %v, %v (%d bytes)", size, probe, train, len(answer))
+	}
+}
@@ -0,0 +1,98 @@
+// Package proxy reaches the server through an upstream proxy, for clients on
+// networks where nothing gets out directly. It speaks SOCKS5 (RFC 1928, with
+// RFC 1929 username/password authentication), which carries both TCP streams
+// (CONNECT) and UDP datagrams (UDP ASSOCIATE), and HTTP CONNECT, which carries
+// TCP streams only.
+//
+// The server's host name is passed to the proxy unresolved, so it works where
+// the client cannot resolve names itself.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// ErrUDPUnsupported is returned by ListenUDP for a proxy that cannot carry UDP.
+var ErrUDPUnsupported = errors.New("proxy: udp is not supported by this proxy")
+
+// Proxy is one upstream proxy, parsed from a URL.
+type Proxy struct {
+	url      *url.URL
+	username string
+	password string
+}
+
+// Parse parses a proxy URL: socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port.
+func Parse(raw string) (*Proxy, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "socks5", "socks5h":
+		if parsed.Port() == "" {
+			parsed.Host = net.JoinHostPort(parsed.Hostname(), "1080")
+		}
+	case "http":
+		if parsed.Port() == "" {
+			parsed.Host = net.JoinHostPort(parsed.Hostname(), "80")
+		}
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme: %q", parsed.Scheme)
+	}
+	if parsed.Hostname() == "" {
+		return nil, fmt.Errorf("proxy: missing host: %q", raw)
+	}
+	self := &Proxy{url: parsed}
+	if parsed.User != nil {
+		self.username = parsed.User.Username()
+		self.password, _ = parsed.User.Password()
+	}
+	return self, nil
+}
+
+// URL returns the proxy's URL, credentials included, as net/http expects it.
+func (self *Proxy) URL() *url.URL {
+	return self.url
+}
+
+// SupportsUDP reports whether ListenUDP can work with this kind of proxy.
+func (self *Proxy) SupportsUDP() bool {
+	return self.url.Scheme != "http"
+}
+
+// Dial opens a TCP stream to address (host:port) through the proxy. The whole
+// exchange with the proxy must finish within timeout.
+func (self *Proxy) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", self.url.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	tunneled := conn
+	if self.url.Scheme == "http" {
+		tunneled, err = self.connect(conn, address)
+	} else {
+		_, err = self.request(conn, commandConnect, address)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunneled, nil
+}
+
+// ListenUDP opens a SOCKS5 UDP association whose datagrams go to and come from
+// address (host:port) only.
+func (self *Proxy) ListenUDP(address string, timeout time.Duration) (net.Conn, error) {
+	if !self.SupportsUDP() {
+		return nil, ErrUDPUnsupported
+	}
+	return self.associate(address, timeout)
+}
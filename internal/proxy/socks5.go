@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+)
+
+const (
+	socksVersion = 0x05
+
+	methodNoAuthentication = 0x00
+	methodUsernamePassword = 0x02
+	methodNoAcceptable     = 0xff
+
+	commandConnect      = 0x01
+	commandUDPAssociate = 0x03
+
+	addressIPv4   = 0x01
+	addressDomain = 0x03
+	addressIPv6   = 0x04
+
+	// usernamePasswordVersion is the sub-negotiation version of RFC 1929.
+	usernamePasswordVersion = 0x01
+)
+
+// replyMessages describes the SOCKS5 reply codes.
+var replyMessages = map[byte]string{
+	0x01: "general server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "ttl expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// request negotiates authentication on conn and issues command for address,
+// returning the address the proxy bound for it.
+func (self *Proxy) request(conn net.Conn, command byte, address string) (*net.UDPAddr, error) {
+	if err := self.authenticate(conn); err != nil {
+		return nil, err
+	}
+	encoded, err := appendAddress(nil, address)
+	if err != nil {
+		return nil, err
+	}
+	message := append([]byte{socksVersion, command, 0x00}, encoded...)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, errors.New("proxy: not a socks5 proxy")
+	}
+	if header[1] != 0x00 {
+		message, ok := replyMessages[header[1]]
+		if !ok {
+			message = fmt.Sprintf("reply code %d", header[1])
+		}
+		return nil, fmt.Errorf("proxy: socks5 request failed: %s", message)
+	}
+	host, port, err := readAddress(conn)
+	if err != nil {
+		return nil, err
+	}
+	bound := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+	return bound, nil
+}
+
+// authenticate performs the method negotiation, and the username/password
+// sub-negotiation when the proxy asks for it.
+func (self *Proxy) authenticate(conn net.Conn) error {
+	greeting := []byte{socksVersion, 1, methodNoAuthentication}
+	if self.username != "" {
+		greeting = []byte{socksVersion, 2, methodNoAuthentication, methodUsernamePassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("proxy: not a socks5 proxy")
+	}
+	switch reply[1] {
+	case methodNoAuthentication:
+		return nil
+	case methodUsernamePassword:
+		if self.username == "" {
+			return errors.New("proxy: socks5 proxy requires a username and password")
+		}
+	case methodNoAcceptable:
+		return errors.New("proxy: socks5 proxy accepted no authentication method")
+	default:
+		return fmt.Errorf("proxy: socks5 proxy chose unknown method %d", reply[1])
+	}
+
+	if len(self.username) > 255 || len(self.password) > 255 {
+		return errors.New("proxy: socks5 username or password too long")
+	}
+	message := []byte{usernamePasswordVersion, byte(len(self.username))}
+	message = append(message, self.username...)
+	message = append(message, byte(len(self.password)))
+	message = append(message, self.password...)
+	if _, err := conn.Write(message); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("proxy: socks5 authentication failed")
+	}
+	return nil
+}
+
+// appendAddress appends a SOCKS5 address (type, address, port) for host:port.
+// A host name is sent as a domain for the proxy to resolve.
+func appendAddress(buffer []byte, address string) ([]byte, error) {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		buffer = append(buffer, addressIPv4)
+		buffer = append(buffer, ip.To4()...)
+	case ip != nil:
+		buffer = append(buffer, addressIPv6)
+		buffer = append(buffer, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("proxy: host name too long: %q", host)
+		}
+		buffer = append(buffer, addressDomain, byte(len(host)))
+		buffer = append(buffer, host...)
+	}
+	return binary.BigEndian.AppendUint16(buffer, uint16(port)), nil
+}
+
+// readAddress reads a SOCKS5 address from a stream.
+func readAddress(reader io.Reader) (string, int, error) {
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(reader, kind); err != nil {
+		return "", 0, err
+	}
+	var host []byte
+	switch kind[0] {
+	case addressIPv4:
+		host = make([]byte, net.IPv4len)
+	case addressIPv6:
+		host = make([]byte, net.IPv6len)
+	case addressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return "", 0, err
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", 0, fmt.Errorf("proxy: unknown socks5 address type %d", kind[0])
+	}
+	if _, err := io.ReadFull(reader, host); err != nil {
+		return "", 0, err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", 0, err
+	}
+	if kind[0] == addressDomain {
+		return string(host), int(binary.BigEndian.Uint16(port)), nil
+	}
+	return net.IP(host).String(), int(binary.BigEndian.Uint16(port)), nil
+}
+
+// splitDatagram strips the SOCKS5 UDP request header from a relayed datagram,
+// returning the address it names and the payload. Fragmented datagrams are not
+// supported.
+func splitDatagram(datagram []byte) (string, []byte, error) {
+	if len(datagram) < 4 || datagram[2] != 0x00 {
+		return "", nil, errors.New("proxy: invalid socks5 datagram")
+	}
+	reader := bytes.NewReader(datagram[3:])
+	host, port, err := readAddress(reader)
+	if err != nil {
+		return "", nil, errors.New("proxy: invalid socks5 datagram")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), datagram[len(datagram)-reader.Len():], nil
+}
+
+// udpAssociation is a SOCKS5 UDP association used as a connected datagram
+// socket: writes go to one destination through the proxy's relay, and reads
+// return only datagrams the relay forwarded. The association lasts as long as
+// its control connection.
+type udpAssociation struct {
+	*net.UDPConn
+	control net.Conn
+	header  []byte // the request header naming the destination
+}
+
+// associate sets up a UDP association for datagrams to and from address.
+func (self *Proxy) associate(address string, timeout time.Duration) (net.Conn, error) {
+	header, err := appendAddress([]byte{0x00, 0x00, 0x00}, address)
+	if err != nil {
+		return nil, err
+	}
+	control, err := net.DialTimeout("tcp", self.url.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = control.SetDeadline(time.Now().Add(timeout))
+	// The client does not know which address its datagrams will come from
+	// (NAT), so it names none.
+	relay, err := self.request(control, commandUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+	_ = control.SetDeadline(time.Time{})
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		// The relay is on the proxy host.
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+	// The proxy ends the association by closing the control connection; close
+	// the socket then too, so reads fail and the link redials.
+	go func() {
+		defer deferutil.Recover()
+		_, _ = io.Copy(io.Discard, control)
+		_ = conn.Close()
+	}()
+	return &udpAssociation{UDPConn: conn, control: control, header: header}, nil
+}
+
+func (self *udpAssociation) Write(payload []byte) (int, error) {
+	datagram := make([]byte, 0, len(self.header)+len(payload))
+	datagram = append(datagram, self.header...)
+	datagram = append(datagram, payload...)
+	if _, err := self.UDPConn.Write(datagram); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+func (self *udpAssociation) Read(buffer []byte) (int, error) {
+	for {
+		size, err := self.UDPConn.Read(buffer)
+		if err != nil {
+			return 0, err
+		}
+		_, payload, err := splitDatagram(buffer[:size])
+		if err != nil {
+			continue
+		}
+		return copy(buffer, payload), nil
+	}
+}
+
+func (self *udpAssociation) Close() error {
+	err := self.UDPConn.Close()
+	_ = self.control.Close()
+	return err
+}
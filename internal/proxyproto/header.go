@@ -0,0 +1,149 @@
+// Package proxyproto reads the PROXY protocol header (versions 1 and 2, as
+// specified by HAProxy) that a load balancer or reverse proxy sends ahead of a
+// forwarded TCP connection, to learn the address of the real client.
+//
+// ReadHeader consumes exactly the header, never any of the payload after it,
+// so the connection can be handed on unchanged.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidHeader is returned by ReadHeader when the stream does not start
+// with a well-formed PROXY protocol header.
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// signature opens every version 2 header.
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// maxLineSize is the longest a version 1 header may be, CRLF included.
+	maxLineSize = 107
+
+	commandLocal = 0x0
+	commandProxy = 0x1
+
+	familyInet  = 0x1
+	familyInet6 = 0x2
+
+	transportStream = 0x1
+)
+
+// ReadHeader reads a version 1 or version 2 header from reader and returns the
+// client's address. It returns a nil address for a header that carries none
+// (v1 UNKNOWN, v2 LOCAL, or a non-TCP/IP family), in which case the
+// connection's own address applies.
+func ReadHeader(reader io.Reader) (*net.TCPAddr, error) {
+	prefix := make([]byte, 6)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return nil, err
+	}
+	switch {
+	case string(prefix) == "PROXY ":
+		return readVersion1(reader)
+	case bytes.Equal(prefix, signature[:len(prefix)]):
+		return readVersion2(reader)
+	}
+	return nil, ErrInvalidHeader
+}
+
+// readVersion1 parses the rest of a text header, such as
+// "TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readVersion1(reader io.Reader) (*net.TCPAddr, error) {
+	var line []byte
+	character := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxLineSize-len("PROXY ") {
+			return nil, ErrInvalidHeader
+		}
+		if _, err := io.ReadFull(reader, character); err != nil {
+			return nil, err
+		}
+		line = append(line, character[0])
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	ip := net.ParseIP(fields[1])
+	if ip == nil || (ip.To4() != nil) != (fields[0] == "TCP4") || net.ParseIP(fields[2]) == nil {
+		return nil, ErrInvalidHeader
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if _, err := strconv.ParseUint(fields[4], 10, 16); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readVersion2 parses the rest of a binary header.
+func readVersion2(reader io.Reader) (*net.TCPAddr, error) {
+	header := make([]byte, len(signature)+4-6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(signature)-6], signature[6:]) {
+		return nil, ErrInvalidHeader
+	}
+	header = header[len(signature)-6:]
+	versionCommand, familyTransport := header[0], header[1]
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if versionCommand>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch versionCommand & 0x0f {
+	case commandLocal:
+		return nil, nil // a health check from the proxy itself
+	case commandProxy:
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if familyTransport&0x0f != transportStream {
+		return nil, nil
+	}
+	switch familyTransport >> 4 {
+	case familyInet:
+		if length < 12 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case familyInet6:
+		if length < 36 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+	return nil, nil
+}
+
+// Trusted reports whether address falls within one of networks.
+func Trusted(networks []*net.IPNet, address net.Addr) bool {
+	tcp, ok := address.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
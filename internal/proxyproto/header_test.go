@@ -0,0 +1,85 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// version2 builds a binary header with the given command, family/transport
+// byte and address block.
+func version2(command, familyTransport byte, addresses []byte) []byte {
+	header := append([]byte{}, signature...)
+	header = append(header, 0x20|command, familyTransport, byte(len(addresses)>>8), byte(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadHeader(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	inet6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	cases := []struct {
+		name   string
+		header []byte
+		want   string // empty for no address
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 inet", version2(commandProxy, familyInet<<4|transportStream, inet), "192.0.2.1:56324"},
+		{"v2 inet6", version2(commandProxy, familyInet6<<4|transportStream, inet6), "[2001:db8::1]:56324"},
+		{"v2 local", version2(commandLocal, 0, nil), ""},
+		{"v2 tlvs", version2(commandProxy, familyInet<<4|transportStream, append(inet, 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:56324"},
+	}
+	for _, test := range cases {
+		// The payload after the header must be left unread.
+		reader := bytes.NewReader(append(test.header, "payload"...))
+		address, err := ReadHeader(reader)
+		if err != nil {
+			t.Errorf("%s: ReadHeader: %s", test.name, err)
+			continue
+		}
+		got := ""
+		if address != nil {
+			got = address.String()
+		}
+		if got != test.want {
+			t.Errorf("%s: address = %q, want %q", test.name, got, test.want)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != "payload" {
+			t.Errorf("%s: remaining = %q, want %q", test.name, rest, "payload")
+		}
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	cases := map[string][]byte{
+		"no header":     []byte("GET / HTTP/1.1\r\n\r\n"),
+		"v1 bad family": []byte("PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n"),
+		"v1 mismatch":   []byte("PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n"),
+		"v1 bad port":   []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 2\r\n"),
+		"v1 too long":   append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...),
+		"v2 bad ver":    append(append([]byte{}, signature...), 0x11, 0x11, 0, 0),
+		"v2 short":      version2(commandProxy, familyInet<<4|transportStream, []byte{1, 2, 3}),
+	}
+	for name, header := range cases {
+		if _, err := ReadHeader(bytes.NewReader(header)); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrInvalidHeader)
+		}
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	networks := []*net.IPNet{network}
+	if !Trusted(networks, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}) {
+		t.Error("10.1.2.3 is not trusted, want trusted")
+	}
+	if Trusted(networks, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}) {
+		t.Error("192.0.2.1 is trusted, want untrusted")
+	}
+	if Trusted(nil, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}) {
+		t.Error("trusted with no networks")
+	}
+}
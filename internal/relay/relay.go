@@ -0,0 +1,379 @@
+// Package relay implements a keyless stepping stone between clients and a
+// server that they cannot reach directly. It forwards TCP streams and UDP
+// datagrams in both directions without decrypting them, so it never holds the
+// password, and a captured relay reveals no keys. Each UDP client gets its own
+// socket toward the server, so the server still tells clients apart; the
+// mappings expire once idle, as the server's own UDP peers do.
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+)
+
+var log = logging.MustGetLogger("relay")
+
+const (
+	// mappingIdleTimeout is how long a UDP mapping may go without a datagram in
+	// either direction before it is reaped.
+	mappingIdleTimeout = 60 * time.Second
+
+	// reapInterval is how often idle UDP mappings are swept.
+	reapInterval = 15 * time.Second
+
+	// DefaultMaxMappings bounds the UDP clients mapped at once, and so the
+	// sockets and goroutines a flood of spoofed sources can take.
+	DefaultMaxMappings = 1024
+
+	// evictableAfter is how long a mapping must have been quiet before a new
+	// client may take its place when there are MaxMappings already. A client
+	// sends a keepalive every second, so a live one is never evicted.
+	evictableAfter = 10 * time.Second
+)
+
+// errTooManyMappings is returned for a new UDP client while every mapping is
+// in use.
+var errTooManyMappings = errors.New("relay: too many udp clients")
+
+// Config selects where the relay listens and where it forwards to.
+type Config struct {
+	Listen   string // TCP and UDP listen address
+	Upstream string // server address (host:port), resolved afresh for each client
+	Timeout  time.Duration
+	// MaxMappings bounds the UDP clients mapped at once; 0 means
+	// DefaultMaxMappings.
+	MaxMappings int
+}
+
+type Relay struct {
+	upstream    string
+	timeout     time.Duration
+	maxMappings int
+	listener    net.Listener
+	conn        *net.UDPConn
+
+	mutex       sync.Mutex
+	mappings    map[string]*mapping
+	connections map[io.Closer]struct{}
+
+	done     chan struct{}
+	stopOnce sync.Once
+	group    sync.WaitGroup
+}
+
+// mapping is one UDP client's socket toward the server.
+type mapping struct {
+	client        *net.UDPAddr
+	upstream      *net.UDPConn
+	lastSeenNanos int64 // atomic; UnixNano of the last datagram either way
+}
+
+func NewRelay(config Config) (*Relay, error) {
+	if _, _, err := net.SplitHostPort(config.Upstream); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, err
+	}
+	address, err := net.ResolveUDPAddr("udp", config.Listen)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", address)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	maxMappings := config.MaxMappings
+	if maxMappings <= 0 {
+		maxMappings = DefaultMaxMappings
+	}
+	return &Relay{
+		upstream:    config.Upstream,
+		timeout:     config.Timeout,
+		maxMappings: maxMappings,
+		listener:    listener,
+		conn:        conn,
+		mappings:    make(map[string]*mapping),
+		connections: make(map[io.Closer]struct{}),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// TCPAddr reports the local TCP address the relay listens on.
+func (self *Relay) TCPAddr() net.Addr {
+	return self.listener.Addr()
+}
+
+// UDPAddr reports the local UDP address the relay listens on.
+func (self *Relay) UDPAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *Relay) Run(signaling chan os.Signal) error {
+	log.Infof("relaying %s to %s", self.listener.Addr(), self.upstream)
+	self.group.Add(3)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.acceptLoop()
+	}()
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.readLoop()
+	}()
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.reapLoop()
+	}()
+
+	<-signaling
+
+	self.stop()
+	return nil
+}
+
+func (self *Relay) Close() error {
+	self.stop()
+	return nil
+}
+
+func (self *Relay) stop() {
+	self.stopOnce.Do(func() {
+		self.mutex.Lock()
+		close(self.done)
+		for conn := range self.connections {
+			_ = conn.Close()
+		}
+		for _, current := range self.mappings {
+			_ = current.upstream.Close()
+		}
+		self.mutex.Unlock()
+		_ = self.listener.Close()
+		_ = self.conn.Close()
+	})
+	self.group.Wait()
+}
+
+func (self *Relay) acceptLoop() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			select {
+			case <-self.done:
+			default:
+				log.Warningf("failed to accept tcp connection: %s", err)
+			}
+			return
+		}
+		if !self.track(conn) {
+			_ = conn.Close()
+			return
+		}
+		self.group.Add(1)
+		go func() {
+			defer deferutil.Recover()
+			defer self.group.Done()
+			defer self.untrack(conn)
+			defer func() { _ = conn.Close() }()
+			self.forwardStream(conn)
+		}()
+	}
+}
+
+// forwardStream copies a client's TCP stream to a fresh connection to the
+// server and back, until either side closes.
+func (self *Relay) forwardStream(conn net.Conn) {
+	upstream, err := net.DialTimeout("tcp", self.upstream, self.timeout)
+	if err != nil {
+		log.Warningf("failed to dial upstream for %v: %s", conn.RemoteAddr(), err)
+		return
+	}
+	if !self.track(upstream) {
+		_ = upstream.Close()
+		return
+	}
+	defer self.untrack(upstream)
+	log.Infof("relaying tcp connection: %v", conn.RemoteAddr())
+
+	copied := make(chan struct{})
+	go func() {
+		defer deferutil.Recover()
+		defer close(copied)
+		_, _ = io.Copy(upstream, conn)
+	}()
+	_, _ = io.Copy(conn, upstream)
+	// Either side closing ends the relay of both.
+	_ = conn.Close()
+	_ = upstream.Close()
+	<-copied
+	log.Infof("tcp connection closed: %v", conn.RemoteAddr())
+}
+
+func (self *Relay) readLoop() {
+	buffer := make([]byte, 65536)
+	for {
+		size, address, err := self.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-self.done:
+			default:
+				log.Warningf("failed to read datagram: %s", err)
+			}
+			return
+		}
+		current, err := self.mapping(address)
+		if errors.Is(err, errTooManyMappings) {
+			log.Debugf("dropped datagram from %s: %s", address, err)
+			continue
+		}
+		if err != nil {
+			log.Warningf("failed to map udp client %s: %s", address, err)
+			continue
+		}
+		atomic.StoreInt64(&current.lastSeenNanos, time.Now().UnixNano())
+		if _, err := current.upstream.Write(buffer[:size]); err != nil {
+			log.Debugf("failed to forward datagram from %s: %s", address, err)
+		}
+	}
+}
+
+// mapping returns the mapping for a client, opening its socket toward the
+// server (and starting the goroutine that returns replies) on first sight.
+// With MaxMappings already, a new client takes the place of the quietest
+// mapping if it has been quiet for evictableAfter, and is refused otherwise.
+func (self *Relay) mapping(client *net.UDPAddr) (*mapping, error) {
+	key := client.String()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if existing, ok := self.mappings[key]; ok {
+		return existing, nil
+	}
+	select {
+	case <-self.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	if len(self.mappings) >= self.maxMappings && !self.evict() {
+		return nil, errTooManyMappings
+	}
+
+	address, err := net.ResolveUDPAddr("udp", self.upstream)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := net.DialUDP("udp", nil, address)
+	if err != nil {
+		return nil, err
+	}
+	created := &mapping{client: client, upstream: upstream, lastSeenNanos: time.Now().UnixNano()}
+	self.mappings[key] = created
+	log.Debugf("udp client mapped: %s via %s", key, upstream.LocalAddr())
+
+	self.group.Add(1)
+	go func() {
+		defer deferutil.Recover()
+		defer self.group.Done()
+		self.returnLoop(created)
+	}()
+	return created, nil
+}
+
+// evict closes the mapping that has been quiet longest, if it has been quiet
+// for evictableAfter, reporting whether it did. The caller holds the mutex.
+func (self *Relay) evict() bool {
+	var quietest string
+	oldest := time.Now().UnixNano() - int64(evictableAfter)
+	for key, current := range self.mappings {
+		if lastSeen := atomic.LoadInt64(&current.lastSeenNanos); lastSeen <= oldest {
+			quietest, oldest = key, lastSeen
+		}
+	}
+	if quietest == "" {
+		return false
+	}
+	_ = self.mappings[quietest].upstream.Close()
+	delete(self.mappings, quietest)
+	log.Debugf("udp client evicted: %s", quietest)
+	return true
+}
+
+// returnLoop sends the server's datagrams for one mapping back to its client,
+// until the mapping is reaped.
+func (self *Relay) returnLoop(current *mapping) {
+	buffer := make([]byte, 65536)
+	for {
+		size, err := current.upstream.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Typically ICMP port unreachable while the server is down; keep
+			// the mapping for when it comes back.
+			log.Debugf("failed to read datagram for %s: %s", current.client, err)
+			continue
+		}
+		atomic.StoreInt64(&current.lastSeenNanos, time.Now().UnixNano())
+		if _, err := self.conn.WriteToUDP(buffer[:size], current.client); err != nil {
+			log.Debugf("failed to return datagram to %s: %s", current.client, err)
+		}
+	}
+}
+
+func (self *Relay) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.reap()
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// reap closes the mappings that have gone idle.
+func (self *Relay) reap() {
+	cutoff := time.Now().UnixNano() - int64(mappingIdleTimeout)
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for key, current := range self.mappings {
+		if atomic.LoadInt64(&current.lastSeenNanos) < cutoff {
+			_ = current.upstream.Close()
+			delete(self.mappings, key)
+			log.Debugf("udp client expired: %s", key)
+		}
+	}
+}
+
+func (self *Relay) track(conn io.Closer) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	select {
+	case <-self.done:
+		return false
+	default:
+	}
+	self.connections[conn] = struct{}{}
+	return true
+}
+
+func (self *Relay) untrack(conn io.Closer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.connections, conn)
+}
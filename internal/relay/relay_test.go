@@ -0,0 +1,182 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// start runs a relay to upstream until the test ends.
+func start(t *testing.T, upstream string) *Relay {
+	t.Helper()
+	return startWith(t, Config{Upstream: upstream})
+}
+
+func startWith(t *testing.T, config Config) *Relay {
+	t.Helper()
+	config.Listen, config.Timeout = "127.0.0.1:0", time.Second
+	relay, err := NewRelay(config)
+	if err != nil {
+		t.Fatalf("NewRelay: %s", err)
+	}
+	signaling := make(chan os.Signal, 1)
+	finished := make(chan struct{})
+	go func() { defer close(finished); _ = relay.Run(signaling) }()
+	t.Cleanup(func() { close(signaling); <-finished })
+	return relay
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	relay := start(t, listener.Addr().String())
+
+	conn, err := net.Dial("tcp", relay.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "hello" {
+		t.Fatalf("reply = %q, %v; want hello", reply, err)
+	}
+}
+
+func TestUDPMapsEachClient(t *testing.T) {
+	// The upstream echoes each datagram prefixed with the address it came
+	// from, so the clients can see that each got a mapping of its own.
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer func() { _ = server.Close() }()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			size, address, err := server.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteToUDP(append([]byte(address.String()+" "), buffer[:size]...), address)
+		}
+	}()
+	relay := start(t, server.LocalAddr().String())
+
+	exchange := func(conn net.Conn) string {
+		t.Helper()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		buffer := make([]byte, 1500)
+		size, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read: %s", err)
+		}
+		return string(buffer[:size])
+	}
+	var replies []string
+	for range 2 {
+		conn, err := net.Dial("udp", relay.UDPAddr().String())
+		if err != nil {
+			t.Fatalf("dial: %s", err)
+		}
+		defer func() { _ = conn.Close() }()
+		first := exchange(conn)
+		if second := exchange(conn); second != first {
+			t.Errorf("one client seen as %q then %q", first, second)
+		}
+		replies = append(replies, first)
+	}
+	if replies[0] == replies[1] {
+		t.Errorf("two clients share the mapping %q", replies[0])
+	}
+}
+
+func TestUDPBoundsMappings(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer func() { _ = server.Close() }()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			size, address, err := server.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteToUDP(buffer[:size], address)
+		}
+	}()
+	relay := startWith(t, Config{Upstream: server.LocalAddr().String(), MaxMappings: 1})
+
+	exchange := func(conn net.Conn) bool {
+		t.Helper()
+		_ = conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		_, err := conn.Read(make([]byte, 1500))
+		return err == nil
+	}
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("udp", relay.UDPAddr().String())
+		if err != nil {
+			t.Fatalf("dial: %s", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	first, second := dial(), dial()
+	if !exchange(first) {
+		t.Fatal("first client not relayed")
+	}
+	// The only mapping is in use, so the second client is dropped.
+	if exchange(second) {
+		t.Fatal("second client relayed beyond MaxMappings")
+	}
+	if !exchange(first) {
+		t.Fatal("first client lost its mapping")
+	}
+
+	// Once the first client has been quiet long enough, the second takes its
+	// place.
+	relay.mutex.Lock()
+	for _, current := range relay.mappings {
+		atomic.StoreInt64(&current.lastSeenNanos, time.Now().Add(-evictableAfter).UnixNano())
+	}
+	relay.mutex.Unlock()
+	if !exchange(second) {
+		t.Fatal("second client not relayed in place of the quiet one")
+	}
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if len(relay.mappings) != 1 {
+		t.Errorf("%d mappings, want 1", len(relay.mappings))
+	}
+}
@@ -0,0 +1,91 @@
+// Package rendezvous encodes the messages with which the server introduces
+// clients to each other, so they can punch a direct UDP path through their NATs
+// instead of relaying every frame through the server.
+//
+// A client registers its peer socket with the server (Register), which notes
+// the address it arrives from; to reach another client it asks the server for
+// it (Lookup), and the server sends each of the two the other's addresses
+// (Introduce), so both start probing at once. The messages travel as
+// obfuscated datagrams on obfuscate.StreamRendezvous.
+package rendezvous
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// Message kinds.
+const (
+	// Register is sent by a client: IP is its tunnel address, Local the address
+	// of its peer socket as it sees it (for peers behind the same NAT).
+	Register byte = 1
+
+	// Lookup is sent by a client: IP is its tunnel address, Target the tunnel
+	// address of the client it wants to reach.
+	Lookup byte = 2
+
+	// Introduce is sent by the server: IP is the tunnel address of a client,
+	// Observed the address its peer socket reaches the server from, and Local
+	// the address it registered.
+	Introduce byte = 3
+)
+
+// size is the length of every encoded message: a kind, two IPv4 addresses and
+// two 18-byte address-port pairs.
+const size = 1 + 4 + 4 + 18 + 18
+
+// ErrInvalidMessage is returned by Parse for a datagram that is not a message.
+var ErrInvalidMessage = errors.New("rendezvous: invalid message")
+
+// Message is one rendezvous message; the fields a kind does not use are zero.
+type Message struct {
+	Kind     byte
+	IP       net.IP
+	Target   net.IP
+	Observed netip.AddrPort
+	Local    netip.AddrPort
+}
+
+// Marshal encodes the message.
+func (self Message) Marshal() []byte {
+	buffer := make([]byte, size)
+	buffer[0] = self.Kind
+	copy(buffer[1:5], self.IP.To4())
+	copy(buffer[5:9], self.Target.To4())
+	putAddrPort(buffer[9:27], self.Observed)
+	putAddrPort(buffer[27:45], self.Local)
+	return buffer
+}
+
+// Parse decodes a message.
+func Parse(buffer []byte) (Message, error) {
+	if len(buffer) != size || buffer[0] < Register || buffer[0] > Introduce {
+		return Message{}, ErrInvalidMessage
+	}
+	return Message{
+		Kind:     buffer[0],
+		IP:       net.IP(append([]byte{}, buffer[1:5]...)),
+		Target:   net.IP(append([]byte{}, buffer[5:9]...)),
+		Observed: getAddrPort(buffer[9:27]),
+		Local:    getAddrPort(buffer[27:45]),
+	}, nil
+}
+
+func putAddrPort(buffer []byte, address netip.AddrPort) {
+	if !address.IsValid() {
+		return
+	}
+	ip := address.Addr().As16()
+	copy(buffer, ip[:])
+	binary.BigEndian.PutUint16(buffer[16:], address.Port())
+}
+
+func getAddrPort(buffer []byte) netip.AddrPort {
+	port := binary.BigEndian.Uint16(buffer[16:])
+	if port == 0 {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(netip.AddrFrom16([16]byte(buffer[:16])).Unmap(), port)
+}
@@ -0,0 +1,43 @@
+package rendezvous
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	messages := []Message{
+		{Kind: Register, IP: net.ParseIP("172.18.0.2"), Target: net.IPv4zero, Local: netip.MustParseAddrPort("192.168.1.20:40000")},
+		{Kind: Lookup, IP: net.ParseIP("172.18.0.2"), Target: net.ParseIP("172.18.0.3")},
+		{
+			Kind:     Introduce,
+			IP:       net.ParseIP("172.18.0.3"),
+			Target:   net.IPv4zero,
+			Observed: netip.MustParseAddrPort("[2001:db8::1]:51000"),
+			Local:    netip.MustParseAddrPort("10.0.0.5:41000"),
+		},
+	}
+	for _, message := range messages {
+		parsed, err := Parse(message.Marshal())
+		if err != nil {
+			t.Fatalf("Parse: %s", err)
+		}
+		if parsed.Kind != message.Kind || !parsed.IP.Equal(message.IP) || !parsed.Target.Equal(message.Target) ||
+			parsed.Observed != message.Observed || parsed.Local != message.Local {
+			t.Errorf("round trip = %+v, want %+v", parsed, message)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	valid := Message{Kind: Lookup, IP: net.ParseIP("172.18.0.2"), Target: net.ParseIP("172.18.0.3")}.Marshal()
+	wrongKind := append([]byte{}, valid...)
+	wrongKind[0] = 9
+	for name, buffer := range map[string][]byte{"short": valid[:10], "long": append(valid, 0), "kind": wrongKind} {
+		if _, err := Parse(buffer); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrInvalidMessage)
+		}
+	}
+}
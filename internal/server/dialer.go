@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/deferutil"
+)
+
+const (
+	// session redial backoff bounds.
+	minSessionBackoff = 1 * time.Second
+	maxSessionBackoff = 30 * time.Second
+)
+
+// sessionDialer keeps a session open to each of a list of other servers — mesh
+// peers, or the primary of an active/standby pair — or of listening clients,
+// over the TCP transport, re-dialing with backoff whenever one ends. sessions
+// serves them: it has no listener.
+type sessionDialer struct {
+	sessions  *tcpTransport
+	addresses []string
+}
+
+func (self *sessionDialer) Start() {
+	for _, address := range self.addresses {
+		self.sessions.group.Add(1)
+		go func() {
+			defer deferutil.Recover()
+			defer self.sessions.group.Done()
+			self.keep(address)
+		}()
+	}
+}
+
+func (self *sessionDialer) Stop() {
+	self.sessions.Stop()
+}
+
+// keep dials the peer at address and serves the session, again and again
+// until the dialer stops.
+func (self *sessionDialer) keep(address string) {
+	backoff := minSessionBackoff
+	for {
+		if self.session(address) {
+			backoff = minSessionBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-self.sessions.done:
+			return
+		}
+		backoff = min(backoff*2, maxSessionBackoff)
+	}
+}
+
+// session serves one session with the peer at address, reporting whether it
+// was established.
+func (self *sessionDialer) session(address string) bool {
+	conn, err := self.sessions.socket.Dialer(self.sessions.timeout).Dial("tcp", address)
+	if err != nil {
+		log.Warningf("failed to dial %s: %s", address, err)
+		return false
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetNoDelay(true)
+	}
+	if !self.sessions.track(conn) {
+		_ = conn.Close()
+		return false
+	}
+	defer self.sessions.untrack(conn)
+	self.sessions.handle(conn.RemoteAddr(), self.sessions.wrap(conn))
+	return true
+}
@@ -1,11 +1,12 @@
 // Package server orchestrates a shadowgate server: it owns the shared router
-// (tun device + routing table) and starts the enabled transports (TCP, UDP, or
-// both), which all route through that single router so clients on different
-// transports can reach each other.
+// (tun device + routing table) and starts the enabled transports (any of TCP,
+// UDP, fake TCP, ICMP, HTTP polling and a stdio stream), which all route through
+// that single router so clients on different transports can reach each other.
 package server
 
 import (
 	"errors"
+	"io"
 	"net"
 	"os"
 	"sync"
@@ -14,6 +15,14 @@ import (
 	"github.com/op/go-logging"
 
 	"github.com/ziyan/shadowgate/internal/core"
+	"github.com/ziyan/shadowgate/internal/faketcp"
+	"github.com/ziyan/shadowgate/internal/ha"
+	"github.com/ziyan/shadowgate/internal/hop"
+	"github.com/ziyan/shadowgate/internal/icmp"
+	"github.com/ziyan/shadowgate/internal/meek"
+	"github.com/ziyan/shadowgate/internal/mesh"
+	"github.com/ziyan/shadowgate/internal/plugin"
+	"github.com/ziyan/shadowgate/internal/sockopt"
 	"github.com/ziyan/shadowgate/internal/tun"
 	"github.com/ziyan/shadowgate/internal/udp"
 )
@@ -22,48 +31,202 @@ var log = logging.MustGetLogger("server")
 
 // Config selects which transports the server listens on and how they behave.
 type Config struct {
-	TCPListen string // TCP listen address; empty disables TCP
-	UDPListen string // UDP listen address; empty disables UDP
-	Password  []byte
-	Compress  bool   // TCP: Snappy-compress the stream
-	Padding   int    // UDP: maximum random padding bytes per datagram
-	Gateway   net.IP // client tunnel address to route otherwise-unroutable egress through; nil disables
-	Timeout   time.Duration
+	TCPListen  string // TCP listen address; empty disables TCP
+	UDPListen  string // UDP listen address; empty disables UDP
+	ICMPListen string // ICMP local IPv4 address ("0.0.0.0" for all); empty disables ICMP
+
+	// UDPHopPorts, unless empty, is a range of ports on UDPListen's host that
+	// the UDP transport listens on too, for clients that hop between them.
+	UDPHopPorts hop.Range
+	// Rendezvous lets the UDP transport introduce clients to each other so they
+	// can exchange frames over direct UDP paths (see internal/rendezvous).
+	Rendezvous bool
+	// FakeTCPListen is the address (host:port) served by the fake TCP transport;
+	// empty disables it. The port must differ from TCPListen's.
+	FakeTCPListen string
+	// HTTPListen is the address (host:port) of the plain-HTTP polling endpoint;
+	// empty disables it. Terminate TLS in front of it to serve HTTPS.
+	HTTPListen string
+	// Stdio, when set, is an already-connected stream to a single client (such
+	// as standard input and output under `ssh host shadowgate server --stdio`).
+	// The server stops when it ends.
+	Stdio io.ReadWriteCloser
+	// Plugin, when its Command is set, runs an external pluggable transport
+	// (SIP003 or Tor managed proxy) that accepts clients on TCPListen and
+	// forwards them to the TCP transport, which then listens on loopback only.
+	Plugin plugin.Config
+	// ProxyProtocolFrom lists the networks of load balancers in front of
+	// TCPListen that send a PROXY protocol (v1 or v2) header with each
+	// connection. Connections from them must carry one; others must not.
+	ProxyProtocolFrom []*net.IPNet
+	// MeshPeers lists the TCP addresses (host:port) of other servers to keep a
+	// mesh session with, and MeshFrom the networks whose connections to
+	// TCPListen may be mesh sessions too. Servers in a mesh share the password
+	// and have distinct tunnel subnets, which they advertise to each other so
+	// their clients can reach one another (see internal/mesh).
+	MeshPeers []string
+	MeshFrom  []*net.IPNet
+	// StandbyOf, when set, makes this server the standby of the primary whose
+	// TCP address (host:port) it names, and StandbyFrom lists the networks whose
+	// connections to TCPListen may be a standby's session. The two servers share
+	// the password and the tunnel subnet and address, and clients list the
+	// standby as their failover endpoint (see internal/ha).
+	StandbyOf   string
+	StandbyFrom []*net.IPNet
+	// DialClients lists the addresses (host:port) of clients that listen for
+	// this server rather than dial it (see client.Config.Listen). The server
+	// keeps a TCP connection open to each and, with UDP enabled, knocks on each
+	// over UDP until its UDP link answers.
+	DialClients []string
+
+	// Batch packs frames queued together for a client into one record of the
+	// encrypted stream, waiting up to BatchDelay after the first for more;
+	// zero takes only those already queued. Over UDP it packs them into one
+	// datagram, but only for clients that batch too, and only with a delay,
+	// since the UDP transport has no queue of its own (see internal/batch).
+	Batch      bool
+	BatchDelay time.Duration
+
+	// Socket tunes the sockets of the TCP and UDP listeners, and of the
+	// sessions the server dials (see internal/sockopt): a firewall mark or a
+	// device to bind to, and the TCP congestion control, user timeout,
+	// keepalives and buffer sizes. Their source address is the listen
+	// address.
+	Socket sockopt.Options
+
+	Password []byte
+	Compress bool   // TCP: Snappy-compress the stream
+	Padding  int    // UDP and ICMP: maximum random padding bytes per datagram
+	Gateway  net.IP // client tunnel address to route otherwise-unroutable egress through; nil disables
+	// FlowIdle, when positive, sends the replies to each flow a client sends
+	// back over the link the flow came in on, until the flow has been idle
+	// this long, for clients that pin their flows (see client.Config.FlowIdle).
+	FlowIdle time.Duration
+	Timeout  time.Duration
 }
 
 type Server struct {
 	router *core.Router
 	tcp    *tcpTransport
 	udp    *udp.Listener
+	icmp   *icmp.Listener
+	fake   *faketcp.Listener
+	meek   *meek.Listener
+	stdio  *tcpTransport
+	plugin *plugin.Process
+	mesh   *mesh.Mesh     // nil outside a mesh
+	peers  *sessionDialer // nil without MeshPeers
+	pair   *ha.Pair       // nil outside an active/standby pair
+	paired *sessionDialer // nil unless a standby
+	dialed *sessionDialer // nil without DialClients
 
 	stopOnce sync.Once
 }
 
 func NewServer(device tun.TUN, ip net.IP, network *net.IPNet, config Config) (*Server, error) {
-	if config.TCPListen == "" && config.UDPListen == "" {
+	if config.TCPListen == "" && config.UDPListen == "" && config.ICMPListen == "" && config.FakeTCPListen == "" && config.HTTPListen == "" && config.Stdio == nil && len(config.DialClients) == 0 {
 		return nil, errors.New("server: no transport enabled")
 	}
 
 	router := core.NewRouter(device, ip, network, config.Gateway)
+	if config.FlowIdle > 0 {
+		router.PinFlows(config.FlowIdle)
+	}
 	self := &Server{router: router}
+	if len(config.MeshPeers) > 0 || len(config.MeshFrom) > 0 {
+		self.mesh = mesh.New(router)
+		router.SetPrefixRoutes(self.mesh)
+	}
+	if config.StandbyOf != "" || len(config.StandbyFrom) > 0 {
+		self.pair = ha.New(router)
+	}
 
 	if config.TCPListen != "" {
-		transport, err := newTcpTransport(router, config.TCPListen, config.Password, config.Compress)
+		listen := config.TCPListen
+		if config.Plugin.Command != "" {
+			listen = "127.0.0.1:0"
+		}
+		transport, err := newTcpTransport(router, listen, config.Password, config.Compress, config.ProxyProtocolFrom, config.Timeout, config.Socket)
 		if err != nil {
 			return nil, err
 		}
+		transport.mesh, transport.meshFrom = self.mesh, config.MeshFrom
+		transport.pair, transport.pairFrom = self.pair, config.StandbyFrom
+		transport.batch, transport.batchDelay = config.Batch, config.BatchDelay
 		self.tcp = transport
 	}
 	if config.UDPListen != "" {
-		listener, err := udp.NewListener(router, config.UDPListen, config.Password, config.Padding)
+		listener, err := udp.NewListener(router, config.UDPListen, config.UDPHopPorts, config.Password, config.Padding, config.Rendezvous, config.Socket)
 		if err != nil {
-			if self.tcp != nil {
-				self.tcp.Stop()
-			}
+			self.stopTransports()
 			return nil, err
 		}
+		listener.Knock(config.DialClients)
+		if config.Batch {
+			listener.Batch(config.BatchDelay)
+		}
 		self.udp = listener
 	}
+	if config.ICMPListen != "" {
+		listener, err := icmp.NewListener(router, config.ICMPListen, config.Password, config.Padding)
+		if err != nil {
+			self.stopTransports()
+			return nil, err
+		}
+		self.icmp = listener
+	}
+	if config.FakeTCPListen != "" {
+		listener, err := faketcp.NewListener(router, config.FakeTCPListen, config.Password, config.Padding)
+		if err != nil {
+			self.stopTransports()
+			return nil, err
+		}
+		self.fake = listener
+	}
+	if config.HTTPListen != "" {
+		listener, err := meek.NewListener(router, config.HTTPListen, config.Password, config.Padding)
+		if err != nil {
+			self.stopTransports()
+			return nil, err
+		}
+		self.meek = listener
+	}
+	if config.Plugin.Command != "" {
+		if self.tcp == nil {
+			self.stopTransports()
+			return nil, errors.New("server: a plugin needs the tcp transport")
+		}
+		process, err := plugin.StartServer(config.Plugin, config.TCPListen, self.tcp.Addr().String())
+		if err != nil {
+			self.stopTransports()
+			return nil, err
+		}
+		self.plugin = process
+	}
+	if config.Stdio != nil {
+		self.stdio = newStreamTransport(router, config.Stdio, config.Password, config.Compress)
+		self.stdio.batch, self.stdio.batchDelay = config.Batch, config.BatchDelay
+	}
+	if len(config.MeshPeers) > 0 {
+		sessions := newSessionTransport(router, config.Password, config.Compress, config.Timeout, true)
+		sessions.mesh = self.mesh
+		sessions.socket = config.Socket
+		sessions.batch, sessions.batchDelay = config.Batch, config.BatchDelay
+		self.peers = &sessionDialer{sessions: sessions, addresses: config.MeshPeers}
+	}
+	if config.StandbyOf != "" {
+		sessions := newSessionTransport(router, config.Password, config.Compress, config.Timeout, true)
+		sessions.pair = self.pair
+		sessions.socket = config.Socket
+		sessions.batch, sessions.batchDelay = config.Batch, config.BatchDelay
+		self.paired = &sessionDialer{sessions: sessions, addresses: []string{config.StandbyOf}}
+	}
+	if len(config.DialClients) > 0 {
+		sessions := newSessionTransport(router, config.Password, config.Compress, config.Timeout, false)
+		sessions.socket = config.Socket
+		sessions.batch, sessions.batchDelay = config.Batch, config.BatchDelay
+		self.dialed = &sessionDialer{sessions: sessions, addresses: config.DialClients}
+	}
 
 	return self, nil
 }
@@ -72,7 +235,8 @@ func (self *Server) Interface() string {
 	return self.router.Interface()
 }
 
-// TCPAddress reports the TCP listen address, or nil if TCP is disabled.
+// TCPAddress reports the TCP listen address (a loopback address when a plugin
+// forwards to it), or nil if TCP is disabled.
 func (self *Server) TCPAddress() net.Addr {
 	if self.tcp == nil {
 		return nil
@@ -88,6 +252,30 @@ func (self *Server) UDPAddress() net.Addr {
 	return self.udp.Addr()
 }
 
+// ICMPAddress reports the ICMP listen address, or nil if ICMP is disabled.
+func (self *Server) ICMPAddress() net.Addr {
+	if self.icmp == nil {
+		return nil
+	}
+	return self.icmp.Addr()
+}
+
+// FakeTCPAddress reports the fake TCP listen address, or nil if it is disabled.
+func (self *Server) FakeTCPAddress() net.Addr {
+	if self.fake == nil {
+		return nil
+	}
+	return self.fake.Addr()
+}
+
+// HTTPAddress reports the HTTP polling listen address, or nil if it is disabled.
+func (self *Server) HTTPAddress() net.Addr {
+	if self.meek == nil {
+		return nil
+	}
+	return self.meek.Addr()
+}
+
 func (self *Server) Run(signaling chan os.Signal) error {
 	self.router.Start()
 	if self.tcp != nil {
@@ -96,8 +284,41 @@ func (self *Server) Run(signaling chan os.Signal) error {
 	if self.udp != nil {
 		self.udp.Start()
 	}
+	if self.icmp != nil {
+		self.icmp.Start()
+	}
+	if self.fake != nil {
+		self.fake.Start()
+	}
+	if self.meek != nil {
+		self.meek.Start()
+	}
+	if self.mesh != nil {
+		self.mesh.Start()
+	}
+	if self.peers != nil {
+		self.peers.Start()
+	}
+	if self.pair != nil {
+		self.pair.Start()
+	}
+	if self.paired != nil {
+		self.paired.Start()
+	}
+	if self.dialed != nil {
+		self.dialed.Start()
+	}
+	var finished <-chan struct{}
+	if self.stdio != nil {
+		self.stdio.Start()
+		finished = self.stdio.Finished()
+	}
 
-	<-signaling
+	select {
+	case <-signaling:
+	case <-finished:
+		log.Infof("stdio peer closed; stopping")
+	}
 
 	self.stop()
 	return nil
@@ -110,12 +331,46 @@ func (self *Server) Close() error {
 
 func (self *Server) stop() {
 	self.stopOnce.Do(func() {
-		if self.tcp != nil {
-			self.tcp.Stop()
-		}
-		if self.udp != nil {
-			self.udp.Stop()
-		}
+		self.stopTransports()
 		self.router.Stop()
 	})
 }
+
+func (self *Server) stopTransports() {
+	if self.tcp != nil {
+		self.tcp.Stop()
+	}
+	if self.udp != nil {
+		self.udp.Stop()
+	}
+	if self.icmp != nil {
+		self.icmp.Stop()
+	}
+	if self.fake != nil {
+		self.fake.Stop()
+	}
+	if self.meek != nil {
+		self.meek.Stop()
+	}
+	if self.stdio != nil {
+		self.stdio.Stop()
+	}
+	if self.plugin != nil {
+		_ = self.plugin.Close()
+	}
+	if self.peers != nil {
+		self.peers.Stop()
+	}
+	if self.mesh != nil {
+		self.mesh.Stop()
+	}
+	if self.paired != nil {
+		self.paired.Stop()
+	}
+	if self.pair != nil {
+		self.pair.Stop()
+	}
+	if self.dialed != nil {
+		self.dialed.Stop()
+	}
+}
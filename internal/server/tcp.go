@@ -2,35 +2,69 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/ziyan/shadowgate/internal/batch"
 	"github.com/ziyan/shadowgate/internal/compress"
 	"github.com/ziyan/shadowgate/internal/core"
 	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/ha"
 	"github.com/ziyan/shadowgate/internal/ipv4"
+	"github.com/ziyan/shadowgate/internal/mesh"
+	"github.com/ziyan/shadowgate/internal/proxyproto"
 	"github.com/ziyan/shadowgate/internal/secure"
+	"github.com/ziyan/shadowgate/internal/sockopt"
 )
 
 // tcpTransport is the server-side TCP transport. Each accepted connection is a
 // stream of IPv4 frames; the transport feeds received frames into the shared
 // router and registers a tcpSink so the router can route frames back to the
-// connection.
+// connection. Without a listener it serves one already-connected stream
+// instead, such as standard input and output (see newStreamTransport).
 type tcpTransport struct {
 	router   *core.Router
 	listener net.Listener
 	password []byte
 	compress bool
 
+	// proxyFrom lists the networks of load balancers trusted to prefix their
+	// connections with a PROXY protocol header naming the real client.
+	proxyFrom []*net.IPNet
+	timeout   time.Duration
+	// socket tunes the listener's sockets, which its connections inherit,
+	// and those of the sessions this server dials.
+	socket sockopt.Options
+
+	// mesh, when set, takes the advertisements of peer servers, and pair the
+	// snapshots of the other server of an active/standby pair: those of every
+	// session when initiator is set (the sessions were dialed to them), or of
+	// connections from meshFrom and pairFrom otherwise.
+	mesh      *mesh.Mesh
+	meshFrom  []*net.IPNet
+	pair      *ha.Pair
+	pairFrom  []*net.IPNet
+	initiator bool
+
+	// batch writes the frames queued for a connection together, in one record
+	// of the encrypted stream, waiting up to batchDelay for more.
+	batch      bool
+	batchDelay time.Duration
+
+	stream   io.ReadWriteCloser // served instead of accepting, when listener is nil
+	finished chan struct{}      // closed when stream ends; nil with a listener
+
 	mutex       sync.Mutex
 	connections map[io.Closer]struct{}
 	group       sync.WaitGroup
 	done        chan struct{}
 }
 
-func newTcpTransport(router *core.Router, listen string, password []byte, useCompression bool) (*tcpTransport, error) {
-	listener, err := net.Listen("tcp", listen)
+func newTcpTransport(router *core.Router, listen string, password []byte, useCompression bool, proxyFrom []*net.IPNet, timeout time.Duration, socket sockopt.Options) (*tcpTransport, error) {
+	listener, err := socket.ListenConfig().Listen(context.Background(), "tcp", listen)
 	if err != nil {
 		return nil, err
 	}
@@ -39,24 +73,86 @@ func newTcpTransport(router *core.Router, listen string, password []byte, useCom
 		listener:    listener,
 		password:    password,
 		compress:    useCompression,
+		proxyFrom:   proxyFrom,
+		timeout:     timeout,
+		socket:      socket,
 		connections: make(map[io.Closer]struct{}),
 		done:        make(chan struct{}),
 	}, nil
 }
 
+// newStreamTransport serves a single peer over an already-connected stream,
+// with the same framing and encryption as a TCP connection.
+func newStreamTransport(router *core.Router, stream io.ReadWriteCloser, password []byte, useCompression bool) *tcpTransport {
+	return &tcpTransport{
+		router:      router,
+		password:    password,
+		compress:    useCompression,
+		stream:      stream,
+		finished:    make(chan struct{}),
+		connections: make(map[io.Closer]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// newSessionTransport serves the sessions this server dials (see
+// sessionDialer): to other servers as the initiator of each, or to listening
+// clients, otherwise served like the clients that connect to it.
+func newSessionTransport(router *core.Router, password []byte, useCompression bool, timeout time.Duration, initiator bool) *tcpTransport {
+	return &tcpTransport{
+		router:      router,
+		password:    password,
+		compress:    useCompression,
+		timeout:     timeout,
+		initiator:   initiator,
+		connections: make(map[io.Closer]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
 func (self *tcpTransport) Addr() net.Addr {
+	if self.listener == nil {
+		return streamAddr{}
+	}
 	return self.listener.Addr()
 }
 
+// Finished is closed once a stream transport's peer has gone; it is nil (never
+// ready) for a listening transport.
+func (self *tcpTransport) Finished() <-chan struct{} {
+	return self.finished
+}
+
 func (self *tcpTransport) Start() {
 	self.group.Add(1)
 	go func() {
 		defer deferutil.Recover()
 		defer self.group.Done()
+		if self.listener == nil {
+			self.serveStream()
+			return
+		}
 		self.acceptLoop()
 	}()
 }
 
+func (self *tcpTransport) serveStream() {
+	defer close(self.finished)
+	wrapped := self.wrap(self.stream)
+	if !self.track(wrapped) {
+		_ = wrapped.Close()
+		return
+	}
+	defer self.untrack(wrapped)
+	self.handle(streamAddr{}, wrapped)
+}
+
+// streamAddr names the peer of a stream transport in logs.
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stdio" }
+func (streamAddr) String() string  { return "stdio" }
+
 func (self *tcpTransport) Stop() {
 	self.closeOnce()
 	self.closeConnections()
@@ -70,7 +166,9 @@ func (self *tcpTransport) closeOnce() {
 	case <-self.done:
 	default:
 		close(self.done)
-		_ = self.listener.Close()
+		if self.listener != nil {
+			_ = self.listener.Close()
+		}
 	}
 }
 
@@ -89,24 +187,59 @@ func (self *tcpTransport) acceptLoop() {
 			_ = tcpConn.SetNoDelay(true)
 		}
 
-		wrapped := wrapConnection(conn, self.password, self.compress)
-		if !self.track(wrapped) {
-			_ = wrapped.Close()
+		if !self.track(conn) {
+			_ = conn.Close()
 			return
 		}
 		self.group.Add(1)
 		go func() {
 			defer deferutil.Recover()
 			defer self.group.Done()
-			self.handle(conn.RemoteAddr(), wrapped)
+			defer self.untrack(conn)
+
+			address, ok := self.clientAddr(conn)
+			if !ok {
+				_ = conn.Close()
+				return
+			}
+			self.handle(address, self.wrap(conn))
 		}()
 	}
 }
 
+// clientAddr returns the address of the client behind conn. A connection from a
+// trusted load balancer must open with a PROXY protocol header, whose source
+// address replaces the balancer's own; one without a valid header is refused.
+func (self *tcpTransport) clientAddr(conn net.Conn) (net.Addr, bool) {
+	if !proxyproto.Trusted(self.proxyFrom, conn.RemoteAddr()) {
+		return conn.RemoteAddr(), true
+	}
+	if self.timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(self.timeout))
+	}
+	source, err := proxyproto.ReadHeader(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Warningf("failed to read proxy protocol header from %v: %s", conn.RemoteAddr(), err)
+		return nil, false
+	}
+	if source == nil {
+		return conn.RemoteAddr(), true
+	}
+	log.Debugf("proxy protocol header from %v names client %v", conn.RemoteAddr(), source)
+	return source, true
+}
+
 func (self *tcpTransport) handle(address net.Addr, conn io.ReadWriteCloser) {
 	log.Infof("client connection established: %v", address)
 
 	sink := &tcpSink{frames: make(chan ipv4.Frame, 1024), closing: make(chan struct{})}
+	if self.mesh != nil && self.initiator {
+		self.mesh.Connect(sink)
+	}
+	if self.pair != nil && self.initiator {
+		self.pair.Connect(sink)
+	}
 
 	writerDone := make(chan struct{})
 	go func() {
@@ -118,11 +251,16 @@ func (self *tcpTransport) handle(address net.Addr, conn io.ReadWriteCloser) {
 	self.reader(conn, address, sink)
 
 	self.router.Unregister(sink)
+	if self.mesh != nil {
+		self.mesh.Disconnect(sink)
+	}
+	if self.pair != nil {
+		self.pair.Disconnect(sink)
+	}
 	close(sink.closing)
 	_ = conn.Close()
 	<-writerDone
 
-	self.untrack(conn)
 	log.Infof("client connection closed: %v", address)
 }
 
@@ -131,13 +269,46 @@ func (self *tcpTransport) reader(conn io.ReadWriteCloser, address net.Addr, sink
 	scanner.Buffer(make([]byte, 65536), 65536)
 	scanner.Split(ipv4.ScanFrame)
 
+	peered := self.mesh != nil && self.initiator
+	paired := self.pair != nil && self.initiator
 	for scanner.Scan() {
 		frame := ipv4.Frame(scanner.Bytes())
+		if mesh.IsAdvertisement(frame) {
+			if peered || (self.mesh != nil && proxyproto.Trusted(self.meshFrom, address)) {
+				peered = true
+				self.mesh.Receive(sink, frame.Copy())
+			}
+			continue
+		}
+		if ha.IsSnapshot(frame) {
+			if paired || (self.pair != nil && proxyproto.Trusted(self.pairFrom, address)) {
+				paired = true
+				self.pair.Receive(sink, frame.Copy())
+			}
+			continue
+		}
 		origin := frame.Source()
+		if peered {
+			// Forwarded by a peer server: its source is attached there, so no
+			// route back is learned here.
+			if !origin.Equal(frame.Destination()) {
+				self.router.Inbound(frame.Copy())
+			}
+			continue
+		}
+		if paired {
+			// Forwarded by the other server of the pair, which had no route for
+			// it; it is never sent back there.
+			if !origin.Equal(frame.Destination()) {
+				self.router.Relayed(frame.Copy())
+			}
+			continue
+		}
+
+		// Checked only now: the other server of a pair shares the address.
 		if self.router.IP().Equal(origin) {
 			continue // a client must not claim the server's own address
 		}
-
 		if origin.Equal(frame.Destination()) {
 			// keepalive from client; keep a route available and reply
 			self.router.EnsureRoute(origin, sink)
@@ -148,8 +319,7 @@ func (self *tcpTransport) reader(conn io.ReadWriteCloser, address net.Addr, sink
 		// A data frame. Learn a route back to its source (which may be a network
 		// behind the client, letting the server route through the client) and pin
 		// it to this transport, then forward the frame.
-		self.router.Register(origin, sink)
-		self.router.Inbound(frame.Copy())
+		self.router.Receive(frame.Copy(), sink)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -161,7 +331,11 @@ func (self *tcpTransport) writer(conn io.ReadWriteCloser, address net.Addr, sink
 	for {
 		select {
 		case frame := <-sink.frames:
-			if _, err := conn.Write(frame); err != nil {
+			payload := []byte(frame)
+			if self.batch {
+				payload = batch.Join(batch.Gather(sink.frames, frame, self.batchDelay, sink.closing))
+			}
+			if _, err := conn.Write(payload); err != nil {
 				log.Warningf("failed to write frame to client %s: %s", address, err)
 			}
 		case <-sink.closing:
@@ -211,11 +385,13 @@ func (self *tcpSink) Send(frame ipv4.Frame) {
 	}
 }
 
-// wrapConnection layers encryption (always) and optional compression over a raw
-// stream connection. The server is the responder of the encrypted session.
-func wrapConnection(conn io.ReadWriteCloser, password []byte, useCompression bool) io.ReadWriteCloser {
-	encrypted := secure.NewEncryptedConnection(conn, password, false)
-	if !useCompression {
+// wrap layers encryption (always) and optional compression over a raw stream
+// connection. The server is the responder of the encrypted session, even when
+// it dials a listening client, except on the sessions it dials to other
+// servers.
+func (self *tcpTransport) wrap(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	encrypted := secure.NewEncryptedConnection(conn, self.password, self.initiator)
+	if !self.compress {
 		return encrypted
 	}
 	return compress.NewCompressedConnection(encrypted)
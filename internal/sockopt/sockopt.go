@@ -0,0 +1,194 @@
+// Package sockopt tunes the sockets of links and listeners: a firewall mark
+// and a device to keep them out of a full tunnel's default route, the TCP
+// congestion control algorithm, user timeout and keepalives, and buffer
+// sizes. The options are set on each socket before it connects or listens;
+// a connection accepted from a listener inherits the listener's.
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Options are the settings of a socket; the zero value changes nothing.
+type Options struct {
+	// Mark sets SO_MARK, which policy routing rules and firewalls match,
+	// so that, say, `ip rule add fwmark 0x100 lookup main` routes the
+	// tunnel's own packets around it. It needs CAP_NET_ADMIN.
+	Mark uint32
+	// Device binds the socket to a network interface with SO_BINDTODEVICE,
+	// which needs CAP_NET_RAW.
+	Device string
+	// Congestion names the TCP congestion control algorithm, such as "bbr"
+	// (TCP_CONGESTION); the kernel must have it loaded.
+	Congestion string
+	// UserTimeout is how long transmitted TCP data may go unacknowledged
+	// before the connection is dropped (TCP_USER_TIMEOUT).
+	UserTimeout time.Duration
+	// KeepAlive, when enabled, sets the TCP keepalive probes.
+	KeepAlive net.KeepAliveConfig
+	// SendBuffer and ReceiveBuffer set SO_SNDBUF and SO_RCVBUF, in bytes.
+	SendBuffer    int
+	ReceiveBuffer int
+}
+
+// Parse parses options of the form key=value[,key=value...], with the keys
+// Set takes.
+func Parse(spec string) (Options, error) {
+	var options Options
+	if spec == "" {
+		return options, nil
+	}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		ok, err := options.Set(key, value)
+		if !ok {
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return options, fmt.Errorf("sockopt: invalid options %q: %s", spec, err)
+		}
+	}
+	return options, nil
+}
+
+// Set sets the option named key: mark (decimal or 0x hexadecimal), device,
+// congestion, user-timeout (a duration), keepalive (idle[/interval[/count]],
+// as in 30s/10s/3), sndbuf or rcvbuf (bytes, with an optional k or m
+// suffix). It returns false for any other key.
+func (self *Options) Set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "mark":
+		var mark uint64
+		mark, err = strconv.ParseUint(value, 0, 32)
+		self.Mark = uint32(mark)
+	case "device":
+		self.Device = value
+	case "congestion":
+		self.Congestion = value
+	case "user-timeout":
+		self.UserTimeout, err = time.ParseDuration(value)
+	case "keepalive":
+		self.KeepAlive, err = parseKeepAlive(value)
+	case "sndbuf":
+		self.SendBuffer, err = parseSize(value)
+	case "rcvbuf":
+		self.ReceiveBuffer, err = parseSize(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func parseKeepAlive(value string) (net.KeepAliveConfig, error) {
+	config := net.KeepAliveConfig{Enable: true}
+	fields := strings.Split(value, "/")
+	if len(fields) > 3 {
+		return config, fmt.Errorf("invalid keepalive %q", value)
+	}
+	var err error
+	if config.Idle, err = time.ParseDuration(fields[0]); err != nil {
+		return config, err
+	}
+	if len(fields) > 1 {
+		if config.Interval, err = time.ParseDuration(fields[1]); err != nil {
+			return config, err
+		}
+	}
+	if len(fields) > 2 {
+		if config.Count, err = strconv.Atoi(fields[2]); err != nil {
+			return config, err
+		}
+	}
+	if config.Idle <= 0 || config.Interval < 0 || config.Count < 0 {
+		return config, fmt.Errorf("invalid keepalive %q", value)
+	}
+	return config, nil
+}
+
+func parseSize(value string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier, value = 1024, strings.TrimSuffix(value, "k")
+	case strings.HasSuffix(value, "m"):
+		multiplier, value = 1024*1024, strings.TrimSuffix(value, "m")
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 || size > (1<<31-1)/multiplier {
+		return 0, errors.New("buffer size out of range")
+	}
+	return size * multiplier, nil
+}
+
+// Control sets the options on a socket of network ("tcp", "udp", "ip4:icmp",
+// and so on) before it connects or listens; the TCP options only on a TCP
+// socket. It suits net.Dialer.Control and net.ListenConfig.Control.
+func (self Options) Control(network, address string, conn syscall.RawConn) error {
+	var err error
+	if controlErr := conn.Control(func(fd uintptr) {
+		err = self.set(int(fd), strings.HasPrefix(network, "tcp"))
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+func (self Options) set(fd int, tcp bool) error {
+	if self.Device != "" {
+		if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, self.Device); err != nil {
+			return fmt.Errorf("sockopt: bind to device %s: %s", self.Device, err)
+		}
+	}
+	if self.Mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(self.Mark)); err != nil {
+			return fmt.Errorf("sockopt: set mark %#x: %s", self.Mark, err)
+		}
+	}
+	if self.SendBuffer > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, self.SendBuffer); err != nil {
+			return fmt.Errorf("sockopt: set send buffer: %s", err)
+		}
+	}
+	if self.ReceiveBuffer > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, self.ReceiveBuffer); err != nil {
+			return fmt.Errorf("sockopt: set receive buffer: %s", err)
+		}
+	}
+	if !tcp {
+		return nil
+	}
+	if self.Congestion != "" {
+		if err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, self.Congestion); err != nil {
+			return fmt.Errorf("sockopt: set congestion control %s: %s", self.Congestion, err)
+		}
+	}
+	if self.UserTimeout > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(self.UserTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("sockopt: set user timeout: %s", err)
+		}
+	}
+	return nil
+}
+
+// Dialer returns a dialer whose sockets get the options.
+func (self Options) Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: self.Control, KeepAliveConfig: self.KeepAlive}
+}
+
+// ListenConfig returns a listen configuration whose sockets, and the
+// connections accepted on them, get the options.
+func (self Options) ListenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: self.Control, KeepAliveConfig: self.KeepAlive}
+}
@@ -0,0 +1,65 @@
+package sockopt
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParse(t *testing.T) {
+	options, err := Parse("mark=0x100,device=eth0,congestion=bbr,user-timeout=30s,keepalive=20s/5s/4,sndbuf=4m,rcvbuf=512k")
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	want := Options{
+		Mark:          0x100,
+		Device:        "eth0",
+		Congestion:    "bbr",
+		UserTimeout:   30 * time.Second,
+		KeepAlive:     net.KeepAliveConfig{Enable: true, Idle: 20 * time.Second, Interval: 5 * time.Second, Count: 4},
+		SendBuffer:    4 << 20,
+		ReceiveBuffer: 512 << 10,
+	}
+	if options != want {
+		t.Errorf("Parse = %+v, want %+v", options, want)
+	}
+	for _, spec := range []string{"mark=-1", "keepalive=0s", "keepalive=1s/1s/1/1", "sndbuf=4g", "rcvbuf=-1", "tos=16"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestControl(t *testing.T) {
+	options := Options{UserTimeout: 7 * time.Second, ReceiveBuffer: 64 << 10}
+	listener, err := options.ListenConfig().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer listener.Close()
+	conn, err := options.Dialer(time.Second).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %s", err)
+	}
+	var timeout, buffer int
+	_ = raw.Control(func(fd uintptr) {
+		timeout, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+		buffer, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if timeout != 7000 {
+		t.Errorf("TCP_USER_TIMEOUT = %d ms, want 7000", timeout)
+	}
+	if buffer < 64<<10 { // the kernel doubles it for bookkeeping
+		t.Errorf("SO_RCVBUF = %d, want at least %d", buffer, 64<<10)
+	}
+}
@@ -0,0 +1,94 @@
+// Package stdio turns a byte pipe that already reaches the other side — the
+// process's own standard input and output, or a child process's — into a
+// stream connection, so the tunnel can run over `ssh host shadowgate server
+// --stdio`, socat, a serial console and the like, much as SSH's ProxyCommand
+// does for a single connection.
+package stdio
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// Stream is a reader and a writer used as one connection.
+type Stream struct {
+	reader io.ReadCloser
+	writer io.WriteCloser
+
+	// command is the child process behind the stream, if any.
+	command *exec.Cmd
+
+	closeOnce sync.Once
+}
+
+// Standard returns a stream over the process's standard input and output. They
+// are switched to non-blocking mode where possible, so closing the stream also
+// interrupts a pending read. Nothing else may write to standard output.
+func Standard() *Stream {
+	return &Stream{
+		reader: pollable(os.Stdin),
+		writer: pollable(os.Stdout),
+	}
+}
+
+// pollable reopens a standard file through the runtime poller, which only
+// adopts descriptors that are already non-blocking.
+func pollable(file *os.File) *os.File {
+	if err := syscall.SetNonblock(int(file.Fd()), true); err != nil {
+		return file
+	}
+	return os.NewFile(file.Fd(), file.Name())
+}
+
+// Command starts command with the shell and returns a stream over its standard
+// input and output. Its standard error passes through to ours. Closing the
+// stream kills the command along with anything it started (such as the ssh of
+// a pipeline).
+func Command(command string) (*Stream, error) {
+	child := exec.Command("/bin/sh", "-c", command)
+	child.Stderr = os.Stderr
+	child.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	writer, err := child.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := child.StdoutPipe()
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if err := child.Start(); err != nil {
+		_ = writer.Close()
+		_ = reader.Close()
+		return nil, err
+	}
+	return &Stream{reader: reader, writer: writer, command: child}, nil
+}
+
+func (self *Stream) Read(buffer []byte) (int, error) {
+	return self.reader.Read(buffer)
+}
+
+func (self *Stream) Write(buffer []byte) (int, error) {
+	return self.writer.Write(buffer)
+}
+
+func (self *Stream) Close() error {
+	var err error
+	self.closeOnce.Do(func() {
+		err = self.writer.Close()
+		if self.command != nil {
+			_ = syscall.Kill(-self.command.Process.Pid, syscall.SIGKILL)
+			// Wait also closes the read end of the pipe.
+			_ = self.command.Wait()
+			return
+		}
+		if closeErr := self.reader.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
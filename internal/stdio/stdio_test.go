@@ -0,0 +1,50 @@
+package stdio
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCommandRoundTrip(t *testing.T) {
+	stream, err := Command("cat")
+	if err != nil {
+		t.Fatalf("Command: %s", err)
+	}
+	defer func() { _ = stream.Close() }()
+
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(stream, reply); err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if string(reply) != "hello" {
+		t.Errorf("reply = %q, want %q", reply, "hello")
+	}
+}
+
+func TestCloseInterruptsRead(t *testing.T) {
+	// The shell's child keeps the pipe open, so only killing the whole process
+	// group ends the read.
+	stream, err := Command("sleep 60; true")
+	if err != nil {
+		t.Fatalf("Command: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	_ = stream.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Read after Close succeeded, want an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read was not interrupted by Close")
+	}
+}
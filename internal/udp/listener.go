@@ -1,6 +1,7 @@
 package udp
 
 import (
+	"context"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -8,10 +9,15 @@ import (
 
 	"github.com/op/go-logging"
 
+	"github.com/ziyan/shadowgate/internal/batch"
 	"github.com/ziyan/shadowgate/internal/core"
 	"github.com/ziyan/shadowgate/internal/deferutil"
+	"github.com/ziyan/shadowgate/internal/fec"
+	"github.com/ziyan/shadowgate/internal/hop"
 	"github.com/ziyan/shadowgate/internal/ipv4"
 	"github.com/ziyan/shadowgate/internal/obfuscate"
+	"github.com/ziyan/shadowgate/internal/pmtu"
+	"github.com/ziyan/shadowgate/internal/sockopt"
 )
 
 var log = logging.MustGetLogger("udp")
@@ -25,42 +31,198 @@ const (
 
 	// reapInterval is how often idle UDP peers are swept.
 	reapInterval = 15 * time.Second
+
+	// knockInterval is how often a listening client that has not answered is
+	// sent a keepalive to reveal the server's address (see Knock).
+	knockInterval = 5 * time.Second
 )
 
 // Listener is the server-side UDP transport. It reads obfuscated datagrams, and
 // feeds decrypted frames into a core.Router; it registers a Sink per learned
-// peer so the router can also route frames toward UDP clients.
+// peer so the router can also route frames toward UDP clients. It may listen on
+// several ports for clients that hop between them (see internal/hop); a peer is
+// known by its own address whichever port it reaches, and is answered from the
+// port it used last. With rendezvous enabled it also introduces clients to each
+// other for direct paths (see internal/rendezvous), and it can knock on
+// clients that listen for the server rather than dial it (see Knock).
 type Listener struct {
-	router *core.Router
-	conn   *net.UDPConn
-	codec  *obfuscate.Codec
+	router     *core.Router
+	conns      []*net.UDPConn
+	codec      *obfuscate.Codec
+	rendezvous bool
+	knocks     []string // addresses of listening clients
+	// batchDelay, when positive, is how long frames to a client that batches
+	// its own wait for more to share their datagram (see Batch).
+	batchDelay time.Duration
 
-	sequence uint64
+	// sequence numbers the datagrams to addresses without a peer (see stamp).
+	sequence atomic.Uint64
 
-	mutex sync.Mutex
-	peers map[string]*udpPeer
+	mutex         sync.Mutex
+	peers         map[string]*udpPeer
+	registrations map[string]*registration // by tunnel IP
 
 	done  chan struct{}
 	group sync.WaitGroup
 }
 
 type udpPeer struct {
+	mutex         sync.Mutex // guards replay, reassembler and decoder: a hopping peer reaches several read loops
 	replay        obfuscate.ReplayWindow
-	sink          core.Sink
+	reassembler   obfuscate.Reassembler
+	decoder       *fec.Decoder // created when the client first sends in error correction groups
+	sink          *udpSink
 	lastSeenNanos int64 // atomic; UnixNano of the last received datagram
 }
 
-// udpSink routes a frame toward one UDP client by its socket address.
+func (self *udpPeer) accept(sequence uint64) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.replay.Accept(sequence)
+}
+
+// reassemble takes the payload of one of the client's datagrams once accepted,
+// returning it, or the whole it completes if it is a fragment, with its
+// stream id; ok is false while a fragmented payload is incomplete.
+func (self *udpPeer) reassemble(sequence uint64, streamId uint16, payload []byte) (uint16, []byte, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.reassembler.Add(sequence, streamId, payload)
+}
+
+// recover takes one of the client's error correction shards (see
+// internal/fec), returning the frames it completes, and answers the client
+// in groups of the same shape.
+func (self *udpPeer) recover(payload []byte) []ipv4.Frame {
+	self.mutex.Lock()
+	if self.decoder == nil {
+		self.decoder = fec.NewDecoder()
+	}
+	decoder := self.decoder
+	shards, err := decoder.Receive(payload)
+	self.mutex.Unlock()
+	if err != nil {
+		return nil
+	}
+	self.sink.mirror(decoder.Shape())
+	var frames []ipv4.Frame
+	for _, shard := range shards {
+		if frame := ipv4.DecodeFrame(shard); frame != nil {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// udpSink routes a frame toward one UDP client by its socket address, from the
+// local port the client last sent to.
 type udpSink struct {
 	listener *Listener
 	address  *net.UDPAddr
+	conn     atomic.Pointer[net.UDPConn]
+	encoder  atomic.Pointer[fec.Encoder]   // set once the client sends in error correction groups
+	batcher  atomic.Pointer[batch.Batcher] // set once the client sends batches, if the listener batches
+
+	// limit is the longest datagram the client has found to cross the path
+	// (see internal/pmtu); longer frames are split to fit. Zero, for a client
+	// that reports none, never splits.
+	limit atomic.Int64
+
+	// sequence numbers the datagrams to the client one after another, so that
+	// it can count those lost by the gaps. It starts from a stamp, past all a
+	// peer before it at the address was sent.
+	sequence atomic.Uint64
 }
 
 func (self *udpSink) Send(frame ipv4.Frame) {
-	self.listener.sendTo(self.address, frame)
+	if encoder := self.encoder.Load(); encoder != nil {
+		if err := encoder.Add(frame); err != nil {
+			log.Warningf("failed to send frame to %s: %s", self.address, err)
+		}
+		return
+	}
+	if batcher := self.batcher.Load(); batcher != nil {
+		if err := batcher.Add(frame); err != nil {
+			log.Warningf("failed to send datagram to %s: %s", self.address, err)
+		}
+		return
+	}
+	if err := self.write(obfuscate.StreamFrame, frame); err != nil {
+		log.Warningf("failed to send datagram to %s: %s", self.address, err)
+	}
+}
+
+// batch makes frames to the client wait up to delay to share a datagram, as
+// the client's own do; a client that reports no path MTU never gets a batch.
+func (self *udpSink) batch(delay time.Duration) {
+	limit := int(self.limit.Load())
+	if limit == 0 || self.batcher.Load() != nil {
+		return
+	}
+	batcher := batch.NewBatcher(limit-self.listener.codec.Overhead(), delay, self.writeBatch)
+	if !self.batcher.CompareAndSwap(nil, batcher) {
+		batcher.Close()
+	}
 }
 
-func NewListener(router *core.Router, listen string, password []byte, maxPadding int) (*Listener, error) {
+// writeBatch sends frames packed into as few datagrams as the path carries.
+func (self *udpSink) writeBatch(frames []ipv4.Frame) error {
+	limit := int(self.limit.Load())
+	for _, run := range batch.Pack(frames, limit-self.listener.codec.Overhead()) {
+		streamId, payload := obfuscate.StreamFrames, batch.Join(run)
+		if len(run) == 1 {
+			streamId = obfuscate.StreamFrame
+		}
+		if err := self.write(streamId, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *udpSink) write(streamId uint16, payload []byte) error {
+	return self.listener.seal(&self.sequence, self.conn.Load(), self.address, streamId, payload, int(self.limit.Load()))
+}
+
+// reply answers one of the client's keepalives from the local port it came
+// in on.
+func (self *udpSink) reply(conn *net.UDPConn, frame ipv4.Frame) {
+	if err := self.listener.seal(&self.sequence, conn, self.address, obfuscate.StreamFrame, frame, 0); err != nil {
+		log.Warningf("failed to send datagram to %s: %s", self.address, err)
+	}
+}
+
+// mirror makes frames to the client go out in error correction groups shaped
+// as ratio.
+func (self *udpSink) mirror(ratio fec.Ratio) {
+	if encoder := self.encoder.Load(); encoder != nil {
+		if err := encoder.Reshape(ratio); err != nil {
+			log.Warningf("failed to send parity shards to %s: %s", self.address, err)
+		}
+		return
+	}
+	encoder := fec.NewEncoder(ratio, func(payload []byte) error {
+		return self.write(obfuscate.StreamFecShard, payload)
+	})
+	if !self.encoder.CompareAndSwap(nil, encoder) {
+		encoder.Close()
+	}
+}
+
+func (self *udpSink) close() {
+	if encoder := self.encoder.Load(); encoder != nil {
+		encoder.Close()
+	}
+	if batcher := self.batcher.Load(); batcher != nil {
+		batcher.Close()
+	}
+}
+
+// NewListener listens on listen (host:port) and, unless hopPorts is empty, on
+// every port of hopPorts on the same host, its sockets tuned by socket. With
+// rendezvous set it answers the rendezvous messages of clients looking for
+// direct paths to each other.
+func NewListener(router *core.Router, listen string, hopPorts hop.Range, password []byte, maxPadding int, rendezvous bool, socket sockopt.Options) (*Listener, error) {
 	key, err := obfuscate.DeriveKey(password)
 	if err != nil {
 		return nil, err
@@ -73,44 +235,129 @@ func NewListener(router *core.Router, listen string, password []byte, maxPadding
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.ListenUDP("udp", address)
+	conn, err := listenUdp(address, socket)
+	if err != nil {
+		return nil, err
+	}
+	self := &Listener{
+		router:        router,
+		conns:         []*net.UDPConn{conn},
+		codec:         codec,
+		rendezvous:    rendezvous,
+		peers:         make(map[string]*udpPeer),
+		registrations: make(map[string]*registration),
+		done:          make(chan struct{}),
+	}
+	for port := hopPorts.First; !hopPorts.Empty() && port <= hopPorts.Last; port++ {
+		if port == conn.LocalAddr().(*net.UDPAddr).Port {
+			continue
+		}
+		conn, err := listenUdp(&net.UDPAddr{IP: address.IP, Port: port, Zone: address.Zone}, socket)
+		if err != nil {
+			self.closeConns()
+			return nil, err
+		}
+		self.conns = append(self.conns, conn)
+	}
+	return self, nil
+}
+
+func listenUdp(address *net.UDPAddr, socket sockopt.Options) (*net.UDPConn, error) {
+	conn, err := socket.ListenConfig().ListenPacket(context.Background(), "udp", address.String())
 	if err != nil {
 		return nil, err
 	}
-	return &Listener{
-		router: router,
-		conn:   conn,
-		codec:  codec,
-		peers:  make(map[string]*udpPeer),
-		done:   make(chan struct{}),
-	}, nil
+	return conn.(*net.UDPConn), nil
 }
 
-// Addr reports the local UDP address the listener is bound to.
+// Addr reports the local UDP address the listener is bound to (the listen
+// address, not the hopping ports).
 func (self *Listener) Addr() net.Addr {
-	return self.conn.LocalAddr()
+	return self.conns[0].LocalAddr()
 }
 
 func (self *Listener) Start() {
-	self.group.Add(2)
-	go func() {
-		defer deferutil.Recover()
-		defer self.group.Done()
-		self.readLoop()
-	}()
+	for _, conn := range self.conns {
+		self.group.Add(1)
+		go func() {
+			defer deferutil.Recover()
+			defer self.group.Done()
+			self.readLoop(conn)
+		}()
+	}
+	self.group.Add(1)
 	go func() {
 		defer deferutil.Recover()
 		defer self.group.Done()
 		self.reapLoop()
 	}()
+	if len(self.knocks) > 0 {
+		self.group.Add(1)
+		go func() {
+			defer deferutil.Recover()
+			defer self.group.Done()
+			self.knockLoop()
+		}()
+	}
+}
+
+// Knock makes the listener send a keepalive every few seconds to each listening
+// client at addresses (host:port) that is not a peer, so that the client
+// learns where to send its own. It must be called before Start.
+func (self *Listener) Knock(addresses []string) {
+	self.knocks = addresses
+}
+
+// Batch makes the listener pack the frames to each client that sends it
+// batches into shared datagrams, waiting up to delay after the first for
+// more; without a delay it does not batch, having no queue to drain. It must
+// be called before Start.
+func (self *Listener) Batch(delay time.Duration) {
+	self.batchDelay = delay
+}
+
+func (self *Listener) knockLoop() {
+	ticker := time.NewTicker(knockInterval)
+	defer ticker.Stop()
+	for {
+		self.knock()
+		select {
+		case <-ticker.C:
+		case <-self.done:
+			return
+		}
+	}
+}
+
+func (self *Listener) knock() {
+	keepalive := ipv4.MakeFrame(self.router.IP(), self.router.IP())
+	for _, knock := range self.knocks {
+		address, err := net.ResolveUDPAddr("udp", knock)
+		if err != nil {
+			log.Warningf("failed to resolve client %s: %s", knock, err)
+			continue
+		}
+		self.mutex.Lock()
+		_, known := self.peers[address.String()]
+		self.mutex.Unlock()
+		if !known {
+			self.sendTo(self.conns[0], address, keepalive)
+		}
+	}
 }
 
 func (self *Listener) Stop() {
 	close(self.done)
-	_ = self.conn.Close()
+	self.closeConns()
 	self.group.Wait()
 }
 
+func (self *Listener) closeConns() {
+	for _, conn := range self.conns {
+		_ = conn.Close()
+	}
+}
+
 func (self *Listener) reapLoop() {
 	ticker := time.NewTicker(reapInterval)
 	defer ticker.Stop()
@@ -129,7 +376,7 @@ func (self *Listener) reapLoop() {
 func (self *Listener) reap() {
 	cutoff := time.Now().UnixNano() - int64(peerIdleTimeout)
 
-	var expired []core.Sink
+	var expired []*udpSink
 	self.mutex.Lock()
 	for key, client := range self.peers {
 		if atomic.LoadInt64(&client.lastSeenNanos) < cutoff {
@@ -139,17 +386,19 @@ func (self *Listener) reap() {
 		}
 	}
 	self.mutex.Unlock()
+	self.reapRegistrations(cutoff)
 
 	// unregister outside the lock to avoid nesting Listener.mutex and router.mutex
 	for _, sink := range expired {
+		sink.close()
 		self.router.Unregister(sink)
 	}
 }
 
-func (self *Listener) readLoop() {
+func (self *Listener) readLoop(conn *net.UDPConn) {
 	buffer := make([]byte, 65536)
 	for {
-		size, address, err := self.conn.ReadFromUDP(buffer)
+		size, address, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			select {
 			case <-self.done:
@@ -159,38 +408,89 @@ func (self *Listener) readLoop() {
 			return
 		}
 
-		sequence, _, payload, err := self.codec.Open(buffer[:size])
+		sequence, streamId, payload, err := self.codec.Open(buffer[:size])
 		if err != nil {
 			log.Debugf("dropped undecryptable datagram from %s", address)
 			continue
 		}
-		frame := ipv4.DecodeFrame(payload)
-		if frame == nil {
+		if streamId == obfuscate.StreamRendezvous && self.rendezvous {
+			self.handleRendezvous(conn, address, sequence, payload)
+			continue
+		}
+		if streamId != obfuscate.StreamFrame && streamId != obfuscate.StreamFrames && streamId != obfuscate.StreamFecShard && !obfuscate.IsFragment(streamId) {
 			continue
 		}
-		source := frame.Source()
-		if self.router.IP().Equal(source) {
-			continue // a client must not claim the server's own address
+		var frames []ipv4.Frame
+		if streamId == obfuscate.StreamFrame {
+			frame := ipv4.DecodeFrame(payload)
+			if frame == nil || self.router.IP().Equal(frame.Source()) {
+				continue // a client must not claim the server's own address
+			}
+			frames = append(frames, frame)
 		}
 
 		client := self.peer(address)
-		if !client.replay.Accept(sequence) {
+		if !client.accept(sequence) {
 			continue
 		}
 		atomic.StoreInt64(&client.lastSeenNanos, time.Now().UnixNano())
-
-		if source.Equal(frame.Destination()) {
-			// keepalive; keep a route available and reply
-			self.router.EnsureRoute(source, client.sink)
-			self.sendTo(address, ipv4.MakeFrame(self.router.IP(), self.router.IP()))
-			continue
+		client.sink.conn.Store(conn)
+		if obfuscate.IsFragment(streamId) {
+			var whole bool
+			if streamId, payload, whole = client.reassemble(sequence, streamId, payload); !whole {
+				continue
+			}
+			if streamId == obfuscate.StreamFrame {
+				if frame := ipv4.DecodeFrame(payload); frame != nil {
+					frames = append(frames, frame)
+				}
+			}
+		}
+		if streamId == obfuscate.StreamFecShard {
+			frames = client.recover(payload)
+		}
+		if streamId == obfuscate.StreamFrames {
+			frames = batch.Split(payload)
+			if self.batchDelay > 0 {
+				client.sink.batch(self.batchDelay)
+			}
+		}
+		for _, frame := range frames {
+			self.handleFrame(conn, address, client, frame)
 		}
+	}
+}
 
-		// A data frame: learn a route back to its source (a network behind the
-		// client) via this client, then forward it.
-		self.router.Register(source, client.sink)
-		self.router.Inbound(frame.Copy())
+// handleFrame takes one frame from a client: a keepalive, or a data frame.
+func (self *Listener) handleFrame(conn *net.UDPConn, address *net.UDPAddr, client *udpPeer, frame ipv4.Frame) {
+	source := frame.Source()
+	if self.router.IP().Equal(source) {
+		return // a client must not claim the server's own address
+	}
+	if source.Equal(frame.Destination()) {
+		// keepalive; keep a route available and reply, reporting the length
+		// of a path MTU probe, or marking the answer to a capacity train's
+		// (see internal/pmtu)
+		self.router.EnsureRoute(source, client.sink)
+		size, probe, train := pmtu.Parse(frame)
+		if probe {
+			client.sink.reply(conn, pmtu.Keepalive(self.router.IP(), len(frame), 0))
+			return
+		}
+		if size > 0 {
+			client.sink.limit.Store(int64(size))
+		}
+		if train {
+			client.sink.reply(conn, pmtu.Train(self.router.IP(), 0, 0))
+			return
+		}
+		client.sink.reply(conn, ipv4.MakeFrame(self.router.IP(), self.router.IP()))
+		return
 	}
+
+	// A data frame: learn a route back to its source (a network behind the
+	// client) via this client, then forward it.
+	self.router.Receive(frame.Copy(), client.sink)
 }
 
 // peer returns the peer for a client socket address, creating it (and its sink)
@@ -205,19 +505,51 @@ func (self *Listener) peer(address *net.UDPAddr) *udpPeer {
 	existing, ok := self.peers[key]
 	if !ok {
 		existing = &udpPeer{sink: &udpSink{listener: self, address: address}}
+		existing.sink.conn.Store(self.conns[0])
+		existing.sink.sequence.Store(self.stamp())
 		self.peers[key] = existing
 	}
 	return existing
 }
 
-func (self *Listener) sendTo(address *net.UDPAddr, frame ipv4.Frame) {
-	sequence := atomic.AddUint64(&self.sequence, 1)
-	datagram, err := self.codec.Seal(sequence, 0, frame)
-	if err != nil {
-		log.Warningf("failed to seal frame: %s", err)
-		return
+// sendTo sends frame to an address without a peer.
+func (self *Listener) sendTo(conn *net.UDPConn, address *net.UDPAddr, frame ipv4.Frame) {
+	datagram, err := self.codec.Seal(self.stamp(), obfuscate.StreamFrame, frame)
+	if err == nil {
+		_, err = conn.WriteToUDP(datagram, address)
 	}
-	if _, err := self.conn.WriteToUDP(datagram, address); err != nil {
+	if err != nil {
 		log.Warningf("failed to send datagram to %s: %s", address, err)
 	}
 }
+
+// stamp returns a sequence number for a datagram to an address without a
+// peer, or to start a peer's numbering from: the clock's nanoseconds, or one
+// past the last stamp. A client takes it for newer than all it had from the
+// server before, which sent fewer than one datagram a nanosecond.
+func (self *Listener) stamp() uint64 {
+	for {
+		last := self.sequence.Load()
+		next := max(last+1, uint64(time.Now().UnixNano()))
+		if self.sequence.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// seal sends payload in one datagram, or in as many as it takes to keep each
+// within limit bytes (0 for no limit), numbered consecutively from sequence.
+func (self *Listener) seal(sequence *atomic.Uint64, conn *net.UDPConn, address *net.UDPAddr, streamId uint16, payload []byte, limit int) error {
+	count := uint64(self.codec.Fragments(len(payload), limit))
+	last := sequence.Add(count)
+	datagrams, err := self.codec.SealFragments(last-count+1, streamId, payload, limit)
+	if err != nil {
+		return err
+	}
+	for _, datagram := range datagrams {
+		if _, err := conn.WriteToUDP(datagram, address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package udp
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/ziyan/shadowgate/internal/obfuscate"
+	"github.com/ziyan/shadowgate/internal/rendezvous"
+)
+
+// registration is where one client's peer socket can be reached: the address
+// its datagrams arrive from, the one it sees itself, and the local socket that
+// reaches it.
+type registration struct {
+	observed      *net.UDPAddr
+	local         netip.AddrPort
+	conn          *net.UDPConn
+	lastSeenNanos int64 // atomic
+}
+
+// handleRendezvous records a client's registration, or answers its lookup by
+// introducing it and the client it looks for to each other.
+func (self *Listener) handleRendezvous(conn *net.UDPConn, address *net.UDPAddr, sequence uint64, payload []byte) {
+	message, err := rendezvous.Parse(payload)
+	if err != nil || message.Kind == rendezvous.Introduce || self.router.IP().Equal(message.IP) {
+		return
+	}
+	client := self.peer(address)
+	if !client.accept(sequence) {
+		return
+	}
+	atomic.StoreInt64(&client.lastSeenNanos, time.Now().UnixNano())
+
+	key := message.IP.String()
+	if message.Kind == rendezvous.Register {
+		self.mutex.Lock()
+		self.registrations[key] = &registration{observed: address, local: message.Local, conn: conn, lastSeenNanos: time.Now().UnixNano()}
+		self.mutex.Unlock()
+		return
+	}
+
+	self.mutex.Lock()
+	requester, target := self.registrations[key], self.registrations[message.Target.String()]
+	self.mutex.Unlock()
+	if requester == nil || target == nil || requester.observed.String() != address.String() {
+		return // only a registered socket may look up, and only registered peers
+	}
+	log.Debugf("introducing %s (%s) and %s (%s)", message.IP, requester.observed, message.Target, target.observed)
+	self.sendMessage(requester.conn, requester.observed, introduction(message.Target, target))
+	self.sendMessage(target.conn, target.observed, introduction(message.IP, requester))
+}
+
+func introduction(ip net.IP, peer *registration) rendezvous.Message {
+	return rendezvous.Message{
+		Kind:     rendezvous.Introduce,
+		IP:       ip,
+		Target:   net.IPv4zero,
+		Observed: peer.observed.AddrPort(),
+		Local:    peer.local,
+	}
+}
+
+func (self *Listener) sendMessage(conn *net.UDPConn, address *net.UDPAddr, message rendezvous.Message) {
+	datagram, err := self.codec.Seal(self.stamp(), obfuscate.StreamRendezvous, message.Marshal())
+	if err != nil {
+		log.Warningf("failed to seal rendezvous message: %s", err)
+		return
+	}
+	if _, err := conn.WriteToUDP(datagram, address); err != nil {
+		log.Warningf("failed to send rendezvous message to %s: %s", address, err)
+	}
+}
+
+// reapRegistrations forgets the clients whose peer sockets have gone silent.
+func (self *Listener) reapRegistrations(cutoff int64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for key, current := range self.registrations {
+		if atomic.LoadInt64(&current.lastSeenNanos) < cutoff {
+			delete(self.registrations, key)
+		}
+	}
+}